@@ -28,7 +28,9 @@ package mangos
 // performed against the socket.
 //
 // Both sockets should be RAW; use of a "cooked" socket will result in
-// ErrNotRaw.
+// ErrNotRaw.  Raw sockets deliver each message with its protocol header
+// (such as the REQ/REP backtrace) intact, and send headers exactly as
+// given, so the device is invisible to the peers on either side.
 func Device(s1 Socket, s2 Socket) error {
 	// Is one of the sockets nil?
 	if s1 == nil {
@@ -14,6 +14,11 @@
 
 package mangos
 
+import (
+	"context"
+	"net"
+)
+
 // Dialer is an interface to the underlying dialer for a transport
 // and address.
 type Dialer interface {
@@ -35,3 +40,37 @@ type Dialer interface {
 	// GetOption gets an option value from the Listener.
 	GetOption(name string) (interface{}, error)
 }
+
+// DialResult is the outcome of dialing one of the addresses given to
+// DialMany.  If dialing succeeded, Err is nil, and Dialer may be used to
+// configure or close the connection.  Otherwise Dialer is nil.
+type DialResult struct {
+	Addr   string
+	Dialer Dialer
+	Err    error
+}
+
+// ContextDialer establishes network connections on behalf of a transport,
+// and is the value type for OptionDialer.  It is satisfied by net.Dialer
+// as well as the proxy dialers from golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Resolver turns the address given to a Dialer into the concrete addresses
+// to connect to, and is the value type for OptionResolver.  The address is
+// passed as host:port, and each result must be in the same form.  This
+// permits service discovery, such as looking up DNS SRV records, or asking
+// a registry like Consul, without a sidecar.
+type Resolver interface {
+	Resolve(ctx context.Context, addr string) ([]string, error)
+}
+
+// ResolverFunc is an adapter to allow the use of ordinary functions as a
+// Resolver.
+type ResolverFunc func(ctx context.Context, addr string) ([]string, error)
+
+// Resolve calls f(ctx, addr).
+func (f ResolverFunc) Resolve(ctx context.Context, addr string) ([]string, error) {
+	return f(ctx, addr)
+}
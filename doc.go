@@ -23,4 +23,16 @@
 //
 // For more information, see www.nanomsg.org.
 //
+// NNG and nanomsg use the same wire protocol as mangos, for the tcp, ipc,
+// tls+tcp and ws transports, and every protocol they have in common.  They
+// do not add flags of their own to message headers.  The headers of REQ,
+// REP, SURVEYOR and RESPONDENT messages hold a backtrace of 32-bit pipe
+// IDs, ending with the request or survey ID, which has its high bit set;
+// these are kept exactly as received, so replies can be routed back
+// through NNG devices.  Features that mangos negotiates in the handshake,
+// such as OptionChecksum, OptionCompression, OptionKeepAliveInterval and
+// OptionHandshakeMetadata, must be left off when the peer is NNG or
+// nanomsg, as these refuse any handshake but the standard one.  In turn,
+// flags in the handshake that mangos does not know are ignored.
+//
 package mangos
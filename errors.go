@@ -20,27 +20,44 @@ import (
 
 // Various error codes.
 const (
-	ErrBadAddr     = errors.ErrBadAddr
-	ErrBadHeader   = errors.ErrBadHeader
-	ErrBadVersion  = errors.ErrBadVersion
-	ErrTooShort    = errors.ErrTooShort
-	ErrTooLong     = errors.ErrTooLong
-	ErrClosed      = errors.ErrClosed
-	ErrConnRefused = errors.ErrConnRefused
-	ErrSendTimeout = errors.ErrSendTimeout
-	ErrRecvTimeout = errors.ErrRecvTimeout
-	ErrProtoState  = errors.ErrProtoState
-	ErrProtoOp     = errors.ErrProtoOp
-	ErrBadTran     = errors.ErrBadTran
-	ErrBadProto    = errors.ErrBadProto
-	ErrBadOption   = errors.ErrBadOption
-	ErrBadValue    = errors.ErrBadValue
-	ErrGarbled     = errors.ErrGarbled
-	ErrAddrInUse   = errors.ErrAddrInUse
-	ErrBadProperty = errors.ErrBadProperty
-	ErrTLSNoConfig = errors.ErrTLSNoConfig
-	ErrTLSNoCert   = errors.ErrTLSNoCert
-	ErrNotRaw      = errors.ErrNotRaw
-	ErrCanceled    = errors.ErrCanceled
-	ErrNoContext   = errors.ErrNoContext
+	ErrBadAddr           = errors.ErrBadAddr
+	ErrBadHeader         = errors.ErrBadHeader
+	ErrBadVersion        = errors.ErrBadVersion
+	ErrTooShort          = errors.ErrTooShort
+	ErrTooLong           = errors.ErrTooLong
+	ErrClosed            = errors.ErrClosed
+	ErrConnRefused       = errors.ErrConnRefused
+	ErrSendTimeout       = errors.ErrSendTimeout
+	ErrRecvTimeout       = errors.ErrRecvTimeout
+	ErrProtoState        = errors.ErrProtoState
+	ErrProtoOp           = errors.ErrProtoOp
+	ErrBadTran           = errors.ErrBadTran
+	ErrBadProto          = errors.ErrBadProto
+	ErrBadOption         = errors.ErrBadOption
+	ErrBadValue          = errors.ErrBadValue
+	ErrGarbled           = errors.ErrGarbled
+	ErrAddrInUse         = errors.ErrAddrInUse
+	ErrBadProperty       = errors.ErrBadProperty
+	ErrTLSNoConfig       = errors.ErrTLSNoConfig
+	ErrTLSNoCert         = errors.ErrTLSNoCert
+	ErrNotRaw            = errors.ErrNotRaw
+	ErrCanceled          = errors.ErrCanceled
+	ErrNoContext         = errors.ErrNoContext
+	ErrHandshakeTimeout  = errors.ErrHandshakeTimeout
+	ErrShortWrite        = errors.ErrShortWrite
+	ErrIncompatibleProto = errors.ErrIncompatibleProto
+	ErrChecksumMismatch  = errors.ErrChecksumMismatch
+	ErrHandshakeFailed   = errors.ErrHandshakeFailed
+	ErrKeepAliveTimeout  = errors.ErrKeepAliveTimeout
+	ErrBufferTooSmall    = errors.ErrBufferTooSmall
+	ErrBusy              = errors.ErrBusy
+	ErrAuthFailed        = errors.ErrAuthFailed
 )
+
+// TooLongError provides the details of a message rejected for exceeding
+// a size limit.  It wraps ErrTooLong.
+type TooLongError = errors.TooLongError
+
+// HandshakeError provides the details of a handshake that failed while
+// reading from the peer.  It matches ErrHandshakeFailed.
+type HandshakeError = errors.HandshakeError
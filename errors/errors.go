@@ -18,6 +18,10 @@
 // pollution.
 package errors
 
+import (
+	"fmt"
+)
+
 type err string
 
 func (e err) Error() string {
@@ -26,27 +30,87 @@ func (e err) Error() string {
 
 // Predefined error values.
 const (
-	ErrBadAddr     = err("invalid address")
-	ErrBadHeader   = err("invalid header received")
-	ErrBadVersion  = err("invalid protocol version")
-	ErrTooShort    = err("message is too short")
-	ErrTooLong     = err("message is too long")
-	ErrClosed      = err("object closed")
-	ErrConnRefused = err("connection refused")
-	ErrSendTimeout = err("send time out")
-	ErrRecvTimeout = err("receive time out")
-	ErrProtoState  = err("incorrect protocol state")
-	ErrProtoOp     = err("invalid operation for protocol")
-	ErrBadTran     = err("invalid or unsupported transport")
-	ErrBadProto    = err("invalid or unsupported protocol")
-	ErrBadOption   = err("invalid or unsupported option")
-	ErrBadValue    = err("invalid option value")
-	ErrGarbled     = err("message garbled")
-	ErrAddrInUse   = err("address in use")
-	ErrBadProperty = err("invalid property name")
-	ErrTLSNoConfig = err("missing TLS configuration")
-	ErrTLSNoCert   = err("missing TLS certificates")
-	ErrNotRaw      = err("socket not raw")
-	ErrCanceled    = err("operation canceled")
-	ErrNoContext   = err("protocol does not support contexts")
+	ErrBadAddr           = err("invalid address")
+	ErrBadHeader         = err("invalid header received")
+	ErrBadVersion        = err("invalid protocol version")
+	ErrTooShort          = err("message is too short")
+	ErrTooLong           = err("message is too long")
+	ErrClosed            = err("object closed")
+	ErrConnRefused       = err("connection refused")
+	ErrSendTimeout       = err("send time out")
+	ErrRecvTimeout       = err("receive time out")
+	ErrProtoState        = err("incorrect protocol state")
+	ErrProtoOp           = err("invalid operation for protocol")
+	ErrBadTran           = err("invalid or unsupported transport")
+	ErrBadProto          = err("invalid or unsupported protocol")
+	ErrBadOption         = err("invalid or unsupported option")
+	ErrBadValue          = err("invalid option value")
+	ErrGarbled           = err("message garbled")
+	ErrAddrInUse         = err("address in use")
+	ErrBadProperty       = err("invalid property name")
+	ErrTLSNoConfig       = err("missing TLS configuration")
+	ErrTLSNoCert         = err("missing TLS certificates")
+	ErrNotRaw            = err("socket not raw")
+	ErrCanceled          = err("operation canceled")
+	ErrNoContext         = err("protocol does not support contexts")
+	ErrHandshakeTimeout  = err("handshake timed out")
+	ErrShortWrite        = err("short write")
+	ErrIncompatibleProto = err("incompatible peer protocol")
+	ErrChecksumMismatch  = err("message checksum mismatch")
+	ErrHandshakeFailed   = err("handshake failed")
+	ErrKeepAliveTimeout  = err("peer did not answer keepalive")
+	ErrBufferTooSmall    = err("buffer too small for message")
+	ErrBusy              = err("object busy")
+	ErrAuthFailed        = err("authentication failed")
 )
+
+// TooLongError describes a message that was rejected for exceeding a
+// size limit.  It wraps ErrTooLong, so errors.Is(err, ErrTooLong) can be
+// used to test for it, while errors.As can be used to obtain the details.
+type TooLongError struct {
+	Size  uint64 // size of the message, in bytes
+	Limit int    // the limit it exceeded, zero if none was configured
+	Peer  string // address of the peer that sent it, if received
+}
+
+func (e *TooLongError) Error() string {
+	var s string
+	if e.Limit > 0 {
+		s = fmt.Sprintf("message of %d bytes exceeds limit %d",
+			e.Size, e.Limit)
+	} else {
+		s = fmt.Sprintf("message of %d bytes is too long", e.Size)
+	}
+	if e.Peer != "" {
+		s += " from peer " + e.Peer
+	}
+	return s
+}
+
+// Unwrap returns ErrTooLong.
+func (e *TooLongError) Unwrap() error {
+	return ErrTooLong
+}
+
+// HandshakeError describes an SP handshake that failed because the
+// connection closed or failed while reading the peer's part.  This
+// usually means that the peer is not an SP peer, or refused us.  It
+// matches ErrHandshakeFailed with errors.Is, and unwraps to the
+// underlying I/O error, such as io.EOF or io.ErrUnexpectedEOF.
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return "handshake failed: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrHandshakeFailed.
+func (e *HandshakeError) Is(target error) bool {
+	return target == ErrHandshakeFailed
+}
@@ -8,5 +8,5 @@ require (
 	github.com/jtolds/gls v4.2.1+incompatible // indirect
 	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
 	github.com/smartystreets/goconvey v0.0.0-20181108003508-044398e4856c
-	golang.org/x/sys v0.0.0-20181128092732-4ed8d59d0b35 // indirect
+	golang.org/x/sys v0.0.0-20181128092732-4ed8d59d0b35
 )
@@ -15,6 +15,7 @@
 package core
 
 import (
+	gocontext "context"
 	"math/rand"
 	"sync"
 	"time"
@@ -38,6 +39,8 @@ type dialer struct {
 	reconnTime    time.Duration
 	reconnMinTime time.Duration
 	reconnMaxTime time.Duration
+	reconnJitter  float64
+	priority      int
 	closeq        chan struct{}
 }
 
@@ -63,6 +66,25 @@ func (d *dialer) Dial() error {
 	return d.dial(false)
 }
 
+// DialContext is like Dial, but the first attempt is always made before
+// returning, and is abandoned if ctx is done before it completes.
+func (d *dialer) DialContext(ctx gocontext.Context) error {
+	d.Lock()
+	if d.active {
+		d.Unlock()
+		return mangos.ErrAddrInUse
+	}
+	if d.closed {
+		d.Unlock()
+		return mangos.ErrClosed
+	}
+	d.closeq = make(chan struct{})
+	d.active = true
+	d.reconnTime = d.reconnMinTime
+	d.Unlock()
+	return d.dialContext(ctx, false)
+}
+
 func (d *dialer) Close() error {
 	d.Lock()
 	defer d.Unlock()
@@ -85,6 +107,16 @@ func (d *dialer) GetOption(n string) (interface{}, error) {
 		v := d.reconnMaxTime
 		d.Unlock()
 		return v, nil
+	case mangos.OptionReconnectJitter:
+		d.Lock()
+		v := d.reconnJitter
+		d.Unlock()
+		return v, nil
+	case mangos.OptionPipePriority:
+		d.Lock()
+		v := d.priority
+		d.Unlock()
+		return v, nil
 	case mangos.OptionDialAsynch:
 		d.Lock()
 		v := d.asynch
@@ -116,6 +148,22 @@ func (d *dialer) SetOption(n string, v interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
+	case mangos.OptionReconnectJitter:
+		if v, ok := v.(float64); ok && v >= 0 && v <= 1 {
+			d.Lock()
+			d.reconnJitter = v
+			d.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionPipePriority:
+		if v, ok := v.(int); ok {
+			d.Lock()
+			d.priority = v
+			d.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
 	case mangos.OptionDialAsynch:
 		if v, ok := v.(bool); ok {
 			d.Lock()
@@ -149,11 +197,60 @@ func (d *dialer) pipeClosed() {
 	// peer refuses to accept our protocol.  Injecting at least a little
 	// delay should help.
 	d.Lock()
-	time.AfterFunc(d.reconnTime, d.redial)
+	time.AfterFunc(jitterTime(d.reconnTime, d.reconnJitter, rand.Float64),
+		d.redial)
 	d.Unlock()
 }
 
+// jitterTime spreads t randomly over t*(1-frac) to t*(1+frac), so that
+// many dialers that lost their peer at the same moment do not all come
+// back at once.  The rnd function returns values in [0.0, 1.0).
+func jitterTime(t time.Duration, frac float64, rnd func() float64) time.Duration {
+	if frac <= 0 {
+		return t
+	}
+	return time.Duration(float64(t) * (1 + frac*(2*rnd()-1)))
+}
+
 func (d *dialer) dial(redial bool) error {
+	return d.dialContext(gocontext.Background(), redial)
+}
+
+// tranDial has the transport dial, giving up once ctx is done.  If the
+// transport cannot be given the context, a pipe that it connects too
+// late is closed.
+func (d *dialer) tranDial(ctx gocontext.Context) (transport.Pipe, error) {
+	if ctx.Done() == nil {
+		return d.d.Dial()
+	}
+	if cd, ok := d.d.(interface {
+		DialContext(gocontext.Context) (transport.Pipe, error)
+	}); ok {
+		return cd.DialContext(ctx)
+	}
+	type result struct {
+		p   transport.Pipe
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		p, err := d.d.Dial()
+		ch <- result{p, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.p, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.p != nil {
+				r.p.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (d *dialer) dialContext(ctx gocontext.Context, redial bool) error {
 	d.Lock()
 	if d.asynch {
 		redial = true
@@ -173,7 +270,7 @@ func (d *dialer) dial(redial bool) error {
 	d.dialing = true
 	d.Unlock()
 
-	p, err := d.d.Dial()
+	p, err := d.tranDial(ctx)
 	if err == nil {
 		d.s.addPipe(p, d, nil)
 
@@ -206,25 +303,36 @@ func (d *dialer) dial(redial bool) error {
 	case mangos.ErrClosed:
 		// Stop redialing, no further action.
 
+	case mangos.ErrBadHeader, mangos.ErrBadVersion,
+		mangos.ErrBadProto, mangos.ErrIncompatibleProto:
+		// The peer is not something we can ever talk to, so
+		// retrying would just waste effort on both sides.
+
 	default:
-		// Exponential backoff, and jitter.  Our backoff grows at
-		// about 1.3x on average, so we don't penalize a failed
-		// connection too badly.
-		minfact := float64(1.1)
-		maxfact := float64(1.5)
-		actfact := rand.Float64()*(maxfact-minfact) + minfact
-		rtime := d.reconnTime
-		if d.reconnMaxTime != 0 {
-			d.reconnTime = time.Duration(actfact * float64(d.reconnTime))
-			if d.reconnTime > d.reconnMaxTime {
-				d.reconnTime = d.reconnMaxTime
-			}
-		}
-		d.redialer = time.AfterFunc(rtime, d.redial)
+		d.redialer = time.AfterFunc(d.backoff(rand.Float64), d.redial)
 	}
 	return err
 }
 
+// backoff returns the time to wait before the next connection attempt,
+// and advances the exponential schedule.  The caller holds the lock.
+func (d *dialer) backoff(rnd func() float64) time.Duration {
+	// Exponential backoff, and jitter.  Our backoff grows at
+	// about 1.3x on average, so we don't penalize a failed
+	// connection too badly.
+	minfact := float64(1.1)
+	maxfact := float64(1.5)
+	actfact := rnd()*(maxfact-minfact) + minfact
+	rtime := d.reconnTime
+	if d.reconnMaxTime != 0 {
+		d.reconnTime = time.Duration(actfact * float64(d.reconnTime))
+		if d.reconnTime > d.reconnMaxTime {
+			d.reconnTime = d.reconnMaxTime
+		}
+	}
+	return jitterTime(rtime, d.reconnJitter, rnd)
+}
+
 func (d *dialer) redial() {
 	d.dial(true)
 }
@@ -0,0 +1,68 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDialerBackoffJitter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1)).Float64
+	d := &dialer{
+		reconnTime:    100 * time.Millisecond,
+		reconnMaxTime: 5 * time.Second,
+		reconnJitter:  0.2,
+	}
+	spread := false
+	for i := 0; i < 50; i++ {
+		base := d.reconnTime
+		wait := d.backoff(rnd)
+		lo := time.Duration(float64(base) * 0.8)
+		hi := time.Duration(float64(base) * 1.2)
+		if wait < lo || wait > hi {
+			t.Fatalf("Attempt %d: wait %v outside [%v, %v]",
+				i, wait, lo, hi)
+		}
+		if wait != base {
+			spread = true
+		}
+		next := time.Duration(float64(base) * 1.1)
+		if next > d.reconnMaxTime {
+			next = d.reconnMaxTime
+		}
+		if d.reconnTime < next || d.reconnTime > d.reconnMaxTime {
+			t.Fatalf("Attempt %d: schedule went from %v to %v",
+				i, base, d.reconnTime)
+		}
+	}
+	if !spread {
+		t.Errorf("Jitter never changed the interval")
+	}
+	if d.reconnTime != d.reconnMaxTime {
+		t.Errorf("Schedule did not reach the maximum: %v", d.reconnTime)
+	}
+}
+
+func TestDialerBackoffNoJitter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1)).Float64
+	d := &dialer{reconnTime: 100 * time.Millisecond}
+	for i := 0; i < 5; i++ {
+		if wait := d.backoff(rnd); wait != 100*time.Millisecond {
+			t.Fatalf("Got %v, expected fixed interval", wait)
+		}
+	}
+}
@@ -24,22 +24,89 @@ import (
 
 type listener struct {
 	sync.Mutex
-	l      transport.Listener
-	s      *socket
-	addr   string
-	closed bool
+	l        transport.Listener
+	s        *socket
+	addr     string
+	closed   bool
+	maxConns int // limit on open pipes, 0 if unlimited
+	numPipes int // number of open pipes
+	priority int // OptionPipePriority
 }
 
 func (l *listener) GetOption(n string) (interface{}, error) {
-	// Listeners do not keep local options; we just pass this down.
+	switch n {
+	case mangos.OptionMaxConnections:
+		l.Lock()
+		v := l.maxConns
+		l.Unlock()
+		return v, nil
+	case mangos.OptionPipePriority:
+		l.Lock()
+		v := l.priority
+		l.Unlock()
+		return v, nil
+	}
+	// Transport specific options passed down.
 	return l.l.GetOption(n)
 }
 
 func (l *listener) SetOption(n string, v interface{}) error {
-	// Listeners do not keep local options; we just pass this down.
+	switch n {
+	case mangos.OptionMaxConnections:
+		if v, ok := v.(int); ok && v >= 0 {
+			l.Lock()
+			l.maxConns = v
+			l.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionPipePriority:
+		if v, ok := v.(int); ok {
+			l.Lock()
+			l.priority = v
+			l.Unlock()
+			return nil
+		}
+		return mangos.ErrBadValue
+	}
+	// Transport specific options passed down.
 	return l.l.SetOption(n, v)
 }
 
+// admit accounts for a newly accepted pipe, returning false if the pipe
+// would exceed the connection limit.
+func (l *listener) admit() bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.maxConns > 0 && l.numPipes >= l.maxConns {
+		return false
+	}
+	l.numPipes++
+	return true
+}
+
+// reject closes a pipe that would exceed the connection limit, logging
+// the reason to the OptionLogger, if there is one.
+func (l *listener) reject(tp transport.Pipe) {
+	if v, err := l.l.GetOption(mangos.OptionLogger); err == nil {
+		if lg, ok := v.(mangos.Logger); ok {
+			l.Lock()
+			max := l.maxConns
+			l.Unlock()
+			lg.Warnf("mangos: connection from %v rejected: limit of %d connections reached",
+				tp.RemoteAddr(), max)
+		}
+	}
+	tp.Close()
+}
+
+// pipeClosed is called when a pipe we accepted is closed.
+func (l *listener) pipeClosed() {
+	l.Lock()
+	l.numPipes--
+	l.Unlock()
+}
+
 // serve spins in a loop, calling the accepter's Accept routine.
 func (l *listener) serve() {
 	for {
@@ -55,6 +122,11 @@ func (l *listener) serve() {
 		if tp, err := l.l.Accept(); err == mangos.ErrClosed {
 			return
 		} else if err == nil {
+			if !l.admit() {
+				// Too many connections, so reject this one.
+				l.reject(tp)
+				continue
+			}
 			l.s.addPipe(tp, nil, l)
 		} else {
 			// Debounce a little bit, to avoid thrashing the CPU.
@@ -15,7 +15,11 @@
 package core
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"math/rand"
+	"net"
 	"sync"
 	"time"
 
@@ -41,7 +45,42 @@ type pipe struct {
 	l      *listener
 	d      *dialer
 	s      *socket
-	closed bool // true if we were closed
+	closed bool  // true if we were closed
+	err    error // why we closed the pipe, if we did
+	closeq chan struct{}
+	seq    uint64 // last sequence number received
+
+	// These enforce the receive rate limits.  Only the receiver
+	// uses them, so they are not locked.
+	rxMsgs  bucket
+	rxBytes bucket
+	rxHold  time.Time // when the limits allow receiving again
+}
+
+// bucket is a token bucket, holding up to a second's worth of tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens, after adding those accrued since the last call
+// at rate tokens per second.  It returns how long it will be until the
+// bucket is no longer in debt.
+func (b *bucket) take(rate int, n int, now time.Time) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
 }
 
 func init() {
@@ -51,10 +90,11 @@ func init() {
 
 func newPipe(tp transport.Pipe, s *socket, d *dialer, l *listener) *pipe {
 	p := &pipe{
-		p: tp,
-		d: d,
-		l: l,
-		s: s,
+		p:      tp,
+		d:      d,
+		l:      l,
+		s:      s,
+		closeq: make(chan struct{}),
 	}
 	pipes.Lock()
 	for {
@@ -85,6 +125,7 @@ func (p *pipe) Close() error {
 		return nil
 	}
 	p.closed = true
+	close(p.closeq)
 	p.Unlock()
 
 	if s != nil {
@@ -96,6 +137,9 @@ func (p *pipe) Close() error {
 	if d := p.d; d != nil {
 		go d.pipeClosed()
 	}
+	if l := p.l; l != nil {
+		l.pipeClosed()
+	}
 
 	// This is last, as we keep the ID reserved until everything is
 	// done with it.
@@ -108,6 +152,12 @@ func (p *pipe) Close() error {
 
 func (p *pipe) SendMsg(msg *mangos.Message) error {
 
+	// The protocols call this as they take messages off their send
+	// queues, so this is where stale messages are dropped.
+	if msg.Expired() {
+		msg.Free()
+		return nil
+	}
 	if err := p.p.Send(msg); err != nil {
 		p.Close()
 		return err
@@ -115,17 +165,282 @@ func (p *pipe) SendMsg(msg *mangos.Message) error {
 	return nil
 }
 
+func (p *pipe) SendPrepared(pm *mangos.PreparedMessage) error {
+	var err error
+
+	if pm.Expired() {
+		return nil
+	}
+
+	// Transports that understand prepared messages can send the
+	// shared encoding, otherwise they get a copy of the message.
+	if ps, ok := p.p.(interface {
+		SendPrepared(*mangos.PreparedMessage) error
+	}); ok {
+		err = ps.SendPrepared(pm)
+	} else {
+		err = p.p.Send(pm.Message())
+	}
+	if err != nil {
+		p.Close()
+		return err
+	}
+	return nil
+}
+
+func (p *pipe) Flush() error {
+	// Transports that buffer writes can flush them, otherwise there
+	// is nothing to wait for.
+	if f, ok := p.p.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (p *pipe) Cork() error {
+	if c, ok := p.p.(interface {
+		Cork() error
+	}); ok {
+		return c.Cork()
+	}
+	return mangos.ErrProtoOp
+}
+
+func (p *pipe) Uncork() error {
+	if c, ok := p.p.(interface {
+		Uncork() error
+	}); ok {
+		return c.Uncork()
+	}
+	return mangos.ErrProtoOp
+}
+
+func (p *pipe) SetMaxRecvSize(n int64) error {
+	if ms, ok := p.p.(interface {
+		SetMaxRecvSize(int64) error
+	}); ok {
+		return ms.SetMaxRecvSize(n)
+	}
+	return mangos.ErrProtoOp
+}
+
+func (p *pipe) LocalAddr() net.Addr {
+	return p.p.LocalAddr()
+}
+
+func (p *pipe) RemoteAddr() net.Addr {
+	return p.p.RemoteAddr()
+}
+
+func (p *pipe) Conn() net.Conn {
+	if c, ok := p.p.(interface {
+		Conn() net.Conn
+	}); ok {
+		return c.Conn()
+	}
+	return nil
+}
+
+func (p *pipe) PeerMetadata() map[string]string {
+	if pm, ok := p.p.(interface {
+		PeerMetadata() map[string]string
+	}); ok {
+		return pm.PeerMetadata()
+	}
+	return nil
+}
+
+func (p *pipe) PeerCertificate() *x509.Certificate {
+	v, err := p.p.GetOption(mangos.OptionTLSConnState)
+	if err != nil {
+		return nil
+	}
+	if cs, ok := v.(tls.ConnectionState); ok && len(cs.PeerCertificates) > 0 {
+		return cs.PeerCertificates[0]
+	}
+	return nil
+}
+
+func (p *pipe) Info() mangos.PipeInfo {
+	var info mangos.PipeInfo
+	if pi, ok := p.p.(interface {
+		Info() mangos.PipeInfo
+	}); ok {
+		info = pi.Info()
+	}
+	info.ID = p.id
+	info.RemoteProtocol = p.p.RemoteProtocol()
+	if v, err := p.p.GetOption(mangos.OptionRemoteAddr); err == nil {
+		info.RemoteAddr, _ = v.(net.Addr)
+	}
+	if v, err := p.p.GetOption(mangos.OptionPipeStats); err == nil {
+		info.Stats, _ = v.(mangos.PipeStats)
+	}
+	return info
+}
+
+// waitResume waits while receiving is paused on the socket.  The
+// transport is told, so that it does not take the silence from the
+// peer for a failure.  It returns false if the pipe is closed first.
+func (p *pipe) waitResume() bool {
+	s := p.s
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	q := s.resumeq
+	s.Unlock()
+	if q == nil {
+		return true
+	}
+	if rp, ok := p.p.(interface {
+		SetRecvPaused(bool)
+	}); ok {
+		rp.SetRecvPaused(true)
+		defer rp.SetRecvPaused(false)
+	}
+	select {
+	case <-q:
+		return true
+	case <-p.closeq:
+		return false
+	}
+}
+
+// waitRate waits until the receive rate limits allow another message to
+// be read.  As with waitResume, the transport is told that it is not
+// reading.  It returns false if the pipe is closed first.
+func (p *pipe) waitRate() bool {
+	d := time.Until(p.rxHold)
+	if d <= 0 {
+		return true
+	}
+	if rp, ok := p.p.(interface {
+		SetRecvPaused(bool)
+	}); ok {
+		rp.SetRecvPaused(true)
+		defer rp.SetRecvPaused(false)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-p.closeq:
+		return false
+	}
+}
+
+// chargeRate accounts for a received message against the receive rate
+// limits, if any.
+func (p *pipe) chargeRate(msg *mangos.Message) {
+	s := p.s
+	if s == nil {
+		return
+	}
+	s.Lock()
+	rate, byteRate := s.rxRate, s.rxByteRate
+	s.Unlock()
+	now := time.Now()
+	var d time.Duration
+	if rate > 0 {
+		d = p.rxMsgs.take(rate, 1, now)
+	}
+	if byteRate > 0 {
+		n := len(msg.Header) + len(msg.Body)
+		if bd := p.rxBytes.take(byteRate, n, now); bd > d {
+			d = bd
+		}
+	}
+	p.rxHold = now.Add(d)
+}
+
+// recv receives the next message from the transport.  If the socket
+// has a receive idle timeout, the idle hook is called each time that
+// passes without a message, rather than failing.
+func (p *pipe) recv() (*mangos.Message, error) {
+	var idle time.Duration
+	var hook mangos.RecvIdleHook
+	if s := p.s; s != nil {
+		s.Lock()
+		idle, hook = s.idleTime, s.idleHook
+		s.Unlock()
+	}
+	tp, ok := p.p.(interface {
+		SetRecvDeadline(time.Time) error
+	})
+	if !ok || idle <= 0 || hook == nil {
+		return p.p.Recv()
+	}
+	defer tp.SetRecvDeadline(time.Time{})
+	for {
+		if err := tp.SetRecvDeadline(time.Now().Add(idle)); err != nil {
+			return nil, err
+		}
+		msg, err := p.p.Recv()
+		var ne net.Error
+		if err == nil || !errors.As(err, &ne) || !ne.Timeout() {
+			return msg, err
+		}
+		hook(p)
+		p.Lock()
+		closed := p.closed
+		p.Unlock()
+		if closed {
+			return nil, err
+		}
+	}
+}
+
 func (p *pipe) RecvMsg() *mangos.Message {
 
-	msg, err := p.p.Recv()
+	if !p.waitResume() || !p.waitRate() {
+		return nil
+	}
+	msg, err := p.recv()
 	if err != nil {
 		p.Close()
 		return nil
 	}
+	if s := p.s; s != nil && s.validate != nil {
+		if err = s.validate(msg); err != nil {
+			msg.Free()
+			p.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.Unlock()
+			p.Close()
+			return nil
+		}
+	}
+	if msg.Seq != 0 {
+		p.checkSeq(msg.Seq)
+	}
+	p.chargeRate(msg)
 	msg.Pipe = p
 	return msg
 }
 
+// checkSeq reports a gap in the sequence numbers received, if any.
+func (p *pipe) checkSeq(seq uint64) {
+	p.Lock()
+	want := p.seq + 1
+	p.seq = seq
+	p.Unlock()
+	if seq == want || p.s == nil {
+		return
+	}
+	p.s.Lock()
+	hook := p.s.gapHook
+	p.s.Unlock()
+	if hook != nil {
+		hook(p, want, seq)
+	}
+}
+
 func (p *pipe) Address() string {
 	switch {
 	case p.l != nil:
@@ -137,6 +452,14 @@ func (p *pipe) Address() string {
 }
 
 func (p *pipe) GetOption(name string) (interface{}, error) {
+	if name == mangos.OptionPipePriority {
+		// This belongs to the dialer or listener.  Transport pipes
+		// report ErrBadProperty for it, so it would not reach them.
+		if p.d != nil {
+			return p.d.GetOption(name)
+		}
+		return p.l.GetOption(name)
+	}
 	val, err := p.p.GetOption(name)
 	if err == mangos.ErrBadOption {
 		if p.d != nil {
@@ -148,6 +471,16 @@ func (p *pipe) GetOption(name string) (interface{}, error) {
 	return val, err
 }
 
+func (p *pipe) CloseErr() error {
+	p.Lock()
+	err := p.err
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+	return p.p.CloseErr()
+}
+
 func (p *pipe) Dialer() mangos.Dialer {
 	if p.d == nil {
 		return nil
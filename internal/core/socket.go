@@ -15,6 +15,7 @@
 package core
 
 import (
+	gocontext "context"
 	"fmt"
 	"strings"
 	"sync"
@@ -30,10 +31,17 @@ type Message = mangos.Message
 // defaultMaxRxSize is the default maximum Rx size
 const defaultMaxRxSize = 1024 * 1024
 
+// defaultMaxTxSize is the default maximum Tx size.  It matches the Rx
+// size, so that peers using the defaults will accept what we send.
+const defaultMaxTxSize = defaultMaxRxSize
+
 const defaultReconnMinTime = time.Millisecond * 100
 
 const defaultReconnMaxTime = time.Duration(0)
 
+// defaultDialConcurrency is the default for OptionDialConcurrency.
+const defaultDialConcurrency = 8
+
 // socket is the meaty part of the core information.
 type socket struct {
 	proto mangos.ProtocolBase
@@ -43,13 +51,31 @@ type socket struct {
 	closed        bool          // true if Socket was closed at API level
 	reconnMinTime time.Duration // reconnect time after error or disconnect
 	reconnMaxTime time.Duration // max reconnect interval
+	reconnJitter  float64       // random fraction applied to reconnect
 	maxRxSize     int           // max recv size
+	maxTxSize     int           // max send size
 	dialAsynch    bool          // asynchronous dialing?
+	linger        time.Duration // time to drain queues on close
+	idleTime      time.Duration // receive idle timeout
+	idleHook      mangos.RecvIdleHook
+	gapHook       mangos.SeqGapHook
+	rxRate        int           // OptionRecvRateLimit
+	rxByteRate    int           // OptionRecvByteRateLimit
+	dialConc      int           // limit on concurrent dials in DialMany
+	sending       int           // sends and round trips in progress
+	resumeq       chan struct{} // closed by ResumeRecv, nil unless paused
+	connq         chan struct{} // closed when a pipe is added
+	closeq        chan struct{} // closed when the socket is closed
+	recvch        chan mangos.RecvResult
 
 	listeners []*listener
 	dialers   []*dialer
 	pipes     map[*pipe]struct{}
 	pipehook  mangos.PipeEventHook
+
+	// validate checks the header of each received message, if the
+	// protocol supports it.
+	validate func(*mangos.Message) error
 }
 
 type context struct {
@@ -79,6 +105,10 @@ func (s *socket) addPipe(tp transport.Pipe, d *dialer, l *listener) {
 		return
 	}
 	s.pipes[p] = struct{}{}
+	if s.connq != nil {
+		close(s.connq)
+		s.connq = nil
+	}
 	if p.d != nil {
 		// This call resets the redial time in the dialer.  Its
 		// kind of ugly that we have the socket doing this, but
@@ -104,12 +134,23 @@ func (s *socket) remPipe(p *pipe) {
 }
 
 func newSocket(proto mangos.ProtocolBase) *socket {
+	info := proto.Info()
+	mangos.RegisterProtocolName(info.Self, info.SelfName)
+	mangos.RegisterProtocolName(info.Peer, info.PeerName)
 	s := &socket{
 		proto:         proto,
 		reconnMinTime: defaultReconnMinTime,
 		reconnMaxTime: defaultReconnMaxTime,
 		maxRxSize:     defaultMaxRxSize,
+		maxTxSize:     defaultMaxTxSize,
+		dialConc:      defaultDialConcurrency,
 		pipes:         make(map[*pipe]struct{}),
+		closeq:        make(chan struct{}),
+	}
+	if v, ok := proto.(interface {
+		ValidateHeader(*mangos.Message) error
+	}); ok {
+		s.validate = v.ValidateHeader
 	}
 	return s
 }
@@ -127,6 +168,16 @@ func (s *socket) Close() error {
 		s.Unlock()
 		return mangos.ErrClosed
 	}
+	s.closed = true
+	linger := s.linger
+	close(s.closeq)
+	s.Unlock()
+
+	// Dialers and listeners are left running while we linger, as
+	// queued messages cannot be delivered without a peer.
+	s.drain(linger)
+
+	s.Lock()
 	listeners := s.listeners
 	dialers := s.dialers
 	pipes := s.pipes
@@ -134,6 +185,10 @@ func (s *socket) Close() error {
 	s.listeners = nil
 	s.dialers = nil
 	s.pipes = nil
+	if s.connq != nil {
+		close(s.connq)
+		s.connq = nil
+	}
 	s.Unlock()
 
 	for _, l := range listeners {
@@ -151,6 +206,121 @@ func (s *socket) Close() error {
 	return nil
 }
 
+// drain waits up to d for the protocol to hand queued messages to the
+// transport.
+func (s *socket) drain(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(done)
+		s.flush(stop)
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+	}
+}
+
+// flushBackoff limits how often flush calls Flush again after it gives up.
+const (
+	minFlushBackoff = 10 * time.Millisecond
+	maxFlushBackoff = 100 * time.Millisecond
+)
+
+// flush waits for the protocol to hand queued messages to the transport,
+// if it is able to Flush them, until stop is closed.  Closing the
+// protocol also ends the wait.
+func (s *socket) flush(stop <-chan struct{}) {
+	f, ok := s.proto.(interface {
+		Flush() error
+	})
+	if !ok {
+		return
+	}
+	// Flush gives up at the send deadline, but we may wait for longer.
+	// A short deadline must not make this spin, so pause in between.
+	backoff := minFlushBackoff
+	for f.Flush() == mangos.ErrSendTimeout {
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return
+		}
+		if backoff *= 2; backoff > maxFlushBackoff {
+			backoff = maxFlushBackoff
+		}
+	}
+}
+
+func (s *socket) Shutdown(ctx gocontext.Context) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return mangos.ErrClosed
+	}
+	listeners := s.listeners
+	s.listeners = nil
+	s.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	err := s.quiesce(ctx)
+	s.Close()
+	return err
+}
+
+// quiesce waits until no calls to SendMsg are in progress, the protocol
+// owes no replies, and queued messages have been flushed.
+func (s *socket) quiesce(ctx gocontext.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for s.busy() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.flush(ctx.Done())
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// busy returns true if a message is being sent, or the protocol has
+// work pending, such as a reply that the application has yet to send.
+func (s *socket) busy() bool {
+	s.Lock()
+	sending := s.sending
+	s.Unlock()
+	if sending > 0 {
+		return true
+	}
+	if p, ok := s.proto.(interface {
+		Pending() bool
+	}); ok {
+		return p.Pending()
+	}
+	return false
+}
+
 func (ctx context) Send(b []byte) error {
 	msg := mangos.NewMessage(len(b))
 	msg.Body = append(msg.Body, b...)
@@ -176,7 +346,99 @@ func (s *socket) OpenContext() (mangos.Context, error) {
 }
 
 func (s *socket) SendMsg(msg *Message) error {
-	return s.proto.SendMsg(msg)
+	return s.send(msg, s.proto.SendMsg)
+}
+
+// send checks msg against OptionMaxSendSize, then sends it using fn,
+// noting that a send is in progress for Shutdown.
+func (s *socket) send(msg *Message, fn func(*Message) error) error {
+	if err := s.beginSend(msg); err != nil {
+		return err
+	}
+	defer s.endSend()
+	return fn(msg)
+}
+
+// beginSend checks msg against OptionMaxSendSize, and if it may be sent,
+// notes that a send is in progress, until endSend is called.
+func (s *socket) beginSend(msg *Message) error {
+	s.Lock()
+	defer s.Unlock()
+	max := s.maxTxSize
+	if sz := len(msg.Header) + len(msg.Body); max > 0 && sz > max {
+		return &mangos.TooLongError{Size: uint64(sz), Limit: max}
+	}
+	s.sending++
+	return nil
+}
+
+func (s *socket) endSend() {
+	s.Lock()
+	s.sending--
+	s.Unlock()
+}
+
+func (s *socket) Flush() error {
+	if f, ok := s.proto.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return mangos.ErrProtoOp
+}
+
+func (s *socket) SendUrgent(msg *Message) error {
+	if u, ok := s.proto.(interface {
+		SendUrgent(*Message) error
+	}); ok {
+		return s.send(msg, u.SendUrgent)
+	}
+	return mangos.ErrProtoOp
+}
+
+func (s *socket) RoundTrip(ctx gocontext.Context, msg *Message) (*Message, error) {
+	if r, ok := s.proto.(interface {
+		RoundTrip(gocontext.Context, *Message) (*Message, error)
+	}); ok {
+		// Shutdown waits for the reply, as for any send.
+		if err := s.beginSend(msg); err != nil {
+			return nil, err
+		}
+		defer s.endSend()
+		return r.RoundTrip(ctx, msg)
+	}
+	return nil, mangos.ErrProtoOp
+}
+
+func (s *socket) PauseRecv() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return mangos.ErrClosed
+	}
+	if s.resumeq == nil {
+		s.resumeq = make(chan struct{})
+	}
+	return nil
+}
+
+func (s *socket) ResumeRecv() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.resumeq != nil {
+		close(s.resumeq)
+		s.resumeq = nil
+	}
+	return nil
+}
+
+func (s *socket) SetRaw(raw bool) error {
+	if r, ok := s.proto.(interface {
+		SetRaw(bool) error
+	}); ok {
+		return r.SetRaw(raw)
+	}
+	return mangos.ErrProtoOp
 }
 
 func (s *socket) Send(b []byte) error {
@@ -189,6 +451,78 @@ func (s *socket) RecvMsg() (*Message, error) {
 	return s.proto.RecvMsg()
 }
 
+func (s *socket) RecvBatch(max int) ([]*Message, error) {
+	if r, ok := s.proto.(interface {
+		RecvBatch(int) ([]*Message, error)
+	}); ok {
+		return r.RecvBatch(max)
+	}
+	return nil, mangos.ErrProtoOp
+}
+
+func (s *socket) RecvChan() <-chan mangos.RecvResult {
+	s.Lock()
+	defer s.Unlock()
+	if s.recvch == nil {
+		s.recvch = make(chan mangos.RecvResult)
+		if s.closed {
+			close(s.recvch)
+		} else {
+			go s.recvLoop(s.recvch)
+		}
+	}
+	return s.recvch
+}
+
+// recvStateBackoff limits how often recvLoop retries after ErrProtoState.
+const (
+	minRecvStateBackoff = 10 * time.Millisecond
+	maxRecvStateBackoff = 100 * time.Millisecond
+)
+
+// recvLoop feeds the channel returned by RecvChan, until the socket is
+// closed.
+func (s *socket) recvLoop(ch chan mangos.RecvResult) {
+	defer close(ch)
+	backoff := time.Duration(0)
+	for {
+		m, err := s.RecvMsg()
+		if err == mangos.ErrClosed {
+			return
+		}
+		select {
+		case ch <- mangos.RecvResult{Msg: m, Err: err}:
+		case <-s.closeq:
+			if m != nil {
+				m.Free()
+			}
+			return
+		}
+		switch err {
+		case mangos.ErrProtoOp:
+			// The protocol cannot receive at all.
+			return
+		case mangos.ErrProtoState:
+			// Nothing can be received until the application does
+			// something, such as sending a request, so don't spin.
+			if backoff == 0 {
+				backoff = minRecvStateBackoff
+			} else if backoff *= 2; backoff > maxRecvStateBackoff {
+				backoff = maxRecvStateBackoff
+			}
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-s.closeq:
+				t.Stop()
+				return
+			}
+		default:
+			backoff = 0
+		}
+	}
+}
+
 func (s *socket) Recv() ([]byte, error) {
 	msg, err := s.RecvMsg()
 	if err != nil {
@@ -231,6 +565,81 @@ func (s *socket) Dial(addr string) error {
 	return s.DialOptions(addr, nil)
 }
 
+func (s *socket) DialMany(addrs []string, opts map[string]interface{}) ([]mangos.DialResult, error) {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil, mangos.ErrClosed
+	}
+	n := s.dialConc
+	s.Unlock()
+	if n <= 0 || n > len(addrs) {
+		n = len(addrs)
+	}
+
+	results := make([]mangos.DialResult, len(addrs))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *mangos.DialResult, addr string) {
+			defer wg.Done()
+			r.Addr = addr
+			d, err := s.NewDialer(addr, opts)
+			if err == nil {
+				if err = d.Dial(); err != nil {
+					d.Close()
+				}
+			}
+			if err == nil {
+				r.Dialer = d
+			}
+			r.Err = err
+			<-sem
+		}(&results[i], addr)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func (s *socket) DialContext(ctx gocontext.Context, addr string) error {
+	d, err := s.NewDialer(addr, nil)
+	if err != nil {
+		return err
+	}
+	return d.(*dialer).DialContext(ctx)
+}
+
+func (s *socket) WaitConnected(ctx gocontext.Context) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return mangos.ErrClosed
+	}
+	if len(s.pipes) > 0 {
+		s.Unlock()
+		return nil
+	}
+	if s.connq == nil {
+		s.connq = make(chan struct{})
+	}
+	connq := s.connq
+	s.Unlock()
+
+	select {
+	case <-connq:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return mangos.ErrClosed
+	}
+	return nil
+}
+
 func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.Dialer, error) {
 	t := s.getTransport(addr)
 	if t == nil {
@@ -245,6 +654,7 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 		s:             s,
 		reconnMinTime: s.reconnMinTime,
 		reconnMaxTime: s.reconnMaxTime,
+		reconnJitter:  s.reconnJitter,
 		addr:          addr,
 	}
 	for n, v := range options {
@@ -253,6 +663,10 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 			fallthrough
 		case mangos.OptionMaxReconnectTime:
 			fallthrough
+		case mangos.OptionReconnectJitter:
+			fallthrough
+		case mangos.OptionPipePriority:
+			fallthrough
 		case mangos.OptionDialAsynch:
 			if err := d.SetOption(n, v); err != nil {
 				return nil, err
@@ -269,6 +683,12 @@ func (s *socket) NewDialer(addr string, options map[string]interface{}) (mangos.
 			return nil, err
 		}
 	}
+	if _, ok := options[mangos.OptionMaxSendSize]; !ok {
+		err = td.SetOption(mangos.OptionMaxSendSize, s.maxTxSize)
+		if err != nil && err != mangos.ErrBadOption {
+			return nil, err
+		}
+	}
 
 	s.Lock()
 	if s.closed {
@@ -285,7 +705,26 @@ func (s *socket) ListenOptions(addr string, options map[string]interface{}) erro
 	if err != nil {
 		return err
 	}
-	return l.Listen()
+	if err = l.Listen(); err != nil {
+		// Don't keep a listener that never started; the socket's
+		// other listeners are unaffected.
+		s.remListener(l.(*listener))
+		l.Close()
+		return err
+	}
+	return nil
+}
+
+// remListener forgets a listener, so that Close does not visit it.
+func (s *socket) remListener(l *listener) {
+	s.Lock()
+	defer s.Unlock()
+	for i, x := range s.listeners {
+		if x == l {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
 }
 
 func (s *socket) Listen(addr string) error {
@@ -306,8 +745,13 @@ func (s *socket) NewListener(addr string, options map[string]interface{}) (mango
 	if err != nil {
 		return nil, err
 	}
+	l := &listener{
+		l:    tl,
+		s:    s,
+		addr: addr,
+	}
 	for n, v := range options {
-		if err = tl.SetOption(n, v); err != nil {
+		if err = l.SetOption(n, v); err != nil {
 			tl.Close()
 			return nil, err
 		}
@@ -315,13 +759,16 @@ func (s *socket) NewListener(addr string, options map[string]interface{}) (mango
 	if _, ok := options[mangos.OptionMaxRecvSize]; !ok {
 		err = tl.SetOption(mangos.OptionMaxRecvSize, s.maxRxSize)
 		if err != nil && err != mangos.ErrBadOption {
+			tl.Close()
 			return nil, err
 		}
 	}
-	l := &listener{
-		l:    tl,
-		s:    s,
-		addr: addr,
+	if _, ok := options[mangos.OptionMaxSendSize]; !ok {
+		err = tl.SetOption(mangos.OptionMaxSendSize, s.maxTxSize)
+		if err != nil && err != mangos.ErrBadOption {
+			tl.Close()
+			return nil, err
+		}
 	}
 	s.Lock()
 	if s.closed {
@@ -351,6 +798,12 @@ func (s *socket) SetOption(name string, value interface{}) error {
 			return mangos.ErrBadValue
 		}
 		break
+	case mangos.OptionMaxSendSize:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.maxTxSize = v
+		} else {
+			return mangos.ErrBadValue
+		}
 	case mangos.OptionReconnectTime:
 		if v, ok := value.(time.Duration); ok {
 			s.reconnMinTime = v
@@ -363,12 +816,60 @@ func (s *socket) SetOption(name string, value interface{}) error {
 		} else {
 			return mangos.ErrBadValue
 		}
+	case mangos.OptionReconnectJitter:
+		if v, ok := value.(float64); ok && v >= 0 && v <= 1 {
+			s.reconnJitter = v
+		} else {
+			return mangos.ErrBadValue
+		}
 	case mangos.OptionDialAsynch:
 		if v, ok := value.(bool); ok {
 			s.dialAsynch = v
 		} else {
 			return mangos.ErrBadValue
 		}
+	case mangos.OptionDialConcurrency:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.dialConc = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionLinger:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.linger = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionRecvIdleTimeout:
+		if v, ok := value.(time.Duration); ok && v >= 0 {
+			s.idleTime = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionRecvIdleHook:
+		if v, ok := value.(mangos.RecvIdleHook); ok {
+			s.idleHook = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionSeqGapHook:
+		if v, ok := value.(mangos.SeqGapHook); ok {
+			s.gapHook = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionRecvRateLimit:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.rxRate = v
+		} else {
+			return mangos.ErrBadValue
+		}
+	case mangos.OptionRecvByteRateLimit:
+		if v, ok := value.(int); ok && v >= 0 {
+			s.rxByteRate = v
+		} else {
+			return mangos.ErrBadValue
+		}
 	default:
 		return mangos.ErrBadOption
 	}
@@ -392,10 +893,28 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	switch name {
 	case mangos.OptionMaxRecvSize:
 		return s.maxRxSize, nil
+	case mangos.OptionMaxSendSize:
+		return s.maxTxSize, nil
 	case mangos.OptionReconnectTime:
 		return s.reconnMinTime, nil
 	case mangos.OptionMaxReconnectTime:
 		return s.reconnMaxTime, nil
+	case mangos.OptionReconnectJitter:
+		return s.reconnJitter, nil
+	case mangos.OptionDialConcurrency:
+		return s.dialConc, nil
+	case mangos.OptionLinger:
+		return s.linger, nil
+	case mangos.OptionRecvIdleTimeout:
+		return s.idleTime, nil
+	case mangos.OptionRecvIdleHook:
+		return s.idleHook, nil
+	case mangos.OptionSeqGapHook:
+		return s.gapHook, nil
+	case mangos.OptionRecvRateLimit:
+		return s.rxRate, nil
+	case mangos.OptionRecvByteRateLimit:
+		return s.rxByteRate, nil
 	}
 	return nil, mangos.ErrBadOption
 }
@@ -404,6 +923,21 @@ func (s *socket) Info() mangos.ProtocolInfo {
 	return s.proto.Info()
 }
 
+func (s *socket) Pipes() []mangos.PipeInfo {
+	s.Lock()
+	pipes := make([]*pipe, 0, len(s.pipes))
+	for p := range s.pipes {
+		pipes = append(pipes, p)
+	}
+	s.Unlock()
+
+	infos := make([]mangos.PipeInfo, 0, len(pipes))
+	for _, p := range pipes {
+		infos = append(infos, p.Info())
+	}
+	return infos
+}
+
 func (s *socket) SetPipeEventHook(newhook mangos.PipeEventHook) mangos.PipeEventHook {
 	s.Lock()
 	oldhook := s.pipehook
@@ -0,0 +1,26 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mangos
+
+// Logger receives diagnostics about events that are otherwise silent,
+// such as a peer failing the handshake, or a pipe being closed because
+// the peer sent a message that was too long.  Warnf reports problems
+// an operator should know about; Debugf reports routine events, such as
+// pipes closing normally.  Messages are not logged individually.  It is
+// the value for OptionLogger, and must be safe for concurrent use.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
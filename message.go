@@ -15,7 +15,9 @@
 package mangos
 
 import (
+	"encoding/binary"
 	"sync"
+	"time"
 )
 
 // Message encapsulates the messages that we exchange back and forth.  The
@@ -36,15 +38,63 @@ type Message struct {
 	// Pipe may be set on message receipt, to indicate the Pipe from
 	// which the Message was received.  There are no guarantees that the
 	// Pipe is still active, and applications should only use this for
-	// informational purposes.
+	// informational purposes.  All of the protocols set it, so that
+	// (for example) BUS and SURVEYOR applications can tell which peer
+	// sent each message.  The Pipe's ID is unique while the Pipe
+	// exists, and is not reused until it has been fully closed, so it
+	// is suitable as a key for per-peer state.  Protocols that reply
+	// to a particular peer, such as REP and RESPONDENT, do so by
+	// means of the protocol header, not this field.
 	Pipe Pipe
 
-	bbuf  []byte
-	hbuf  []byte
-	bsize int
-	pool  *sync.Pool
+	// Priority is a local scheduling hint.  Protocols that support it
+	// (presently only BUS) send messages with a non-zero Priority
+	// ahead of any ordinary messages already queued.  Messages of the
+	// same priority class are sent in order.  It is not transmitted to
+	// the peer, so received messages always have zero Priority.
+	Priority uint8
+
+	// TraceID carries a trace context, such as a distributed tracing
+	// span ID, along with the message.  It is transmitted only over
+	// pipes where both peers enabled OptionTraceHeader, and it is kept
+	// apart from the Header, so the protocols never see it.  REP and
+	// RESPONDENT copy it from each request to the reply, unless the
+	// reply already has one.
+	TraceID [TraceIDSize]byte
+
+	// Type and Flags are an application defined message type and
+	// flags, for routing or dispatching without inventing a framing
+	// of one's own.  They are transmitted only over pipes where both
+	// peers enabled OptionTypeHeader, and like TraceID are kept apart
+	// from the Header.  Mangos attaches no meaning to either, so all
+	// values are passed along untouched, such as by a Device.
+	Type  uint16
+	Flags uint8
+
+	// Seq is the sequence number of a received message, over pipes
+	// where both peers enabled OptionSeqHeader, and zero otherwise.
+	// Numbers are assigned by the sending pipe, so any value set on
+	// a message being sent is ignored.
+	Seq uint64
+
+	// Expiry, if not zero, is the time after which the message is no
+	// longer worth delivering.  A message still waiting in a send
+	// queue when it expires is discarded when it reaches the head of
+	// the queue, instead of being sent.  Messages already handed to
+	// the transport are sent regardless.  It is not transmitted to
+	// the peer.
+	Expiry time.Time
+
+	bbuf    []byte
+	hbuf    []byte
+	bsize   int
+	pool    *sync.Pool
+	release func() // for a Body from a RecvAllocator
 }
 
+// TraceIDSize is the size of the trace context carried by Message.TraceID.
+const TraceIDSize = 16
+
 type msgCacheInfo struct {
 	maxbody int
 	pool    *sync.Pool
@@ -107,7 +157,25 @@ var messageCache = []msgCacheInfo{
 // While this is not strictly necessary thanks to GC, doing so allows
 // for the resources to be recycled without engaging GC.  This can have
 // rather substantial benefits for performance.
+//
+// Once Free has been called, the caller must not retain or use the
+// Message, or any slice of its Header or Body, as these may be handed
+// out again by a subsequent NewMessage.
 func (m *Message) Free() {
+	m.Pipe = nil
+	m.Priority = 0
+	m.TraceID = [TraceIDSize]byte{}
+	m.Type = 0
+	m.Flags = 0
+	m.Seq = 0
+	m.Expiry = time.Time{}
+	if release := m.release; release != nil {
+		m.release = nil
+		m.Header = nil
+		m.Body = nil
+		release()
+		return
+	}
 	for i := range messageCache {
 		if m.bsize == messageCache[i].maxbody {
 			messageCache[i].pool.Put(m)
@@ -124,15 +192,65 @@ func (m *Message) Dup() *Message {
 	dup.Body = append(dup.Body, m.Body...)
 	dup.Header = append(dup.Header, m.Header...)
 	dup.Pipe = m.Pipe
+	dup.Priority = m.Priority
+	dup.TraceID = m.TraceID
+	dup.Type = m.Type
+	dup.Flags = m.Flags
+	dup.Seq = m.Seq
+	dup.Expiry = m.Expiry
 	return dup
 }
 
+// Expired returns true if the message has an Expiry, and it has passed.
+func (m *Message) Expired() bool {
+	return !m.Expiry.IsZero() && time.Now().After(m.Expiry)
+}
+
+// PushHeader prepends b to the Header.  Protocols build up headers this
+// way, with the most recently added value (such as a pipe ID) first.
+// The Header is kept in storage owned by the Message, which is reused
+// when there is room, and grown when there is not, so the Body is never
+// disturbed even if the Header was sliced from it.
+func (m *Message) PushHeader(b []byte) {
+	sz := len(b) + len(m.Header)
+	if cap(m.hbuf) < sz {
+		m.hbuf = make([]byte, 0, sz*2)
+	}
+	// The Header may already live in hbuf, so move it before
+	// writing the new bytes in front of it.
+	h := m.hbuf[:sz]
+	copy(h[len(b):], m.Header)
+	copy(h, b)
+	m.Header = h
+}
+
+// PopHeader removes the first n bytes of the Header, and returns them.
+// The returned slice shares storage with the Message, so it is only
+// valid until the Header is next modified.  If the Header is shorter
+// than n bytes, it is left alone and nil is returned.
+func (m *Message) PopHeader(n int) []byte {
+	if n < 0 || len(m.Header) < n {
+		return nil
+	}
+	b := m.Header[:n]
+	m.Header = m.Header[n:]
+	return b
+}
+
+// PutUint32Header prepends v to the Header, in network byte order.
+// This is the form used for request IDs and pipe IDs.
+func (m *Message) PutUint32Header(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	m.PushHeader(b[:])
+}
+
 // NewMessage is the supported way to obtain a new Message.  This makes
 // use of a "cache" which greatly reduces the load on the garbage collector.
 func NewMessage(sz int) *Message {
 	var m *Message
 	for i := range messageCache {
-		if sz < messageCache[i].maxbody {
+		if sz <= messageCache[i].maxbody {
 			m = messageCache[i].pool.Get().(*Message)
 			break
 		}
@@ -145,3 +263,82 @@ func NewMessage(sz int) *Message {
 	m.Header = m.hbuf
 	return m
 }
+
+// RecvAllocator supplies the buffers that stream transports receive
+// message bodies into, in place of the usual message pools, and is the
+// value type for OptionRecvAllocator.  Alloc returns a slice of the given
+// length, and a function to call when it is no longer in use, which may
+// be nil.  That is called when the message is freed, so for example the
+// buffer may be part of a memory mapped file.  If Alloc fails, the pipe
+// is closed.
+//
+// The size is the one declared by the peer, and Alloc is called before
+// any of the body has arrived, so it must not be trusted.  Unlike the
+// usual receive path, which grows large bodies as the data arrives, the
+// whole buffer is requested at once.  Use OptionMaxRecvSize to bound it,
+// or return an error from Alloc for sizes that are not acceptable.
+type RecvAllocator interface {
+	Alloc(size int) ([]byte, func(), error)
+}
+
+type makeAllocator struct{}
+
+func (makeAllocator) Alloc(size int) ([]byte, func(), error) {
+	return make([]byte, size), nil, nil
+}
+
+// DefaultRecvAllocator allocates each buffer with make, and needs no
+// release.  A RecvAllocator can use it for messages that it does not
+// want to handle itself, such as small ones.
+var DefaultRecvAllocator RecvAllocator = makeAllocator{}
+
+// NewAllocatedMessage returns a Message whose Body is the given buffer,
+// as obtained from a RecvAllocator.  When the Message is freed, release
+// (if not nil) is called, rather than the Message being kept for reuse.
+func NewAllocatedMessage(body []byte, release func()) *Message {
+	return &Message{Body: body, release: release}
+}
+
+// PreparedMessage is a Message that is serialized for transmission only
+// once, so that it can be sent to many pipes cheaply.  Protocols such as
+// PUB, which send the same message to every peer, use this instead of
+// duplicating the Message for each Pipe.  The Message must not be modified
+// or freed once it has been prepared.
+type PreparedMessage struct {
+	msg  *Message
+	once sync.Once
+	wire []byte
+}
+
+// NewPreparedMessage prepares a Message for sending to multiple pipes.
+// The PreparedMessage takes ownership of the Message.
+func NewPreparedMessage(m *Message) *PreparedMessage {
+	return &PreparedMessage{msg: m}
+}
+
+// Message returns a new copy of the prepared Message, which the caller
+// owns.  This is used by transports that cannot use the Wire encoding.
+func (pm *PreparedMessage) Message() *Message {
+	return pm.msg.Dup()
+}
+
+// Expired returns true if the prepared Message has expired.
+func (pm *PreparedMessage) Expired() bool {
+	return pm.msg.Expired()
+}
+
+// Wire returns the Message in the standard SP stream encoding, which is
+// the 64-bit length (network byte order), followed by the header and the
+// body.  The encoding is done on the first call, and the same slice is
+// returned to all callers, so it must not be modified.
+func (pm *PreparedMessage) Wire() []byte {
+	pm.once.Do(func() {
+		m := pm.msg
+		sz := len(m.Header) + len(m.Body)
+		pm.wire = make([]byte, 8, 8+sz)
+		binary.BigEndian.PutUint64(pm.wire, uint64(sz))
+		pm.wire = append(pm.wire, m.Header...)
+		pm.wire = append(pm.wire, m.Body...)
+	})
+	return pm.wire
+}
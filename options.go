@@ -65,11 +65,12 @@ const (
 
 	// OptionSurveyTime is used to indicate the deadline for survey
 	// responses, when used with a SURVEYOR socket.  Messages arriving
-	// after this will be discarded.  Additionally, this will set the
-	// OptionRecvDeadline when starting the survey, so that attempts to
-	// receive messages fail with ErrRecvTimeout when the survey is
-	// concluded.  The value is a time.Duration.  Zero can be passed to
-	// indicate an infinite time.  Default is 1 second.
+	// after this will be discarded, as will responses to any earlier
+	// survey, which are recognized by the survey ID in their header.
+	// Once the survey is concluded, attempts to receive messages fail
+	// with ErrRecvTimeout, until the next survey is sent.  The value is
+	// a time.Duration.  Zero can be passed to indicate an infinite time.
+	// Default is 1 second.
 	OptionSurveyTime = "SURVEY-TIME"
 
 	// OptionTLSConfig is used to supply TLS configuration details. It
@@ -79,21 +80,35 @@ const (
 
 	// OptionWriteQLen is used to set the size, in messages, of the write
 	// queue channel. By default, it's 128. This option cannot be set if
-	// Dial or Listen has been called on the socket.
+	// Dial or Listen has been called on the socket.  What happens when
+	// the queue is full is set with OptionWriteQueueFullPolicy.
 	OptionWriteQLen = "WRITEQ-LEN"
 
+	// OptionWriteQueueFullPolicy determines what happens to a message
+	// sent when the write queue (see OptionWriteQLen) is full, which is
+	// usually because a peer has stalled.  The value is one of the
+	// QueueFullPolicy constants.  PUB defaults to QueueFullDropNewest,
+	// and PUSH to QueueFullBlock.  With QueueFullBlock, a send waits no
+	// longer than the send deadline, and not at all with
+	// OptionBestEffort, for either protocol.  Other protocols do not
+	// support it.
+	OptionWriteQueueFullPolicy = "WRITEQ-FULL-POLICY"
+
 	// OptionReadQLen is used to set the size, in messages, of the read
 	// queue channel. By default, it's 128. This option cannot be set if
 	// Dial or Listen has been called on the socket.
 	OptionReadQLen = "READQ-LEN"
 
 	// OptionKeepAlive is used to set TCP KeepAlive.  Value is a boolean.
-	// Default is true.
+	// Default is true.  Like the other TCP options, this is applied to
+	// the connection before the SP handshake is performed, so the
+	// handshake itself is subject to it.  Changing the option only
+	// affects connections established afterwards.
 	OptionKeepAlive = "KEEPALIVE"
 
-	// OptionKeepAliveTime is used to set TCP KeepAlive time in seconds.
+	// OptionKeepAliveTime is used to set the TCP KeepAlive period, which
+	// is the idle time before keep alive probes are sent.
 	// Value is a time.Duration. Default is OS dependent.
-	// Default is true.
 	OptionKeepAliveTime = "KEEPALIVETIME"
 
 	// OptionNoDelay is used to configure Nagle -- when true messages are
@@ -101,11 +116,23 @@ const (
 	// Value is a boolean.  Default is true.
 	OptionNoDelay = "NO-DELAY"
 
+	// OptionTOS sets the IP type of service byte (the traffic class for
+	// IPv6) on TCP connections, so that SP traffic can be given a DSCP
+	// marking for QoS.  Note that the DSCP value occupies the upper six
+	// bits, so DSCP 46 (EF) is 46<<2.  It is an int from 0 to 255, and
+	// is applied to connections made after it is set.  It is ignored
+	// where the platform does not support it, such as Windows.
+	OptionTOS = "TOS"
+
 	// OptionLinger is used to set the linger property.  This is the amount
 	// of time to wait for send queues to drain when Close() is called.
 	// Close() may block for up to this long if there is unsent data, but
 	// will return as soon as all data is delivered to the transport.
-	// Value is a time.Duration.  Default is one second.
+	// Dialers and listeners keep running meanwhile, so that messages
+	// queued before any peer connected can still be delivered.  Any
+	// messages left after that are discarded.  Only protocols that
+	// support Flush (such as PUSH and PAIR) can linger.
+	// Value is a time.Duration.  Default is zero, which closes at once.
 	OptionLinger = "LINGER"
 
 	// OptionTTL is used to set the maximum time-to-live for messages.
@@ -115,6 +142,26 @@ const (
 	// loops in the topology.  The default is protocol specific.
 	OptionTTL = "TTL"
 
+	// OptionStrictHeaders makes REP and RESPONDENT sockets accept only
+	// requests sent directly by a peer, whose header is just the 32-bit
+	// request ID.  A request that carries hops added by devices, or is
+	// too short, is rejected with ErrBadHeader, and the pipe it came on
+	// is closed.  This hardens services exposed to untrusted clients,
+	// which might otherwise craft a backtrace to misdirect replies.
+	// It has no effect on a REP socket in raw mode.  The value is a
+	// bool, and the default is false.
+	OptionStrictHeaders = "STRICT-HEADERS"
+
+	// OptionPipePriority sets the priority of the pipes created by a
+	// Dialer or Listener.  Protocols that support it (presently only
+	// REQ) send only on the connected pipes with the highest priority,
+	// falling back to lower ones while no such pipe is connected.  This
+	// allows a standby peer to take over when the primary is lost, with
+	// traffic returning to the primary once it reconnects.  The value
+	// is an int, where a larger value is preferred, and the default is
+	// 0.  It is set on a Dialer or Listener, not on the Socket.
+	OptionPipePriority = "PIPE-PRIORITY"
+
 	// OptionMaxRecvSize supplies the maximum receive size for inbound
 	// messages.  This option exists because the wire protocol allows
 	// the sender to specify the size of the incoming message, and
@@ -134,15 +181,231 @@ const (
 	// This option is only intended to prevent gross abuse  of the system,
 	// and not a substitute for proper application message verification.
 	//
-	// This option is type int64.
+	// Like other transport options, changing this on a socket or
+	// Listener only affects connections established afterwards.  Each
+	// connection keeps the value that was current at its handshake.
+	//
+	// This option is type int.
 	OptionMaxRecvSize = "MAX-RCV-SIZE"
 
+	// OptionMaxSendSize is the largest message that may be sent.  Attempts
+	// to send a larger message fail with ErrTooLong, without anything
+	// being written.  Without this, an oversized message would only be
+	// detected by the peer (see OptionMaxRecvSize), which would then
+	// disconnect.  The size includes any protocol header, so it is best
+	// to leave a little room.  The default value is 1MB, matching the
+	// default for OptionMaxRecvSize, and 0 removes the limit.
+	//
+	// This option is type int.
+	OptionMaxSendSize = "MAX-SND-SIZE"
+
+	// OptionChecksum enables a CRC32C checksum on every message, to
+	// detect corruption that slipped past the network.  It is offered
+	// to the peer during the handshake, and only used if the peer
+	// offers it too; otherwise messages are sent without checksums.
+	// A message that fails verification causes the pipe to be closed
+	// with ErrChecksumMismatch.  Other SP implementations do not
+	// understand the offer, and reject it, so only enable this when
+	// all peers are using mangos.  It is supported by the tcp and
+	// tls+tcp transports.
+	//
+	// This option is type bool, and defaults to false.
+	OptionChecksum = "CHECKSUM"
+
+	// OptionCompression selects a compression codec, "gzip" or
+	// "deflate", for message data.  Like OptionChecksum, it is offered
+	// during the handshake, and used only when the peer offers the same
+	// codec; otherwise messages are sent uncompressed.  Small messages,
+	// and those that do not shrink, are always sent uncompressed.
+	// OptionMaxRecvSize applies to the message after it is
+	// decompressed.  Only mangos peers understand the offer.  It is
+	// supported by the tcp and tls+tcp transports.
+	//
+	// This option is type string, and defaults to "none".
+	OptionCompression = "COMPRESSION"
+
+	// OptionTraceHeader enables the transmission of Message.TraceID.
+	// When both peers enable it, a fixed size trace block is sent ahead
+	// of every message, and stripped off again on receipt, before the
+	// protocol sees the message.  Like OptionChecksum, it is offered
+	// during the handshake, and without agreement from the peer the
+	// TraceID is simply not sent.  Only mangos peers understand the
+	// offer.  It is supported by the tcp and tls+tcp transports.
+	//
+	// This option is type bool, and defaults to false.
+	OptionTraceHeader = "TRACE-HEADER"
+
+	// OptionTypeHeader enables the transmission of Message.Type and
+	// Message.Flags.  It is negotiated like OptionTraceHeader: when
+	// both peers enable it, the type and flags are sent ahead of every
+	// message, and otherwise they are not sent at all, and are zero on
+	// receipt.  It is supported by the tcp and tls+tcp transports.
+	//
+	// This option is type bool, and defaults to false.
+	OptionTypeHeader = "TYPE-HEADER"
+
+	// OptionSeqHeader enables sequence numbers.  It is negotiated like
+	// OptionTraceHeader: when both peers enable it, each message written
+	// to the connection carries a number one greater than the last,
+	// starting at 1, which is reported as Message.Seq on receipt.  A gap
+	// in the numbers received on a Pipe means that messages were lost,
+	// and is reported to the OptionSeqGapHook.  It is supported by the
+	// tcp and tls+tcp transports.
+	//
+	// This option is type bool, and defaults to false.
+	OptionSeqHeader = "SEQ-HEADER"
+
+	// OptionReuseAddr sets SO_REUSEADDR on TCP listening sockets, so
+	// that a restarted server can bind its port again while connections
+	// from the previous instance linger in TIME_WAIT.  It is supported
+	// by the tcp and tls+tcp transports on Unix systems, and ignored
+	// elsewhere.  (On Windows the option allows other sockets to steal
+	// the port, so it is never set.)
+	//
+	// This option is type bool, and defaults to false.
+	OptionReuseAddr = "REUSE-ADDR"
+
+	// OptionReusePort sets SO_REUSEPORT on TCP listening sockets, which
+	// lets several listeners bind the same port, with the kernel sharing
+	// incoming connections among them.  It is supported where
+	// OptionReuseAddr is.
+	//
+	// This option is type bool, and defaults to false.
+	OptionReusePort = "REUSE-PORT"
+
+	// OptionSendBatch lets several small messages be written to the
+	// connection at once, rather than with a system call each.  The
+	// messages are still framed individually, so the peer sees no
+	// difference.  Each message may be held back for at most the given
+	// time, though protocols that know no more messages are waiting
+	// (presently PUSH) write them out straight away.  It is supported
+	// by the tcp and tls+tcp transports.
+	//
+	// This option is type time.Duration, and defaults to zero, which
+	// disables batching.
+	OptionSendBatch = "SEND-BATCH"
+
+	// OptionKeepAliveInterval enables SP level keepalives, to detect
+	// peers that have died or hung, even when no messages are being
+	// exchanged.  A ping is sent at this interval, and the pipe is
+	// closed with ErrKeepAliveTimeout once OptionKeepAliveMissed pings
+	// in a row pass without anything being heard from the peer.  The
+	// pings and their replies are never seen by the application.  Like
+	// OptionChecksum, this is offered during the handshake, and only
+	// used when the peer offers it too.  (OptionKeepAlive, by contrast,
+	// is the TCP keepalive, which only notices a peer that has
+	// vanished from the network.)  It is supported by the tcp and
+	// tls+tcp transports.
+	//
+	// This option is type time.Duration, and defaults to zero, which
+	// disables it.
+	OptionKeepAliveInterval = "KEEPALIVE-INTERVAL"
+
+	// OptionKeepAliveMissed is the number of pings in a row that may go
+	// unanswered before the pipe is closed.  See OptionKeepAliveInterval.
+	//
+	// This option is type int, and defaults to 3.
+	OptionKeepAliveMissed = "KEEPALIVE-MISSED"
+
+	// OptionAsyncRecv has each pipe read messages ahead of the protocol
+	// asking for them, using a goroutine of its own, so that they are
+	// already decoded when wanted.  The value is how many messages may
+	// be read ahead; once that many are waiting, reading stops until
+	// some are taken.  It is supported by the tcp and tls+tcp
+	// transports.
+	//
+	// This option is type int, and defaults to zero, which disables it.
+	OptionAsyncRecv = "ASYNC-RECV"
+
+	// OptionFlowCredits enables flow control by credits, so that a fast
+	// sender, such as PUSH, cannot overwhelm a slow receiver, such as
+	// PULL.  The value is how many messages the receiving side lets the
+	// peer send before they are consumed; it grants more credit as the
+	// protocol takes messages from the pipe.  Once the sender runs out
+	// of credit, the pipe's Send blocks, the protocol's queue fills, and
+	// eventually the application's Send blocks (or times out, with
+	// OptionSendDeadline).  The grants are never seen by the
+	// application.  Like OptionChecksum, this is offered during the
+	// handshake, and only used when the peer offers it too.  It is
+	// supported by the tcp and tls+tcp transports.
+	//
+	// This option is type int, and defaults to zero, which disables it.
+	OptionFlowCredits = "FLOW-CREDITS"
+
+	// OptionMaxFrameSize enables fragmentation, for use where something
+	// between the peers limits the size of frames.  Messages larger
+	// than this many bytes are split into fragments no larger, each
+	// sent in a frame of its own, and the receiver puts them back
+	// together before handing over the message.  OptionMaxRecvSize
+	// applies to the reassembled message.  Like OptionChecksum, this is
+	// offered during the handshake, and only used when the peer offers
+	// it too, though each peer may use a different size.  It is
+	// supported by the tcp and tls+tcp transports.
+	//
+	// This option is type int, and defaults to zero, which disables it.
+	OptionMaxFrameSize = "MAX-FRAME-SIZE"
+
+	// OptionReadBufferSize is the size of the buffer used when reading
+	// from stream oriented transports (tcp, tls+tcp, and ipc).  The
+	// buffer allows the length prefix and body of small messages to be
+	// obtained with a single system call.  The value is an int, and the
+	// default is 4096.  A value of 0 disables buffering.
+	OptionReadBufferSize = "READ-BUFFER-SIZE"
+
+	// OptionRecvAllocator supplies a RecvAllocator, which stream
+	// oriented transports (tcp, tls+tcp, and ipc) use to obtain the
+	// buffer for each message body they receive.  This allows large
+	// messages to be received straight into memory of the caller's
+	// choosing, such as a memory mapped file.  It is not used with
+	// OptionChecksum.  Where the message is transformed by a feature
+	// negotiated with the peer, such as OptionCompression, the buffer
+	// holds the message as it arrived, and is released once the message
+	// has been decoded.  The allocator is asked for the full size the
+	// peer declares before the body arrives, so it should be used with
+	// OptionMaxRecvSize when the peer is not trusted.
+	OptionRecvAllocator = "RECV-ALLOCATOR"
+
+	// OptionByteOrder selects the byte order of the length that precedes
+	// each message.  The SP protocols require big-endian, which is the
+	// default, and the handshake is always big-endian.  This exists for
+	// custom transports that bridge to legacy systems using little-endian
+	// lengths; they pass it to transport.NewConnPipe.  The standard
+	// transports do not accept it.  Checksums and compression are never
+	// offered when it is not big-endian.
+	//
+	// This option is type binary.ByteOrder.
+	OptionByteOrder = "BYTE-ORDER"
+
+	// OptionWriteTimeout limits the time that writing each message to
+	// the connection may take.  If a peer stops reading, so that a
+	// message cannot be written in time, the pipe is closed rather than
+	// holding up the sender.  This lets a publisher drop subscribers
+	// that fail to keep up, for example.  It overrides any send
+	// deadline set on the pipe.  It is supported by the stream
+	// transports (tcp, tls+tcp, and ipc), and applies to pipes
+	// created after it is set.  The value is a time.Duration, and the
+	// default of 0 means no limit.
+	OptionWriteTimeout = "WRITE-TIMEOUT"
+
+	// OptionHandshakeTimeout limits the time that a connection accepted
+	// by a Listener may take to complete the SP handshake (and for
+	// tls+tcp, the TLS handshake).  A peer that connects, but never sends
+	// its header, is then disconnected rather than holding resources
+	// indefinitely.  It is supported by the stream transports (tcp,
+	// tls+tcp, and ipc), and is set on the Listener.  The value is a
+	// time.Duration, and the default of 0 means no limit.
+	OptionHandshakeTimeout = "HANDSHAKE-TIMEOUT"
+
 	// OptionReconnectTime is the initial interval used for connection
 	// attempts.  If a connection attempt does not succeed, then ths socket
 	// will wait this long before trying again.  An optional exponential
 	// backoff may cause this value to grow.  See OptionMaxReconnectTime
 	// for more details.   This is a time.Duration whose default value is
 	// 100msec.  This option must be set before starting any dialers.
+	//
+	// Network errors, such as a refused connection, are always retried.
+	// However, if the SP handshake shows that the peer is incompatible
+	// (for example, it uses the wrong protocol), the dialer gives up.
 	OptionReconnectTime = "RECONNECT-TIME"
 
 	// OptionMaxReconnectTime is the maximum value of the time between
@@ -153,6 +416,15 @@ const (
 	// This option must be set before starting any dialers.
 	OptionMaxReconnectTime = "MAX-RECONNECT-TIME"
 
+	// OptionReconnectJitter randomizes each wait between connection
+	// attempts by up to this fraction of the interval, in either
+	// direction.  It is applied after the exponential backoff, so that
+	// a group of dialers that lose the same peer spread their attempts
+	// out instead of all reconnecting at once.  This is a float64
+	// between 0 and 1, with a default of 0 (no jitter).
+	// This option must be set before starting any dialers.
+	OptionReconnectJitter = "RECONNECT-JITTER"
+
 	// OptionBestEffort enables non-blocking send operations on the
 	// socket. Normally (for some socket types), a socket will block if
 	// there are no receivers, or the receivers are unable to keep up
@@ -169,6 +441,18 @@ const (
 	// be available on dialers or listeners.
 	OptionLocalAddr = "LOCAL-ADDR"
 
+	// OptionLocalAddress (used on a Dialer) binds the connections made
+	// by stream transports (tcp and tls+tcp) to the given local
+	// address, so that on hosts with several interfaces, they originate
+	// from a particular one.  The value is a string, being an IP
+	// address, optionally with a port, or a *net.TCPAddr.  If the
+	// address cannot be used, for example because it is not assigned to
+	// this host, dialing fails with the error from the system (and
+	// with OptionDialAsynch, is retried as usual).  It is not used with
+	// OptionDialer.  (Compare OptionLocalAddr, which reports the local
+	// address of a pipe.)
+	OptionLocalAddress = "LOCAL-ADDRESS"
+
 	// OptionRemoteAddr expresses a remote address.  For dialers, this is
 	// the service address.  For listeners, its the address of the far
 	// end dialer.  The value is a net.Addr.  It is generally read-only
@@ -184,6 +468,164 @@ const (
 	// only exists for Pipes using websocket connections.
 	OptionHTTPRequest = "HTTP-REQUEST"
 
+	// OptionPipeStats is a read-only option available on Pipes, and
+	// returns a PipeStats describing the traffic carried by the Pipe.
+	// The counters are maintained without locking, so retrieving
+	// them frequently is inexpensive.  Not all transports support it.
+	OptionPipeStats = "PIPE-STATS"
+
+	// OptionIPCSocketPermissions is used on IPC listeners to set the
+	// file permissions of the UNIX domain socket.  The value is an
+	// os.FileMode, and is applied when the listener starts listening.
+	// By default the permissions are determined by the process umask.
+	// This option is not supported on Windows.
+	OptionIPCSocketPermissions = "IPC-SOCKET-PERMISSIONS"
+
+	// OptionMaxConnections (used on a Listener) limits the number of
+	// pipes accepted by the Listener that may be open at the same time.
+	// Connections accepted while at the limit are closed immediately
+	// after the SP handshake.  This protects services from being
+	// exhausted by a flood of idle connections.  The value is an int,
+	// and the default of 0 means no limit.
+	OptionMaxConnections = "MAX-CONNECTIONS"
+
+	// OptionDialer (used on a Dialer) supplies a ContextDialer that
+	// stream transports (tcp and tls+tcp) use to establish outgoing
+	// connections, instead of dialing directly.  This permits
+	// connecting through a SOCKS proxy, for example.  The address is
+	// passed to it unresolved, as host:port.
+	OptionDialer = "DIALER"
+
+	// OptionListener (used on a Listener) supplies a net.Listener that
+	// stream transports (tcp and tls+tcp) accept connections from,
+	// instead of binding the address themselves.  This permits using a
+	// socket inherited from the parent process, as with systemd socket
+	// activation (see transport.SystemdListeners), so that the service
+	// can be restarted without refusing any connections.  The address
+	// given to the Listener must still be valid, but is otherwise unused.
+	// The net.Listener is closed when the Listener is.
+	OptionListener = "LISTENER"
+
+	// OptionResolver (used on a Dialer) supplies a Resolver, which
+	// stream transports (tcp and tls+tcp) consult every time they dial,
+	// to turn the host and port in the address into the ones to
+	// connect to.  The addresses returned are tried in turn, starting
+	// one further along on each dial, so that reconnects go round-robin
+	// and follow any changes in what the Resolver returns.  With a
+	// Resolver, the host in the address may be a logical name, such as
+	// tcp://service.consul:4444, which need not be resolvable by DNS.
+	OptionResolver = "RESOLVER"
+
+	// OptionHandshakeHook supplies a HandshakeHook, which is called
+	// as the SP handshake on each new connection starts, and again
+	// when it succeeds or fails.  This is useful to learn why peers
+	// are failing to connect.  It may be set on Dialers and Listeners
+	// using stream transports (tcp, tls+tcp, and ipc).
+	OptionHandshakeHook = "HANDSHAKE-HOOK"
+
+	// OptionAcceptHook supplies an AcceptHook, which is called with
+	// each connection a Listener accepts, before anything is read from
+	// or written to it.  If the hook returns an error, the connection
+	// is closed without attempting the handshake.  This can be used to
+	// implement address allowlists, or limits on connections from each
+	// source.  It may be set on Listeners using stream transports
+	// (tcp, tls+tcp, and ipc).  With tls+tcp, the hook is called before
+	// the TLS handshake.
+	OptionAcceptHook = "ACCEPT-HOOK"
+
+	// OptionAuthenticator supplies an Authenticator, which is run on
+	// each new connection once the SP header has been exchanged, and
+	// before the Pipe is opened.  Dialers use its ClientAuth method,
+	// and Listeners its ServerAuth method.  If it fails, the connection
+	// is closed, and the handshake fails with ErrAuthFailed.  Both
+	// peers must use compatible Authenticators.  It may be set on
+	// Dialers and Listeners using stream transports (tcp, tls+tcp,
+	// and ipc).
+	OptionAuthenticator = "AUTHENTICATOR"
+
+	// OptionRecvFilter supplies a MessageFilter, which is called with
+	// every message received on a pipe, before the protocol sees it.
+	// This can be used for auditing, or to reject unwanted messages.
+	// If the filter returns an error, the message is dropped, or if
+	// OptionRecvFilterClose is true, the pipe is closed.  The filter is
+	// called with the pipe's receive lock held, so it delays every
+	// message after it, and should be quick.  While it is set, the
+	// streaming RecvReader is not available.  It may be set on Dialers
+	// and Listeners using stream transports (tcp, tls+tcp, and ipc).
+	OptionRecvFilter = "RECV-FILTER"
+
+	// OptionRecvFilterClose makes a pipe close when the OptionRecvFilter
+	// rejects a message, rather than just dropping the message.  The
+	// error is reported by the pipe's CloseErr.  The value is a bool,
+	// and defaults to false.
+	OptionRecvFilterClose = "RECV-FILTER-CLOSE"
+
+	// OptionSendFilter supplies a MessageFilter, which is called with
+	// every message as it is about to be sent on a pipe.  If it returns
+	// an error, the message is not sent, and the error is returned from
+	// the pipe's Send.  (As with any other failure to send, the socket
+	// closes the pipe.)  The filter is called with the pipe's send lock
+	// held, so it should be quick.  While it is set, the streaming
+	// SendReader is not available.  It may be set on Dialers and
+	// Listeners using stream transports (tcp, tls+tcp, and ipc).
+	OptionSendFilter = "SEND-FILTER"
+
+	// OptionLogger supplies a Logger, which is told when the handshake
+	// fails, and when pipes fail or are closed, along with the reason.
+	// A Listener also logs connections rejected by OptionMaxConnections.
+	// By default nothing is logged.  It may be set on Dialers and
+	// Listeners using stream transports (tcp, tls+tcp, and ipc), and
+	// applies to pipes created after it is set.
+	OptionLogger = "LOGGER"
+
+	// OptionRecvIdleTimeout is how long a Pipe may go without receiving
+	// a message before the RecvIdleHook (see OptionRecvIdleHook) is
+	// called.  The Pipe is not closed; the hook is called again each
+	// time another such interval passes in silence, and may send a ping
+	// or close the Pipe as it sees fit.  This requires a transport that
+	// supports receive deadlines (tcp, tls+tcp, and ipc).  The value is
+	// a time.Duration, and the default of 0 disables it.  Changes apply
+	// from the next message received on each Pipe.
+	OptionRecvIdleTimeout = "RECV-IDLE-TIMEOUT"
+
+	// OptionRecvIdleHook supplies the RecvIdleHook that is called when
+	// a Pipe is idle for OptionRecvIdleTimeout.  Nothing is received
+	// from the Pipe while the hook runs.
+	OptionRecvIdleHook = "RECV-IDLE-HOOK"
+
+	// OptionSeqGapHook supplies the SeqGapHook that is called when the
+	// sequence numbers (see OptionSeqHeader) received on a Pipe skip
+	// ahead.  The message that revealed the gap is still delivered.
+	// Nothing is received from the Pipe while the hook runs.
+	OptionSeqGapHook = "SEQ-GAP-HOOK"
+
+	// OptionRecvRateLimit limits the rate at which messages are
+	// received from each Pipe, in messages per second.  A Pipe that
+	// goes faster is not read from for a while, so that its peer is
+	// held back by flow control, rather than messages being dropped.
+	// Up to a second's worth may arrive in a burst.  This keeps one
+	// busy peer from crowding out the others.  The value is an int,
+	// and the default of 0 means no limit.
+	OptionRecvRateLimit = "RECV-RATE-LIMIT"
+
+	// OptionRecvByteRateLimit is like OptionRecvRateLimit, but limits
+	// the bytes of message data received per second instead.  Both
+	// limits may be used together.
+	OptionRecvByteRateLimit = "RECV-BYTE-RATE-LIMIT"
+
+	// OptionHandshakeMetadata supplies key/value pairs that are sent
+	// to the peer during the SP handshake, such as an identity or an
+	// authentication token.  What the peer sent is available from
+	// Pipe.PeerMetadata.  Both sides must set this option (possibly to
+	// an empty map) for the metadata to be exchanged; otherwise the
+	// connection proceeds without it.  Other SP implementations do not
+	// understand it, and reject peers that set it, so only use this
+	// when all peers are using mangos.  The size of the metadata is
+	// limited by the peer's OptionMaxRecvSize.  It may be set on
+	// Dialers and Listeners using stream transports (tcp, tls+tcp,
+	// and ipc).  The value is a map[string]string.
+	OptionHandshakeMetadata = "HANDSHAKE-METADATA"
+
 	// OptionDialAsynch (used on a Dialer) causes the Dial() operation
 	// to run in the background.  Further, the Dialer will always redial,
 	// even if the first attempt fails.  (Normally dialing is performed
@@ -192,4 +634,24 @@ const (
 	// Note that mangos v1 behavior is the same as if this option is
 	// set to true.
 	OptionDialAsynch = "DIAL-ASYNCH"
+
+	// OptionDialConcurrency (used on a Socket) limits how many of the
+	// addresses given to DialMany are dialed at the same time.  The
+	// value is an int, and defaults to 8.  Zero means no limit.
+	OptionDialConcurrency = "DIAL-CONCURRENCY"
+)
+
+// QueueFullPolicy is the value of OptionWriteQueueFullPolicy.
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock waits for room in the queue.
+	QueueFullBlock QueueFullPolicy = iota
+
+	// QueueFullDropNewest discards the message being sent.
+	QueueFullDropNewest
+
+	// QueueFullDropOldest discards the oldest queued message, to
+	// make room for the one being sent.
+	QueueFullDropOldest
 )
@@ -14,6 +14,12 @@
 
 package mangos
 
+import (
+	"crypto/x509"
+	"net"
+	"time"
+)
+
 // Pipe represents the high level interface to a low level communications
 // channel.  There is one of these associated with a given TCP connection,
 // for example.  This interface is intended for application use.
@@ -32,6 +38,14 @@ type Pipe interface {
 	// This matches the string passed to Dial() or Listen().
 	Address() string
 
+	// LocalAddr returns the local network address of the Pipe.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the network address of the peer, which
+	// identifies the client of a Listener, for example.  For inproc
+	// the address is the inproc URL, with network "inproc".
+	RemoteAddr() net.Addr
+
 	// GetOption returns an arbitrary option.  The details will vary
 	// for different transport types.
 	GetOption(name string) (interface{}, error)
@@ -45,6 +59,56 @@ type Pipe interface {
 	// Close closes the Pipe.  This does a disconnect, or something similar.
 	// Note that if a dialer is present and active, it will redial.
 	Close() error
+
+	// Flush blocks until any message being sent on the Pipe has been
+	// written to the underlying connection.
+	Flush() error
+
+	// Cork holds back messages sent on the Pipe, until Uncork is
+	// called, so that a batch of messages goes out together, in as
+	// few segments as possible.  Transports that cannot do this
+	// return ErrProtoOp.
+	Cork() error
+
+	// Uncork writes out everything held back since Cork.
+	Uncork() error
+
+	// SetMaxRecvSize changes OptionMaxRecvSize for this Pipe alone,
+	// starting with the next message received.  This can be used to
+	// raise the limit once the peer is trusted.  Transports that
+	// cannot change the limit return ErrProtoOp.
+	SetMaxRecvSize(n int64) error
+
+	// Conn returns the net.Conn underlying the Pipe, for applying
+	// settings that mangos does not otherwise expose.  This is for
+	// advanced use only; the connection must not be read, written,
+	// or closed directly.  It returns nil if the Pipe is closed, or
+	// if the transport is not built on a net.Conn.
+	Conn() net.Conn
+
+	// PeerMetadata returns the metadata the peer sent during the
+	// handshake (see OptionHandshakeMetadata), or nil if none was
+	// exchanged.
+	PeerMetadata() map[string]string
+
+	// PeerCertificate returns the certificate the peer presented during
+	// the TLS handshake, which identifies it when client certificates
+	// are required.  For example, the Subject.CommonName may be used
+	// to authorize requests.  It returns nil if the transport does not
+	// use TLS, or the peer sent no certificate.
+	PeerCertificate() *x509.Certificate
+
+	// Info returns a description of the Pipe, including what was
+	// negotiated during the handshake, and how long it took.  Only
+	// the Stats change once the Pipe is open.  Transports that do not
+	// report the handshake leave those fields zero.
+	Info() PipeInfo
+
+	// CloseErr returns the reason the Pipe failed, or nil if it has
+	// not.  For example, io.EOF indicates the peer closed the
+	// connection, while a TooLongError (which wraps ErrTooLong)
+	// indicates the peer sent a message that exceeded OptionMaxRecvSize.
+	CloseErr() error
 }
 
 // PipeEvent determines what is actually transpiring on the Pipe.
@@ -69,3 +133,106 @@ const (
 // PipeEventHook is an application supplied function to be called when
 // events occur relating to a Pipe.
 type PipeEventHook func(PipeEvent, Pipe)
+
+// RecvIdleHook is an application supplied function to be called when
+// nothing has been received on a Pipe for OptionRecvIdleTimeout; it is
+// the value for OptionRecvIdleHook.
+type RecvIdleHook func(Pipe)
+
+// SeqGapHook is an application supplied function to be called when a
+// message arrives on a Pipe with sequence number got, where want was
+// expected, so that got-want messages are missing.  It is the value for
+// OptionSeqGapHook.
+type SeqGapHook func(p Pipe, want, got uint64)
+
+// PipeStats is a snapshot of the traffic carried by a Pipe.  It is
+// available from transports that support it using OptionPipeStats.
+type PipeStats struct {
+	RxBytes        uint64        // bytes received
+	TxBytes        uint64        // bytes sent
+	RxMsgs         uint64        // messages received
+	TxMsgs         uint64        // messages sent
+	RemoteProtocol uint16        // peer's protocol number
+	Duration       time.Duration // how long the pipe has been open
+}
+
+// PipeInfo describes a Pipe, and the outcome of its SP handshake.  It is
+// a copy, so it may be kept and used after the Pipe is closed.
+type PipeInfo struct {
+	ID                uint32        // the Pipe's ID
+	RemoteAddr        net.Addr      // peer's address, if known
+	Stats             PipeStats     // traffic when the PipeInfo was made
+	Version           byte          // negotiated SP wire version
+	RemoteProtocol    uint16        // peer's protocol number
+	HandshakeDuration time.Duration // time taken by the handshake
+	Compression       string        // negotiated OptionCompression, or ""
+	Checksum          bool          // OptionChecksum is in use
+	TraceHeader       bool          // OptionTraceHeader is in use
+	TypeHeader        bool          // OptionTypeHeader is in use
+	SeqHeader         bool          // OptionSeqHeader is in use
+	KeepAlive         bool          // OptionKeepAliveInterval is in use
+	FlowCredits       bool          // OptionFlowCredits is in use
+	MaxFrameSize      int           // OptionMaxFrameSize in use, or 0
+}
+
+// HandshakeEventType says which stage of the SP handshake a
+// HandshakeEvent reports.
+type HandshakeEventType int
+
+const (
+	// HandshakeStarted is reported before the SP header is exchanged.
+	HandshakeStarted HandshakeEventType = iota
+
+	// HandshakeSucceeded is reported once the peer has been accepted.
+	HandshakeSucceeded
+
+	// HandshakeFailed is reported when the handshake fails.  The Err
+	// is ErrBadHeader, ErrBadVersion, ErrIncompatibleProto,
+	// ErrHandshakeTimeout, a *HandshakeError if the connection failed
+	// while reading from the peer, or the I/O error from writing.
+	HandshakeFailed
+)
+
+// HandshakeEvent describes the progress of the SP handshake on a new
+// connection.  Every connection reports HandshakeStarted, followed by
+// exactly one of HandshakeSucceeded or HandshakeFailed.
+type HandshakeEvent struct {
+	Type       HandshakeEventType
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Proto      uint16 // peer's protocol number, zero if not yet known
+	Err        error  // reason for failure
+}
+
+// AcceptHook is an application supplied function to be called with each
+// newly accepted connection; it is the value for OptionAcceptHook.  If it
+// returns an error, the connection is closed.  The connection must not
+// be read from, written to, or closed by the hook.
+type AcceptHook func(net.Conn) error
+
+// MessageFilter is an application supplied function to be called with
+// each message a Pipe sends or receives; it is the value for
+// OptionSendFilter and OptionRecvFilter.  It may inspect or modify the
+// message, and rejects it by returning an error.  It must not retain
+// the message, nor free it.
+type MessageFilter func(*Message) error
+
+// Authenticator performs application defined authentication, such as a
+// challenge and response using a shared secret, on a new connection; it
+// is the value for OptionAuthenticator.  Each method may read from and
+// write to the connection as it likes, but must leave nothing unread
+// that the peer sent as part of the authentication, and must not close
+// the connection.  Returning an error rejects the peer.
+type Authenticator interface {
+	// ClientAuth is called on connections made by a Dialer.
+	ClientAuth(c net.Conn) error
+
+	// ServerAuth is called on connections accepted by a Listener.
+	ServerAuth(c net.Conn) error
+}
+
+// HandshakeHook is an application supplied function to be called as the
+// SP handshake progresses; it is the value for OptionHandshakeHook.
+// It is called synchronously from the handshake, so it should be cheap,
+// or hand the event off to a channel or goroutine.
+type HandshakeHook func(HandshakeEvent)
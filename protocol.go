@@ -14,6 +14,11 @@
 
 package mangos
 
+import (
+	"fmt"
+	"sync"
+)
+
 // ProtocolPipe represents the handle that a Protocol implementation has
 // to the underlying stream transport.  It can be thought of as one side
 // of a TCP, IPC, or other type of connection.
@@ -29,6 +34,11 @@ type ProtocolPipe interface {
 	// blocking call.
 	SendMsg(*Message) error
 
+	// SendPrepared is like SendMsg, but sends a PreparedMessage, which
+	// may be shared with other pipes.  The PreparedMessage is not
+	// modified.
+	SendPrepared(*PreparedMessage) error
+
 	// RecvMsg receives a message.  It blocks until the message is
 	// received.  On error, the pipe is closed and nil is returned.
 	RecvMsg() *Message
@@ -110,3 +120,47 @@ const (
 	ProtoBus        = (7 * 16)
 	ProtoStar       = (100 * 16) // Experimental!
 )
+
+// protocolNames maps protocol numbers to their names.  The standard
+// protocols are always present, and others are added as sockets using
+// them are made.
+var protocolNames = struct {
+	sync.RWMutex
+	m map[uint16]string
+}{
+	m: map[uint16]string{
+		ProtoPair:       "pair",
+		ProtoPub:        "pub",
+		ProtoSub:        "sub",
+		ProtoReq:        "req",
+		ProtoRep:        "rep",
+		ProtoPush:       "push",
+		ProtoPull:       "pull",
+		ProtoSurveyor:   "surveyor",
+		ProtoRespondent: "respondent",
+		ProtoBus:        "bus",
+		ProtoStar:       "star",
+	},
+}
+
+// RegisterProtocolName records the name of a protocol number, so that
+// ProtocolName can report it.  This is done automatically for protocols
+// when a socket is made using them.
+func RegisterProtocolName(proto uint16, name string) {
+	protocolNames.Lock()
+	protocolNames.m[proto] = name
+	protocolNames.Unlock()
+}
+
+// ProtocolName returns the name of the given protocol number, such as
+// "req" for ProtoReq.  Unrecognized numbers are reported in the form
+// "unknown(0x1234)".
+func ProtocolName(proto uint16) string {
+	protocolNames.RLock()
+	name, ok := protocolNames.m[proto]
+	protocolNames.RUnlock()
+	if !ok {
+		return fmt.Sprintf("unknown(0x%04x)", proto)
+	}
+	return name
+}
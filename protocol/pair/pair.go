@@ -41,6 +41,18 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	return s.Protocol.GetOption(name)
 }
 
+// Flush waits for queued messages to be handed to the transport.
+func (s *socket) Flush() error {
+	return s.Protocol.(interface{ Flush() error }).Flush()
+}
+
+// SendUrgent sends a message ahead of any that are queued.
+func (s *socket) SendUrgent(m *protocol.Message) error {
+	return s.Protocol.(interface {
+		SendUrgent(*protocol.Message) error
+	}).SendUrgent(m)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
@@ -18,6 +18,8 @@
 package protocol
 
 import (
+	"fmt"
+
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/errors"
 	"nanomsg.org/go/mangos/v2/internal/core"
@@ -57,6 +59,17 @@ type Socket = mangos.Socket
 // Message is an alias for the common mangos.Message.
 type Message = mangos.Message
 
+// TraceIDSize is the size of Message.TraceID.
+const TraceIDSize = mangos.TraceIDSize
+
+// PreparedMessage is an alias for the common mangos.PreparedMessage.
+type PreparedMessage = mangos.PreparedMessage
+
+// NewPreparedMessage prepares a Message for sending to multiple pipes.
+func NewPreparedMessage(m *Message) *PreparedMessage {
+	return mangos.NewPreparedMessage(m)
+}
+
 // Borrow common error codes for convenience.
 const (
 	ErrClosed      = errors.ErrClosed
@@ -67,6 +80,9 @@ const (
 	ErrProtoOp     = errors.ErrProtoOp
 	ErrProtoState  = errors.ErrProtoState
 	ErrCanceled    = errors.ErrCanceled
+	ErrGarbled     = errors.ErrGarbled
+	ErrBadHeader   = errors.ErrBadHeader
+	ErrBusy        = errors.ErrBusy
 )
 
 // Common option definitions
@@ -84,8 +100,79 @@ const (
 	OptionLinger       = mangos.OptionLinger // Remove?
 	OptionTTL          = mangos.OptionTTL
 	OptionBestEffort   = mangos.OptionBestEffort
+
+	OptionWriteQueueFullPolicy = mangos.OptionWriteQueueFullPolicy
+	OptionStrictHeaders        = mangos.OptionStrictHeaders
+	OptionPipePriority         = mangos.OptionPipePriority
+)
+
+// QueueFullPolicy is an alias for mangos.QueueFullPolicy.
+type QueueFullPolicy = mangos.QueueFullPolicy
+
+// Write queue policies.
+const (
+	QueueFullBlock      = mangos.QueueFullBlock
+	QueueFullDropNewest = mangos.QueueFullDropNewest
+	QueueFullDropOldest = mangos.QueueFullDropOldest
 )
 
+// HeaderValidator may be implemented by a Protocol to check the header of
+// each message as it is received, before the protocol sees it.  The
+// header is still at the front of the Body at that point.  If
+// ValidateHeader returns an error, the message is discarded, and the
+// Pipe is closed, with the error reported by its CloseErr method.  This
+// guards against peers that handshake correctly, but then send garbage.
+type HeaderValidator interface {
+	ValidateHeader(*Message) error
+}
+
+// CheckRequestID verifies that the Body of m begins with a request ID,
+// as REQ and SURVEYOR expect of replies: 32 bits, with the high order
+// bit set.  It is meant for use by ValidateHeader implementations.
+func CheckRequestID(m *Message) error {
+	if len(m.Body) < 4 {
+		return fmt.Errorf("%w: %d bytes is too short for a request ID",
+			ErrGarbled, len(m.Body))
+	}
+	if m.Body[0]&0x80 == 0 {
+		return fmt.Errorf("%w: request ID %02x%02x%02x%02x lacks high bit",
+			ErrGarbled, m.Body[0], m.Body[1], m.Body[2], m.Body[3])
+	}
+	return nil
+}
+
+// CheckBacktrace verifies that the Body of m begins with a backtrace, as
+// REP and RESPONDENT expect of requests: zero or more 32-bit hops, ending
+// with a request ID, which has the high order bit set.  It is meant for
+// use by ValidateHeader implementations.
+func CheckBacktrace(m *Message) error {
+	for off := 0; ; off += 4 {
+		if len(m.Body) < off+4 {
+			return fmt.Errorf("%w: backtrace truncated after %d bytes",
+				ErrGarbled, off)
+		}
+		if m.Body[off]&0x80 != 0 {
+			return nil
+		}
+	}
+}
+
+// CheckDirectRequest verifies that the Body of m begins with a request ID
+// and nothing else in the way of a backtrace, as sent by a REQ or
+// SURVEYOR peer without any devices in between.  It is meant for use by
+// ValidateHeader implementations when OptionStrictHeaders is set.
+func CheckDirectRequest(m *Message) error {
+	if len(m.Body) < 4 {
+		return fmt.Errorf("%w: %d bytes is too short for a request ID",
+			ErrBadHeader, len(m.Body))
+	}
+	if m.Body[0]&0x80 == 0 {
+		return fmt.Errorf("%w: backtrace has hops before the request ID",
+			ErrBadHeader)
+	}
+	return nil
+}
+
 // MakeSocket creates a Socket on top of a Protocol.
 func MakeSocket(proto Protocol) Socket {
 	return core.MakeSocket(proto)
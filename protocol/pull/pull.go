@@ -41,6 +41,13 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	return s.Protocol.GetOption(name)
 }
 
+// RecvBatch receives up to max messages that are already queued.
+func (s *socket) RecvBatch(max int) ([]*protocol.Message, error) {
+	return s.Protocol.(interface {
+		RecvBatch(int) ([]*protocol.Message, error)
+	}).RecvBatch(max)
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
@@ -41,6 +41,11 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 	return s.Protocol.GetOption(name)
 }
 
+// Flush waits for queued messages to be handed to the transport.
+func (s *socket) Flush() error {
+	return s.Protocol.(interface{ Flush() error }).Flush()
+}
+
 // NewProtocol returns a new protocol implementation.
 func NewProtocol() protocol.Protocol {
 	s := &socket{
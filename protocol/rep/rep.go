@@ -17,6 +17,7 @@
 package rep
 
 import (
+	"encoding/binary"
 	"sync"
 	"time"
 
@@ -44,11 +45,13 @@ type socket struct {
 	closed   bool
 	pipes    map[uint32]*pipe
 	ttl      int
+	strict   bool // OptionStrictHeaders
 	sendQLen int
 	recvCond *sync.Cond
 	recvCtxs map[*context]struct{}
 	ctxs     map[*context]struct{}
 	defCtx   *context
+	raw      bool // defCtx works like XREP, see SetRaw
 	sync.Mutex
 }
 
@@ -67,6 +70,7 @@ type context struct {
 
 	bestEffort bool
 	backtrace  []byte
+	traceID    [protocol.TraceIDSize]byte
 	repMsg     *protocol.Message
 	pipeID     uint32 // using ID keeps GC from holding the pipe
 
@@ -134,8 +138,14 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 		default:
 		}
 	}
-	if m != nil {
+	if m != nil && c == s.defCtx && s.raw {
+		// The pipe ID goes in front of the backtrace, just as XREP
+		// does it, so that SendMsg can find the pipe again.
+		m.PutUint32Header(c.recvPipe.p.ID())
+		c.recvPipe = nil
+	} else if m != nil {
 		c.backtrace = append([]byte{}, m.Header...)
+		c.traceID = m.TraceID
 		m.Header = nil
 	}
 	c.recvWait = false
@@ -151,6 +161,10 @@ func (c *context) SendMsg(m *protocol.Message) error {
 		r.Unlock()
 		return protocol.ErrClosed
 	}
+	if c == r.defCtx && r.raw {
+		r.Unlock()
+		return c.sendRaw(m)
+	}
 	if c.backtrace == nil {
 		r.Unlock()
 		return protocol.ErrProtoState
@@ -168,6 +182,9 @@ func (c *context) SendMsg(m *protocol.Message) error {
 
 	m.Header = c.backtrace
 	c.backtrace = nil
+	if m.TraceID == [protocol.TraceIDSize]byte{} {
+		m.TraceID = c.traceID
+	}
 	cq := c.closeQ
 	r.Unlock()
 
@@ -195,6 +212,54 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	}
 }
 
+// sendRaw sends a message whose header starts with the pipe ID, as
+// returned by RecvMsg in raw mode.  Messages for pipes that have gone
+// away are discarded, as XREP does.
+func (c *context) sendRaw(m *protocol.Message) error {
+	r := c.s
+	if len(m.Header) < 4 {
+		m.Free()
+		return nil
+	}
+	hdr := m.Header
+	id := binary.BigEndian.Uint32(hdr)
+
+	r.Lock()
+	p, ok := r.pipes[id]
+	bestEffort := c.bestEffort
+	wq := nilQ
+	if bestEffort {
+		wq = closedQ
+	} else if c.sendExpire > 0 {
+		wq = time.After(c.sendExpire)
+	}
+	cq := c.closeQ
+	r.Unlock()
+	if !ok {
+		m.Free()
+		return nil
+	}
+	m.Header = hdr[4:]
+
+	select {
+	case <-cq:
+		m.Header = hdr
+		return protocol.ErrClosed
+	case <-p.closeQ:
+		m.Free()
+		return nil
+	case <-wq:
+		if bestEffort {
+			m.Free()
+			return nil
+		}
+		m.Header = hdr
+		return protocol.ErrSendTimeout
+	case p.sendQ <- m:
+		return nil
+	}
+}
+
 func (c *context) Close() error {
 	s := c.s
 	s.Lock()
@@ -366,6 +431,63 @@ func (s *socket) Close() error {
 	return nil
 }
 
+// Pending returns true if any requests have been received but not yet
+// replied to, or replies are waiting to be sent.
+func (s *socket) Pending() bool {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.ctxs {
+		if c.backtrace != nil {
+			return true
+		}
+	}
+	for _, p := range s.pipes {
+		if len(p.sendQ) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRaw switches the socket between cooked and raw mode.  In raw mode
+// it works like XREP, so that it can be used with Device.  It fails with
+// ErrBusy while a request is waiting for a reply, or replies are waiting
+// to be sent.
+func (s *socket) SetRaw(raw bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return protocol.ErrClosed
+	}
+	if s.raw == raw {
+		return nil
+	}
+	for c := range s.ctxs {
+		if c.backtrace != nil {
+			return protocol.ErrBusy
+		}
+	}
+	for _, p := range s.pipes {
+		if len(p.sendQ) > 0 {
+			return protocol.ErrBusy
+		}
+	}
+	s.raw = raw
+	return nil
+}
+
+// ValidateHeader checks that requests start with a complete backtrace.
+// With OptionStrictHeaders, that must be the request ID alone.
+func (s *socket) ValidateHeader(m *protocol.Message) error {
+	s.Lock()
+	strict := s.strict && !s.raw
+	s.Unlock()
+	if strict {
+		return protocol.CheckDirectRequest(m)
+	}
+	return protocol.CheckBacktrace(m)
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -424,6 +546,15 @@ func (s *socket) SetOption(name string, v interface{}) error {
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionStrictHeaders:
+		if strict, ok := v.(bool); ok {
+			s.Lock()
+			s.strict = strict
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 	}
 	return s.defCtx.SetOption(name, v)
 }
@@ -431,12 +562,20 @@ func (s *socket) SetOption(name string, v interface{}) error {
 func (s *socket) GetOption(name string) (interface{}, error) {
 	switch name {
 	case protocol.OptionRaw:
-		return false, nil
+		s.Lock()
+		v := s.raw
+		s.Unlock()
+		return v, nil
 	case protocol.OptionTTL:
 		s.Lock()
 		v := s.ttl
 		s.Unlock()
 		return v, nil
+	case protocol.OptionStrictHeaders:
+		s.Lock()
+		v := s.strict
+		s.Unlock()
+		return v, nil
 	case protocol.OptionWriteQLen:
 		s.Lock()
 		v := s.sendQLen
@@ -458,6 +597,7 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 		closeQ: make(chan struct{}),
 		recvQ:  make(chan *protocol.Message, 1),
 	}
+	s.ctxs[c] = struct{}{}
 	return c, nil
 }
 
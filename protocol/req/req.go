@@ -17,6 +17,7 @@
 package req
 
 import (
+	gocontext "context"
 	"encoding/binary"
 	"sync"
 	"sync/atomic"
@@ -36,6 +37,7 @@ const (
 type pipe struct {
 	p      protocol.Pipe
 	s      *socket
+	pri    int // OptionPipePriority
 	closed bool
 }
 
@@ -73,15 +75,37 @@ type socket struct {
 	pipes   map[uint32]*pipe      // all pipes for the socket (by pipe ID)
 }
 
+// nextPipe removes the first ready pipe from the ready queue and returns
+// it, skipping pipes with a lower priority than some connected pipe.  It
+// returns nil if none of the preferred pipes is ready.
+func (s *socket) nextPipe() *pipe {
+	top := 0
+	found := false
+	for _, p := range s.pipes {
+		if !found || p.pri > top {
+			top = p.pri
+			found = true
+		}
+	}
+	for i, p := range s.readyq {
+		if !found || p.pri >= top {
+			s.readyq = append(s.readyq[:i], s.readyq[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
 func (s *socket) send() {
-	for len(s.sendq) != 0 && len(s.readyq) != 0 {
+	for len(s.sendq) != 0 {
+		p := s.nextPipe()
+		if p == nil {
+			break
+		}
 		c := s.sendq[0]
 		s.sendq = s.sendq[1:]
 		c.wantw = false
 
-		p := s.readyq[0]
-		s.readyq = s.readyq[1:]
-
 		if c.sendID != 0 {
 			c.reqMsg = c.sendMsg
 			c.sendMsg = nil
@@ -92,11 +116,14 @@ func (s *socket) send() {
 		}
 		m := c.reqMsg.Dup()
 
-		// Schedule a retransmit for the future.
+		// Schedule a retransmit for the future.  This must refer
+		// to the request itself, not the copy we are sending, as
+		// that is how resendMessage knows it is still current.
 		c.lastPipe = p
 		if c.resendTime > 0 {
+			reqMsg := c.reqMsg
 			c.resender = time.AfterFunc(c.resendTime, func() {
-				c.resendMessage(m)
+				c.resendMessage(reqMsg)
 			})
 		}
 		go p.sendCtx(c, m)
@@ -490,6 +517,39 @@ func (s *socket) Close() error {
 	return nil
 }
 
+// RoundTrip sends m on a context of its own, and waits for the reply.
+// Closing the context when ctx is done wakes up either step, and makes
+// sure that a late reply is dropped.
+func (s *socket) RoundTrip(ctx gocontext.Context, m *protocol.Message) (*protocol.Message, error) {
+	pc, err := s.OpenContext()
+	if err != nil {
+		return nil, err
+	}
+	c := pc.(*context)
+	stopq := make(chan struct{})
+	doneq := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopq:
+		}
+		close(doneq)
+	}()
+
+	var rep *protocol.Message
+	if err = c.SendMsg(m); err == nil {
+		rep, err = c.RecvMsg()
+	}
+	close(stopq)
+	<-doneq
+	c.Close()
+	if err == protocol.ErrClosed && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return rep, err
+}
+
 func (s *socket) OpenContext() (protocol.Context, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -513,6 +573,13 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		p: pp,
 		s: s,
 	}
+	if o, ok := pp.(interface {
+		GetOption(string) (interface{}, error)
+	}); ok {
+		if v, err := o.GetOption(protocol.OptionPipePriority); err == nil {
+			p.pri, _ = v.(int)
+		}
+	}
 	s.Lock()
 	defer s.Unlock()
 	if s.closed {
@@ -548,6 +615,8 @@ func (s *socket) RemovePipe(pp protocol.Pipe) {
 				}
 			}
 		}
+		// Pipes of lower priority may be usable now.
+		s.send()
 	}
 	s.Unlock()
 	for _, p := range pipes {
@@ -555,6 +624,11 @@ func (s *socket) RemovePipe(pp protocol.Pipe) {
 	}
 }
 
+// ValidateHeader checks that replies start with the request ID.
+func (*socket) ValidateHeader(m *protocol.Message) error {
+	return protocol.CheckRequestID(m)
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
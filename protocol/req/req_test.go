@@ -0,0 +1,66 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package req
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestReqRetry(t *testing.T) {
+	addr := "inproc://req_retry"
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	if err = srv.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	s, err := NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionRetryTime, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = s.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// The request is never answered, so it is sent again, and again.
+	for i := 0; i < 3; i++ {
+		b, err := srv.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if string(b) != "ping" {
+			t.Fatalf("Got %q", b)
+		}
+	}
+}
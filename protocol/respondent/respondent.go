@@ -44,6 +44,7 @@ type socket struct {
 	closed   bool
 	pipes    map[uint32]*pipe
 	ttl      int
+	strict   bool // OptionStrictHeaders
 	sendQLen int
 	recvCond *sync.Cond
 	recvCtxs map[*context]struct{}
@@ -67,6 +68,7 @@ type context struct {
 
 	bestEffort bool
 	backtrace  []byte
+	traceID    [protocol.TraceIDSize]byte
 	repMsg     *protocol.Message
 	pipeID     uint32 // using ID keeps GC from holding the pipe
 
@@ -136,6 +138,7 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	}
 	if m != nil {
 		c.backtrace = append([]byte{}, m.Header...)
+		c.traceID = m.TraceID
 		m.Header = nil
 	}
 	c.recvWait = false
@@ -168,6 +171,9 @@ func (c *context) SendMsg(m *protocol.Message) error {
 
 	m.Header = c.backtrace
 	c.backtrace = nil
+	if m.TraceID == [protocol.TraceIDSize]byte{} {
+		m.TraceID = c.traceID
+	}
 	cq := c.closeQ
 	r.Unlock()
 
@@ -360,6 +366,36 @@ func (s *socket) Close() error {
 	return nil
 }
 
+// Pending returns true if any surveys have been received but not yet
+// replied to, or replies are waiting to be sent.
+func (s *socket) Pending() bool {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.ctxs {
+		if c.backtrace != nil {
+			return true
+		}
+	}
+	for _, p := range s.pipes {
+		if len(p.sendQ) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateHeader checks that surveys start with a complete backtrace.
+// With OptionStrictHeaders, that must be the survey ID alone.
+func (s *socket) ValidateHeader(m *protocol.Message) error {
+	s.Lock()
+	strict := s.strict
+	s.Unlock()
+	if strict {
+		return protocol.CheckDirectRequest(m)
+	}
+	return protocol.CheckBacktrace(m)
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -418,6 +454,15 @@ func (s *socket) SetOption(name string, v interface{}) error {
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionStrictHeaders:
+		if strict, ok := v.(bool); ok {
+			s.Lock()
+			s.strict = strict
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 	}
 	return s.defCtx.SetOption(name, v)
 }
@@ -431,6 +476,11 @@ func (s *socket) GetOption(name string) (interface{}, error) {
 		v := s.ttl
 		s.Unlock()
 		return v, nil
+	case protocol.OptionStrictHeaders:
+		s.Lock()
+		v := s.strict
+		s.Unlock()
+		return v, nil
 	case protocol.OptionWriteQLen:
 		s.Lock()
 		v := s.sendQLen
@@ -452,6 +502,7 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 		closeQ: make(chan struct{}),
 		recvQ:  make(chan *protocol.Message, 1),
 	}
+	s.ctxs[c] = struct{}{}
 	return c, nil
 }
 
@@ -16,10 +16,12 @@
 // This is like the BUS protocol, except that each member of the network
 // automatically forwards any message it receives to any other peers.
 // In a star network, this means that all members should receive all messages,
-// assuming that there is a central server.  Its important to ensure that
-// the topology is free from cycles, as there is no protection against
-// that, and cycles can lead to infinite message storms.  (TODO: Add a TTL,
-// and basic message ID / anti-replay protection.)
+// assuming that there is a central server.  Messages are never sent back
+// to the peer they came from, and each carries a hop count, so that it is
+// dropped after OptionTTL hops (8 by default).  Still, it's important to
+// ensure that the topology is free from cycles, such as a full mesh, as
+// there is no message ID or anti-replay protection, so cycles lead to
+// duplicated messages, and storms of them until the TTL runs out.
 package star
 
 import (
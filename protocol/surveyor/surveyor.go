@@ -52,6 +52,7 @@ type context struct {
 	recvExpire time.Duration
 	survExpire time.Duration
 	survID     uint32
+	expired    bool // the last survey ended by timing out
 }
 
 type socket struct {
@@ -97,8 +98,8 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	id := atomic.AddUint32(&s.nextID, 1)
 	id |= 0x80000000
 
-	m.Header = make([]byte, 4)
-	binary.BigEndian.PutUint32(m.Header, id)
+	m.Header = m.Header[:0]
+	m.PutUint32Header(id)
 
 	s.Lock()
 	defer s.Unlock()
@@ -107,15 +108,19 @@ func (c *context) SendMsg(m *protocol.Message) error {
 	}
 	c.cancel()
 	c.survID = id
+	c.expired = false
 	c.recvq = make(chan *protocol.Message, c.recvQLen)
 	s.surveys[id] = c
-	time.AfterFunc(c.survExpire, func() {
-		s.Lock()
-		if c.survID == id {
-			c.cancel()
-		}
-		s.Unlock()
-	})
+	if c.survExpire > 0 {
+		time.AfterFunc(c.survExpire, func() {
+			s.Lock()
+			if c.survID == id {
+				c.cancel()
+				c.expired = true
+			}
+			s.Unlock()
+		})
+	}
 
 	// Best-effort broadcast on all pipes
 	for _, p := range s.pipes {
@@ -135,6 +140,7 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 
 	s.Lock()
 	recvq := c.recvq
+	expired := c.expired
 	timeq := nilQ
 	if c.recvExpire > 0 {
 		timeq = time.After(c.recvExpire)
@@ -142,6 +148,9 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 	s.Unlock()
 
 	if recvq == nil {
+		if expired {
+			return nil, protocol.ErrRecvTimeout
+		}
 		return nil, protocol.ErrProtoState
 	}
 
@@ -151,6 +160,14 @@ func (c *context) RecvMsg() (*protocol.Message, error) {
 
 	case m := <-recvq:
 		if m == nil {
+			// The survey ended, either because it timed out,
+			// or a new one was started.
+			s.Lock()
+			expired = c.expired
+			s.Unlock()
+			if expired {
+				return nil, protocol.ErrRecvTimeout
+			}
 			return nil, protocol.ErrProtoState
 		}
 		return m, nil
@@ -413,6 +430,11 @@ func (s *socket) SetOption(option string, value interface{}) error {
 	return s.master.SetOption(option, value)
 }
 
+// ValidateHeader checks that responses start with the survey ID.
+func (*socket) ValidateHeader(m *protocol.Message) error {
+	return protocol.CheckRequestID(m)
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -32,6 +32,7 @@ type pipe struct {
 	closed bool
 	closeq chan struct{}
 	sendq  chan *protocol.Message
+	prioq  chan *protocol.Message // for messages with Priority set
 }
 
 type socket struct {
@@ -85,8 +86,12 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 			continue
 		}
 		pm := m.Dup()
+		sendq := p.sendq
+		if pm.Priority > 0 {
+			sendq = p.prioq
+		}
 		select {
-		case p.sendq <- pm:
+		case sendq <- pm:
 		case <-p.closeq:
 			pm.Free()
 		default:
@@ -207,6 +212,7 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		s:      s,
 		closeq: make(chan struct{}),
 		sendq:  make(chan *protocol.Message, s.sendQLen),
+		prioq:  make(chan *protocol.Message, s.sendQLen),
 	}
 	s.pipes[pp.ID()] = p
 
@@ -266,10 +272,17 @@ func (p *pipe) sender() {
 outer:
 	for {
 		var m *protocol.Message
+
+		// Prioritized messages go ahead of everything else.
 		select {
-		case <-p.closeq:
-			break outer
-		case m = <-p.sendq:
+		case m = <-p.prioq:
+		default:
+			select {
+			case <-p.closeq:
+				break outer
+			case m = <-p.prioq:
+			case m = <-p.sendq:
+			}
 		}
 
 		if err := p.p.SendMsg(m); err != nil {
@@ -293,8 +306,8 @@ outer:
 		// In that case, this pipe won't get a copy of the
 		// message.
 
-		m.Header = make([]byte, 4)
-		binary.BigEndian.PutUint32(m.Header, p.p.ID())
+		m.Header = m.Header[:0]
+		m.PutUint32Header(p.p.ID())
 
 		select {
 		case p.s.recvq <- m:
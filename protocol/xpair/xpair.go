@@ -51,6 +51,8 @@ type socket struct {
 	bestEffort bool
 	recvq      chan *protocol.Message
 	sendq      chan *protocol.Message
+	pending    int // messages queued or being sent
+	flushCv    *sync.Cond
 	sync.Mutex
 }
 
@@ -74,12 +76,15 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 	} else if s.sendExpire > 0 {
 		tq = time.After(s.sendExpire)
 	}
+	s.pending++
 	s.Unlock()
 
 	select {
 	case <-s.closeq:
+		s.sent()
 		return protocol.ErrClosed
 	case <-tq:
+		s.sent()
 		if tq == closedQ {
 			m.Free()
 			return nil
@@ -91,6 +96,71 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 	}
 }
 
+// sent notes that a message is no longer pending, waking up Flush.
+func (s *socket) sent() {
+	s.Lock()
+	s.pending--
+	s.flushCv.Broadcast()
+	s.Unlock()
+}
+
+// Flush waits until every message queued by SendMsg has been handed
+// to the transport.  It gives up with ErrSendTimeout once the send
+// deadline passes, or ErrClosed if the socket is closed.
+func (s *socket) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	expired := false
+	if s.sendExpire > 0 {
+		t := time.AfterFunc(s.sendExpire, func() {
+			s.Lock()
+			expired = true
+			s.flushCv.Broadcast()
+			s.Unlock()
+		})
+		defer t.Stop()
+	}
+	for {
+		if s.closed {
+			return protocol.ErrClosed
+		}
+		if s.pending <= 0 {
+			return nil
+		}
+		if expired {
+			return protocol.ErrSendTimeout
+		}
+		s.flushCv.Wait()
+	}
+}
+
+// SendUrgent writes the message to the peer at once, bypassing the send
+// queue, so that it arrives ahead of messages that are still queued.  It
+// only waits for a message that is being written already, as messages
+// are never interleaved on the wire.  If there is no peer, ErrProtoState
+// is returned.
+func (s *socket) SendUrgent(m *protocol.Message) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return protocol.ErrClosed
+	}
+	p := s.peer
+	s.Unlock()
+	if p == nil {
+		return protocol.ErrProtoState
+	}
+	if err := p.p.SendMsg(m); err != nil {
+		m.Free()
+		return err
+	}
+	// Do not leave it waiting for a batch (see OptionSendBatch).
+	if f, ok := p.p.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	return nil
+}
+
 func (s *socket) RecvMsg() (*protocol.Message, error) {
 	// For now this uses a simple unified queue for the entire
 	// socket.  Later we can look at moving this to priority queues
@@ -160,9 +230,27 @@ func (s *socket) SetOption(name string, value interface{}) error {
 
 			s.Lock()
 			s.sendQLen = v
+			oldchan := s.sendq
 			s.sendq = newchan
 			s.Unlock()
 
+			// Keep what was queued, as far as it fits.
+			for {
+				var m *protocol.Message
+				select {
+				case m = <-oldchan:
+				default:
+				}
+				if m == nil {
+					break
+				}
+				select {
+				case newchan <- m:
+				default:
+					m.Free()
+					s.sent()
+				}
+			}
 			return nil
 		}
 		return protocol.ErrBadValue
@@ -258,6 +346,7 @@ func (s *socket) Close() error {
 		return protocol.ErrClosed
 	}
 	s.closed = true
+	s.flushCv.Broadcast()
 
 	p := s.peer
 
@@ -300,7 +389,9 @@ outer:
 	for {
 		select {
 		case m := <-s.sendq:
-			if err := p.p.SendMsg(m); err != nil {
+			err := p.p.SendMsg(m)
+			s.sent()
+			if err != nil {
 				m.Free()
 				break outer
 			}
@@ -340,6 +431,7 @@ func NewProtocol() protocol.Protocol {
 		recvQLen: defaultQLen,
 		sendQLen: defaultQLen,
 	}
+	s.flushCv = sync.NewCond(s)
 	return s
 }
 
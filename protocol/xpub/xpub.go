@@ -28,13 +28,16 @@ type pipe struct {
 	s      *socket
 	closed bool
 	closeq chan struct{}
-	sendq  chan *protocol.Message
+	sendq  chan *protocol.PreparedMessage
 }
 
 type socket struct {
-	closed   bool
-	pipes    map[uint32]*pipe
-	sendQLen int
+	closed     bool
+	pipes      map[uint32]*pipe
+	sendQLen   int
+	policy     protocol.QueueFullPolicy
+	sendExpire time.Duration // only with QueueFullBlock
+	bestEffort bool          // only with QueueFullBlock
 	sync.Mutex
 }
 
@@ -58,23 +61,61 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 		s.Unlock()
 		return protocol.ErrClosed
 	}
-	// This could benefit from optimization to avoid useless duplicates.
-	for _, p := range s.pipes {
-		pm := m.Dup()
-		select {
-		case p.sendq <- pm:
-		case <-p.closeq:
-			pm.Free()
-		default:
-			// backpressure, but we do not exert
-			pm.Free()
+	// The message is shared by all pipes, and serialized just once.
+	pm := protocol.NewPreparedMessage(m)
+	if s.policy == protocol.QueueFullBlock && !s.bestEffort {
+		// We cannot wait for slow pipes while holding the lock.
+		pipes := make([]*pipe, 0, len(s.pipes))
+		for _, p := range s.pipes {
+			pipes = append(pipes, p)
+		}
+		tq := nilQ
+		if s.sendExpire > 0 {
+			tq = time.After(s.sendExpire)
+		}
+		s.Unlock()
+		// The deadline covers the whole send, so pipes that are
+		// still full when it expires do not get the message.
+		for _, p := range pipes {
+			select {
+			case p.sendq <- pm:
+			case <-p.closeq:
+			case <-tq:
+				return protocol.ErrSendTimeout
+			}
 		}
+		return nil
+	}
+	for _, p := range s.pipes {
+		p.enqueue(pm, s.policy)
 	}
 	s.Unlock()
-	m.Free()
 	return nil
 }
 
+// enqueue queues the message without blocking, discarding either it
+// or the oldest queued message if the queue is full.
+func (p *pipe) enqueue(pm *protocol.PreparedMessage, policy protocol.QueueFullPolicy) {
+	select {
+	case p.sendq <- pm:
+		return
+	case <-p.closeq:
+		return
+	default:
+	}
+	if policy != protocol.QueueFullDropOldest {
+		return
+	}
+	select {
+	case <-p.sendq:
+	default:
+	}
+	select {
+	case p.sendq <- pm:
+	default:
+	}
+}
+
 func (s *socket) RecvMsg() (*protocol.Message, error) {
 	return nil, protocol.ErrProtoOp
 }
@@ -90,6 +131,34 @@ func (s *socket) SetOption(name string, value interface{}) error {
 			return nil
 		}
 		return protocol.ErrBadValue
+
+	case protocol.OptionWriteQueueFullPolicy:
+		if v, ok := value.(protocol.QueueFullPolicy); ok &&
+			v >= protocol.QueueFullBlock && v <= protocol.QueueFullDropOldest {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionSendDeadline:
+		if v, ok := value.(time.Duration); ok {
+			s.Lock()
+			s.sendExpire = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionBestEffort:
+		if v, ok := value.(bool); ok {
+			s.Lock()
+			s.bestEffort = v
+			s.Unlock()
+			return nil
+		}
+		return protocol.ErrBadValue
 	}
 
 	return protocol.ErrBadOption
@@ -104,6 +173,21 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionWriteQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
+	case protocol.OptionSendDeadline:
+		s.Lock()
+		v := s.sendExpire
+		s.Unlock()
+		return v, nil
+	case protocol.OptionBestEffort:
+		s.Lock()
+		v := s.bestEffort
+		s.Unlock()
+		return v, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -119,7 +203,7 @@ func (s *socket) AddPipe(pp protocol.Pipe) error {
 		p:      pp,
 		s:      s,
 		closeq: make(chan struct{}),
-		sendq:  make(chan *protocol.Message, s.sendQLen),
+		sendq:  make(chan *protocol.PreparedMessage, s.sendQLen),
 	}
 	s.pipes[pp.ID()] = p
 
@@ -175,15 +259,14 @@ func (s *socket) Close() error {
 func (p *pipe) sender() {
 outer:
 	for {
-		var m *protocol.Message
+		var pm *protocol.PreparedMessage
 		select {
 		case <-p.closeq:
 			break outer
-		case m = <-p.sendq:
+		case pm = <-p.sendq:
 		}
 
-		if err := p.p.SendMsg(m); err != nil {
-			m.Free()
+		if err := p.p.SendPrepared(pm); err != nil {
 			break
 		}
 	}
@@ -221,6 +304,7 @@ func NewProtocol() protocol.Protocol {
 	s := &socket{
 		pipes:    make(map[uint32]*pipe),
 		sendQLen: defaultQLen,
+		policy:   protocol.QueueFullDropNewest,
 	}
 	return s
 }
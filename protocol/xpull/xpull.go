@@ -78,6 +78,31 @@ func (s *socket) RecvMsg() (*protocol.Message, error) {
 	}
 }
 
+// RecvBatch waits for a message like RecvMsg, and returns it along with
+// up to max-1 more that are already queued.
+func (s *socket) RecvBatch(max int) ([]*protocol.Message, error) {
+	if max < 1 {
+		return nil, protocol.ErrBadValue
+	}
+	m, err := s.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	recvq := s.recvq
+	s.Unlock()
+	msgs := []*protocol.Message{m}
+	for len(msgs) < max {
+		select {
+		case m = <-recvq:
+			msgs = append(msgs, m)
+		default:
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
+
 func (s *socket) SetOption(name string, value interface{}) error {
 	switch name {
 
@@ -45,47 +45,71 @@ type socket struct {
 	sendExpire time.Duration
 	sendQLen   int
 	bestEffort bool
+	policy     protocol.QueueFullPolicy
 	readyq     []*pipe
 	cv         *sync.Cond
+	pending    int // messages queued or being sent
+	flushCv    *sync.Cond
 	sync.Mutex
 }
 
-var (
-	nilQ    <-chan time.Time
-	closedQ chan time.Time
-)
+var nilQ <-chan time.Time
 
 const defaultQLen = 128
 
-func init() {
-	closedQ = make(chan time.Time)
-	close(closedQ)
-}
-
 // SendMsg implements sending a message.  The message must come with
 // its headers already prepared.  This will be at a minimum the request
 // ID at the end of the header, plus any leading backtrace information
 // coming from a paired REP socket.
 func (s *socket) SendMsg(m *protocol.Message) error {
 	s.Lock()
-	bestEffort := s.bestEffort
+	bestEffort := s.bestEffort || s.policy == protocol.QueueFullDropNewest
+	dropOldest := s.policy == protocol.QueueFullDropOldest && s.sendQLen > 0
 	tq := nilQ
-	if bestEffort {
-		tq = closedQ
-	} else if s.sendExpire > 0 {
+	if s.sendExpire > 0 {
 		tq = time.After(s.sendExpire)
 	}
+	s.pending++
 	s.Unlock()
 
+	// Try without waiting first, so that a full queue can be handled
+	// as the policy requires.
+	for {
+		select {
+		case s.sendq <- m:
+			s.Lock()
+			s.cv.Signal()
+			s.Unlock()
+			return nil
+		case <-s.closeq:
+			s.sent()
+			return protocol.ErrClosed
+		default:
+		}
+		if !dropOldest {
+			break
+		}
+		// Make room by discarding the oldest message.
+		select {
+		case old := <-s.sendq:
+			old.Free()
+			s.sent()
+		default:
+		}
+	}
+	if bestEffort {
+		s.sent()
+		m.Free()
+		return nil
+	}
+
 	select {
 	case s.sendq <- m:
 	case <-s.closeq:
+		s.sent()
 		return protocol.ErrClosed
 	case <-tq:
-		if bestEffort {
-			m.Free()
-			return nil
-		}
+		s.sent()
 		return protocol.ErrSendTimeout
 	}
 
@@ -95,6 +119,44 @@ func (s *socket) SendMsg(m *protocol.Message) error {
 	return nil
 }
 
+// sent notes that a message is no longer pending, waking up Flush.
+func (s *socket) sent() {
+	s.Lock()
+	s.pending--
+	s.flushCv.Broadcast()
+	s.Unlock()
+}
+
+// Flush waits until every message queued by SendMsg has been handed
+// to the transport.  It gives up with ErrSendTimeout once the send
+// deadline passes, or ErrClosed if the socket is closed.
+func (s *socket) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	expired := false
+	if s.sendExpire > 0 {
+		t := time.AfterFunc(s.sendExpire, func() {
+			s.Lock()
+			expired = true
+			s.flushCv.Broadcast()
+			s.Unlock()
+		})
+		defer t.Stop()
+	}
+	for {
+		if s.closed {
+			return protocol.ErrClosed
+		}
+		if s.pending <= 0 {
+			return nil
+		}
+		if expired {
+			return protocol.ErrSendTimeout
+		}
+		s.flushCv.Wait()
+	}
+}
+
 func (s *socket) sender() {
 	s.Lock()
 	defer s.Unlock()
@@ -131,7 +193,18 @@ func (p *pipe) receiver() {
 
 func (p *pipe) send(m *protocol.Message) {
 	s := p.s
-	if err := p.p.SendMsg(m); err != nil {
+	err := p.p.SendMsg(m)
+	if err == nil && len(s.sendq) == 0 {
+		// Nothing more is coming for now, so write out anything
+		// the transport is holding back (see OptionSendBatch).
+		// If that fails, the pipe is closed, and we find out on
+		// the next send.
+		if f, ok := p.p.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+	}
+	s.sent()
+	if err != nil {
 		m.Free()
 		if err == protocol.ErrClosed {
 			return
@@ -211,8 +284,20 @@ func (s *socket) SetOption(name string, value interface{}) error {
 				case newchan <- m:
 				default:
 					m.Free()
+					s.sent()
 				}
 			}
+			return nil
+		}
+		return protocol.ErrBadValue
+
+	case protocol.OptionWriteQueueFullPolicy:
+		if v, ok := value.(protocol.QueueFullPolicy); ok &&
+			v >= protocol.QueueFullBlock && v <= protocol.QueueFullDropOldest {
+			s.Lock()
+			s.policy = v
+			s.Unlock()
+			return nil
 		}
 		return protocol.ErrBadValue
 	}
@@ -238,6 +323,11 @@ func (s *socket) GetOption(option string) (interface{}, error) {
 		v := s.sendQLen
 		s.Unlock()
 		return v, nil
+	case protocol.OptionWriteQueueFullPolicy:
+		s.Lock()
+		v := s.policy
+		s.Unlock()
+		return v, nil
 	}
 
 	return nil, protocol.ErrBadOption
@@ -251,6 +341,7 @@ func (s *socket) Close() error {
 		return protocol.ErrClosed
 	}
 	s.closed = true
+	s.flushCv.Broadcast()
 	pipes := make([]*pipe, 0, len(s.pipes))
 	for _, p := range s.pipes {
 		pipes = append(pipes, p)
@@ -316,6 +407,7 @@ func NewProtocol() protocol.Protocol {
 		sendQLen: defaultQLen,
 	}
 	s.cv = sync.NewCond(s)
+	s.flushCv = sync.NewCond(s)
 	go s.sender()
 	return s
 }
@@ -145,8 +145,7 @@ outer:
 		}
 
 		// Outer most value of header is pipe ID
-		m.Header = append(make([]byte, 4), m.Header...)
-		binary.BigEndian.PutUint32(m.Header, p.p.ID())
+		m.PutUint32Header(p.p.ID())
 
 		s.Lock()
 		ttl := s.ttl
@@ -380,6 +379,11 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 	return nil, protocol.ErrProtoOp
 }
 
+// ValidateHeader checks that requests start with a complete backtrace.
+func (*socket) ValidateHeader(m *protocol.Message) error {
+	return protocol.CheckBacktrace(m)
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
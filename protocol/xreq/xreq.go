@@ -321,6 +321,12 @@ func (s *socket) OpenContext() (protocol.Context, error) {
 	return nil, protocol.ErrProtoOp
 }
 
+// ValidateHeader checks that replies start with a complete backtrace.
+// When forwarding, this includes the hops yet to be unwound.
+func (*socket) ValidateHeader(m *protocol.Message) error {
+	return protocol.CheckBacktrace(m)
+}
+
 func (*socket) Info() protocol.Info {
 	return protocol.Info{
 		Self:     Self,
@@ -14,6 +14,8 @@
 
 package mangos
 
+import "context"
+
 // Socket is the main access handle applications use to access the SP
 // system.  It is an abstraction of an application's "connection" to a
 // messaging topology.  Applications can have more than one Socket open
@@ -27,13 +29,50 @@ type Socket interface {
 	// will return ErrClosed.
 	Close() error
 
+	// Shutdown closes the Socket gracefully.  It first stops listening
+	// for new connections.  It then waits for calls to Send that are
+	// in progress, for replies owed by REP and RESPONDENT sockets to be
+	// sent, and for queued messages to be flushed (see Flush), before
+	// closing the Socket.  Calls to Recv that are waiting for a message
+	// are not waited for; they return ErrClosed.  If ctx expires first,
+	// the Socket is closed anyway, and the context error is returned.
+	Shutdown(ctx context.Context) error
+
 	// Send puts the message on the outbound send queue.  It blocks
 	// until the message can be queued, or the send deadline expires.
 	// If a queued message is later dropped for any reason,
 	// there will be no notification back to the application.
+	// Zero-length messages are valid, and are delivered to the peer
+	// as such; some protocols use them as signals.
 	Send([]byte) error
 
+	// Flush blocks until messages queued by Send or SendMsg have been
+	// written to the underlying connection.  This is useful to be sure
+	// a final message is delivered before calling Close.  It returns
+	// ErrSendTimeout if the send deadline expires first, or ErrProtoOp
+	// if the protocol does not support it.
+	Flush() error
+
+	// SendUrgent sends the message ahead of any that are still queued.
+	// It is written to the peer directly, waiting only for a message
+	// being written already to finish, so that messages are never
+	// split; an urgent message may arrive between any two queued ones.
+	// It returns ErrProtoOp if the protocol does not support it.
+	SendUrgent(*Message) error
+
+	// RoundTrip sends a request, and waits for the matching reply,
+	// giving up when ctx is done, in which case the context's error is
+	// returned.  The request is resent on another Pipe if the one it
+	// was sent on is lost.  Each call uses a Context of its own, so
+	// calls may be made concurrently, and a reply that arrives too late
+	// is discarded rather than returned by a later call.  The send and
+	// receive deadlines of the Socket still apply.  It returns
+	// ErrProtoOp if the protocol does not support it (only REQ does).
+	RoundTrip(ctx context.Context, req *Message) (*Message, error)
+
 	// Recv receives a complete message.  The entire message is received.
+	// A zero-length message is returned as an empty slice with a nil
+	// error, so it cannot be mistaken for a failure.
 	Recv() ([]byte, error)
 
 	// SendMsg puts the message on the outbound send.  It works like Send,
@@ -45,14 +84,67 @@ type Socket interface {
 	// which is useful for protocols in raw mode.
 	RecvMsg() (*Message, error)
 
+	// RecvBatch receives up to max messages.  It waits for the first
+	// message like RecvMsg, then returns it together with any further
+	// messages that are already queued, without waiting for more.
+	// It returns ErrProtoOp if the protocol does not support it.
+	RecvBatch(max int) ([]*Message, error)
+
+	// RecvChan returns a channel delivering received messages, for use
+	// in a select statement together with other sockets or a context.
+	// Each call returns the same channel.  A goroutine receives on the
+	// application's behalf, and may hold one message until it is read
+	// from the channel, so mixing RecvChan with the other receive
+	// methods is not recommended.  Errors, such as ErrRecvTimeout when
+	// a receive deadline is set, are delivered too.  The channel is
+	// closed when the Socket is closed, and any message then waiting
+	// in it is discarded.  It is also closed after ErrProtoOp, if the
+	// protocol cannot receive at all.  After ErrProtoState, such as from
+	// a REQ socket with no request outstanding, receiving is retried
+	// after a pause of up to 100ms, rather than repeating the error as
+	// fast as it is read.
+	RecvChan() <-chan RecvResult
+
+	// PauseRecv stops receiving from the Socket's pipes, without closing
+	// them, until ResumeRecv is called.  Once the receive queue and the
+	// connections' buffers are full, the peers are held back by flow
+	// control.  A pipe that is already waiting for a message may receive
+	// one more.  Keepalives are still sent, and a paused pipe is not
+	// closed because nothing is heard from its peer.  Calls to Recv
+	// continue to return messages that were queued already.
+	PauseRecv() error
+
+	// ResumeRecv restarts receiving after PauseRecv.
+	ResumeRecv() error
+
 	// Dial connects a remote endpoint to the Socket.  The function
 	// returns immediately, and an asynchronous goroutine is started to
 	// establish and maintain the connection, reconnecting as needed.
 	// If the address is invalid, then an error is returned.
 	Dial(addr string) error
 
+	// DialContext is like Dial, but waits for the first connection to
+	// be established, including the SP handshake, giving up if ctx is
+	// done first.  In that case the context's error is returned.  The
+	// connection is re-established as usual if it is later lost.
+	DialContext(ctx context.Context, addr string) error
+
 	DialOptions(addr string, options map[string]interface{}) error
 
+	// WaitConnected blocks until the Socket has at least one pipe that
+	// has completed the SP handshake, so that a message sent right
+	// after Dial is not lost for want of a peer.  It returns at once if
+	// such a pipe already exists.  If ctx is done first, the context's
+	// error is returned, and ErrClosed if the Socket is closed.
+	WaitConnected(ctx context.Context) error
+
+	// DialMany is like DialOptions, but dials each of the addresses,
+	// several at a time (see OptionDialConcurrency), and returns the
+	// result for each, in the same order.  The failure of some does
+	// not affect the others; the error is only for the call as a
+	// whole, such as ErrClosed if the Socket is closed.
+	DialMany(addrs []string, options map[string]interface{}) ([]DialResult, error)
+
 	// NewDialer returns a Dialer object which can be used to get
 	// access to the underlying configuration for dialing.
 	NewDialer(addr string, options map[string]interface{}) (Dialer, error)
@@ -77,6 +169,20 @@ type Socket interface {
 	// support separate contexts, this will return an error.
 	OpenContext() (Context, error)
 
+	// SetRaw switches the Socket between cooked and raw mode (see
+	// OptionRaw), for example so that it can be used with Device.
+	// Only the Socket itself is affected, not any other contexts.
+	// If the Socket is part way through an exchange, such as a REP
+	// socket that has received a request but not yet replied, ErrBusy
+	// is returned, and the mode is not changed.  Protocols that cannot
+	// switch return ErrProtoOp.  (Presently only REP can.)
+	SetRaw(raw bool) error
+
+	// Pipes returns a description of each Pipe connected to the Socket,
+	// including its traffic so far.  It is a snapshot, so Pipes may
+	// connect or disconnect at any time after it was taken.
+	Pipes() []PipeInfo
+
 	// SetPipeEventHook sets a PipeEventHook function to be called when a
 	// Pipe is added or removed from this socket (connect/disconnect).
 	// The previous hook is returned (nil if none.)  (Only one hook can
@@ -84,6 +190,13 @@ type Socket interface {
 	SetPipeEventHook(PipeEventHook) PipeEventHook
 }
 
+// RecvResult is a value delivered by the channel from RecvChan.  Exactly
+// one of Msg and Err is set.
+type RecvResult struct {
+	Msg *Message
+	Err error
+}
+
 // Context is a protocol context, and represents the upper side operations
 // that applications will want to use.  Every socket has a default context,
 // but only a certain protocols will allow the creation of additional
@@ -0,0 +1,122 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// recvAllocator hands out buffers of its own, noting which are in use.
+type recvAllocator struct {
+	sync.Mutex
+	allocs int
+	inUse  map[*byte]bool
+}
+
+func (a *recvAllocator) Alloc(size int) ([]byte, func(), error) {
+	if size == 0 {
+		return mangos.DefaultRecvAllocator.Alloc(size)
+	}
+	b := make([]byte, size)
+	a.Lock()
+	a.allocs++
+	a.inUse[&b[0]] = true
+	a.Unlock()
+	return b, func() {
+		a.Lock()
+		delete(a.inUse, &b[0])
+		a.Unlock()
+	}, nil
+}
+
+// counts returns the number of allocations, and of buffers in use.
+func (a *recvAllocator) counts() (int, int) {
+	a.Lock()
+	defer a.Unlock()
+	return a.allocs, len(a.inUse)
+}
+
+func testRecvAllocator(t *testing.T, addr string) {
+	a := &recvAllocator{inUse: make(map[*byte]bool)}
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	l, err := rx.NewListener(addr, nil)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	if err = l.SetOption(mangos.OptionRecvAllocator, "garbage"); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = l.SetOption(mangos.OptionRecvAllocator, a); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 100000)
+	for _, body := range [][]byte{[]byte("small"), {}, big} {
+		if err = tx.Send(body); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		m, err := rx.RecvMsg()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if !bytes.Equal(m.Body, body) {
+			t.Fatalf("Got %d bytes, expected %d", len(m.Body), len(body))
+		}
+		if _, n := a.counts(); len(body) > 0 && n != 1 {
+			t.Errorf("Message body is not from the allocator")
+		}
+		m.Free()
+		if _, n := a.counts(); n != 0 {
+			t.Errorf("Buffer not released")
+		}
+	}
+	if n, _ := a.counts(); n != 2 {
+		t.Errorf("Got %d allocations, expected 2", n)
+	}
+}
+
+func TestRecvAllocatorTCP(t *testing.T) {
+	testRecvAllocator(t, AddrTestTCP())
+}
+
+func TestRecvAllocatorIPC(t *testing.T) {
+	testRecvAllocator(t, AddrTestIPC())
+}
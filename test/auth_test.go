@@ -0,0 +1,127 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+// tokenAuth is an Authenticator where the client presents a token of a
+// fixed size, and the server answers whether it is acceptable.
+type tokenAuth string
+
+func (a tokenAuth) ClientAuth(c net.Conn) error {
+	if _, err := c.Write([]byte(a)); err != nil {
+		return err
+	}
+	var ok [1]byte
+	if _, err := io.ReadFull(c, ok[:]); err != nil {
+		return err
+	}
+	if ok[0] != 'Y' {
+		return errors.New("token rejected")
+	}
+	return nil
+}
+
+func (a tokenAuth) ServerAuth(c net.Conn) error {
+	b := make([]byte, len(a))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != string(a) {
+		c.Write([]byte{'N'})
+		return errors.New("bad token")
+	}
+	_, err := c.Write([]byte{'Y'})
+	return err
+}
+
+func testAuthenticator(t *testing.T, addr string) {
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	if err = srv.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	attached := make(chan struct{}, 10)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			attached <- struct{}{}
+		}
+	})
+	opts := map[string]interface{}{mangos.OptionAuthenticator: tokenAuth("letmein")}
+	if err = srv.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+
+	// The wrong token never gets connected.
+	bad, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer bad.Close()
+	opts = map[string]interface{}{mangos.OptionAuthenticator: tokenAuth("opensez")}
+	if err = bad.DialOptions(addr, opts); err != mangos.ErrAuthFailed {
+		t.Fatalf("Expected ErrAuthFailed, got %v", err)
+	}
+	select {
+	case <-attached:
+		t.Fatalf("Unauthenticated peer attached")
+	case <-time.After(200 * time.Millisecond):
+	}
+	bad.Close()
+
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = cli.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	opts = map[string]interface{}{mangos.OptionAuthenticator: tokenAuth("letmein")}
+	if err = cli.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Failed dial: %v", err)
+	}
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Failed send: %v", err)
+	}
+	b, err := srv.Recv()
+	if err != nil {
+		t.Fatalf("Failed recv: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("Got %q", b)
+	}
+}
+
+func TestAuthenticatorTCP(t *testing.T) {
+	testAuthenticator(t, AddrTestTCP())
+}
+
+func TestAuthenticatorIPC(t *testing.T) {
+	testAuthenticator(t, AddrTestIPC())
+}
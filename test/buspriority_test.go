@@ -0,0 +1,84 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestBusPriority(t *testing.T) {
+	addr := AddrTestInp()
+	rx, _ := bus.NewSocket()
+	defer rx.Close()
+	tx, _ := bus.NewSocket()
+	defer tx.Close()
+
+	// With no read queue, the receiver only takes messages as fast
+	// as we call Recv, so the sender will back up.
+	if err := rx.SetOption(mangos.OptionReadQLen, 0); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err := rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	const nlow = 20
+	for i := 0; i < nlow; i++ {
+		m := mangos.NewMessage(1)
+		m.Body = append(m.Body, 'L')
+		if err := tx.SendMsg(m); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	m := mangos.NewMessage(1)
+	m.Body = append(m.Body, 'H')
+	m.Priority = 1
+	if err := tx.SendMsg(m); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if err := rx.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	pos := -1
+	for i := 0; i <= nlow; i++ {
+		m, err := rx.RecvMsg()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if m.Priority != 0 {
+			t.Errorf("Received message has priority")
+		}
+		if string(m.Body) == "H" {
+			pos = i
+		}
+		m.Free()
+	}
+	// A few messages may already be in flight, but the urgent message
+	// must overtake the rest of the backlog.
+	if pos < 0 || pos > 4 {
+		t.Errorf("Priority message received at position %d", pos)
+	}
+}
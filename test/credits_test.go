@@ -0,0 +1,107 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// creditSends counts the messages PUSH can send to a PULL that is not
+// receiving, before Send times out.
+func creditSends(t *testing.T, opts map[string]interface{}) (int, mangos.Socket, mangos.Socket) {
+	addr := AddrTestTCP()
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	if err = tx.SetOption(mangos.OptionWriteQLen, 1); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.SetOption(mangos.OptionReadQLen, 1); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = tx.SetOption(mangos.OptionSendDeadline, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = tx.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	body := make([]byte, 1024)
+	n := 0
+	for ; n < 10000; n++ {
+		if err = tx.Send(body); err != nil {
+			if err != mangos.ErrSendTimeout {
+				t.Fatalf("Send failed: %v", err)
+			}
+			break
+		}
+	}
+	return n, tx, rx
+}
+
+func TestFlowCredits(t *testing.T) {
+	// Without credits, the socket buffers soak up a great deal.
+	n, tx, rx := creditSends(t, nil)
+	tx.Close()
+	rx.Close()
+	if n < 100 {
+		t.Fatalf("Only %d sent without credits", n)
+	}
+
+	// With them, the producer is held back once the credits and the
+	// queues along the way are used up.
+	opts := map[string]interface{}{mangos.OptionFlowCredits: 4}
+	n, tx, rx = creditSends(t, opts)
+	defer tx.Close()
+	defer rx.Close()
+	if n > 16 {
+		t.Fatalf("Sent %d with 4 credits", n)
+	}
+	t.Logf("Sent %d with 4 credits", n)
+
+	// Once the consumer catches up, the producer can carry on.
+	for i := 0; i < n; i++ {
+		if _, err := rx.Recv(); err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := tx.Send([]byte("more")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if m, err := rx.Recv(); err != nil || string(m) != "more" {
+			t.Fatalf("Recv got %q, %v", m, err)
+		}
+	}
+}
@@ -177,6 +177,76 @@ func TestDeviceReqRep(t *testing.T) {
 	}
 }
 
+// TestDeviceReqRepForward sends a request and its reply through a device.
+// The device sockets are raw, so the request ID and backtrace headers
+// pass through untouched, and neither end can tell the device is there.
+func TestDeviceReqRepForward(t *testing.T) {
+	front := AddrTestTCP()
+	back := AddrTestInp()
+
+	s1, err := xrep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to open S1: %v", err)
+	}
+	defer s1.Close()
+	s2, err := xreq.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to open S2: %v", err)
+	}
+	defer s2.Close()
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to open REP: %v", err)
+	}
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to open REQ: %v", err)
+	}
+	defer cli.Close()
+
+	for _, s := range []mangos.Socket{srv, cli} {
+		if err = s.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+			t.Fatalf("SetOption failed: %v", err)
+		}
+	}
+	if err = srv.Listen(back); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = s1.Listen(front); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = s2.Dial(back); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = mangos.Device(s1, s2); err != nil {
+		t.Fatalf("Device failed: %v", err)
+	}
+	if err = cli.Dial(front); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	b, err := srv.Recv()
+	if err != nil {
+		t.Fatalf("REP Recv failed: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("REP got %q", b)
+	}
+	if err = srv.Send([]byte("pong")); err != nil {
+		t.Fatalf("REP Send failed: %v", err)
+	}
+	if b, err = cli.Recv(); err != nil {
+		t.Fatalf("REQ Recv failed: %v", err)
+	}
+	if string(b) != "pong" {
+		t.Errorf("REQ got %q", b)
+	}
+}
+
 // TODO: Add fanout and concurrency testing.
 type devTest struct {
 	T
@@ -0,0 +1,81 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestDialContext(t *testing.T) {
+	addr := AddrTestTCP()
+	srv := resolverPull(t, addr)
+	defer srv.Close()
+
+	s, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = s.DialContext(ctx, addr); err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	if err = s.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, srv, "hello")
+}
+
+func TestDialContextHandshakeTimeout(t *testing.T) {
+	// The peer accepts, but never completes the SP handshake.
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", hostPort(addr))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	s, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = s.DialContext(ctx, addr)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("DialContext took %v", d)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestDialMany(t *testing.T) {
+	var good []string
+	for i := 0; i < 4; i++ {
+		addr := AddrTestTCP()
+		s := resolverPull(t, addr)
+		defer s.Close()
+		good = append(good, addr)
+	}
+	// Nothing listens on these, or they cannot be dialed at all.
+	refused := AddrTestTCP()
+	addrs := []string{
+		good[0], refused, good[1], "tcp://no-port", good[2],
+		"bogus://127.0.0.1:1", good[3],
+	}
+
+	s, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionDialConcurrency, -1); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = s.SetOption(mangos.OptionDialConcurrency, 2); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if v, err := s.GetOption(mangos.OptionDialConcurrency); err != nil || v.(int) != 2 {
+		t.Errorf("GetOption got %v %v", v, err)
+	}
+
+	results, err := s.DialMany(addrs, nil)
+	if err != nil {
+		t.Fatalf("DialMany failed: %v", err)
+	}
+	if len(results) != len(addrs) {
+		t.Fatalf("Got %d results", len(results))
+	}
+	for i, r := range results {
+		if r.Addr != addrs[i] {
+			t.Errorf("Result %d is for %s, expected %s", i, r.Addr, addrs[i])
+		}
+	}
+	for _, i := range []int{0, 2, 4, 6} {
+		if r := results[i]; r.Err != nil || r.Dialer == nil {
+			t.Errorf("Dial %s failed: %v", r.Addr, r.Err)
+		}
+	}
+	if results[1].Err == nil {
+		t.Errorf("Dial %s succeeded", refused)
+	}
+	if err = results[3].Err; err != mangos.ErrBadAddr {
+		t.Errorf("Dial without port: expected ErrBadAddr, got %v", err)
+	}
+	if err = results[5].Err; err != mangos.ErrBadTran {
+		t.Errorf("Dial bad scheme: expected ErrBadTran, got %v", err)
+	}
+	for _, i := range []int{1, 3, 5} {
+		if results[i].Dialer != nil {
+			t.Errorf("Dialer returned for failed %s", addrs[i])
+		}
+	}
+
+	if n := len(s.Pipes()); n != len(good) {
+		t.Errorf("Got %d pipes, expected %d", n, len(good))
+	}
+}
+
+func TestDialManyClosed(t *testing.T) {
+	s, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	s.Close()
+	if _, err = s.DialMany([]string{AddrTestTCP()}, nil); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
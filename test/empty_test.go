@@ -0,0 +1,68 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+func testEmptyMessage(t *testing.T, addr string) {
+	s1, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer s1.Close()
+	s2, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer s2.Close()
+
+	if err = s2.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = s2.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = s1.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = s1.Send([]byte{}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	b, err := s2.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if b == nil || len(b) != 0 {
+		t.Errorf("Expected empty message, got %v", b)
+	}
+}
+
+func TestEmptyMessageTCP(t *testing.T) {
+	testEmptyMessage(t, AddrTestTCP())
+}
+
+func TestEmptyMessageIPC(t *testing.T) {
+	testEmptyMessage(t, AddrTestIPC())
+}
+
+func TestEmptyMessageInp(t *testing.T) {
+	testEmptyMessage(t, AddrTestInp())
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
+)
+
+func TestMessageExpiry(t *testing.T) {
+	addr := AddrTestInp()
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+
+	if err = rx.SetOption(mangos.OptionReadQLen, 1); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = tx.SetOption(mangos.OptionWriteQLen, 64); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Nobody is receiving, so these stall the pipe: a few are taken
+	// up by the PULL queue and by the sender, and the rest wait in
+	// the PUSH queue along with everything that follows.
+	const stalled = 8
+	for i := 0; i < stalled; i++ {
+		if err = tx.Send([]byte("stall")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	expiry := time.Now().Add(20 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, []byte("stale")...)
+		m.Expiry = expiry
+		if err = tx.SendMsg(m); err != nil {
+			t.Fatalf("SendMsg failed: %v", err)
+		}
+	}
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("fresh")...)
+	m.Expiry = time.Now().Add(time.Hour)
+	if err = tx.SendMsg(m); err != nil {
+		t.Fatalf("SendMsg failed: %v", err)
+	}
+	if err = tx.Send([]byte("last")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	got := map[string]int{}
+	for {
+		m, err := rx.RecvMsg()
+		if err != nil {
+			t.Fatalf("RecvMsg failed: %v", err)
+		}
+		body := string(m.Body)
+		if !m.Expiry.IsZero() {
+			t.Errorf("Expiry was passed to the receiver")
+		}
+		m.Free()
+		got[body]++
+		if body == "last" {
+			break
+		}
+	}
+	if got["stall"] != stalled {
+		t.Errorf("Got %d stalled messages, expected %d", got["stall"], stalled)
+	}
+	if got["stale"] != 0 {
+		t.Errorf("Got %d expired messages", got["stale"])
+	}
+	if got["fresh"] != 1 {
+		t.Errorf("Got %d unexpired messages, expected 1", got["fresh"])
+	}
+}
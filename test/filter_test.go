@@ -0,0 +1,90 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+func testRecvFilter(t *testing.T, addr string) {
+	var rejected int
+	filter := func(m *mangos.Message) error {
+		if bytes.HasPrefix(m.Body, []byte("DROP")) {
+			rejected++
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	rx, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer rx.Close()
+	tx, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer tx.Close()
+
+	if err = rx.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.ListenOptions(addr, map[string]interface{}{
+		mangos.OptionRecvFilter: filter,
+	}); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	for _, b := range []string{"one", "DROP table", "two", "DROP it"} {
+		if err = tx.Send([]byte(b)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for _, want := range []string{"one", "two"} {
+		b, err := rx.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(b) != want {
+			t.Errorf("Got %q, expected %q", b, want)
+		}
+	}
+	// The pipe stays up after a rejection.
+	if err = tx.Send([]byte("three")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := rx.Recv(); err != nil || string(b) != "three" {
+		t.Errorf("Recv got %q, %v", b, err)
+	}
+	if rejected != 2 {
+		t.Errorf("Rejected %d messages, expected 2", rejected)
+	}
+}
+
+func TestRecvFilterTCP(t *testing.T) {
+	testRecvFilter(t, AddrTestTCP())
+}
+
+func TestRecvFilterIPC(t *testing.T) {
+	testRecvFilter(t, AddrTestIPC())
+}
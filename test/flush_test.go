@@ -0,0 +1,197 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+)
+
+func testFlushBeforeClose(t *testing.T, tx, rx mangos.Socket) {
+	addr := AddrTestTCP()
+	defer rx.Close()
+
+	if err := rx.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err := rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		if err := tx.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err := tx.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	tx.Close()
+
+	for i := 0; i < count; i++ {
+		b, err := rx.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if string(b) != fmt.Sprintf("%d", i) {
+			t.Fatalf("Got %q, expected %d", b, i)
+		}
+	}
+}
+
+func TestFlushPush(t *testing.T) {
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	testFlushBeforeClose(t, tx, rx)
+}
+
+func TestFlushPair(t *testing.T) {
+	tx, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	rx, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	testFlushBeforeClose(t, tx, rx)
+}
+
+// testFlushResize queues messages with no peer, then changes the write
+// queue length to qlen, which drops those that no longer fit.  Flush must
+// not wait for the dropped messages once a peer is connected.
+func testFlushResize(t *testing.T, tx, rx mangos.Socket, qlen int) {
+	addr := AddrTestTCP()
+	defer tx.Close()
+	defer rx.Close()
+
+	const count = 3
+	for i := 0; i < count; i++ {
+		if err := tx.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err := tx.SetOption(mangos.OptionWriteQLen, qlen); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err := tx.SetOption(mangos.OptionSendDeadline, 2*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err := rx.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err := rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err := tx.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	kept := count
+	if qlen < kept {
+		kept = qlen
+	}
+	for i := 0; i < kept; i++ {
+		b, err := rx.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if string(b) != fmt.Sprintf("%d", i) {
+			t.Fatalf("Got %q, expected %d", b, i)
+		}
+	}
+}
+
+func TestFlushResizePush(t *testing.T) {
+	for _, qlen := range []int{1, 8} {
+		tx, err := push.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make PUSH: %v", err)
+		}
+		rx, err := pull.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make PULL: %v", err)
+		}
+		testFlushResize(t, tx, rx, qlen)
+	}
+}
+
+func TestFlushResizePair(t *testing.T) {
+	for _, qlen := range []int{1, 8} {
+		tx, err := pair.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make PAIR: %v", err)
+		}
+		rx, err := pair.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make PAIR: %v", err)
+		}
+		testFlushResize(t, tx, rx, qlen)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	sock, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer sock.Close()
+
+	// With no peer, the message stays queued.
+	if err = sock.SetOption(mangos.OptionSendDeadline, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = sock.Send([]byte("stuck")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err = sock.Flush(); err != mangos.ErrSendTimeout {
+		t.Errorf("Expected ErrSendTimeout, got %v", err)
+	}
+	sock.Close()
+	if err = sock.Flush(); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFlushNotSupported(t *testing.T) {
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer sock.Close()
+	if err = sock.Flush(); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+func TestHeaderPushPop(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+
+	m.PushHeader([]byte{3, 4})
+	m.PushHeader([]byte{1, 2})
+	if !bytes.Equal(m.Header, []byte{1, 2, 3, 4}) {
+		t.Fatalf("Wrong header: %v", m.Header)
+	}
+	if b := m.PopHeader(1); !bytes.Equal(b, []byte{1}) {
+		t.Errorf("Wrong pop: %v", b)
+	}
+	if b := m.PopHeader(4); b != nil {
+		t.Errorf("Popped past end: %v", b)
+	}
+	if !bytes.Equal(m.Header, []byte{2, 3, 4}) {
+		t.Errorf("Failed pop changed header: %v", m.Header)
+	}
+	if b := m.PopHeader(3); !bytes.Equal(b, []byte{2, 3, 4}) {
+		t.Errorf("Wrong pop: %v", b)
+	}
+	if len(m.Header) != 0 {
+		t.Errorf("Header not empty: %v", m.Header)
+	}
+}
+
+func TestHeaderUint32Cycles(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+
+	// Repeated cycles should settle into the same storage.
+	var first *byte
+	for i := 0; i < 100; i++ {
+		m.PutUint32Header(0x80000000 | uint32(i))
+		m.PutUint32Header(uint32(i))
+		if first == nil {
+			first = &m.Header[0]
+		} else if &m.Header[0] != first {
+			t.Fatalf("Header storage not reused on cycle %d", i)
+		}
+		if b := m.PopHeader(4); !bytes.Equal(b, []byte{0, 0, 0, byte(i)}) {
+			t.Fatalf("Wrong pipe ID: %v", b)
+		}
+		if b := m.PopHeader(4); !bytes.Equal(b, []byte{0x80, 0, 0, byte(i)}) {
+			t.Fatalf("Wrong request ID: %v", b)
+		}
+	}
+}
+
+func TestHeaderGrowth(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+
+	// Push well past the initial capacity, as a deep backtrace would.
+	for i := 0; i < 64; i++ {
+		m.PutUint32Header(uint32(i))
+	}
+	if len(m.Header) != 256 {
+		t.Fatalf("Wrong header length: %d", len(m.Header))
+	}
+	for i := 63; i >= 0; i-- {
+		if b := m.PopHeader(4); !bytes.Equal(b, []byte{0, 0, 0, byte(i)}) {
+			t.Fatalf("Wrong value %d: %v", i, b)
+		}
+	}
+}
+
+func TestHeaderFromBody(t *testing.T) {
+	m := mangos.NewMessage(0)
+	defer m.Free()
+
+	// Raw protocols slice the header out of the body; pushing more
+	// header must not overwrite the body.
+	m.Body = append(m.Body, []byte{0x80, 0, 0, 1, 'h', 'i'}...)
+	m.Header = m.Body[:4]
+	m.Body = m.Body[4:]
+	m.PutUint32Header(7)
+	if !bytes.Equal(m.Header, []byte{0, 0, 0, 7, 0x80, 0, 0, 1}) {
+		t.Errorf("Wrong header: %v", m.Header)
+	}
+	if string(m.Body) != "hi" {
+		t.Errorf("Body clobbered: %q", m.Body)
+	}
+}
+
+func TestHeaderGrowthFree(t *testing.T) {
+	m := mangos.NewMessage(0)
+	for i := 0; i < 64; i++ {
+		m.PutUint32Header(uint32(i))
+	}
+	m.Free()
+
+	// Recycled messages must come back with an empty header, even
+	// when the header storage was grown.
+	for i := 0; i < 10; i++ {
+		m = mangos.NewMessage(0)
+		if len(m.Header) != 0 {
+			t.Fatalf("Stale header: %d bytes", len(m.Header))
+		}
+		m.Free()
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// testLinger queues messages on a PUSH socket before its peer is
+// listening, then closes it, and returns how many were delivered.
+func testLinger(t *testing.T, linger time.Duration) int {
+	addr := AddrTestTCP()
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+
+	if err = tx.SetOption(mangos.OptionLinger, linger); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if v, err := tx.GetOption(mangos.OptionLinger); err != nil || v != linger {
+		t.Fatalf("Bad linger: %v %v", v, err)
+	}
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 500*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	opts := map[string]interface{}{mangos.OptionDialAsynch: true}
+	if err = tx.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		if err = tx.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if err := rx.Listen(addr); err != nil {
+			t.Errorf("Listen failed: %v", err)
+		}
+	}()
+	start := time.Now()
+	if err = tx.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if elapsed := time.Since(start); linger > 0 && elapsed >= linger {
+		t.Errorf("Close did not stop lingering once drained: %v", elapsed)
+	}
+	// Let the listener start, if Close did not wait for it.
+	time.Sleep(250 * time.Millisecond)
+
+	n := 0
+	for ; n < count; n++ {
+		b, err := rx.Recv()
+		if err != nil {
+			break
+		}
+		if string(b) != fmt.Sprintf("%d", n) {
+			t.Fatalf("Got %q, expected %d", b, n)
+		}
+	}
+	return n
+}
+
+func TestLingerDelivers(t *testing.T) {
+	if n := testLinger(t, 5*time.Second); n != 20 {
+		t.Errorf("Only %d messages delivered", n)
+	}
+}
+
+func TestLingerZeroDrops(t *testing.T) {
+	if n := testLinger(t, 0); n != 0 {
+		t.Errorf("%d messages delivered after close", n)
+	}
+}
+
+// flushCounter counts the calls to the Flush method of its protocol.
+type flushCounter struct {
+	protocol.Protocol
+	calls int32
+}
+
+func (f *flushCounter) Flush() error {
+	atomic.AddInt32(&f.calls, 1)
+	return f.Protocol.(interface{ Flush() error }).Flush()
+}
+
+func TestLingerShortSendDeadline(t *testing.T) {
+	fc := &flushCounter{Protocol: push.NewProtocol()}
+	sock := protocol.MakeSocket(fc)
+	if err := sock.SetOption(mangos.OptionSendDeadline, time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err := sock.SetOption(mangos.OptionLinger, 300*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	// With no peer, the message stays queued for the whole linger.
+	if err := sock.Send([]byte("stuck")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	sock.Close()
+	if n := atomic.LoadInt32(&fc.calls); n > 20 {
+		t.Errorf("Flush called %d times while lingering", n)
+	}
+}
+
+func TestLingerBadValue(t *testing.T) {
+	sock, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer sock.Close()
+	if err = sock.SetOption(mangos.OptionLinger, -time.Second); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = sock.SetOption(mangos.OptionLinger, 1); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/transport"
+	"nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// dialRaw makes a pipe to the address, and reports whether the peer
+// kept it open.
+func dialRaw(t *testing.T, addr string) (transport.Pipe, bool) {
+	sock, _ := req.NewSocket()
+	defer sock.Close()
+	d, err := tcp.Transport.NewDialer(addr, sock)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	p, err := d.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	p.(interface{ SetRecvDeadline(time.Time) error }).SetRecvDeadline(
+		time.Now().Add(time.Millisecond * 100))
+	_, err = p.Recv()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return p, true
+	}
+	return p, false
+}
+
+// warnLogger keeps the lines logged at Warn level.
+type warnLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *warnLogger) Warnf(format string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.Unlock()
+}
+
+func (*warnLogger) Debugf(string, ...interface{}) {}
+
+func (l *warnLogger) find(text ...string) bool {
+	l.Lock()
+	defer l.Unlock()
+outer:
+	for _, line := range l.lines {
+		for _, s := range text {
+			if !strings.Contains(line, s) {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func TestMaxConnections(t *testing.T) {
+	addr := AddrTestTCP()
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer sock.Close()
+
+	lg := &warnLogger{}
+	opts := map[string]interface{}{
+		mangos.OptionMaxConnections: 2,
+		mangos.OptionLogger:         lg,
+	}
+	if err = sock.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	p1, ok := dialRaw(t, addr)
+	if !ok {
+		t.Fatalf("First connection rejected")
+	}
+	defer p1.Close()
+	p2, ok := dialRaw(t, addr)
+	if !ok {
+		t.Fatalf("Second connection rejected")
+	}
+	p3, ok := dialRaw(t, addr)
+	p3.Close()
+	if ok {
+		t.Errorf("Third connection accepted")
+	}
+	if !lg.find("rejected", "limit of 2", p3.LocalAddr().String()) {
+		t.Errorf("Rejection not logged")
+	}
+
+	// Closing one should make room for another.
+	p2.Close()
+	time.Sleep(time.Millisecond * 100)
+	p4, ok := dialRaw(t, addr)
+	p4.Close()
+	if !ok {
+		t.Errorf("Connection rejected after close")
+	}
+}
+
+func TestMaxConnectionsOption(t *testing.T) {
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer sock.Close()
+
+	l, err := sock.NewListener(AddrTestTCP(), nil)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	if err = l.SetOption(mangos.OptionMaxConnections, -1); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = l.SetOption(mangos.OptionMaxConnections, 5); err != nil {
+		t.Errorf("SetOption failed: %v", err)
+	}
+	if v, err := l.GetOption(mangos.OptionMaxConnections); err != nil || v.(int) != 5 {
+		t.Errorf("GetOption failed: %v %v", v, err)
+	}
+}
@@ -16,10 +16,12 @@ package test
 
 import (
 	"bytes"
+	"sync"
 	"testing"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
 	"nanomsg.org/go/mangos/v2/protocol/rep"
 	"nanomsg.org/go/mangos/v2/protocol/req"
 )
@@ -195,3 +197,77 @@ func TestMaxRxTCP(t *testing.T) {
 func TestMaxRxWS(t *testing.T) {
 	testMaxRx(t, AddrTestWS())
 }
+
+func TestMaxRxRaiseOnPipe(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer srv.Close()
+	cli, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer cli.Close()
+
+	// Pipes start out capped, and are only raised once we decide
+	// to trust the peer.
+	var lock sync.Mutex
+	trusted := false
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		lock.Lock()
+		defer lock.Unlock()
+		if ev == mangos.PipeEventAttached && trusted {
+			if err := p.SetMaxRecvSize(8192); err != nil {
+				t.Errorf("SetMaxRecvSize failed: %v", err)
+			}
+		}
+	})
+
+	if err = srv.SetOption(mangos.OptionMaxRecvSize, 1024); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = srv.SetOption(mangos.OptionRecvDeadline, 200*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = cli.SetOption(mangos.OptionReconnectTime, 10*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	big := make([]byte, 4096)
+	if err = cli.Send(big); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err = srv.Recv(); err != mangos.ErrRecvTimeout {
+		t.Fatalf("Expected ErrRecvTimeout, got %v", err)
+	}
+
+	// The oversized message cost us the connection; once the dialer
+	// reconnects, the new pipe has the raised limit.  Messages sent
+	// before the old pipe is noticed to be gone can be lost, so retry.
+	lock.Lock()
+	trusted = true
+	lock.Unlock()
+	for i := 0; ; i++ {
+		if err = cli.Send(big); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		var v []byte
+		if v, err = srv.Recv(); err == nil {
+			if len(v) != len(big) {
+				t.Errorf("Wrong length: %d", len(v))
+			}
+			break
+		}
+		if i == 10 {
+			t.Fatalf("Recv after raise failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestMaxTxSizeDefault(t *testing.T) {
+	sock, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer sock.Close()
+
+	v, err := sock.GetOption(mangos.OptionMaxSendSize)
+	if err != nil {
+		t.Fatalf("Failed GetOption: %v", err)
+	}
+	if v.(int) != 1024*1024 {
+		t.Errorf("Wrong default: %v", v)
+	}
+	if err = sock.SetOption(mangos.OptionMaxSendSize, -1); err != mangos.ErrBadValue {
+		t.Errorf("Permitted negative max send size: %v", err)
+	}
+	if err = sock.SetOption(mangos.OptionMaxSendSize, "garbage"); err != mangos.ErrBadValue {
+		t.Errorf("Permitted non-int max send size: %v", err)
+	}
+}
+
+func TestMaxTxSizeSend(t *testing.T) {
+	sock, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer sock.Close()
+
+	if err = sock.SetOption(mangos.OptionMaxSendSize, 100); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = sock.SetOption(mangos.OptionBestEffort, true); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = sock.Send(make([]byte, 101)); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+	if err = sock.Send(make([]byte, 100)); err != nil {
+		t.Errorf("Send failed: %v", err)
+	}
+	if err = sock.SetOption(mangos.OptionMaxSendSize, 0); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = sock.Send(make([]byte, 2*1024*1024)); err != nil {
+		t.Errorf("Unlimited send failed: %v", err)
+	}
+}
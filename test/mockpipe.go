@@ -0,0 +1,219 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// mockID is used to allocate IDs for MockPipes.
+var mockID uint32
+
+// MockPipe is an in-memory implementation of the Pipe interface used by
+// protocols (protocol.Pipe), so that protocol logic can be tested without
+// sockets or transports.  Pass it to the protocol's AddPipe method.
+// Messages the protocol sends are collected with Sent, and messages for
+// the protocol to receive are supplied with Deliver.  Failures can be
+// simulated with InjectSendError, and slow peers with the delays.
+// Closing the MockPipe is the same as a transport failing, and causes
+// the protocol's pending RecvMsg to return nil.
+type MockPipe struct {
+	id        uint32
+	self      uint16
+	peer      uint16
+	sendQ     chan *mangos.Message
+	recvQ     chan *mangos.Message
+	closeQ    chan struct{}
+	closed    bool
+	sendErr   error
+	sendDelay time.Duration
+	recvDelay time.Duration
+	sync.Mutex
+}
+
+// NewMockPipe returns a MockPipe, with the given local and remote
+// protocol numbers.  Each MockPipe has a unique ID.  Up to qlen
+// messages may be sent or delivered before the other side takes them;
+// after that SendMsg and Deliver block.
+func NewMockPipe(self, peer uint16, qlen int) *MockPipe {
+	return &MockPipe{
+		id:     atomic.AddUint32(&mockID, 1) & 0x7fffffff,
+		self:   self,
+		peer:   peer,
+		sendQ:  make(chan *mangos.Message, qlen),
+		recvQ:  make(chan *mangos.Message, qlen),
+		closeQ: make(chan struct{}),
+	}
+}
+
+// ID implements the Pipe ID method.
+func (p *MockPipe) ID() uint32 {
+	return p.id
+}
+
+// LocalProtocol returns the local protocol number.
+func (p *MockPipe) LocalProtocol() uint16 {
+	return p.self
+}
+
+// RemoteProtocol returns the protocol number of the simulated peer.
+func (p *MockPipe) RemoteProtocol() uint16 {
+	return p.peer
+}
+
+// Close implements the Pipe Close method.  It returns ErrClosed if the
+// MockPipe was already closed.
+func (p *MockPipe) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return mangos.ErrClosed
+	}
+	p.closed = true
+	close(p.closeQ)
+	return nil
+}
+
+// IsClosed returns true if the MockPipe has been closed.
+func (p *MockPipe) IsClosed() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.closed
+}
+
+// SendMsg implements the Pipe SendMsg method.  After any send delay,
+// the message is queued for Sent, unless an error was injected, in
+// which case that is returned instead, and the caller keeps the message.
+func (p *MockPipe) SendMsg(m *mangos.Message) error {
+	p.Lock()
+	delay := p.sendDelay
+	p.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-p.closeQ:
+			return mangos.ErrClosed
+		}
+	}
+
+	p.Lock()
+	err := p.sendErr
+	if p.closed {
+		err = mangos.ErrClosed
+	}
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case p.sendQ <- m:
+		return nil
+	case <-p.closeQ:
+		return mangos.ErrClosed
+	}
+}
+
+// SendPrepared implements the Pipe SendPrepared method, by sending a
+// copy of the message.
+func (p *MockPipe) SendPrepared(pm *mangos.PreparedMessage) error {
+	m := pm.Message()
+	if err := p.SendMsg(m); err != nil {
+		m.Free()
+		return err
+	}
+	return nil
+}
+
+// RecvMsg implements the Pipe RecvMsg method.  It returns the messages
+// given to Deliver, in order, each after the receive delay.  Once the
+// MockPipe is closed, nil is returned.
+func (p *MockPipe) RecvMsg() *mangos.Message {
+	var m *mangos.Message
+	select {
+	case m = <-p.recvQ:
+	case <-p.closeQ:
+		return nil
+	}
+	p.Lock()
+	delay := p.recvDelay
+	p.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-p.closeQ:
+			m.Free()
+			return nil
+		}
+	}
+	return m
+}
+
+// Deliver supplies a message for the protocol to receive.  As with a
+// real transport, the protocol header must be at the front of the
+// Body, and the Header empty.  The MockPipe takes ownership of the
+// message, unless ErrClosed is returned.
+func (p *MockPipe) Deliver(m *mangos.Message) error {
+	select {
+	case p.recvQ <- m:
+		return nil
+	case <-p.closeQ:
+		return mangos.ErrClosed
+	}
+}
+
+// Sent returns the next message sent by the protocol, waiting up to the
+// given time for one.  The caller owns the message.  Nil is returned if
+// no message was sent in time.
+func (p *MockPipe) Sent(wait time.Duration) *mangos.Message {
+	select {
+	case m := <-p.sendQ:
+		return m
+	default:
+	}
+	select {
+	case m := <-p.sendQ:
+		return m
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// InjectSendError causes subsequent calls to SendMsg to fail with err.
+// Pass nil to let them succeed again.
+func (p *MockPipe) InjectSendError(err error) {
+	p.Lock()
+	p.sendErr = err
+	p.Unlock()
+}
+
+// SetSendDelay sets the time that each SendMsg waits before sending,
+// as though the peer were slow to accept messages.
+func (p *MockPipe) SetSendDelay(d time.Duration) {
+	p.Lock()
+	p.sendDelay = d
+	p.Unlock()
+}
+
+// SetRecvDelay sets the time that each message given to Deliver takes
+// to arrive, as though the network were slow.
+func (p *MockPipe) SetRecvDelay(d time.Duration) {
+	p.Lock()
+	p.recvDelay = d
+	p.Unlock()
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+// TestMockPipeReqRetry drives the REQ protocol directly, without a
+// socket, to check that it resends a request that goes unanswered.
+func TestMockPipeReqRetry(t *testing.T) {
+	s := req.NewProtocol()
+	defer s.Close()
+	if err := s.SetOption(mangos.OptionRetryTime, 20*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	mp := NewMockPipe(mangos.ProtoReq, mangos.ProtoRep, 4)
+	if err := s.AddPipe(mp); err != nil {
+		t.Fatalf("AddPipe failed: %v", err)
+	}
+
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("ping")...)
+	if err := s.SendMsg(m); err != nil {
+		t.Fatalf("SendMsg failed: %v", err)
+	}
+	first := mp.Sent(time.Second)
+	if first == nil {
+		t.Fatalf("Request not sent")
+	}
+	if len(first.Header) != 4 || first.Header[0]&0x80 == 0 {
+		t.Fatalf("Bad request ID: %v", first.Header)
+	}
+
+	// We don't answer, so the request is sent again.
+	again := mp.Sent(time.Second)
+	if again == nil {
+		t.Fatalf("Request not resent")
+	}
+	if !bytes.Equal(again.Header, first.Header) || string(again.Body) != "ping" {
+		t.Errorf("Resent request differs: %v %q", again.Header, again.Body)
+	}
+
+	// The reply carries the request ID at the front of the body,
+	// just as it would arrive from a transport.
+	rep := mangos.NewMessage(0)
+	rep.Body = append(rep.Body, first.Header...)
+	rep.Body = append(rep.Body, []byte("pong")...)
+	first.Free()
+	again.Free()
+	if err := mp.Deliver(rep); err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	m, err := s.RecvMsg()
+	if err != nil {
+		t.Fatalf("RecvMsg failed: %v", err)
+	}
+	if string(m.Body) != "pong" {
+		t.Errorf("Wrong reply: %q", m.Body)
+	}
+	m.Free()
+}
+
+func TestMockPipeFailures(t *testing.T) {
+	mp := NewMockPipe(mangos.ProtoPair, mangos.ProtoPair, 1)
+	if mp.LocalProtocol() != mangos.ProtoPair || mp.RemoteProtocol() != mangos.ProtoPair {
+		t.Errorf("Wrong protocols")
+	}
+
+	boom := errors.New("boom")
+	mp.InjectSendError(boom)
+	m := mangos.NewMessage(0)
+	if err := mp.SendMsg(m); err != boom {
+		t.Errorf("Expected injected error, got %v", err)
+	}
+	mp.InjectSendError(nil)
+
+	mp.SetSendDelay(50 * time.Millisecond)
+	start := time.Now()
+	if err := mp.SendMsg(m); err != nil {
+		t.Fatalf("SendMsg failed: %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Send not delayed")
+	}
+	if got := mp.Sent(0); got != m {
+		t.Errorf("Wrong message sent")
+	}
+
+	mp.SetRecvDelay(50 * time.Millisecond)
+	if err := mp.Deliver(m); err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	start = time.Now()
+	if got := mp.RecvMsg(); got != m {
+		t.Errorf("Wrong message received")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Receive not delayed")
+	}
+
+	// Closing looks like a transport failure to the protocol.
+	done := make(chan *mangos.Message)
+	go func() {
+		done <- mp.RecvMsg()
+	}()
+	mp.Close()
+	if got := <-done; got != nil {
+		t.Errorf("RecvMsg returned message after close")
+	}
+	if err := mp.SendMsg(m); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := mp.Close(); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed on second close, got %v", err)
+	}
+	m.Free()
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func TestListenMultipleTransports(t *testing.T) {
+	addrs := []string{AddrTestTCP(), AddrTestIPC()}
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	if err = srv.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	for _, addr := range addrs {
+		if err = srv.Listen(addr); err != nil {
+			t.Fatalf("Listen %s failed: %v", addr, err)
+		}
+	}
+	// A failed Listen leaves the others alone.
+	if err = srv.Listen(addrs[0]); err == nil {
+		t.Errorf("Duplicate Listen succeeded")
+	}
+
+	var clients []mangos.Socket
+	for _, addr := range addrs {
+		cli, err := req.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make REQ: %v", err)
+		}
+		defer cli.Close()
+		if err = cli.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+			t.Fatalf("Failed SetOption: %v", err)
+		}
+		if err = cli.Dial(addr); err != nil {
+			t.Fatalf("Dial %s failed: %v", addr, err)
+		}
+		clients = append(clients, cli)
+	}
+
+	// Both requests are outstanding at once, so the replies must be
+	// routed back through the right pipes.
+	for i, cli := range clients {
+		if err = cli.Send([]byte(addrs[i])); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for range clients {
+		m, err := srv.RecvMsg()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if addr := m.Pipe.Address(); addr != string(m.Body) {
+			t.Errorf("Request for %q arrived on %q", m.Body, addr)
+		}
+		m.Body = append(m.Body, []byte(" reply")...)
+		if err = srv.SendMsg(m); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for i, cli := range clients {
+		b, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv on %s failed: %v", addrs[i], err)
+		}
+		if string(b) != addrs[i]+" reply" {
+			t.Errorf("Wrong reply on %s: %q", addrs[i], b)
+		}
+	}
+
+	// Close tears down every listener.
+	srv.Close()
+	for _, addr := range addrs {
+		cli, err := req.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make REQ: %v", err)
+		}
+		if err = cli.Dial(addr); err == nil {
+			t.Errorf("Dial %s succeeded after Close", addr)
+		}
+		cli.Close()
+	}
+}
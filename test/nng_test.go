@@ -0,0 +1,156 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+)
+
+// These are the bytes that NNG writes on a TCP connection.  NNG uses
+// the SP wire protocol as is: an 8 byte handshake, with the reserved
+// field zero, then messages, each a 64-bit big-endian length followed
+// by the SP header and the body.
+var (
+	nngReqHandshake = []byte{0x00, 'S', 'P', 0x00, 0x00, 0x30, 0x00, 0x00}
+	nngRepHandshake = []byte{0x00, 'S', 'P', 0x00, 0x00, 0x31, 0x00, 0x00}
+
+	// A request that came through a device, so the header has the
+	// pipe ID of the hop, then the request ID, with its high bit set.
+	nngRequest = []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+		0x00, 0x00, 0x00, 0x05,
+		0x80, 0x00, 0x00, 0x07,
+		'p', 'i', 'n', 'g',
+	}
+	// The reply that must go back: the same header, with a new body.
+	nngReply = []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+		0x00, 0x00, 0x00, 0x05,
+		0x80, 0x00, 0x00, 0x07,
+		'p', 'o', 'n', 'g',
+	}
+	// A reply as it reaches the REQ socket; the device took its hop
+	// off the header on the way back.
+	nngReplyDirect = []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08,
+		0x80, 0x00, 0x00, 0x07,
+		'p', 'o', 'n', 'g',
+	}
+)
+
+func TestNNGRepWire(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	c, err := net.Dial("tcp", hostPort(addr))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write(nngReqHandshake); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	hdr := make([]byte, 8)
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(hdr, nngRepHandshake) {
+		t.Errorf("Handshake is %v, NNG expects %v", hdr, nngRepHandshake)
+	}
+	if _, err = c.Write(nngRequest); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	b, err := s.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("Got %q", b)
+	}
+	if err = s.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	reply := make([]byte, len(nngReply))
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(reply, nngReply) {
+		t.Errorf("Reply is %v, expected %v", reply, nngReply)
+	}
+}
+
+func TestNNGReqWire(t *testing.T) {
+	// A raw REQ keeps the header, so it can be checked in full.
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", hostPort(addr))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write(nngRepHandshake)
+		c.Write(nngReplyDirect)
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	s, err := xreq.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make XREQ: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	m, err := s.RecvMsg()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	defer m.Free()
+	if !bytes.Equal(m.Header, nngReplyDirect[8:12]) {
+		t.Errorf("Header is %v, expected %v", m.Header, nngReplyDirect[8:12])
+	}
+	if string(m.Body) != "pong" {
+		t.Errorf("Body is %q", m.Body)
+	}
+}
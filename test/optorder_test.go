@@ -0,0 +1,84 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+)
+
+// testOptionOrder verifies that options set on a socket after Listen
+// apply to connections accepted afterwards, and that each connection
+// keeps the value that was current when it was established.
+func testOptionOrder(t *testing.T, addr string) {
+	srv, err := bus.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make server: %v", err)
+	}
+	defer srv.Close()
+
+	got := make(chan int, 2)
+	srv.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev != mangos.PipeEventAttached {
+			return
+		}
+		v, err := p.GetOption(mangos.OptionMaxRecvSize)
+		if err != nil {
+			t.Errorf("Failed pipe GetOption: %v", err)
+			return
+		}
+		got <- v.(int)
+	})
+
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+
+	for _, size := range []int{100, 200} {
+		if err = srv.SetOption(mangos.OptionMaxRecvSize, size); err != nil {
+			t.Fatalf("Failed SetOption: %v", err)
+		}
+
+		cli, err := bus.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make client: %v", err)
+		}
+		defer cli.Close()
+		if err = cli.Dial(addr); err != nil {
+			t.Fatalf("Failed dial: %v", err)
+		}
+
+		select {
+		case v := <-got:
+			if v != size {
+				t.Errorf("Pipe got max recv size %d, expected %d",
+					v, size)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for pipe")
+		}
+	}
+}
+
+func TestOptionOrderTCP(t *testing.T) {
+	testOptionOrder(t, AddrTestTCP())
+}
+
+func TestOptionOrderIPC(t *testing.T) {
+	testOptionOrder(t, AddrTestIPC())
+}
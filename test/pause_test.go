@@ -0,0 +1,98 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestPauseRecv(t *testing.T) {
+	addr := AddrTestTCP()
+	opts := map[string]interface{}{
+		mangos.OptionKeepAliveInterval: 10 * time.Millisecond,
+	}
+
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+	if err = rx.SetOption(mangos.OptionReadQLen, 1); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	if err = tx.SetOption(mangos.OptionWriteQLen, 1); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = tx.SetOption(mangos.OptionSendDeadline, 200*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = tx.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = tx.Send([]byte("first")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, rx, "first")
+
+	if err = rx.PauseRecv(); err != nil {
+		t.Fatalf("PauseRecv failed: %v", err)
+	}
+	// Sends fill the queues and connection buffers, and then block.
+	sent := 0
+	for ; sent < 4096; sent++ {
+		if err = tx.Send(make([]byte, 64*1024)); err != nil {
+			break
+		}
+	}
+	if err != mangos.ErrSendTimeout {
+		t.Fatalf("Send did not block after %d: %v", sent, err)
+	}
+
+	// Many keepalive intervals pass without the peer being heard.
+	time.Sleep(100 * time.Millisecond)
+	if err = rx.ResumeRecv(); err != nil {
+		t.Fatalf("ResumeRecv failed: %v", err)
+	}
+	for i := 0; i < sent; i++ {
+		b, err := rx.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d of %d failed: %v", i, sent, err)
+		}
+		if len(b) != 64*1024 {
+			t.Fatalf("Got %d bytes", len(b))
+		}
+	}
+	if err = tx.Send([]byte("last")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, rx, "last")
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+// testPeerCertificate sends a request from REQ to REP, and returns the
+// pipe that REP received it on.
+func testPeerCertificate(t *testing.T, addr string, lopts, dopts map[string]interface{}) mangos.Pipe {
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = srv.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+
+	if err = srv.ListenOptions(addr, lopts); err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+	if err = cli.DialOptions(addr, dopts); err != nil {
+		t.Fatalf("Failed dial: %v", err)
+	}
+	if err = cli.Send([]byte("hello")); err != nil {
+		t.Fatalf("Failed send: %v", err)
+	}
+	m, err := srv.RecvMsg()
+	if err != nil {
+		t.Fatalf("Failed recv: %v", err)
+	}
+	defer m.Free()
+	return m.Pipe
+}
+
+func TestPeerCertificateTLS(t *testing.T) {
+	scfg, err := GetTLSConfig(true)
+	if err != nil {
+		t.Fatalf("Failed to get server config: %v", err)
+	}
+	ccfg, err := GetTLSConfig(false)
+	if err != nil {
+		t.Fatalf("Failed to get client config: %v", err)
+	}
+	scfg = scfg.Clone()
+	scfg.ClientAuth = tls.RequireAnyClientCert
+
+	p := testPeerCertificate(t, AddrTestTLS(),
+		map[string]interface{}{mangos.OptionTLSConfig: scfg},
+		map[string]interface{}{mangos.OptionTLSConfig: ccfg})
+	cert := p.PeerCertificate()
+	if cert == nil {
+		t.Fatalf("No peer certificate")
+	}
+	if cn := cert.Subject.CommonName; cn != "client.mangos.example.com" {
+		t.Errorf("Wrong peer CN: %s", cn)
+	}
+}
+
+func TestPeerCertificateTCP(t *testing.T) {
+	p := testPeerCertificate(t, AddrTestTCP(), nil, nil)
+	if cert := p.PeerCertificate(); cert != nil {
+		t.Errorf("Got peer certificate on TCP: %v", cert.Subject)
+	}
+}
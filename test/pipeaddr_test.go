@@ -0,0 +1,68 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// testPipeAddr sends a message from a PUSH socket dialed to addr, and
+// checks the addresses of the Pipe it arrived on, as the receiver sees it.
+func testPipeAddr(t *testing.T, addr string, network string) {
+	rx := resolverPull(t, addr)
+	defer rx.Close()
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = tx.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := rx.RecvMsg()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	defer m.Free()
+
+	ra, la := m.Pipe.RemoteAddr(), m.Pipe.LocalAddr()
+	if ra == nil || la == nil {
+		t.Fatalf("Missing address: remote %v local %v", ra, la)
+	}
+	if ra.Network() != network || la.Network() != network {
+		t.Errorf("Got networks %q and %q, expected %q",
+			ra.Network(), la.Network(), network)
+	}
+	if ra.String() == "" {
+		t.Errorf("Remote address is empty")
+	}
+}
+
+func TestPipeAddrTCP(t *testing.T) {
+	testPipeAddr(t, AddrTestTCP(), "tcp")
+}
+
+func TestPipeAddrWS(t *testing.T) {
+	testPipeAddr(t, AddrTestWS(), "tcp")
+}
+
+func TestPipeAddrInp(t *testing.T) {
+	testPipeAddr(t, AddrTestInp(), "inproc")
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+)
+
+func TestBusMessagePipe(t *testing.T) {
+	addr := AddrTestTCP()
+	center, err := bus.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make BUS: %v", err)
+	}
+	defer center.Close()
+
+	var lock sync.Mutex
+	attached := make(map[uint32]mangos.Pipe)
+	center.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			lock.Lock()
+			attached[p.ID()] = p
+			lock.Unlock()
+		}
+	})
+	if err = center.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	// Metadata is only exchanged if both sides offer it.
+	md := map[string]string{}
+	opts := map[string]interface{}{mangos.OptionHandshakeMetadata: md}
+	if err = center.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	names := []string{"alpha", "beta", "gamma"}
+	var peers []mangos.Socket
+	for _, name := range names {
+		peer, err := bus.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make BUS: %v", err)
+		}
+		defer peer.Close()
+		md := map[string]string{"name": name}
+		opts := map[string]interface{}{mangos.OptionHandshakeMetadata: md}
+		if err = peer.DialOptions(addr, opts); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		peers = append(peers, peer)
+	}
+	for i := 0; ; i++ {
+		lock.Lock()
+		n := len(attached)
+		lock.Unlock()
+		if n == len(peers) {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Only %d pipes attached", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, peer := range peers {
+		if err = peer.Send([]byte(names[i])); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	seen := make(map[uint32]string)
+	for range peers {
+		m, err := center.RecvMsg()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if m.Pipe == nil {
+			t.Fatalf("Message has no Pipe")
+		}
+		id := m.Pipe.ID()
+		lock.Lock()
+		p := attached[id]
+		lock.Unlock()
+		if p != m.Pipe {
+			t.Errorf("Message from unknown pipe %x", id)
+		}
+		if name := m.Pipe.PeerMetadata()["name"]; name != string(m.Body) {
+			t.Errorf("Message %q attributed to %q", m.Body, name)
+		}
+		if prev, ok := seen[id]; ok {
+			t.Errorf("Pipe %x sent both %q and %q", id, prev, m.Body)
+		}
+		seen[id] = string(m.Body)
+		m.Free()
+	}
+}
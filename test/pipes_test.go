@@ -0,0 +1,99 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestSocketPipes(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer srv.Close()
+	if err = srv.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+	if n := len(srv.Pipes()); n != 0 {
+		t.Errorf("Got %d pipes before connecting", n)
+	}
+
+	// Snapshots may be taken while peers come and go.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				srv.Pipes()
+			}
+		}
+	}()
+
+	const peers = 3
+	for i := 0; i < peers; i++ {
+		cli, err := push.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make PUSH: %v", err)
+		}
+		defer cli.Close()
+		if err = cli.Dial(addr); err != nil {
+			t.Fatalf("Failed dial: %v", err)
+		}
+		if err = cli.Send([]byte("hello")); err != nil {
+			t.Fatalf("Failed send: %v", err)
+		}
+		if _, err = srv.Recv(); err != nil {
+			t.Fatalf("Failed recv: %v", err)
+		}
+	}
+	close(stop)
+	<-done
+
+	infos := srv.Pipes()
+	if len(infos) != peers {
+		t.Fatalf("Got %d pipes, expected %d", len(infos), peers)
+	}
+	ids := make(map[uint32]bool)
+	for _, info := range infos {
+		ids[info.ID] = true
+		if info.RemoteProtocol != mangos.ProtoPush {
+			t.Errorf("Wrong remote protocol %d", info.RemoteProtocol)
+		}
+		if a, ok := info.RemoteAddr.(*net.TCPAddr); !ok || !a.IP.IsLoopback() {
+			t.Errorf("Wrong remote address %v", info.RemoteAddr)
+		}
+		if info.Stats.RxMsgs != 1 || info.Stats.RxBytes != 5 {
+			t.Errorf("Wrong stats %+v", info.Stats)
+		}
+	}
+	if len(ids) != peers {
+		t.Errorf("Pipe IDs are not distinct: %v", ids)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+// priorityServer starts a REP socket on addr that answers every request
+// with name.
+func priorityServer(t *testing.T, addr string, name string) mangos.Socket {
+	s, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	if err = s.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			if _, err := s.Recv(); err != nil {
+				return
+			}
+			if err := s.Send([]byte(name)); err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func TestPipePriority(t *testing.T) {
+	addrA := AddrTestTCP()
+	addrB := AddrTestTCP()
+	srvA := priorityServer(t, addrA, "primary")
+	srvB := priorityServer(t, addrB, "standby")
+	defer srvB.Close()
+
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = cli.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	attached := make(chan string, 10)
+	cli.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			attached <- p.Address()
+		}
+	})
+
+	d, err := cli.NewDialer(addrA, map[string]interface{}{
+		mangos.OptionPipePriority:  1,
+		mangos.OptionReconnectTime: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	if v, err := d.GetOption(mangos.OptionPipePriority); err != nil || v.(int) != 1 {
+		t.Errorf("GetOption got %v %v", v, err)
+	}
+	if err = d.SetOption(mangos.OptionPipePriority, "high"); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = d.Dial(); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = cli.Dial(addrB); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	waitAttached := func(addr string) {
+		for {
+			select {
+			case a := <-attached:
+				if a == addr {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("No pipe to %s", addr)
+			}
+		}
+	}
+	waitAttached(addrA)
+
+	expect := func(name string) {
+		for i := 0; i < 10; i++ {
+			if err := cli.Send([]byte("ping")); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			b, err := cli.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			if string(b) != name {
+				t.Fatalf("Request %d answered by %s, expected %s",
+					i, b, name)
+			}
+		}
+	}
+	expect("primary")
+
+	// The standby takes over once the primary is lost.
+	srvA.Close()
+	expect("standby")
+
+	// And traffic shifts back once the primary returns.
+	srvA = priorityServer(t, addrA, "primary")
+	defer srvA.Close()
+	waitAttached(addrA)
+	expect("primary")
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/star"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+	"nanomsg.org/go/mangos/v2/protocol/xbus"
+	"nanomsg.org/go/mangos/v2/protocol/xpair"
+	"nanomsg.org/go/mangos/v2/protocol/xpub"
+	"nanomsg.org/go/mangos/v2/protocol/xpull"
+	"nanomsg.org/go/mangos/v2/protocol/xpush"
+	"nanomsg.org/go/mangos/v2/protocol/xrep"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+	"nanomsg.org/go/mangos/v2/protocol/xrespondent"
+	"nanomsg.org/go/mangos/v2/protocol/xstar"
+	"nanomsg.org/go/mangos/v2/protocol/xsub"
+	"nanomsg.org/go/mangos/v2/protocol/xsurveyor"
+)
+
+func TestProtocolNames(t *testing.T) {
+	canonical := map[uint16]string{
+		mangos.ProtoPair:       "pair",
+		mangos.ProtoPub:        "pub",
+		mangos.ProtoSub:        "sub",
+		mangos.ProtoReq:        "req",
+		mangos.ProtoRep:        "rep",
+		mangos.ProtoPush:       "push",
+		mangos.ProtoPull:       "pull",
+		mangos.ProtoSurveyor:   "surveyor",
+		mangos.ProtoRespondent: "respondent",
+		mangos.ProtoBus:        "bus",
+		mangos.ProtoStar:       "star",
+	}
+	for num, name := range canonical {
+		if got := mangos.ProtocolName(num); got != name {
+			t.Errorf("Protocol %d is %q, expected %q", num, got, name)
+		}
+	}
+
+	for _, f := range []func() (mangos.Socket, error){
+		bus.NewSocket, pair.NewSocket, pub.NewSocket, sub.NewSocket,
+		req.NewSocket, rep.NewSocket, push.NewSocket, pull.NewSocket,
+		surveyor.NewSocket, respondent.NewSocket, star.NewSocket,
+		xbus.NewSocket, xpair.NewSocket, xpub.NewSocket, xsub.NewSocket,
+		xreq.NewSocket, xrep.NewSocket, xpush.NewSocket, xpull.NewSocket,
+		xsurveyor.NewSocket, xrespondent.NewSocket, xstar.NewSocket,
+	} {
+		sock, err := f()
+		if err != nil {
+			t.Fatalf("Failed to make socket: %v", err)
+		}
+		info := sock.Info()
+		if canonical[info.Self] != info.SelfName {
+			t.Errorf("Protocol %d calls itself %q", info.Self, info.SelfName)
+		}
+		if canonical[info.Peer] != info.PeerName {
+			t.Errorf("Protocol %d calls its peer %q", info.Peer, info.PeerName)
+		}
+		sock.Close()
+	}
+
+	if got := mangos.ProtocolName(0x1234); got != "unknown(0x1234)" {
+		t.Errorf("Wrong unknown name: %q", got)
+	}
+	mangos.RegisterProtocolName(0x1234, "custom")
+	if got := mangos.ProtocolName(0x1234); got != "custom" {
+		t.Errorf("Registered name not used: %q", got)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+// benchmarkPubFanout publishes to many subscribers.  Each message is
+// serialized only once by PUB, regardless of the number of subscribers,
+// which is visible in the allocations reported.
+func benchmarkPubFanout(b *testing.B, nsub int) {
+	addr := AddrTestTCP()
+	p, err := pub.NewSocket()
+	if err != nil {
+		b.Fatalf("Failed to make PUB: %v", err)
+	}
+	defer p.Close()
+	if err = p.Listen(addr); err != nil {
+		b.Fatalf("Listen failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	subs := make([]mangos.Socket, 0, nsub)
+	defer func() {
+		for _, s := range subs {
+			s.Close()
+		}
+		wg.Wait()
+	}()
+	for i := 0; i < nsub; i++ {
+		s, err := sub.NewSocket()
+		if err != nil {
+			b.Fatalf("Failed to make SUB: %v", err)
+		}
+		subs = append(subs, s)
+		s.SetOption(mangos.OptionSubscribe, []byte{})
+		if err = s.Dial(addr); err != nil {
+			b.Fatalf("Dial failed: %v", err)
+		}
+		wg.Add(1)
+		go func(s mangos.Socket) {
+			defer wg.Done()
+			for {
+				m, err := s.RecvMsg()
+				if err != nil {
+					return
+				}
+				m.Free()
+			}
+		}(s)
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	body := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = p.Send(body); err != nil {
+			b.Fatalf("Send failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkPubFanout1000TCP(b *testing.B) {
+	benchmarkPubFanout(b, 1000)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// rateLimitRun sends count messages of size bytes from a PUSH socket to
+// a PULL socket with the given option set, and returns how long it took
+// to receive them all.
+func rateLimitRun(t *testing.T, opt string, limit int, count int, size int) time.Duration {
+	addr := AddrTestTCP()
+	rx := resolverPull(t, addr)
+	defer rx.Close()
+	if err := rx.SetOption(opt, limit); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	go func() {
+		for i := 0; i < count; i++ {
+			if tx.Send(make([]byte, size)) != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if _, err = rx.Recv(); err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestRecvRateLimit(t *testing.T) {
+	// The first second's worth arrives at once, the other 50 at 100/s.
+	d := rateLimitRun(t, mangos.OptionRecvRateLimit, 100, 150, 8)
+	if d < 400*time.Millisecond {
+		t.Errorf("Received too fast: %v", d)
+	}
+	if d > 3*time.Second {
+		t.Errorf("Received too slow: %v", d)
+	}
+}
+
+func TestRecvByteRateLimit(t *testing.T) {
+	// 40000 bytes at 20000 bytes/s, after the first 20000 at once.
+	d := rateLimitRun(t, mangos.OptionRecvByteRateLimit, 20000, 40, 1000)
+	if d < 900*time.Millisecond {
+		t.Errorf("Received too fast: %v", d)
+	}
+	if d > 4*time.Second {
+		t.Errorf("Received too slow: %v", d)
+	}
+}
+
+func TestRecvRateLimitOptions(t *testing.T) {
+	s := resolverPull(t, AddrTestTCP())
+	defer s.Close()
+	for _, opt := range []string{
+		mangos.OptionRecvRateLimit,
+		mangos.OptionRecvByteRateLimit,
+	} {
+		if v, err := s.GetOption(opt); err != nil || v.(int) != 0 {
+			t.Errorf("%s default: %v %v", opt, v, err)
+		}
+		if err := s.SetOption(opt, -1); err != mangos.ErrBadValue {
+			t.Errorf("%s negative: %v", opt, err)
+		}
+		if err := s.SetOption(opt, "fast"); err != mangos.ErrBadValue {
+			t.Errorf("%s string: %v", opt, err)
+		}
+		if err := s.SetOption(opt, 50); err != nil {
+			t.Errorf("%s set: %v", opt, err)
+		}
+		if v, err := s.GetOption(opt); err != nil || v.(int) != 50 {
+			t.Errorf("%s get: %v %v", opt, v, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+)
+
+func TestRecvBatch(t *testing.T) {
+	addr := AddrTestTCP()
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		if err = tx.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err = tx.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	// Give the receiver time to queue them all.
+	time.Sleep(100 * time.Millisecond)
+
+	msgs, err := rx.RecvBatch(10)
+	if err != nil {
+		t.Fatalf("RecvBatch failed: %v", err)
+	}
+	if len(msgs) != count {
+		t.Fatalf("Got %d messages, expected %d", len(msgs), count)
+	}
+	for i, m := range msgs {
+		if string(m.Body) != fmt.Sprintf("%d", i) {
+			t.Errorf("Got %q, expected %d", m.Body, i)
+		}
+		m.Free()
+	}
+
+	// Nothing is left, so the next batch times out waiting for the first.
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if _, err = rx.RecvBatch(10); err != mangos.ErrRecvTimeout {
+		t.Errorf("Expected ErrRecvTimeout, got %v", err)
+	}
+	if _, err = rx.RecvBatch(0); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+}
+
+func TestRecvBatchLimit(t *testing.T) {
+	addr := AddrTestTCP()
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = tx.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err = tx.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	msgs, err := rx.RecvBatch(3)
+	if err != nil {
+		t.Fatalf("RecvBatch failed: %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("Got %d messages, expected 3", len(msgs))
+	}
+	msgs, err = rx.RecvBatch(3)
+	if err != nil {
+		t.Fatalf("RecvBatch failed: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Got %d messages, expected 2", len(msgs))
+	}
+}
+
+func TestRecvBatchNotSupported(t *testing.T) {
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer sock.Close()
+	if _, err = sock.RecvBatch(10); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+}
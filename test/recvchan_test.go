@@ -0,0 +1,192 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func TestRecvChan(t *testing.T) {
+	var rxs, txs [2]mangos.Socket
+	for i := range rxs {
+		addr := AddrTestInp()
+		rxs[i] = resolverPull(t, addr)
+		defer rxs[i].Close()
+		tx, err := push.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make PUSH: %v", err)
+		}
+		defer tx.Close()
+		if err = tx.Dial(addr); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		txs[i] = tx
+	}
+	if rxs[0].RecvChan() != rxs[0].RecvChan() {
+		t.Errorf("RecvChan returned different channels")
+	}
+
+	want := []string{"one", "two", "one", "one", "two"}
+	for _, w := range want {
+		tx := txs[0]
+		if w == "two" {
+			tx = txs[1]
+		}
+		if err := tx.Send([]byte(w)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	got := map[string]int{}
+	for range want {
+		select {
+		case r := <-rxs[0].RecvChan():
+			if r.Err != nil || string(r.Msg.Body) != "one" {
+				t.Fatalf("Socket one got %v %v", r.Msg, r.Err)
+			}
+			got["one"]++
+			r.Msg.Free()
+		case r := <-rxs[1].RecvChan():
+			if r.Err != nil || string(r.Msg.Body) != "two" {
+				t.Fatalf("Socket two got %v %v", r.Msg, r.Err)
+			}
+			got["two"]++
+			r.Msg.Free()
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out, got %v", got)
+		}
+	}
+	if got["one"] != 3 || got["two"] != 2 {
+		t.Errorf("Wrong messages: %v", got)
+	}
+
+	// The receive deadline is reported through the channel.
+	select {
+	case r := <-rxs[0].RecvChan():
+		if r.Err != mangos.ErrRecvTimeout || r.Msg != nil {
+			t.Errorf("Expected ErrRecvTimeout, got %v %v", r.Msg, r.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No timeout delivered")
+	}
+
+	// Closing the socket closes the channel, even with a message
+	// waiting in it.
+	if err := txs[1].Send([]byte("lost")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ch := rxs[1].RecvChan()
+	rxs[1].Close()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				return
+			}
+			if r.Msg != nil {
+				r.Msg.Free()
+			}
+			continue
+		case <-deadline:
+			t.Fatalf("Channel not closed")
+		}
+	}
+}
+
+func TestRecvChanClosed(t *testing.T) {
+	s, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	s.Close()
+	if _, ok := <-s.RecvChan(); ok {
+		t.Errorf("Channel not closed")
+	}
+
+	// PUSH cannot receive, so the channel is closed after the error.
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	ch := tx.RecvChan()
+	if r := <-ch; r.Err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", r.Err)
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("Channel not closed")
+	}
+}
+
+func TestRecvChanProtoState(t *testing.T) {
+	addr := AddrTestInp()
+	srv := roundTripServer(t, addr, 0)
+	defer srv.Close()
+	s, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer s.Close()
+	if err = s.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// With no request outstanding, the error repeats, but slowly.
+	n := 0
+	stop := time.After(300 * time.Millisecond)
+drain:
+	for {
+		select {
+		case r := <-s.RecvChan():
+			if r.Err != mangos.ErrProtoState {
+				t.Fatalf("Expected ErrProtoState, got %v %v", r.Msg, r.Err)
+			}
+			n++
+		case <-stop:
+			break drain
+		}
+	}
+	if n == 0 || n > 20 {
+		t.Errorf("Got %d errors in 300ms", n)
+	}
+
+	// Once a request is sent, the reply arrives on the same channel.
+	if err = s.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case r := <-s.RecvChan():
+			if r.Err == mangos.ErrProtoState {
+				continue
+			}
+			if r.Err != nil || string(r.Msg.Body) != "ping" {
+				t.Fatalf("Got %v %v", r.Msg, r.Err)
+			}
+			r.Msg.Free()
+			return
+		case <-timeout:
+			t.Fatalf("Timed out waiting for reply")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+)
+
+// idlePair returns a connected pair of PAIR sockets, the first of which
+// calls hook when idle for 50 msec, and a channel that reports when
+// its pipe is detached.
+func idlePair(t *testing.T, hook mangos.RecvIdleHook) (mangos.Socket, mangos.Socket, chan struct{}) {
+	addr := AddrTestTCP()
+	s1, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	s2, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	detached := make(chan struct{})
+	var once sync.Once
+	s1.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventDetached {
+			once.Do(func() { close(detached) })
+		}
+	})
+	if err = s1.SetOption(mangos.OptionRecvIdleTimeout, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s1.SetOption(mangos.OptionRecvIdleHook, hook); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s1.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s1.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = s2.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	return s1, s2, detached
+}
+
+func TestRecvIdleHook(t *testing.T) {
+	var lock sync.Mutex
+	var count int
+	var pipe mangos.Pipe
+	s1, s2, detached := idlePair(t, func(p mangos.Pipe) {
+		lock.Lock()
+		count++
+		pipe = p
+		lock.Unlock()
+	})
+	defer s1.Close()
+	defer s2.Close()
+
+	// The peer says nothing, so the hook fires repeatedly.
+	time.Sleep(400 * time.Millisecond)
+	lock.Lock()
+	n := count
+	lock.Unlock()
+	if n < 3 {
+		t.Errorf("Idle hook only called %d times", n)
+	}
+	select {
+	case <-detached:
+		t.Fatalf("Idle pipe was closed")
+	default:
+	}
+
+	// And the pipe still works.
+	if err := s2.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := s1.RecvMsg()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "ping" {
+		t.Errorf("Wrong message: %q", m.Body)
+	}
+	lock.Lock()
+	if pipe != m.Pipe {
+		t.Errorf("Hook called with wrong pipe")
+	}
+	lock.Unlock()
+	m.Free()
+}
+
+func TestRecvIdleHookClose(t *testing.T) {
+	s1, s2, detached := idlePair(t, func(p mangos.Pipe) {
+		p.Close()
+	})
+	defer s1.Close()
+	defer s2.Close()
+
+	select {
+	case <-detached:
+	case <-time.After(time.Second):
+		t.Fatalf("Hook did not close the pipe")
+	}
+}
+
+func TestRecvIdleOptions(t *testing.T) {
+	sock, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer sock.Close()
+	if err = sock.SetOption(mangos.OptionRecvIdleTimeout, -time.Second); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = sock.SetOption(mangos.OptionRecvIdleHook, func(mangos.Pipe) {}); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = sock.SetOption(mangos.OptionRecvIdleTimeout, time.Second); err != nil {
+		t.Errorf("SetOption failed: %v", err)
+	}
+	if v, err := sock.GetOption(mangos.OptionRecvIdleTimeout); err != nil || v != time.Second {
+		t.Errorf("Bad idle timeout: %v %v", v, err)
+	}
+}
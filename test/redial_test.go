@@ -0,0 +1,148 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/bus"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	_ "nanomsg.org/go/mangos/v2/transport/tcp"
+)
+
+func TestRedialLateListener(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, _ := bus.NewSocket()
+	defer srv.Close()
+	cli, _ := bus.NewSocket()
+	defer cli.Close()
+
+	opts := map[string]interface{}{
+		mangos.OptionDialAsynch:       true,
+		mangos.OptionReconnectTime:    time.Millisecond * 10,
+		mangos.OptionMaxReconnectTime: time.Millisecond * 50,
+	}
+	if err := cli.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// Several attempts will fail before the listener shows up.
+	time.Sleep(time.Millisecond * 200)
+	if err := srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	srv.SetOption(mangos.OptionRecvDeadline, time.Second)
+	b, err := srv.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("Wrong message: %q", b)
+	}
+}
+
+func TestRedialIncompatible(t *testing.T) {
+	addr := AddrTestTCP()
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	// Pretend to be a PULL peer, which PUB cannot talk to.
+	var accepts int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepts, 1)
+			c.Write([]byte{0, 'S', 'P', 0, 0, 0x51, 0, 0})
+			go func() {
+				var b [8]byte
+				c.Read(b[:])
+				c.Close()
+			}()
+		}
+	}()
+
+	sock, _ := pub.NewSocket()
+	defer sock.Close()
+	opts := map[string]interface{}{
+		mangos.OptionDialAsynch:    true,
+		mangos.OptionReconnectTime: time.Millisecond * 10,
+	}
+	if err = sock.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	if n := atomic.LoadInt32(&accepts); n != 1 {
+		t.Errorf("Expected a single attempt, got %d", n)
+	}
+}
+
+func TestRedialJitter(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, _ := bus.NewSocket()
+	defer srv.Close()
+	cli, _ := bus.NewSocket()
+	defer cli.Close()
+
+	for _, v := range []interface{}{-0.1, 1.5, "garbage"} {
+		if err := cli.SetOption(mangos.OptionReconnectJitter, v); err != mangos.ErrBadValue {
+			t.Errorf("Expected ErrBadValue for %v, got %v", v, err)
+		}
+	}
+	if err := cli.SetOption(mangos.OptionReconnectJitter, 0.2); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if v, err := cli.GetOption(mangos.OptionReconnectJitter); err != nil || v.(float64) != 0.2 {
+		t.Errorf("GetOption got %v %v", v, err)
+	}
+
+	opts := map[string]interface{}{
+		mangos.OptionDialAsynch:       true,
+		mangos.OptionReconnectTime:    time.Millisecond * 10,
+		mangos.OptionMaxReconnectTime: time.Millisecond * 50,
+		mangos.OptionReconnectJitter:  0.5,
+	}
+	if err := cli.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	srv.SetOption(mangos.OptionRecvDeadline, time.Second)
+	if _, err := srv.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+}
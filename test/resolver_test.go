@@ -0,0 +1,174 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// stubResolver returns whatever addresses it was last given, and counts
+// how often it was asked.
+type stubResolver struct {
+	sync.Mutex
+	addrs []string
+	calls int
+}
+
+func (r *stubResolver) set(addrs ...string) {
+	r.Lock()
+	r.addrs = addrs
+	r.Unlock()
+}
+
+func (r *stubResolver) Resolve(_ context.Context, addr string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls++
+	if addr != "service.invalid:4444" {
+		return nil, mangos.ErrBadAddr
+	}
+	return append([]string{}, r.addrs...), nil
+}
+
+func hostPort(addr string) string {
+	return strings.TrimPrefix(addr, "tcp://")
+}
+
+func resolverPull(t *testing.T, addr string) mangos.Socket {
+	s, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	if err = s.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = s.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	return s
+}
+
+func resolverRecv(t *testing.T, s mangos.Socket, want string) {
+	m, err := s.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m) != want {
+		t.Fatalf("Got %q, expected %q", m, want)
+	}
+}
+
+func TestResolverFollows(t *testing.T) {
+	addrA := AddrTestTCP()
+	addrB := AddrTestTCP()
+	rxA := resolverPull(t, addrA)
+	defer rxA.Close()
+	rxB := resolverPull(t, addrB)
+	defer rxB.Close()
+
+	r := &stubResolver{}
+	r.set(hostPort(addrA))
+
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	if err = tx.SetOption(mangos.OptionReconnectTime, 10*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = tx.DialOptions("tcp://service.invalid:4444", map[string]interface{}{
+		mangos.OptionResolver: r,
+	}); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = tx.Send([]byte("one")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, rxA, "one")
+
+	// The service moves; once the old instance goes away, the
+	// redial must find the new one.
+	r.set(hostPort(addrB))
+	rxA.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if err = tx.Send([]byte("two")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, rxB, "two")
+
+	r.Lock()
+	calls := r.calls
+	r.Unlock()
+	if calls < 2 {
+		t.Errorf("Resolver called %d times, expected at least 2", calls)
+	}
+}
+
+func TestResolverSkipsDead(t *testing.T) {
+	dead := AddrTestTCP()
+	addr := AddrTestTCP()
+	rx := resolverPull(t, addr)
+	defer rx.Close()
+
+	r := &stubResolver{}
+	r.set(hostPort(dead), hostPort(addr))
+
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	// Synchronous dials try every address before giving up.
+	if err = tx.DialOptions("tcp://service.invalid:4444", map[string]interface{}{
+		mangos.OptionResolver: r,
+	}); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = tx.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, rx, "hello")
+}
+
+func TestResolverEmpty(t *testing.T) {
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	r := mangos.ResolverFunc(func(context.Context, string) ([]string, error) {
+		return nil, nil
+	})
+	if err = tx.DialOptions("tcp://service.invalid:4444", map[string]interface{}{
+		mangos.OptionResolver: r,
+	}); err != mangos.ErrConnRefused {
+		t.Errorf("Dial got %v, expected ErrConnRefused", err)
+	}
+	if err = tx.DialOptions("tcp://service.invalid", map[string]interface{}{
+		mangos.OptionResolver: r,
+	}); err != mangos.ErrBadAddr {
+		t.Errorf("Dial got %v, expected ErrBadAddr", err)
+	}
+}
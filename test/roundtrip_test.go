@@ -0,0 +1,224 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+// roundTripServer starts a REP socket on addr that answers each request
+// with its own body, after waiting for delay if the request is "slow".
+func roundTripServer(t *testing.T, addr string, delay time.Duration) mangos.Socket {
+	s, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	if err = s.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			b, err := s.Recv()
+			if err != nil {
+				return
+			}
+			if string(b) == "slow" {
+				time.Sleep(delay)
+			}
+			if err = s.Send(b); err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func roundTripMsg(body string) *mangos.Message {
+	m := mangos.NewMessage(len(body))
+	m.Body = append(m.Body, body...)
+	return m
+}
+
+func TestRoundTrip(t *testing.T) {
+	addr := AddrTestTCP()
+	srv := roundTripServer(t, addr, 200*time.Millisecond)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, body := range []string{"one", "two"} {
+		m, err := cli.RoundTrip(ctx, roundTripMsg(body))
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		if string(m.Body) != body {
+			t.Errorf("Got reply %q to %q", m.Body, body)
+		}
+		m.Free()
+	}
+}
+
+func TestRoundTripTimeout(t *testing.T) {
+	addr := AddrTestTCP()
+	srv := roundTripServer(t, addr, 200*time.Millisecond)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = cli.RoundTrip(ctx, roundTripMsg("slow")); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("RoundTrip took %v", d)
+	}
+
+	// The late reply to the slow request is not mistaken for this one.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := cli.RoundTrip(ctx, roundTripMsg("fast"))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	if string(m.Body) != "fast" {
+		t.Errorf("Got reply %q", m.Body)
+	}
+	m.Free()
+}
+
+func TestRoundTripPipeLost(t *testing.T) {
+	// The first server drops the connection instead of replying, so
+	// the request must be sent again to the second.
+	addrA := AddrTestTCP()
+	addrB := AddrTestTCP()
+	srvA, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srvA.Close()
+	if err = srvA.Listen(addrA); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		m, err := srvA.RecvMsg()
+		if err == nil {
+			m.Pipe.Close()
+			m.Free()
+		}
+	}()
+
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = cli.Dial(addrA); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errq := make(chan error, 1)
+	go func() {
+		m, err := cli.RoundTrip(ctx, roundTripMsg("hello"))
+		if err == nil {
+			m.Free()
+		}
+		errq <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	srvB := roundTripServer(t, addrB, 0)
+	defer srvB.Close()
+	if err = cli.Dial(addrB); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = <-errq; err != nil {
+		t.Errorf("RoundTrip failed: %v", err)
+	}
+}
+
+func TestRoundTripShutdown(t *testing.T) {
+	addr := AddrTestTCP()
+	srv := roundTripServer(t, addr, 200*time.Millisecond)
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replies := make(chan error, 1)
+	go func() {
+		m, err := cli.RoundTrip(ctx, roundTripMsg("slow"))
+		if err == nil {
+			m.Free()
+		}
+		replies <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Shutdown waits for the round trip to finish.
+	if err = cli.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	select {
+	case err = <-replies:
+		if err != nil {
+			t.Errorf("RoundTrip failed: %v", err)
+		}
+	default:
+		t.Errorf("Shutdown returned before the reply")
+	}
+}
+
+func TestRoundTripNotReq(t *testing.T) {
+	s, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer s.Close()
+	m := roundTripMsg("hello")
+	if _, err = s.RoundTrip(context.Background(), m); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+	m.Free()
+}
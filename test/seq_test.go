@@ -0,0 +1,149 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pull"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+type seqGap struct {
+	want, got uint64
+}
+
+func TestSeqGapHook(t *testing.T) {
+	s, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	var lock sync.Mutex
+	var gaps []seqGap
+	if err = s.SetOption(mangos.OptionSeqGapHook, "garbage"); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	hook := mangos.SeqGapHook(func(p mangos.Pipe, want, got uint64) {
+		lock.Lock()
+		gaps = append(gaps, seqGap{want, got})
+		lock.Unlock()
+	})
+	if err = s.SetOption(mangos.OptionSeqGapHook, hook); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	l, err := s.NewListener(AddrTestTCP(), map[string]interface{}{
+		mangos.OptionSeqHeader: true,
+	})
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Pretend to be a PUSH peer that offers sequence numbers, and
+	// then loses message 3.
+	c, err := net.Dial("tcp", hostPort(l.Address()))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	hdr := []byte{0, 'S', 'P', 0, 0, byte(mangos.ProtoPush), 1, 0}
+	if _, err = c.Write(hdr); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if hdr[6]&1 == 0 {
+		t.Fatalf("Sequence numbers not offered: %v", hdr)
+	}
+	seqs := []uint64{1, 2, 4, 5}
+	for _, seq := range seqs {
+		frame := make([]byte, 19)
+		binary.BigEndian.PutUint64(frame, 11)
+		binary.BigEndian.PutUint64(frame[8:], seq)
+		copy(frame[16:], "msg")
+		if _, err = c.Write(frame); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	for _, seq := range seqs {
+		m, err := s.RecvMsg()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if m.Seq != seq || string(m.Body) != "msg" {
+			t.Errorf("Got %q with sequence %d, expected %d",
+				m.Body, m.Seq, seq)
+		}
+		m.Free()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(gaps) != 1 || gaps[0] != (seqGap{3, 4}) {
+		t.Errorf("Wrong gaps reported: %v", gaps)
+	}
+}
+
+func TestSeqHeader(t *testing.T) {
+	addr := AddrTestTCP()
+	opts := map[string]interface{}{mangos.OptionSeqHeader: true}
+	rx, err := pull.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PULL: %v", err)
+	}
+	defer rx.Close()
+	hook := mangos.SeqGapHook(func(p mangos.Pipe, want, got uint64) {
+		t.Errorf("Unexpected gap: %d %d", want, got)
+	})
+	if err = rx.SetOption(mangos.OptionSeqGapHook, hook); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = rx.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	tx, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer tx.Close()
+	if err = tx.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if err = tx.Send([]byte("hello")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		m, err := rx.RecvMsg()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if m.Seq != i {
+			t.Errorf("Got sequence %d, expected %d", m.Seq, i)
+		}
+		m.Free()
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/xreq"
+)
+
+func TestSetRawDevice(t *testing.T) {
+	front, back := AddrTestTCP(), AddrTestTCP()
+
+	// The REP socket is switched to raw, and made into a device.
+	drep, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer drep.Close()
+	if v, _ := drep.GetOption(mangos.OptionRaw); v.(bool) {
+		t.Fatalf("REP started raw")
+	}
+	if err = drep.SetRaw(true); err != nil {
+		t.Fatalf("SetRaw failed: %v", err)
+	}
+	if v, _ := drep.GetOption(mangos.OptionRaw); !v.(bool) {
+		t.Fatalf("REP is not raw")
+	}
+	dreq, err := xreq.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make XREQ: %v", err)
+	}
+	defer dreq.Close()
+	if err = mangos.Device(drep, dreq); err != nil {
+		t.Fatalf("Device failed: %v", err)
+	}
+
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+
+	for _, s := range []mangos.Socket{srv, cli} {
+		if err = s.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+			t.Fatalf("Failed SetOption: %v", err)
+		}
+	}
+	if err = drep.Listen(front); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = srv.Listen(back); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = dreq.Dial(back); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = cli.Dial(front); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// The request and reply pass through the device verbatim, so the
+	// REQ sees the reply to its own request.
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	b, err := srv.Recv()
+	if err != nil {
+		t.Fatalf("Recv request failed: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("Got request %q", b)
+	}
+	if err = srv.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send reply failed: %v", err)
+	}
+	if b, err = cli.Recv(); err != nil {
+		t.Fatalf("Recv reply failed: %v", err)
+	}
+	if string(b) != "pong" {
+		t.Errorf("Got reply %q", b)
+	}
+}
+
+func TestSetRawBusy(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+
+	for _, s := range []mangos.Socket{srv, cli} {
+		if err = s.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+			t.Fatalf("Failed SetOption: %v", err)
+		}
+	}
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err = srv.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+
+	// A reply is owed, so the mode cannot change.
+	if err = srv.SetRaw(true); err != mangos.ErrBusy {
+		t.Errorf("Expected ErrBusy, got %v", err)
+	}
+	if err = srv.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err = cli.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if err = srv.SetRaw(true); err != nil {
+		t.Errorf("SetRaw failed: %v", err)
+	}
+	if err = srv.SetRaw(false); err != nil {
+		t.Errorf("SetRaw failed: %v", err)
+	}
+}
+
+func TestSetRawNotSupported(t *testing.T) {
+	sock, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer sock.Close()
+	if err = sock.SetRaw(true); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+}
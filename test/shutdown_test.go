@@ -0,0 +1,157 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+// shutdownPair returns a REP socket listening on addr, and a REQ socket
+// connected to it, which has sent a request that REP has received.
+func shutdownPair(t *testing.T, addr string) (mangos.Socket, mangos.Socket) {
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	for _, s := range []mangos.Socket{srv, cli} {
+		if err = s.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+			t.Fatalf("Failed SetOption: %v", err)
+		}
+	}
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = cli.Send([]byte("request")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err = srv.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	return srv, cli
+}
+
+func TestShutdownPendingRecv(t *testing.T) {
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	if err = sock.Listen(AddrTestTCP()); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	errq := make(chan error, 1)
+	go func() {
+		_, err := sock.Recv()
+		errq <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = sock.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown waited for Recv: %v", d)
+	}
+	select {
+	case err = <-errq:
+		if err != mangos.ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Recv did not return")
+	}
+	if err = sock.Shutdown(ctx); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err = sock.Close(); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestShutdownWaitsForReply(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, cli := shutdownPair(t, addr)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// No new connections are accepted while draining.
+	if c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://")); err == nil {
+		c.Close()
+		t.Errorf("Connection accepted during Shutdown")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown did not wait for reply: %v", err)
+	default:
+	}
+
+	if err := srv.Send([]byte("reply")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown did not finish")
+	}
+	b, err := cli.Recv()
+	if err != nil {
+		t.Fatalf("Reply lost: %v", err)
+	}
+	if string(b) != "reply" {
+		t.Errorf("Wrong reply: %q", b)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv, cli := shutdownPair(t, AddrTestTCP())
+	defer cli.Close()
+
+	// The reply is never sent.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if err := srv.Send([]byte("late")); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -222,3 +222,59 @@ func TestStarTTLSet(t *testing.T) {
 func TestStarTTLDrop(t *testing.T) {
 	TTLDropTest(t, star.NewSocket, star.NewSocket, xstar.NewSocket, xstar.NewSocket)
 }
+
+func TestStarExactlyOnce(t *testing.T) {
+	// Four nodes in a chain, 0-1-2-3, so that messages must be
+	// forwarded over several hops to reach everyone.
+	const num = 4
+	socks := make([]mangos.Socket, num)
+	for i := range socks {
+		s, err := star.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make STAR: %v", err)
+		}
+		defer s.Close()
+		socks[i] = s
+	}
+	for i := 0; i < num-1; i++ {
+		addr := AddrTestTCP()
+		if err := socks[i].Listen(addr); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		if err := socks[i+1].Dial(addr); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for from := 0; from < num; from++ {
+		body := []byte{byte(from)}
+		if err := socks[from].Send(body); err != nil {
+			t.Fatalf("Send from %d failed: %v", from, err)
+		}
+		for i, s := range socks {
+			if i == from {
+				continue
+			}
+			if err := s.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+				t.Fatalf("Failed SetOption: %v", err)
+			}
+			b, err := s.Recv()
+			if err != nil {
+				t.Fatalf("Node %d did not get message from %d: %v", i, from, err)
+			}
+			if len(b) != 1 || b[0] != byte(from) {
+				t.Errorf("Node %d got %v, expected message from %d", i, b, from)
+			}
+		}
+		// Nobody gets a second copy, including the sender.
+		for i, s := range socks {
+			if err := s.SetOption(mangos.OptionRecvDeadline, 50*time.Millisecond); err != nil {
+				t.Fatalf("Failed SetOption: %v", err)
+			}
+			if b, err := s.Recv(); err != mangos.ErrRecvTimeout {
+				t.Errorf("Node %d got extra %v from %d (%v)", i, b, from, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+)
+
+// collectSurvey sends a survey, and returns the responses received
+// before it concludes.
+func collectSurvey(t *testing.T, sock mangos.Socket, survey string) []string {
+	if err := sock.Send([]byte(survey)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	var got []string
+	for {
+		b, err := sock.Recv()
+		if err == mangos.ErrRecvTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		got = append(got, string(b))
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestSurveyTime(t *testing.T) {
+	addr := AddrTestTCP()
+	sock, err := surveyor.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make SURVEYOR: %v", err)
+	}
+	defer sock.Close()
+	if err = sock.SetOption(mangos.OptionSurveyTime, 200*time.Millisecond); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = sock.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	delays := map[string]time.Duration{
+		"fast": 0,
+		"ok":   50 * time.Millisecond,
+		"slow": 300 * time.Millisecond,
+	}
+	for name, delay := range delays {
+		r, err := respondent.NewSocket()
+		if err != nil {
+			t.Fatalf("Failed to make RESPONDENT: %v", err)
+		}
+		defer r.Close()
+		if err = r.Dial(addr); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		go func(r mangos.Socket, name string, delay time.Duration) {
+			for {
+				b, err := r.Recv()
+				if err != nil {
+					return
+				}
+				time.Sleep(delay)
+				r.Send([]byte(string(b) + ":" + name))
+			}
+		}(r, name, delay)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	got := collectSurvey(t, sock, "1")
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("Survey lasted %v", d)
+	}
+	if strings.Join(got, ",") != "1:fast,1:ok" {
+		t.Errorf("Wrong responses: %v", got)
+	}
+	// Once concluded, Recv keeps failing until the next survey.
+	if _, err = sock.Recv(); err != mangos.ErrRecvTimeout {
+		t.Errorf("Expected ErrRecvTimeout, got %v", err)
+	}
+
+	// The slow response to the first survey arrives during this one,
+	// and must be discarded.
+	got = collectSurvey(t, sock, "2")
+	if strings.Join(got, ",") != "2:fast,2:ok" {
+		t.Errorf("Wrong responses: %v", got)
+	}
+}
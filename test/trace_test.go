@@ -0,0 +1,88 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func TestTraceHeaderReqRep(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REP: %v", err)
+	}
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make REQ: %v", err)
+	}
+	defer cli.Close()
+
+	for _, s := range []mangos.Socket{srv, cli} {
+		if err = s.SetOption(mangos.OptionRecvDeadline, time.Second); err != nil {
+			t.Fatalf("Failed SetOption: %v", err)
+		}
+	}
+	opts := map[string]interface{}{mangos.OptionTraceHeader: true}
+	if err = srv.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+	if err = cli.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Failed dial: %v", err)
+	}
+
+	id := [mangos.TraceIDSize]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4}
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("ping")...)
+	m.TraceID = id
+	if err = cli.SendMsg(m); err != nil {
+		t.Fatalf("Failed send: %v", err)
+	}
+
+	if m, err = srv.RecvMsg(); err != nil {
+		t.Fatalf("Failed recv: %v", err)
+	}
+	if m.TraceID != id {
+		t.Errorf("Request has wrong trace ID: %v", m.TraceID)
+	}
+	if string(m.Body) != "ping" {
+		t.Errorf("Request has wrong body: %q", m.Body)
+	}
+	m.Free()
+
+	// The reply does not set a trace ID, so it inherits the request's.
+	m = mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("pong")...)
+	if err = srv.SendMsg(m); err != nil {
+		t.Fatalf("Failed reply: %v", err)
+	}
+
+	if m, err = cli.RecvMsg(); err != nil {
+		t.Fatalf("Failed recv reply: %v", err)
+	}
+	if m.TraceID != id {
+		t.Errorf("Reply has wrong trace ID: %v", m.TraceID)
+	}
+	if string(m.Body) != "pong" {
+		t.Errorf("Reply has wrong body: %q", m.Body)
+	}
+	m.Free()
+}
@@ -116,10 +116,14 @@ func (tt *TranTest) TestListenAndAccept(t *testing.T) {
 	if v, err := server.GetOption(mangos.OptionLocalAddr); err == nil {
 		addr := v.(net.Addr)
 		t.Logf("Accepted on local net %s addr %s", addr.Network(), addr.String())
+	} else {
+		t.Errorf("Failed to get local addr: %v", err)
 	}
 	if v, err := server.GetOption(mangos.OptionRemoteAddr); err == nil {
 		addr := v.(net.Addr)
 		t.Logf("Accepted remote peer %s addr %s", addr.Network(), addr.String())
+	} else {
+		t.Errorf("Failed to get remote addr: %v", err)
 	}
 	defer server.Close()
 
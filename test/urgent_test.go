@@ -0,0 +1,122 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestSendUrgent(t *testing.T) {
+	addr := AddrTestTCP()
+	tx, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer tx.Close()
+	rx, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer rx.Close()
+
+	if err = rx.SetOption(mangos.OptionRecvDeadline, 5*time.Second); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.SetOption(mangos.OptionReadQLen, 0); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = rx.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Far more than the connection can buffer, so that most of the
+	// backlog is still queued while the receiver is not reading.
+	const count = 128
+	if err = tx.SetOption(mangos.OptionWriteQLen, count); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	if err = tx.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		if err = tx.Send(make([]byte, 256*1024)); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, []byte("urgent")...)
+		done <- tx.SendUrgent(m)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	urgent := -1
+	for i := 0; i <= count; i++ {
+		b, err := rx.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if string(b) == "urgent" {
+			urgent = i
+		} else if len(b) != 256*1024 {
+			t.Fatalf("Got %d bytes", len(b))
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("SendUrgent failed: %v", err)
+	}
+	if urgent < 0 || urgent >= count/2 {
+		t.Errorf("Urgent message arrived at %d of %d", urgent, count)
+	}
+}
+
+func TestSendUrgentTooLong(t *testing.T) {
+	s, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PAIR: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionMaxSendSize, 10); err != nil {
+		t.Fatalf("Failed SetOption: %v", err)
+	}
+	m := mangos.NewMessage(20)
+	m.Body = append(m.Body, make([]byte, 20)...)
+	var tl *mangos.TooLongError
+	if err = s.SendUrgent(m); !errors.As(err, &tl) {
+		t.Fatalf("Expected TooLongError, got %v", err)
+	}
+	if tl.Size != 20 || tl.Limit != 10 {
+		t.Errorf("Got size %d limit %d", tl.Size, tl.Limit)
+	}
+}
+
+func TestSendUrgentNotSupported(t *testing.T) {
+	s, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer s.Close()
+	if err = s.SendUrgent(mangos.NewMessage(0)); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+}
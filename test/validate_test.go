@@ -0,0 +1,241 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/protocol/respondent"
+	"nanomsg.org/go/mangos/v2/protocol/surveyor"
+)
+
+// sendGarbage connects to sock as a peer using protocol proto, which
+// handshakes correctly, but then sends body as a message.  It returns
+// the reason the socket gave for closing the pipe.
+func sendGarbage(t *testing.T, sock mangos.Socket, proto uint16, body []byte) error {
+	addr := AddrTestTCP()
+	errq := make(chan error, 1)
+	sock.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventDetached {
+			errq <- p.CloseErr()
+		}
+	})
+	if err := sock.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	c, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	hdr := []byte{0, 'S', 'P', 0, byte(proto >> 8), byte(proto), 0, 0}
+	if _, err = c.Write(hdr); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	frame := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(frame, uint64(len(body)))
+	if _, err = c.Write(append(frame, body...)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case err = <-errq:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Pipe not closed")
+	}
+	return err
+}
+
+func TestValidateHeaderRep(t *testing.T) {
+	for _, body := range [][]byte{
+		{},
+		{0x80, 0},
+		{0, 0, 0, 1},                // hop, but no request ID
+		{0, 0, 0, 1, 0, 0, 0, 2, 9}, // truncated after two hops
+	} {
+		sock, err := rep.NewSocket()
+		if err != nil {
+			t.Fatalf("NewSocket failed: %v", err)
+		}
+		err = sendGarbage(t, sock, mangos.ProtoReq, body)
+		if !errors.Is(err, mangos.ErrGarbled) {
+			t.Errorf("Body %v: expected ErrGarbled, got %v", body, err)
+		}
+		sock.Close()
+	}
+}
+
+func TestValidateHeaderReq(t *testing.T) {
+	for _, body := range [][]byte{
+		{0x80, 0, 0},
+		{0, 0, 0, 1, 'h', 'i'}, // ID lacks the high order bit
+	} {
+		sock, err := req.NewSocket()
+		if err != nil {
+			t.Fatalf("NewSocket failed: %v", err)
+		}
+		err = sendGarbage(t, sock, mangos.ProtoRep, body)
+		if !errors.Is(err, mangos.ErrGarbled) {
+			t.Errorf("Body %v: expected ErrGarbled, got %v", body, err)
+		}
+		sock.Close()
+	}
+}
+
+func TestValidateHeaderSurveyor(t *testing.T) {
+	sock, err := surveyor.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer sock.Close()
+	err = sendGarbage(t, sock, mangos.ProtoRespondent, []byte{0x80})
+	if !errors.Is(err, mangos.ErrGarbled) {
+		t.Errorf("Expected ErrGarbled, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "too short") {
+		t.Errorf("Error not descriptive: %v", err)
+	}
+}
+
+func TestValidateHeaderRespondent(t *testing.T) {
+	sock, err := respondent.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer sock.Close()
+	err = sendGarbage(t, sock, mangos.ProtoSurveyor, []byte{0, 0, 0, 5})
+	if !errors.Is(err, mangos.ErrGarbled) {
+		t.Errorf("Expected ErrGarbled, got %v", err)
+	}
+}
+
+// TestValidateHeaderGood makes sure that well formed messages still
+// get through.
+func TestValidateHeaderGood(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer srv.Close()
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer cli.Close()
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := srv.Recv(); err != nil || string(b) != "ping" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+	if err = srv.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := cli.Recv(); err != nil || string(b) != "pong" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+}
+
+func TestStrictHeaders(t *testing.T) {
+	for _, body := range [][]byte{
+		{0x80, 0},                        // too short
+		{0, 0, 0, 1, 0x80, 0, 0, 2, 'h'}, // a hop before the ID
+		{0, 0, 0, 1, 0, 0, 0, 2, 0x80, 0, 0, 3},
+	} {
+		for _, test := range []struct {
+			newSocket func() (mangos.Socket, error)
+			peer      uint16
+		}{
+			{rep.NewSocket, mangos.ProtoReq},
+			{respondent.NewSocket, mangos.ProtoSurveyor},
+		} {
+			sock, err := test.newSocket()
+			if err != nil {
+				t.Fatalf("NewSocket failed: %v", err)
+			}
+			if err = sock.SetOption(mangos.OptionStrictHeaders, 1); err != mangos.ErrBadValue {
+				t.Errorf("Expected ErrBadValue, got %v", err)
+			}
+			if err = sock.SetOption(mangos.OptionStrictHeaders, true); err != nil {
+				t.Fatalf("SetOption failed: %v", err)
+			}
+			if v, err := sock.GetOption(mangos.OptionStrictHeaders); err != nil || !v.(bool) {
+				t.Errorf("GetOption got %v %v", v, err)
+			}
+			err = sendGarbage(t, sock, test.peer, body)
+			if !errors.Is(err, mangos.ErrBadHeader) {
+				t.Errorf("Body %v: expected ErrBadHeader, got %v", body, err)
+			}
+			sock.Close()
+		}
+	}
+}
+
+// TestStrictHeadersGood makes sure that strict headers still let
+// requests from a directly connected client through.
+func TestStrictHeadersGood(t *testing.T) {
+	addr := AddrTestTCP()
+	srv, err := rep.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer srv.Close()
+	if err = srv.SetOption(mangos.OptionStrictHeaders, true); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	cli, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer cli.Close()
+	if err = srv.Listen(addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err = cli.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := srv.Recv(); err != nil || string(b) != "ping" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+	if err = srv.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := cli.Recv(); err != nil || string(b) != "pong" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+}
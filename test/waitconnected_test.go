@@ -0,0 +1,98 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+func TestWaitConnected(t *testing.T) {
+	addr := AddrTestTCP()
+	s, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	defer s.Close()
+	opts := map[string]interface{}{
+		mangos.OptionDialAsynch:    true,
+		mangos.OptionReconnectTime: 10 * time.Millisecond,
+	}
+	if err = s.DialOptions(addr, opts); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// Nothing is listening yet.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = s.WaitConnected(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	errq := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errq <- s.WaitConnected(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	srv := resolverPull(t, addr)
+	defer srv.Close()
+	if err = <-errq; err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+
+	// A pipe is ready, so the first send goes out.
+	if err = s.SetOption(mangos.OptionBestEffort, true); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = s.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resolverRecv(t, srv, "hello")
+
+	// Once connected, it does not wait at all.
+	if err = s.WaitConnected(context.Background()); err != nil {
+		t.Errorf("WaitConnected failed: %v", err)
+	}
+}
+
+func TestWaitConnectedClose(t *testing.T) {
+	s, err := push.NewSocket()
+	if err != nil {
+		t.Fatalf("Failed to make PUSH: %v", err)
+	}
+	errq := make(chan error, 1)
+	go func() {
+		errq <- s.WaitConnected(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case err = <-errq:
+		if err != mangos.ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitConnected did not return")
+	}
+	if err = s.WaitConnected(context.Background()); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/push"
+)
+
+// testWriteQueuePolicy stalls a pipe, with one message in flight, and
+// then sends four more messages through a write queue of two.  The
+// messages that eventually make it to the pipe are compared against
+// those expected for the policy.
+func testWriteQueuePolicy(t *testing.T, s protocol.Protocol, self, peer uint16,
+	policy mangos.QueueFullPolicy, want string) {
+
+	defer s.Close()
+	if err := s.SetOption(mangos.OptionWriteQLen, 2); err != nil {
+		t.Fatalf("SetOption WriteQLen failed: %v", err)
+	}
+	if err := s.SetOption(mangos.OptionWriteQueueFullPolicy, policy); err != nil {
+		t.Fatalf("SetOption policy failed: %v", err)
+	}
+	if v, err := s.GetOption(mangos.OptionWriteQueueFullPolicy); err != nil || v != policy {
+		t.Errorf("GetOption policy got %v, %v", v, err)
+	}
+	mp := NewMockPipe(self, peer, 0)
+	if err := s.AddPipe(mp); err != nil {
+		t.Fatalf("AddPipe failed: %v", err)
+	}
+
+	send := func(body string) {
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, []byte(body)...)
+		if err := s.SendMsg(m); err != nil {
+			t.Errorf("SendMsg %s failed: %v", body, err)
+		}
+	}
+	send("0")
+	// Give the pipe time to pick up the first message, and stall.
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, body := range []string{"1", "2", "3", "4"} {
+			send(body)
+		}
+	}()
+	if policy != mangos.QueueFullBlock {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Send blocked")
+		}
+	}
+
+	got := ""
+	for len(got) < len(want) {
+		m := mp.Sent(time.Second)
+		if m == nil {
+			break
+		}
+		got += string(m.Body)
+		m.Free()
+	}
+	<-done
+	if m := mp.Sent(20 * time.Millisecond); m != nil {
+		got += string(m.Body)
+	}
+	if got != want {
+		t.Errorf("Sent %q, expected %q", got, want)
+	}
+}
+
+func TestWriteQueuePolicyPub(t *testing.T) {
+	for _, c := range []struct {
+		policy mangos.QueueFullPolicy
+		want   string
+	}{
+		{mangos.QueueFullDropNewest, "012"},
+		{mangos.QueueFullDropOldest, "034"},
+		{mangos.QueueFullBlock, "01234"},
+	} {
+		testWriteQueuePolicy(t, pub.NewProtocol(),
+			mangos.ProtoPub, mangos.ProtoSub, c.policy, c.want)
+	}
+}
+
+func TestWriteQueuePolicyPush(t *testing.T) {
+	for _, c := range []struct {
+		policy mangos.QueueFullPolicy
+		want   string
+	}{
+		{mangos.QueueFullDropNewest, "012"},
+		{mangos.QueueFullDropOldest, "034"},
+		{mangos.QueueFullBlock, "01234"},
+	} {
+		testWriteQueuePolicy(t, push.NewProtocol(),
+			mangos.ProtoPush, mangos.ProtoPull, c.policy, c.want)
+	}
+}
+
+func TestWriteQueuePolicyPushTimeout(t *testing.T) {
+	s := push.NewProtocol()
+	defer s.Close()
+	s.SetOption(mangos.OptionWriteQLen, 1)
+	s.SetOption(mangos.OptionSendDeadline, 20*time.Millisecond)
+	mp := NewMockPipe(mangos.ProtoPush, mangos.ProtoPull, 0)
+	if err := s.AddPipe(mp); err != nil {
+		t.Fatalf("AddPipe failed: %v", err)
+	}
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = s.SendMsg(mangos.NewMessage(0))
+	}
+	if err != mangos.ErrSendTimeout {
+		t.Errorf("Expected ErrSendTimeout, got %v", err)
+	}
+}
+
+func TestWriteQueuePolicyPubTimeout(t *testing.T) {
+	s := pub.NewProtocol()
+	defer s.Close()
+	s.SetOption(mangos.OptionWriteQLen, 1)
+	s.SetOption(mangos.OptionWriteQueueFullPolicy, mangos.QueueFullBlock)
+	if err := s.SetOption(mangos.OptionSendDeadline, 20*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	mp := NewMockPipe(mangos.ProtoPub, mangos.ProtoSub, 0)
+	if err := s.AddPipe(mp); err != nil {
+		t.Fatalf("AddPipe failed: %v", err)
+	}
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = s.SendMsg(mangos.NewMessage(0))
+	}
+	if err != mangos.ErrSendTimeout {
+		t.Errorf("Expected ErrSendTimeout, got %v", err)
+	}
+
+	// With best effort, a full queue does not hold up the send.
+	if err = s.SetOption(mangos.OptionBestEffort, true); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	start := time.Now()
+	if err = s.SendMsg(mangos.NewMessage(0)); err != nil {
+		t.Errorf("Best effort send failed: %v", err)
+	}
+	if d := time.Since(start); d >= 20*time.Millisecond {
+		t.Errorf("Best effort send waited %v", d)
+	}
+}
+
+func TestWriteQueuePolicyBadValue(t *testing.T) {
+	for _, s := range []protocol.Protocol{pub.NewProtocol(), push.NewProtocol()} {
+		for _, v := range []interface{}{mangos.QueueFullPolicy(-1),
+			mangos.QueueFullPolicy(3), 1} {
+			if err := s.SetOption(mangos.OptionWriteQueueFullPolicy, v); err != mangos.ErrBadValue {
+				t.Errorf("Expected ErrBadValue for %v, got %v", v, err)
+			}
+		}
+		s.Close()
+	}
+}
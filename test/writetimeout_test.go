@@ -0,0 +1,116 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pub"
+	"nanomsg.org/go/mangos/v2/protocol/sub"
+)
+
+func TestWriteTimeoutSlowSubscriber(t *testing.T) {
+	addr := AddrTestTCP()
+	p, err := pub.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer p.Close()
+
+	var lock sync.Mutex
+	attached := 0
+	detached := make(chan struct{}, 2)
+	p.SetPipeEventHook(func(ev mangos.PipeEvent, _ mangos.Pipe) {
+		switch ev {
+		case mangos.PipeEventAttached:
+			lock.Lock()
+			attached++
+			lock.Unlock()
+		case mangos.PipeEventDetached:
+			detached <- struct{}{}
+		}
+	})
+	opts := map[string]interface{}{
+		mangos.OptionWriteTimeout: 50 * time.Millisecond,
+	}
+	if err = p.ListenOptions(addr, opts); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	s, err := sub.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	defer s.Close()
+	if err = s.SetOption(mangos.OptionSubscribe, []byte{}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err = s.Dial(addr); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// The slow subscriber completes the handshake, but never reads
+	// anything after that.
+	slow, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer slow.Close()
+	if _, err = slow.Write([]byte{0, 'S', 'P', 0, 0, 0x21, 0, 0}); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	for i := 0; ; i++ {
+		lock.Lock()
+		n := attached
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Only %d pipes attached", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Publish enough to fill the slow subscriber's socket buffers.
+	// The other subscriber should see every message regardless.
+	big := make([]byte, 256*1024)
+	for i := 0; i < 100; i++ {
+		big[0] = byte(i)
+		if err = p.Send(big); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+		v, err := s.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		if !bytes.Equal(v, big) {
+			t.Fatalf("Wrong message %d", i)
+		}
+	}
+
+	select {
+	case <-detached:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Slow subscriber not dropped")
+	}
+}
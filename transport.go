@@ -14,6 +14,8 @@
 
 package mangos
 
+import "net"
+
 // XXX: The interfaces listed here will eventually move to the Transport
 // package, to be named without the Tran prefix, and then this file will
 // go away.
@@ -37,8 +39,15 @@ type TranPipe interface {
 	// complete message could not be received, an error is returned
 	// to the caller and the Pipe is closed.
 	//
-	// To mitigate Denial-of-Service attacks, we limit the max message
-	// size to 1M.
+	// The wire format does not distinguish the protocol header from
+	// the body, so the entire message is returned in the Body, with
+	// an empty Header.  The protocol is responsible for moving its
+	// header (whose length may vary, e.g. REP backtraces) from the
+	// front of the Body into the Header.
+	//
+	// To mitigate Denial-of-Service attacks, the max message size
+	// is limited by OptionMaxRecvSize (1MB by default at the socket
+	// level).  The limit is checked before any buffer is allocated.
 	Recv() (*Message, error)
 
 	// Close closes the underlying transport.  Further operations on
@@ -57,11 +66,32 @@ type TranPipe interface {
 	// connection establishment.
 	RemoteProtocol() uint16
 
+	// LocalProtocolName returns the name of the local protocol,
+	// as reported by ProtocolName.
+	LocalProtocolName() string
+
+	// RemoteProtocolName returns the name of the remote protocol,
+	// as reported by ProtocolName.
+	RemoteProtocolName() string
+
+	// LocalAddr returns the local address of the connection.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the address of the peer.  Transports without
+	// network addresses, such as inproc, return a synthetic one.
+	RemoteAddr() net.Addr
+
 	// GetOption returns an arbitrary transport specific option on a
 	// pipe.  Options for pipes are read-only and specific to that
 	// particular connection. If the property doesn't exist, then
 	// ErrBadOption should be returned.
 	GetOption(string) (interface{}, error)
+
+	// CloseErr returns the first error that caused the Pipe to fail,
+	// or nil if it has not failed.  A graceful close by the peer is
+	// reported as io.EOF, and a local Close as ErrClosed.  This is
+	// meant for diagnostics.
+	CloseErr() error
 }
 
 // TranDialer represents the client side of a connection.  Clients initiate
@@ -0,0 +1,251 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// compressMin is the smallest message that we try to compress.  Smaller
+// messages rarely get any smaller, and are sent as is.
+const compressMin = 128
+
+// Each compressed frame starts with one of these, saying how the rest
+// of the frame is encoded.
+const (
+	frameStored     = 0
+	frameCompressed = 1
+)
+
+// compressor is a compressed stream writer that can be reused.
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// codec describes a compression algorithm that may be negotiated.
+type codec struct {
+	name    string
+	flag    uint16 // feature flag advertised in the handshake
+	writers sync.Pool
+	readers sync.Pool
+	newR    func(io.Reader) (io.ReadCloser, error)
+	resetR  func(io.ReadCloser, io.Reader) error
+}
+
+var codecs = []*codec{
+	{
+		name: "gzip",
+		flag: rsvdGzip,
+		writers: sync.Pool{New: func() interface{} {
+			return gzip.NewWriter(nil)
+		}},
+		newR: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		resetR: func(zr io.ReadCloser, r io.Reader) error {
+			return zr.(*gzip.Reader).Reset(r)
+		},
+	},
+	{
+		name: "deflate",
+		flag: rsvdDeflate,
+		writers: sync.Pool{New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		}},
+		newR: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+		resetR: func(zr io.ReadCloser, r io.Reader) error {
+			return zr.(flate.Resetter).Reset(r, nil)
+		},
+	},
+}
+
+// codecByName returns the codec for a value of OptionCompression, or
+// nil if none is to be used.
+func codecByName(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// codecByFlags returns the codec for the feature flags that both peers
+// advertised, or nil if they have none in common.
+func codecByFlags(flags uint16) *codec {
+	for _, c := range codecs {
+		if flags&c.flag != 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// ValidCompression returns true if name is a supported value for
+// OptionCompression.
+func ValidCompression(name string) bool {
+	return name == "none" || codecByName(name) != nil
+}
+
+// compressFramer compresses messages, then frames them with another
+// Framer.  Messages that do not get smaller are sent stored, so that
+// compression never makes things worse by more than one byte.  It is
+// used when both peers agree on the codec during the handshake.
+type compressFramer struct {
+	inner Framer
+	codec *codec
+	maxrx int
+}
+
+func newCompressFramer(inner Framer, c *codec, maxrx int) compressFramer {
+	return compressFramer{
+		inner: withMaxRecvSize(inner, compressedLimit(maxrx)),
+		codec: c,
+		maxrx: maxrx,
+	}
+}
+
+// compressedLimit is the limit on frames carrying messages of at most
+// maxrx bytes.  The marker byte makes stored messages one byte larger.
+func compressedLimit(maxrx int) int {
+	if maxrx > 0 {
+		return maxrx + 1
+	}
+	return 0
+}
+
+// ReadMsg implements the Framer ReadMsg method.  The decompressed message
+// is subject to the receive limit, so that a small frame cannot expand
+// to exhaust our memory.
+func (f compressFramer) ReadMsg(r io.Reader) (*Message, error) {
+	m, err := f.inner.ReadMsg(r)
+	if err != nil {
+		var tl *mangos.TooLongError
+		if errors.As(err, &tl) {
+			tl.Size--
+			tl.Limit = f.maxrx
+		}
+		return nil, err
+	}
+	if len(m.Body) == 0 {
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+	switch m.Body[0] {
+	case frameStored:
+		m.Body = m.Body[1:]
+		return m, nil
+	case frameCompressed:
+	default:
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+
+	var zr io.ReadCloser
+	src := bytes.NewReader(m.Body[1:])
+	if v := f.codec.readers.Get(); v != nil {
+		zr = v.(io.ReadCloser)
+		err = f.codec.resetR(zr, src)
+	} else {
+		zr, err = f.codec.newR(src)
+	}
+	if err != nil {
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+	var lr io.Reader = zr
+	if f.maxrx > 0 {
+		lr = io.LimitReader(zr, int64(f.maxrx)+1)
+	}
+	body, err := ioutil.ReadAll(lr)
+	zr.Close()
+	f.codec.readers.Put(zr)
+	m.Free()
+	if err != nil {
+		return nil, mangos.ErrGarbled
+	}
+	if f.maxrx > 0 && len(body) > f.maxrx {
+		// We stopped reading, so the real size is unknown.
+		return nil, &mangos.TooLongError{Size: uint64(len(body)), Limit: f.maxrx}
+	}
+	m = mangos.NewMessage(0)
+	m.Body = body
+	return m, nil
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f compressFramer) WriteMsg(w io.Writer, m *Message) error {
+	sz := len(m.Header) + len(m.Body)
+	if sz >= compressMin {
+		var buf bytes.Buffer
+		buf.Grow(sz / 2)
+		buf.WriteByte(frameCompressed)
+		zw := f.codec.writers.Get().(compressor)
+		zw.Reset(&buf)
+		zw.Write(m.Header)
+		zw.Write(m.Body)
+		zw.Close()
+		f.codec.writers.Put(zw)
+		if buf.Len() <= sz {
+			return f.inner.WriteMsg(w, &Message{Body: buf.Bytes()})
+		}
+	}
+	hdr := make([]byte, 0, 1+len(m.Header))
+	hdr = append(append(hdr, frameStored), m.Header...)
+	return f.inner.WriteMsg(w, withHeader(m, hdr))
+}
+
+// withMaxRecvSize returns f, with its receive limit changed to n, if it
+// is one of our Framers.
+func withMaxRecvSize(f Framer, n int) Framer {
+	switch f := f.(type) {
+	case DefaultFramer:
+		f.MaxRecvSize = n
+		return f
+	case VarintFramer:
+		f.MaxRecvSize = n
+		return f
+	case crcFramer:
+		f.maxrx = n
+		return f
+	case compressFramer:
+		return newCompressFramer(f.inner, f.codec, n)
+	case traceFramer:
+		return newTraceFramer(f.inner, n)
+	case typeFramer:
+		return newTypeFramer(f.inner, n)
+	case seqFramer:
+		g := newSeqFramer(f.inner, n)
+		g.last = f.last
+		return g
+	case pingFramer:
+		return newPingFramer(f.inner, n)
+	case fragFramer:
+		return newFragFramer(f.inner, f.size, n)
+	}
+	return f
+}
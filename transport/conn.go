@@ -15,10 +15,17 @@
 package transport
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"nanomsg.org/go/mangos/v2"
 )
@@ -27,11 +34,83 @@ import (
 // assumption is that transports using this have similar wire protocols,
 // and conn is meant to be used as a building block.
 type conn struct {
-	c       net.Conn
-	proto   ProtocolInfo
-	open    bool
-	options map[string]interface{}
-	maxrx   int
+	// Traffic counters, updated atomically.  These are first to
+	// guarantee 64-bit alignment.
+	rxBytes uint64
+	txBytes uint64
+	rxMsgs  uint64
+	txMsgs  uint64
+	rxLimit int64 // set by SetMaxRecvSize, applied to maxrx by Recv
+
+	c        net.Conn
+	rd       io.Reader      // c, or a buffered reader on it
+	cr       countingReader // reads from rd
+	framer   Framer
+	proto    ProtocolInfo
+	open     bool
+	closing  bool // set by Close, so that fail reports ErrClosed
+	options  map[string]interface{}
+	maxrx    int
+	maxtx    int
+	wtimeout time.Duration
+	version  byte   // negotiated SP version
+	versions []byte // SP versions we support
+	peerMD   map[string]string
+	rlock    sync.Mutex
+	wlock    sync.Mutex
+	pending  *io.LimitedReader // unread body from RecvReader
+	started  time.Time         // when the handshake completed
+	info     mangos.PipeInfo   // filled in by the handshake
+	accepted bool              // accepted by a Listener, see Accepted
+	closeErr error             // why the pipe failed or was closed
+
+	byteOrder binary.ByteOrder // of message lengths, normally big-endian
+	alloc     mangos.RecvAllocator
+	log       mangos.Logger
+
+	// OptionRecvFilter and OptionSendFilter, called with the rlock
+	// and wlock held respectively.
+	rfilter mangos.MessageFilter
+	rfClose bool
+	sfilter mangos.MessageFilter
+
+	// With OptionSendBatch, messages are written to bw, which is
+	// flushed by batchT, or when the protocol calls Flush.
+	wr     io.Writer // c, or bw
+	bw     *bufio.Writer
+	batch  time.Duration
+	batchT *time.Timer
+
+	// Between Cork and Uncork, flushBatch does nothing, so messages
+	// are held back in bw, or by TCP_CORK if kcork is set.
+	corked bool
+	kcork  bool
+
+	// With OptionKeepAliveInterval, keepAlive sends pings, and counts
+	// them in kaMissed until something is heard from the peer.  The
+	// kaFramer is also used for flow credits.  Pings are not counted
+	// while kaPaused is set, as the peer is not being listened to.
+	kaFramer pingFramer
+	kaMissed int32
+	kaPaused int32
+	kaPong   chan struct{}
+	kaStop   chan struct{}
+
+	// With OptionFlowCredits, Send uses up the credits granted by the
+	// peer, waiting on crMore for more, while grantCredit grants the
+	// peer crUsed more whenever crGrant is signaled.
+	credits  int64
+	crWindow int
+	crUsed   int
+	crMore   chan struct{}
+	crGrant  chan struct{}
+	crStop   chan struct{}
+
+	// With OptionAsyncRecv, messages are read ahead into asyncQ.
+	asyncQ    chan asyncMsg
+	asyncStop chan struct{}
+	asyncOnce sync.Once // starts readAhead
+	rdeadline time.Time // for Recv from asyncQ
 	sync.Mutex
 }
 
@@ -42,53 +121,716 @@ type connipc struct {
 	conn
 }
 
-// Recv implements the TranPipe Recv method.  The message received is expected
-// as a 64-bit size (network byte order) followed by the message itself.
-func (p *conn) Recv() (*Message, error) {
-
+// RecvReader implements the streaming receive for IPC, skipping over the
+// leading message type byte.
+func (p *connipc) RecvReader() (io.Reader, int64, error) {
 	var sz int64
 	var err error
-	var msg *Message
+	var one [1]byte
 
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
-		return nil, err
+	if p.rfilter != nil {
+		return nil, 0, mangos.ErrProtoOp
 	}
 
-	// Limit messages to the maximum receive value, if not
-	// unlimited.  This avoids a potential denaial of service.
+	p.rlock.Lock()
+	defer p.rlock.Unlock()
+
+	p.syncMaxRecvSize()
+	if err = p.drain(); err != nil {
+		return nil, 0, p.fail(err)
+	}
+	if _, err = io.ReadFull(p.rd, one[:]); err != nil {
+		return nil, 0, p.fail(err)
+	}
+	if err = binary.Read(p.rd, p.byteOrder, &sz); err != nil {
+		return nil, 0, p.fail(err)
+	}
 	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) {
-		return nil, mangos.ErrTooLong
+		return nil, 0, p.fail(p.tooLong(uint64(sz)))
+	}
+	p.pending = &io.LimitedReader{R: p.rd, N: sz}
+	p.countRx(sz)
+	return p.pending, sz, nil
+}
+
+// RecvInto implements the streaming receive for IPC.
+func (p *connipc) RecvInto(buf []byte) (int, error) {
+	return p.recvInto(buf, p.RecvReader)
+}
+
+// countingReader counts the bytes read through it.  This lets us tell
+// whether a failed read lost our place in the stream.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Recv implements the TranPipe Recv method.  Messages are delimited using
+// the pipe's Framer, which by default expects a 64-bit size (network byte
+// order) followed by the message itself.
+func (p *conn) Recv() (*Message, error) {
+	if p.asyncQ != nil {
+		return p.recvAsync()
 	}
-	msg = mangos.NewMessage(int(sz))
-	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
+	return p.recv()
+}
+
+// asyncMsg is the result of a receive done ahead of time.
+type asyncMsg struct {
+	m   *Message
+	err error
+}
+
+// readAhead receives messages into asyncQ until the pipe fails or is
+// closed.  When asyncQ is full, it waits, so the peer is held back by
+// the usual flow control.
+func (p *conn) readAhead() {
+	defer close(p.asyncQ)
+	for {
+		m, err := p.recv()
+		select {
+		case p.asyncQ <- asyncMsg{m, err}:
+		case <-p.asyncStop:
+			if m != nil {
+				m.Free()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// recvAsync takes the next message from asyncQ.
+func (p *conn) recvAsync() (*Message, error) {
+	if p.closed() {
+		return nil, mangos.ErrClosed
+	}
+	// Reading starts with the first Recv, once any handshake deadline
+	// has been cleared.
+	p.asyncOnce.Do(func() { go p.readAhead() })
+	p.Lock()
+	dl := p.rdeadline
+	p.Unlock()
+	var tq <-chan time.Time
+	if !dl.IsZero() {
+		t := time.NewTimer(time.Until(dl))
+		defer t.Stop()
+		tq = t.C
+	}
+	select {
+	case r, ok := <-p.asyncQ:
+		if !ok {
+			return nil, mangos.ErrClosed
+		}
+		return r.m, r.err
+	case <-tq:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// recv does the work of Recv, reading from the connection.
+func (p *conn) recv() (*Message, error) {
+	p.rlock.Lock()
+	defer p.rlock.Unlock()
+
+	return p.filterRecv(p.recvMsg)
+}
+
+// filterRecv receives messages using recv, until one is accepted by the
+// OptionRecvFilter, if there is one.  The caller must hold the rlock.
+func (p *conn) filterRecv(recv func() (*Message, error)) (*Message, error) {
+	for {
+		msg, err := recv()
+		if err != nil || p.rfilter == nil {
+			return msg, err
+		}
+		if err = p.rfilter(msg); err == nil {
+			return msg, nil
+		}
 		msg.Free()
-		return nil, err
+		if p.rfClose {
+			return nil, p.abort(err)
+		}
+		p.log.Debugf("mangos: message from %v rejected: %v", p.c.RemoteAddr(), err)
+	}
+}
+
+// recvMsg reads the next message.  The caller must hold the rlock.
+func (p *conn) recvMsg() (*Message, error) {
+	if p.closed() {
+		return nil, mangos.ErrClosed
+	}
+	p.syncMaxRecvSize()
+	if err := p.drain(); err != nil {
+		return nil, p.fail(err)
+	}
+	var msg *Message
+	var err error
+	for {
+		p.cr.n = 0
+		msg, err = p.framer.ReadMsg(&p.cr)
+		if p.kaStop != nil && p.cr.n != 0 {
+			// Anything at all shows that the peer is alive.
+			atomic.StoreInt32(&p.kaMissed, 0)
+		}
+		if err == errPing {
+			select {
+			case p.kaPong <- struct{}{}:
+			default: // a pong is already due, or we never ping
+			}
+			continue
+		}
+		if g, ok := err.(creditGrant); ok {
+			p.addCredit(int64(g))
+			continue
+		}
+		if err != errPong {
+			break
+		}
+	}
+	if err != nil {
+		var tl *mangos.TooLongError
+		if errors.As(err, &tl) {
+			tl.Peer = p.peerName()
+		}
+		if p.cr.n != 0 {
+			// We have lost our place in the stream.
+			return nil, p.abort(err)
+		}
+		return nil, p.fail(err)
+	}
+
+	// Framers are expected to enforce the limit themselves, before
+	// allocating the message, but be certain.
+	if p.maxrx > 0 && len(msg.Body) > p.maxrx {
+		sz := uint64(len(msg.Body))
+		msg.Free()
+		return nil, p.abort(p.tooLong(sz))
+	}
+	p.countRx(int64(len(msg.Body)))
+	if p.crStop != nil {
+		p.consumed()
 	}
 	return msg, nil
 }
 
-// Send implements the Pipe Send method.  The message is sent as a 64-bit
-// size (network byte order) followed by the message itself.
-func (p *conn) Send(msg *Message) error {
-	var buff = net.Buffers{}
+// recvSize reads the length prefix of the next message.  If the receive
+// deadline expires before any of the prefix has arrived, the timeout
+// error is returned, and the pipe may continue to be used.
+func (p *conn) recvSize() (int64, error) {
+	var b [8]byte
+	if n, err := io.ReadFull(p.rd, b[:]); err != nil {
+		if n != 0 {
+			return 0, p.abort(err)
+		}
+		return 0, p.fail(err)
+	}
+	return int64(p.byteOrder.Uint64(b[:])), nil
+}
+
+// SetRecvDeadline sets a deadline for receiving messages on the pipe.
+// If the deadline expires while waiting for a message, Recv returns a
+// net.Error whose Timeout method returns true, and the pipe remains
+// open.  If the deadline expires part way through a message, the pipe
+// is closed, since the message boundaries can no longer be found.
+// The zero value means no deadline.
+func (p *conn) SetRecvDeadline(t time.Time) error {
+	if p.asyncQ != nil {
+		p.Lock()
+		p.rdeadline = t
+		p.Unlock()
+		return nil
+	}
+	return p.c.SetReadDeadline(t)
+}
+
+// SetSendDeadline sets a deadline for sending messages on the pipe.
+// Like SetRecvDeadline, the pipe remains open if the deadline expires
+// before any part of a message was written, but is closed otherwise.
+// The zero value means no deadline.
+func (p *conn) SetSendDeadline(t time.Time) error {
+	return p.c.SetWriteDeadline(t)
+}
+
+// RecvReader is like Recv, but rather than buffering the entire message,
+// it returns the size declared by the peer, and a reader from which the
+// message (header and body together) can be streamed.  Any part of the
+// message that is not read by the caller is discarded by the next call
+// to Recv or RecvReader, so that framing is preserved.  The reader must
+// not be used once another receive operation has started, or once the
+// pipe is closed; Recv and RecvReader cannot be interleaved.  RecvReader
+// is only supported with the DefaultFramer, and without OptionAsyncRecv;
+// otherwise ErrProtoOp is returned.
+func (p *conn) RecvReader() (io.Reader, int64, error) {
+	var sz int64
+	var err error
+
+	if _, ok := p.framer.(DefaultFramer); !ok || p.asyncQ != nil || p.rfilter != nil {
+		return nil, 0, mangos.ErrProtoOp
+	}
+
+	p.rlock.Lock()
+	defer p.rlock.Unlock()
+
+	p.syncMaxRecvSize()
+	if err = p.drain(); err != nil {
+		return nil, 0, p.fail(err)
+	}
+	if sz, err = p.recvSize(); err != nil {
+		return nil, 0, err
+	}
+	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) {
+		return nil, 0, p.fail(p.tooLong(uint64(sz)))
+	}
+	p.pending = &io.LimitedReader{R: p.rd, N: sz}
+	p.countRx(sz)
+	return p.pending, sz, nil
+}
+
+// RecvInto is like Recv, but the message (header and body together) is
+// read into buf, which the caller owns, rather than into a new Message.
+// It returns the size of the message.  If the message is larger than
+// buf, ErrBufferTooSmall is returned, and the message is discarded.
+// The usual receive limit applies as well.  Like RecvReader, it is only
+// supported with the DefaultFramer, and cannot be interleaved with
+// other receive operations.
+func (p *conn) RecvInto(buf []byte) (int, error) {
+	return p.recvInto(buf, p.RecvReader)
+}
+
+// recvInto does the work of RecvInto, using recv to find the message.
+func (p *conn) recvInto(buf []byte, recv func() (io.Reader, int64, error)) (int, error) {
+	r, sz, err := recv()
+	if err != nil {
+		return 0, err
+	}
+	if sz > int64(len(buf)) {
+		// The next receive discards it.
+		return 0, mangos.ErrBufferTooSmall
+	}
+	n, err := io.ReadFull(r, buf[:sz])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, p.abort(err)
+	}
+	return n, nil
+}
+
+// SetMaxRecvSize changes the receive limit for the pipe.  This lets an
+// application accept larger messages once a peer has been authenticated,
+// for example.  The new limit applies from the next call to Recv or
+// RecvReader; a receive already in progress keeps the limit it started
+// with.  Zero means no limit.  The same value is reported by
+// OptionMaxRecvSize.
+func (p *conn) SetMaxRecvSize(n int64) error {
+	if n < 0 || int64(int(n)) != n {
+		return mangos.ErrBadValue
+	}
+	atomic.StoreInt64(&p.rxLimit, n)
+	return nil
+}
 
-	// Serialize the length header
-	l := uint64(len(msg.Header) + len(msg.Body))
-	lbyte := make([]byte, 8)
-	binary.BigEndian.PutUint64(lbyte, l)
+// syncMaxRecvSize picks up any limit set by SetMaxRecvSize, updating
+// the framer to match.  The caller must hold the rlock.
+func (p *conn) syncMaxRecvSize() {
+	n := int(atomic.LoadInt64(&p.rxLimit))
+	if n == p.maxrx {
+		return
+	}
+	p.maxrx = n
+	p.framer = withMaxRecvSize(p.framer, n)
+}
 
-	// Attach the length header along with the actual header and body
-	buff = append(buff, lbyte, msg.Header, msg.Body)
+// tooLong describes a received message of size sz that exceeds the
+// receive limit.
+func (p *conn) tooLong(sz uint64) error {
+	return &mangos.TooLongError{Size: sz, Limit: p.maxrx, Peer: p.peerName()}
+}
 
-	if _, err := buff.WriteTo(p.c); err != nil {
+// peerName returns the peer's address, for error reporting.
+func (p *conn) peerName() string {
+	if a := p.c.RemoteAddr(); a != nil {
+		return a.String()
+	}
+	return ""
+}
+
+// drain discards whatever remains of a message body returned by
+// RecvReader.  The caller must hold the rlock.
+func (p *conn) drain() error {
+	if p.pending == nil {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, p.pending)
+	if err == nil && p.pending.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	p.pending = nil
+	return err
+}
+
+// Send implements the Pipe Send method.  The message is delimited using
+// the pipe's Framer, which by default sends a 64-bit size (network byte
+// order) followed by the message itself.
+func (p *conn) Send(msg *Message) error {
+
+	if err := p.takeCredit(); err != nil {
+		return err
+	}
+
+	// The lock keeps concurrent senders from interleaving, as
+	// the framer may need multiple writes if the connection
+	// does not support vectored I/O.
+	p.wlock.Lock()
+	l, err := p.checkSend(msg)
+	if err != nil {
+		p.wlock.Unlock()
+		p.refundCredit()
 		return err
 	}
+	p.armWrite()
+	err = p.framer.WriteMsg(p.wr, msg)
+	p.armBatch()
+	p.wlock.Unlock()
+	if err != nil {
+		// Framers never report a timeout once part of the
+		// message is written, so the pipe is only usable after
+		// a timeout, unless it was OptionWriteTimeout.  Batched
+		// messages may have been partly written, though.
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && p.wtimeout == 0 && p.bw == nil {
+			return err
+		}
+		return p.abort(err)
+	}
+	p.countTx(int64(l))
 
 	msg.Free()
 	return nil
 }
 
+// checkSend runs the OptionSendFilter, if there is one, on a message
+// about to be sent, and checks it against OptionMaxSendSize.  It returns
+// the size of the message.  The caller must hold the wlock.
+func (p *conn) checkSend(msg *Message) (int, error) {
+	if p.sfilter != nil {
+		if err := p.sfilter(msg); err != nil {
+			return 0, err
+		}
+	}
+	l := len(msg.Header) + len(msg.Body)
+	if p.maxtx > 0 && l > p.maxtx {
+		return 0, &mangos.TooLongError{Size: uint64(l), Limit: p.maxtx}
+	}
+	return l, nil
+}
+
+// fail records err as the reason for the pipe failing, unless a reason
+// was already recorded, and returns err.  Timeouts are not recorded, as
+// the pipe remains usable after them.
+func (p *conn) fail(err error) error {
+	if p.closedLocally() {
+		return mangos.ErrClosed
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return err
+	}
+	p.setCloseErr(err)
+	return err
+}
+
+// abort is like fail, but also closes the pipe.  This is used when the
+// stream can no longer be used, because a message was partially lost.
+func (p *conn) abort(err error) error {
+	if p.closedLocally() {
+		return mangos.ErrClosed
+	}
+	p.setCloseErr(err)
+	p.Close()
+	return err
+}
+
+// setCloseErr records err as the reason for the pipe failing, and logs
+// it, unless a reason was already recorded.
+func (p *conn) setCloseErr(err error) {
+	p.Lock()
+	first := p.closeErr == nil
+	if first {
+		p.closeErr = err
+	}
+	p.Unlock()
+	if !first {
+		return
+	}
+	if err == io.EOF || err == mangos.ErrClosed {
+		p.log.Debugf("mangos: pipe to %v closed: %v", p.c.RemoteAddr(), err)
+	} else {
+		p.log.Warnf("mangos: pipe to %v failed: %v", p.c.RemoteAddr(), err)
+	}
+}
+
+// CloseErr returns the first error that caused the pipe to fail, or
+// nil if the pipe has not failed.  If the peer closed the connection,
+// this is io.EOF.  If the pipe was closed locally before any error
+// occurred, it is ErrClosed.
+func (p *conn) CloseErr() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.closeErr
+}
+
+// Flush waits for any Send in progress to finish, and writes out any
+// messages held back by OptionSendBatch.  Once Flush returns everything
+// sent has been handed to the net.Conn.
+func (p *conn) Flush() error {
+	p.wlock.Lock()
+	err := p.flushBatch()
+	p.wlock.Unlock()
+	if err != nil {
+		return p.abort(err)
+	}
+	if p.closed() {
+		return mangos.ErrClosed
+	}
+	return nil
+}
+
+// SetRecvPaused tells the pipe whether its owner has stopped receiving
+// for now.  While it has, keepalives are still sent, but the peer is not
+// considered dead because nothing is heard from it.
+func (p *conn) SetRecvPaused(paused bool) {
+	if paused {
+		atomic.StoreInt32(&p.kaPaused, 1)
+	} else {
+		atomic.StoreInt32(&p.kaMissed, 0)
+		atomic.StoreInt32(&p.kaPaused, 0)
+	}
+}
+
+// Cork holds back the messages sent on the pipe, until Uncork is called,
+// so that a batch of them goes out in as few segments as possible.  On
+// Linux, TCP connections use TCP_CORK, which the kernel honors for at
+// most 200ms.  Otherwise, the messages are buffered, and not written
+// to the connection at all until Uncork.  Flush has no effect while the
+// pipe is corked.  Calling Cork on a corked pipe does nothing.
+func (p *conn) Cork() error {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	if p.corked {
+		return nil
+	}
+	if p.closed() {
+		return mangos.ErrClosed
+	}
+	kcork, err := setCork(p.c, true)
+	if err != nil {
+		return err
+	}
+	p.corked = true
+	p.kcork = kcork
+	if !kcork && p.bw == nil {
+		p.bw = getWriter(p.c)
+		p.wr = p.bw
+	}
+	return nil
+}
+
+// Uncork writes out everything held back since Cork.  Calling Uncork on
+// a pipe that is not corked does nothing.
+func (p *conn) Uncork() error {
+	p.wlock.Lock()
+	if !p.corked {
+		p.wlock.Unlock()
+		return nil
+	}
+	p.corked = false
+	err := p.flushBatch()
+	if err == nil && p.kcork {
+		_, err = setCork(p.c, false)
+	}
+	p.kcork = false
+	if err == nil && p.batch == 0 && p.bw != nil {
+		// The buffer was only for the cork.
+		putWriter(p.bw)
+		p.bw = nil
+		p.wr = p.c
+	}
+	p.wlock.Unlock()
+	if err != nil {
+		return p.abort(err)
+	}
+	return nil
+}
+
+// armBatch starts the timer to flush batched messages, if it is not
+// already running.  The caller must hold the wlock.
+func (p *conn) armBatch() {
+	if p.bw != nil && p.batchT == nil && !p.corked && p.bw.Buffered() > 0 {
+		p.batchT = time.AfterFunc(p.batch, func() {
+			p.wlock.Lock()
+			p.batchT = nil
+			err := p.flushBatch()
+			p.wlock.Unlock()
+			if err != nil {
+				p.abort(err)
+			}
+		})
+	}
+}
+
+// flushBatch writes out any batched messages.  The caller must hold
+// the wlock.
+func (p *conn) flushBatch() error {
+	if p.bw == nil || p.corked || p.bw.Buffered() == 0 {
+		return nil
+	}
+	if p.batchT != nil {
+		p.batchT.Stop()
+		p.batchT = nil
+	}
+	p.armWrite()
+	return p.bw.Flush()
+}
+
+// SendPrepared sends a message that was prepared for sending to many
+// pipes.  With the standard framing, the shared encoding is written as
+// is, so that no per-pipe copy of the message is needed.
+func (p *conn) SendPrepared(pm *mangos.PreparedMessage) error {
+	if _, ok := p.framer.(DefaultFramer); !ok || p.sfilter != nil {
+		return p.Send(pm.Message())
+	}
+	return p.sendWire(net.Buffers{pm.Wire()}, 8)
+}
+
+// sendWire writes an already framed message, where the framing adds
+// overhead bytes to the message size.
+func (p *conn) sendWire(buff net.Buffers, overhead int) error {
+	want := int64(0)
+	for _, b := range buff {
+		want += int64(len(b))
+	}
+	l := want - int64(overhead)
+	if p.maxtx > 0 && l > int64(p.maxtx) {
+		return &mangos.TooLongError{Size: uint64(l), Limit: p.maxtx}
+	}
+
+	p.wlock.Lock()
+	p.armWrite()
+	n, err := buff.WriteTo(p.wr)
+	p.armBatch()
+	p.wlock.Unlock()
+	if err != nil {
+		if n != 0 || p.wtimeout > 0 || p.bw != nil {
+			return p.abort(err)
+		}
+		return p.fail(err)
+	}
+	if n != want {
+		return p.abort(mangos.ErrShortWrite)
+	}
+	p.countTx(l)
+	return nil
+}
+
+// SendReader is like Send, but the body is streamed from r rather than
+// held in memory.  Exactly size bytes are copied from r; if r has fewer,
+// io.ErrUnexpectedEOF is returned.  As the length was already sent, the
+// pipe is closed in that case, just as for any other failure part way
+// through a message.  SendReader is only supported with the
+// DefaultFramer; otherwise ErrProtoOp is returned.
+func (p *conn) SendReader(header []byte, r io.Reader, size int64) error {
+	if _, ok := p.framer.(DefaultFramer); !ok || p.sfilter != nil {
+		return mangos.ErrProtoOp
+	}
+	var b [8]byte
+	p.byteOrder.PutUint64(b[:], uint64(int64(len(header))+size))
+	return p.sendReader(b[:], header, r, size)
+}
+
+// sendReader writes the framing prefix and header, followed by size
+// bytes copied from r.
+func (p *conn) sendReader(prefix, header []byte, r io.Reader, size int64) error {
+	if size < 0 {
+		return mangos.ErrBadValue
+	}
+	l := int64(len(header)) + size
+	if p.maxtx > 0 && l > int64(p.maxtx) {
+		return &mangos.TooLongError{Size: uint64(l), Limit: p.maxtx}
+	}
+
+	p.wlock.Lock()
+	p.armWrite()
+	buff := net.Buffers{prefix, header}
+	n, err := buff.WriteTo(p.wr)
+	if err == nil {
+		var nb int64
+		nb, err = io.CopyN(p.wr, r, size)
+		n += nb
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	p.armBatch()
+	p.wlock.Unlock()
+	if err != nil {
+		if n != 0 || p.wtimeout > 0 || p.bw != nil {
+			return p.abort(err)
+		}
+		return p.fail(err)
+	}
+	p.countTx(l)
+	return nil
+}
+
+// armWrite sets the write deadline for OptionWriteTimeout, if there is
+// one, before a message is written.  If it expires, the peer is not
+// keeping up, so the pipe is closed, even if nothing was written.  The
+// caller must hold the wlock.
+func (p *conn) armWrite() {
+	if p.wtimeout > 0 {
+		p.c.SetWriteDeadline(time.Now().Add(p.wtimeout))
+	}
+}
+
+func (p *conn) countRx(n int64) {
+	atomic.AddUint64(&p.rxBytes, uint64(n))
+	atomic.AddUint64(&p.rxMsgs, 1)
+}
+
+func (p *conn) countTx(n int64) {
+	atomic.AddUint64(&p.txBytes, uint64(n))
+	atomic.AddUint64(&p.txMsgs, 1)
+}
+
+// Stats returns a snapshot of the traffic counters for the pipe.  The
+// byte counts include protocol headers, but not the length prefix.
+// The same value is available using OptionPipeStats.
+func (p *conn) Stats() mangos.PipeStats {
+	return mangos.PipeStats{
+		RxBytes:        atomic.LoadUint64(&p.rxBytes),
+		TxBytes:        atomic.LoadUint64(&p.txBytes),
+		RxMsgs:         atomic.LoadUint64(&p.rxMsgs),
+		TxMsgs:         atomic.LoadUint64(&p.txMsgs),
+		RemoteProtocol: p.proto.Peer,
+		Duration:       time.Since(p.started),
+	}
+}
+
+// Info returns what was negotiated during the handshake.  It is filled
+// in before the pipe is returned, and never changes after that.
+func (p *conn) Info() mangos.PipeInfo {
+	return p.info
+}
+
 // LocalProtocol returns our local protocol number.
 func (p *conn) LocalProtocol() uint16 {
 	return p.proto.Self
@@ -99,18 +841,160 @@ func (p *conn) RemoteProtocol() uint16 {
 	return p.proto.Peer
 }
 
+// LocalProtocolName returns our local protocol name.
+func (p *conn) LocalProtocolName() string {
+	return mangos.ProtocolName(p.proto.Self)
+}
+
+// RemoteProtocolName returns our peer's protocol name.
+func (p *conn) RemoteProtocolName() string {
+	return mangos.ProtocolName(p.proto.Peer)
+}
+
+// LocalAddr returns the local address of the underlying connection.
+// This is the same value available via OptionLocalAddr.
+func (p *conn) LocalAddr() net.Addr {
+	return p.c.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer.  This is the same value
+// available via OptionRemoteAddr.
+func (p *conn) RemoteAddr() net.Addr {
+	return p.c.RemoteAddr()
+}
+
+// Conn returns the underlying net.Conn, so that settings which mangos
+// does not expose, such as socket options, can be applied.  This is an
+// advanced interface, and must be used with care: reading, writing,
+// closing, or setting deadlines on the connection directly will corrupt
+// the message stream.  Nil is returned once the pipe is closed.
+func (p *conn) Conn() net.Conn {
+	p.Lock()
+	defer p.Unlock()
+	if !p.open {
+		return nil
+	}
+	return p.c
+}
+
+// IsOpen returns true if the handshake has completed, and the pipe has
+// not been closed.  It is safe to call concurrently with Close.
+func (p *conn) IsOpen() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.open
+}
+
+// closed returns true if the pipe has been closed.  Data remaining in
+// the read buffer must not be delivered once that has happened.
+func (p *conn) closed() bool {
+	p.Lock()
+	defer p.Unlock()
+	return !p.open && p.closeErr != nil
+}
+
+// closedLocally returns true once Close has been called.  A receive or
+// send interrupted by that fails with ErrClosed, rather than whatever
+// error the connection happened to report.
+func (p *conn) closedLocally() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.closing
+}
+
 // Close implements the Pipe Close method.
 func (p *conn) Close() error {
+	p.setCloseErr(mangos.ErrClosed)
 	p.Lock()
 	defer p.Unlock()
 	if p.open {
 		p.open = false
+		p.closing = true
+		// Not every net.Conn wakes a blocked Read when it is closed,
+		// but they all honor a deadline that has already passed.
+		_ = p.c.SetReadDeadline(time.Unix(1, 0))
+		if p.kaStop != nil {
+			close(p.kaStop)
+		}
+		if p.crStop != nil {
+			close(p.crStop)
+		}
+		if p.asyncStop != nil {
+			close(p.asyncStop)
+		}
+		// Receives and sends in progress fail once the connection
+		// is closed, but they may be the ones closing the pipe, so
+		// the buffers are released once they have let go.
+		go p.reset()
 		return p.c.Close()
 	}
 	return nil
 }
 
+// reset returns the pipe's buffers to their pools, and frees any
+// messages that were read ahead, once the pipe is closed.  Reads and
+// writes are pointed at the closed connection, so that nothing can
+// reach a buffer now used by another pipe.
+func (p *conn) reset() {
+	p.rlock.Lock()
+	if br, ok := p.rd.(*bufio.Reader); ok {
+		putReader(br)
+	}
+	p.rd = p.c
+	p.cr.r = p.c
+	p.pending = nil
+	p.rlock.Unlock()
+
+	p.wlock.Lock()
+	if p.batchT != nil {
+		p.batchT.Stop()
+		p.batchT = nil
+	}
+	if p.bw != nil {
+		putWriter(p.bw)
+		p.bw = nil
+	}
+	p.wr = p.c
+	p.wlock.Unlock()
+
+	if p.asyncQ != nil {
+		// If reading ahead never started, it never will now.
+		p.asyncOnce.Do(func() { close(p.asyncQ) })
+		for r := range p.asyncQ {
+			if r.m != nil {
+				r.m.Free()
+			}
+		}
+	}
+}
+
+// CloseWrite shuts down the sending side of the connection, after any
+// message being sent has been written.  The peer will see the end of
+// the stream once it has received all our messages, while we can still
+// receive from the peer until it closes the connection.  Transports
+// that do not support half-close simply close the connection.
+func (p *conn) CloseWrite() error {
+	cw, ok := p.c.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return p.Close()
+	}
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	if err := p.flushBatch(); err != nil {
+		return err
+	}
+	return cw.CloseWrite()
+}
+
 func (p *conn) GetOption(n string) (interface{}, error) {
+	switch n {
+	case mangos.OptionPipeStats:
+		return p.Stats(), nil
+	case mangos.OptionMaxRecvSize:
+		return int(atomic.LoadInt64(&p.rxLimit)), nil
+	}
 	if v, ok := p.options[n]; ok {
 		return v, nil
 	}
@@ -127,67 +1011,499 @@ func (p *conn) GetOption(n string) (interface{}, error) {
 // the implementation needn't bother concerning itself with passing actual
 // SP messages once the lower layer connection is established.
 func NewConnPipe(c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
-	p := &conn{
-		c:       c,
-		proto:   proto,
-		options: make(map[string]interface{}),
+	return NewConnPipeWithTimeout(c, proto, options, 0)
+}
+
+// NewConnPipeFramer is like NewConnPipe, but messages are delimited using
+// the supplied Framer instead of the standard SP framing.  The handshake
+// is unaffected.  The peer must use the same framing.  If the framer is
+// nil, a DefaultFramer is used.
+func NewConnPipeFramer(c net.Conn, proto ProtocolInfo, options map[string]interface{}, f Framer) (Pipe, error) {
+	p := &conn{}
+	p.init(c, proto, options)
+	if f != nil {
+		p.framer = f
+	}
+
+	if err := p.handshake(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewConnPipeWithTimeout is like NewConnPipe, but the SP layer handshake
+// must complete within the given timeout.  If it does not, the connection
+// is closed and ErrHandshakeTimeout is returned.  This protects listeners
+// from peers that connect but never send their header.  A zero timeout
+// means no limit.
+func NewConnPipeWithTimeout(c net.Conn, proto ProtocolInfo, options map[string]interface{}, timeout time.Duration) (Pipe, error) {
+	p := &conn{}
+	p.init(c, proto, options)
+
+	if err := p.handshakeWithin(timeout); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handshakeWithin performs the handshake, which must complete within the
+// timeout, unless that is zero.  On timeout, the connection is closed and
+// ErrHandshakeTimeout is returned.
+func (p *conn) handshakeWithin(timeout time.Duration) error {
+	c := p.c
+	if timeout > 0 {
+		if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if err := p.handshake(); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.Close()
+			return mangos.ErrHandshakeTimeout
+		}
+		return err
+	}
+	if timeout > 0 {
+		if err := c.SetDeadline(time.Time{}); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// NewConnPipeContext is like NewConnPipe, but the SP layer handshake is
+// abandoned if the context is canceled or expires before it completes.
+// In that case the connection is closed, and the context's error is
+// returned.
+func NewConnPipeContext(ctx context.Context, c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
+	p := &conn{}
+	p.init(c, proto, options)
+
+	done := make(chan struct{})
+	canceled := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			canceled <- true
+		case <-done:
+			canceled <- false
+		}
+	}()
+
+	err := p.handshake()
+	close(done)
+	if <-canceled {
+		if err == nil {
+			// The handshake finished first, and may have started
+			// goroutines that only stop when the pipe is closed.
+			p.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
 	}
+	return p, nil
+}
+
+// NewRawConnPipe allocates a new Pipe using the supplied net.Conn,
+// without performing the SP handshake.  Messages use the standard SP
+// length-prefixed framing, and the protocol numbers are taken as given.
+//
+// This is only for adapters bridging to systems that use the SP framing
+// but not the SP handshake.  Such a Pipe cannot talk to a standard SP
+// peer, and no options (such as compression or checksums) are
+// negotiated.  The far side must likewise skip the handshake, for
+// example by using NewRawConnPipe itself.
+func NewRawConnPipe(c net.Conn, lproto, rproto uint16) Pipe {
+	p := &conn{}
+	p.init(c, ProtocolInfo{Self: lproto, Peer: rproto}, nil)
+	p.info.RemoteProtocol = rproto
+	p.started = time.Now()
+	p.open = true
+	return p
+}
+
+// init sets up the conn prior to the handshake.
+func (p *conn) init(c net.Conn, proto ProtocolInfo, options map[string]interface{}) {
+	p.c = c
+	p.proto = proto
+	p.versions = supportedVersions
+	if _, ok := options[mangos.OptionHandshakeMetadata]; ok {
+		p.versions = metadataVersions
+	}
+	p.options = make(map[string]interface{})
 
 	p.options[mangos.OptionMaxRecvSize] = int(0)
+	p.options[mangos.OptionMaxSendSize] = int(0)
+	p.options[mangos.OptionReadBufferSize] = defaultReadBufferSize
 	p.options[mangos.OptionLocalAddr] = p.c.LocalAddr()
 	p.options[mangos.OptionRemoteAddr] = p.c.RemoteAddr()
 	for n, v := range options {
 		p.options[n] = v
 	}
+	_, p.accepted = p.options[optionAccepted]
+	delete(p.options, optionAccepted)
 	p.maxrx = p.options[mangos.OptionMaxRecvSize].(int)
+	p.rxLimit = int64(p.maxrx)
+	p.maxtx = p.options[mangos.OptionMaxSendSize].(int)
+	p.wtimeout, _ = p.options[mangos.OptionWriteTimeout].(time.Duration)
+	p.rfilter, _ = p.options[mangos.OptionRecvFilter].(mangos.MessageFilter)
+	p.rfClose, _ = p.options[mangos.OptionRecvFilterClose].(bool)
+	p.sfilter, _ = p.options[mangos.OptionSendFilter].(mangos.MessageFilter)
+	p.rd = c
+	if sz := p.options[mangos.OptionReadBufferSize].(int); sz > 0 {
+		p.rd = getReader(c, sz)
+	}
+	p.cr.r = p.rd
+	p.wr = c
+	if v, ok := p.options[mangos.OptionSendBatch].(time.Duration); ok && v > 0 {
+		p.batch = v
+		p.bw = getWriter(c)
+		p.wr = p.bw
+	}
+	p.byteOrder = binary.BigEndian
+	if v, ok := p.options[mangos.OptionByteOrder].(binary.ByteOrder); ok {
+		p.byteOrder = v
+	}
+	p.alloc, _ = p.options[mangos.OptionRecvAllocator].(mangos.RecvAllocator)
+	p.framer = DefaultFramer{
+		MaxRecvSize: p.maxrx,
+		ByteOrder:   p.byteOrder,
+		Allocator:   p.alloc,
+	}
+	p.log = nopLogger{}
+	if v, ok := p.options[mangos.OptionLogger].(mangos.Logger); ok {
+		p.log = v
+	}
+}
 
-	if err := p.handshake(); err != nil {
-		return nil, err
+// defaultReadBufferSize is the default for OptionReadBufferSize.  This
+// is enough for the length prefix and body of typical small messages.
+const defaultReadBufferSize = 4096
+
+// sendBatchSize is the size of the buffer used for OptionSendBatch.
+// Once this much is waiting, it is written without further delay.
+const sendBatchSize = 32 * 1024
+
+// Buffers of the default sizes are kept in pools when pipes close, as
+// connections come and go often enough that they would otherwise be a
+// large part of the garbage.
+var (
+	readerPool sync.Pool
+	writerPool sync.Pool
+)
+
+func getReader(c net.Conn, sz int) *bufio.Reader {
+	if sz == defaultReadBufferSize {
+		if br, ok := readerPool.Get().(*bufio.Reader); ok {
+			br.Reset(c)
+			return br
+		}
 	}
+	return bufio.NewReaderSize(c, sz)
+}
 
-	return p, nil
+func putReader(br *bufio.Reader) {
+	if br.Size() == defaultReadBufferSize {
+		br.Reset(nil)
+		readerPool.Put(br)
+	}
+}
+
+func getWriter(c net.Conn) *bufio.Writer {
+	if bw, ok := writerPool.Get().(*bufio.Writer); ok {
+		bw.Reset(c)
+		return bw
+	}
+	return bufio.NewWriterSize(c, sendBatchSize)
 }
 
+func putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	writerPool.Put(bw)
+}
+
+// supportedVersions is the set of SP wire versions that we can speak.
+// The highest version is advertised to the peer during the handshake.
+// Note that other SP implementations reject any version but 0, so a
+// higher version should only be added when the handshake remains
+// compatible.  For that reason, version 1 (see metadataVersion) is
+// only spoken when OptionHandshakeMetadata is set.
+var supportedVersions = []byte{0}
+
 // connHeader is exchanged during the initial handshake.
 type connHeader struct {
 	Zero    byte // must be zero
 	S       byte // 'S'
 	P       byte // 'P'
-	Version byte // only zero at present
+	Version byte // highest version supported by the sender
 	Proto   uint16
-	Rsvd    uint16 // always zero at present
+	Rsvd    uint16 // feature flags, see below
+}
+
+// Feature flags carried in the reserved field of the header.  These are
+// only ever sent when enabled by an option, as other implementations
+// insist that the field be zero.  A feature is used only when both peers
+// set its flag, so flags that we do not know are ignored, allowing peers
+// to add features of their own.
+const (
+	rsvdChecksum = 1 << 0 // willing to use crcFramer
+	rsvdGzip     = 1 << 1 // willing to use gzip compression
+	rsvdDeflate  = 1 << 2 // willing to use deflate compression
+	rsvdTrace    = 1 << 3 // willing to use traceFramer
+	rsvdPing     = 1 << 4 // willing to use pingFramer
+	rsvdType     = 1 << 5 // willing to use typeFramer
+	rsvdCredit   = 1 << 6 // willing to use flow credits (with pingFramer)
+	rsvdFragment = 1 << 7 // willing to use fragFramer
+	rsvdSeq      = 1 << 8 // willing to use seqFramer
+)
+
+// Version returns the SP wire version negotiated with the peer.
+func (p *conn) Version() byte {
+	return p.version
+}
+
+// negotiateVersion selects the highest version supported by both
+// ourself and a peer whose highest supported version is given.
+func (p *conn) negotiateVersion(peer byte) (byte, bool) {
+	best := -1
+	for _, v := range p.versions {
+		if v <= peer && int(v) > best {
+			best = int(v)
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	return byte(best), true
 }
 
 // handshake establishes an SP connection between peers.  Both sides must
 // send the header, then both sides must wait for the peer's header.
 // As a side effect, the peer's protocol number is stored in the conn.
-// Also, various properties are initialized.
+// Also, various properties are initialized.  The OptionHandshakeHook,
+// if any, is told when the handshake starts, and how it ends.
 func (p *conn) handshake() error {
+	hook, _ := p.options[mangos.OptionHandshakeHook].(mangos.HandshakeHook)
+	ev := mangos.HandshakeEvent{
+		Type:       mangos.HandshakeStarted,
+		LocalAddr:  p.c.LocalAddr(),
+		RemoteAddr: p.c.RemoteAddr(),
+	}
+	if hook != nil {
+		hook(ev)
+	}
+	start := time.Now()
+	proto, err := p.negotiate()
+	p.info.HandshakeDuration = time.Since(start)
+	if err != nil {
+		p.log.Warnf("mangos: handshake with %v failed: %v", p.c.RemoteAddr(), err)
+	}
+	if hook != nil {
+		ev.Proto = proto
+		if err == nil {
+			ev.Type = mangos.HandshakeSucceeded
+		} else {
+			ev.Type = mangos.HandshakeFailed
+			ev.Err = err
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				ev.Err = mangos.ErrHandshakeTimeout
+			}
+		}
+		hook(ev)
+	}
+	return err
+}
+
+// negotiate does the work of the handshake, returning the protocol
+// number the peer sent, if it got that far.
+func (p *conn) negotiate() (uint16, error) {
 	var err error
+	var ok bool
+
+	var max byte
+	for _, v := range p.versions {
+		if v > max {
+			max = v
+		}
+	}
 
-	h := connHeader{S: 'S', P: 'P', Proto: p.proto.Self}
+	h := connHeader{S: 'S', P: 'P', Version: max, Proto: p.proto.Self}
+	// The other framings always use big-endian lengths.
+	if _, ok = p.framer.(DefaultFramer); ok && p.byteOrder == binary.BigEndian {
+		if v, ok := p.options[mangos.OptionChecksum].(bool); ok && v {
+			h.Rsvd |= rsvdChecksum
+		}
+		if v, ok := p.options[mangos.OptionTraceHeader].(bool); ok && v {
+			h.Rsvd |= rsvdTrace
+		}
+		if v, ok := p.options[mangos.OptionTypeHeader].(bool); ok && v {
+			h.Rsvd |= rsvdType
+		}
+		if v, ok := p.options[mangos.OptionSeqHeader].(bool); ok && v {
+			h.Rsvd |= rsvdSeq
+		}
+		if v, ok := p.options[mangos.OptionKeepAliveInterval].(time.Duration); ok && v > 0 {
+			h.Rsvd |= rsvdPing
+		}
+		if v, ok := p.options[mangos.OptionFlowCredits].(int); ok && v > 0 {
+			h.Rsvd |= rsvdCredit
+		}
+		if v, ok := p.options[mangos.OptionMaxFrameSize].(int); ok && v > 0 {
+			h.Rsvd |= rsvdFragment
+		}
+		if v, ok := p.options[mangos.OptionCompression].(string); ok {
+			if c := codecByName(v); c != nil {
+				h.Rsvd |= c.flag
+			}
+		}
+	}
+	flags := h.Rsvd
 	if err = binary.Write(p.c, binary.BigEndian, &h); err != nil {
-		return err
+		p.c.Close()
+		return 0, err
 	}
 	if err = binary.Read(p.c, binary.BigEndian, &h); err != nil {
 		p.c.Close()
-		return err
+		return 0, handshakeError(err)
 	}
-	if h.Zero != 0 || h.S != 'S' || h.P != 'P' || h.Rsvd != 0 {
+	if h.Zero != 0 || h.S != 'S' || h.P != 'P' {
 		p.c.Close()
-		return mangos.ErrBadHeader
+		return 0, mangos.ErrBadHeader
 	}
-	// The only version number we support at present is "0", at offset 3.
-	if h.Version != 0 {
+	// The version number is at offset 3.  Each side advertises
+	// the highest version it supports, and both settle on the
+	// highest version that they have in common.
+	if p.version, ok = p.negotiateVersion(h.Version); !ok {
 		p.c.Close()
-		return mangos.ErrBadVersion
+		return h.Proto, mangos.ErrBadVersion
 	}
 
 	// The protocol number lives as 16-bits (big-endian) at offset 4.
-	if h.Proto != p.proto.Peer {
+	if h.Proto != p.proto.Peer && !ValidPeer(p.proto.Self, h.Proto) {
+		p.c.Close()
+		return h.Proto, mangos.ErrIncompatibleProto
+	}
+	p.proto.Peer = h.Proto
+	if p.version >= metadataVersion {
+		if err = p.exchangeMetadata(); err != nil {
+			p.c.Close()
+			return h.Proto, err
+		}
+	}
+	if err = p.authenticate(); err != nil {
 		p.c.Close()
-		return mangos.ErrBadProto
+		return h.Proto, err
+	}
+	p.info.Version = p.version
+	p.info.RemoteProtocol = h.Proto
+	if flags&h.Rsvd&rsvdChecksum != 0 {
+		p.framer = crcFramer{maxrx: p.maxrx}
+		p.info.Checksum = true
+	}
+	if flags&h.Rsvd&rsvdFragment != 0 {
+		// This goes nearest the wire, so that everything else
+		// is done to whole messages.
+		size := p.options[mangos.OptionMaxFrameSize].(int)
+		p.framer = newFragFramer(p.framer, size, p.maxrx)
+		p.info.MaxFrameSize = size
+	}
+	if c := codecByFlags(flags & h.Rsvd); c != nil {
+		p.framer = newCompressFramer(p.framer, c, p.maxrx)
+		p.info.Compression = c.name
+	}
+	if flags&h.Rsvd&rsvdTrace != 0 {
+		p.framer = newTraceFramer(p.framer, p.maxrx)
+		p.info.TraceHeader = true
+	}
+	if flags&h.Rsvd&rsvdType != 0 {
+		p.framer = newTypeFramer(p.framer, p.maxrx)
+		p.info.TypeHeader = true
 	}
+	if flags&h.Rsvd&(rsvdPing|rsvdCredit) != 0 {
+		p.kaFramer = newPingFramer(p.framer, p.maxrx)
+		p.framer = p.kaFramer
+	}
+	if flags&h.Rsvd&rsvdSeq != 0 {
+		// This goes outside the pingFramer, so that pings and
+		// grants of credit do not use up sequence numbers.
+		p.framer = newSeqFramer(p.framer, p.maxrx)
+		p.info.SeqHeader = true
+	}
+	if flags&h.Rsvd&rsvdPing != 0 {
+		p.info.KeepAlive = true
+		p.kaPong = make(chan struct{}, 1)
+		p.kaStop = make(chan struct{})
+	}
+	if flags&h.Rsvd&rsvdCredit != 0 {
+		p.info.FlowCredits = true
+		p.crWindow = p.options[mangos.OptionFlowCredits].(int)
+		p.crUsed = p.crWindow // the initial grant
+		p.crMore = make(chan struct{}, 1)
+		p.crGrant = make(chan struct{}, 1)
+		p.crGrant <- struct{}{}
+		p.crStop = make(chan struct{})
+	}
+	if n, ok := p.options[mangos.OptionAsyncRecv].(int); ok && n > 0 {
+		p.asyncQ = make(chan asyncMsg, n)
+		p.asyncStop = make(chan struct{})
+	}
+	p.started = time.Now()
+	p.Lock()
 	p.open = true
+	p.Unlock()
+	if p.kaStop != nil {
+		interval := p.options[mangos.OptionKeepAliveInterval].(time.Duration)
+		missed, ok := p.options[mangos.OptionKeepAliveMissed].(int)
+		if !ok {
+			missed = defaultKeepAliveMissed
+		}
+		go p.keepAlive(interval, missed)
+	}
+	if p.crStop != nil {
+		go p.grantCredit()
+	}
+	return h.Proto, nil
+}
+
+// authenticate runs the OptionAuthenticator, if there is one.
+func (p *conn) authenticate() error {
+	a, ok := p.options[mangos.OptionAuthenticator].(mangos.Authenticator)
+	if !ok {
+		return nil
+	}
+	var err error
+	if p.accepted {
+		err = a.ServerAuth(p.c)
+	} else {
+		err = a.ClientAuth(p.c)
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return err
+		}
+		p.log.Warnf("mangos: authentication of %v failed: %v", p.c.RemoteAddr(), err)
+		return mangos.ErrAuthFailed
+	}
 	return nil
 }
+
+// handshakeError wraps a failure to read the peer's handshake in a
+// HandshakeError.  Timeouts are left alone, as they are reported as
+// ErrHandshakeTimeout.
+func handshakeError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return err
+	}
+	return &mangos.HandshakeError{Err: err}
+}
+
+// nopLogger is the Logger used when OptionLogger is not set.
+type nopLogger struct{}
+
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Debugf(string, ...interface{}) {}
@@ -0,0 +1,2944 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+var reqInfo = ProtocolInfo{Self: mangos.ProtoReq, Peer: mangos.ProtoRep}
+var repInfo = ProtocolInfo{Self: mangos.ProtoRep, Peer: mangos.ProtoReq}
+
+// connPair returns a connected pair of TCP loopback pipes, the first
+// being REQ, and the second REP.
+func connPair(t testing.TB, copts, sopts map[string]interface{}) (Pipe, Pipe) {
+	return framerPair(t, copts, sopts, nil)
+}
+
+// framerPair is like connPair, but both pipes use the given Framer.
+func framerPair(t testing.TB, copts, sopts map[string]interface{}, f Framer) (Pipe, Pipe) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	type result struct {
+		p   Pipe
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		p, err := NewConnPipeFramer(c, repInfo, sopts, f)
+		ch <- result{p, err}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	client, err := NewConnPipeFramer(c, reqInfo, copts, f)
+	if err != nil {
+		t.Fatalf("Client handshake failed: %v", err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("Server handshake failed: %v", r.err)
+	}
+	return client, r.p
+}
+
+func newMsg(b []byte) *Message {
+	m := mangos.NewMessage(len(b))
+	m.Body = append(m.Body, b...)
+	return m
+}
+
+func TestConnRecvReader(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	big := bytes.Repeat([]byte("abcdefgh"), 1024)
+	for _, b := range [][]byte{big, big, []byte("last")} {
+		if err := client.Send(newMsg(b)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	rp := server.(interface {
+		RecvReader() (io.Reader, int64, error)
+	})
+
+	// Read the first message fully.
+	r, sz, err := rp.RecvReader()
+	if err != nil {
+		t.Fatalf("RecvReader failed: %v", err)
+	}
+	if sz != int64(len(big)) {
+		t.Errorf("Wrong size: %d", sz)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(b, big) {
+		t.Errorf("Body mismatch: %v", err)
+	}
+
+	// Read only a little of the second, abandoning the rest.
+	if r, _, err = rp.RecvReader(); err != nil {
+		t.Fatalf("RecvReader failed: %v", err)
+	}
+	if _, err = io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Errorf("Partial read failed: %v", err)
+	}
+
+	// The pipe should still be in sync for the next message.
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "last" {
+		t.Errorf("Lost framing, got %d bytes", len(m.Body))
+	}
+}
+
+func TestConnRecvInto(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	for _, b := range []string{"exact", "too long", "next"} {
+		if err := client.Send(newMsg([]byte(b))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	ri := server.(interface {
+		RecvInto([]byte) (int, error)
+	})
+
+	buf := make([]byte, 5)
+	n, err := ri.RecvInto(buf)
+	if err != nil {
+		t.Fatalf("RecvInto failed: %v", err)
+	}
+	if n != 5 || string(buf) != "exact" {
+		t.Errorf("Got %q", buf[:n])
+	}
+	if _, err = ri.RecvInto(buf); err != mangos.ErrBufferTooSmall {
+		t.Errorf("Expected ErrBufferTooSmall, got %v", err)
+	}
+	// The message that did not fit was skipped.
+	if n, err = ri.RecvInto(buf); err != nil {
+		t.Fatalf("RecvInto failed: %v", err)
+	}
+	if string(buf[:n]) != "next" {
+		t.Errorf("Lost framing, got %q", buf[:n])
+	}
+}
+
+func TestConnRecvLyingSize(t *testing.T) {
+	// The peer declares a gigabyte, but sends almost nothing.
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint64(1<<30))
+	b.Write([]byte("short"))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f := DefaultFramer{MaxRecvSize: 1 << 30}
+	if _, err := f.ReadMsg(&b); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("Allocated %d bytes", n)
+	}
+}
+
+func TestConnRecvLarge(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// This is received in several chunks, which must be reassembled.
+	body := make([]byte, 5*readChunkSize+123)
+	rand.Read(body)
+	go client.Send(newMsg(body))
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if !bytes.Equal(m.Body, body) {
+		t.Errorf("Body mismatch")
+	}
+	m.Free()
+}
+
+func TestConnHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	// This peer connects, but never sends its header.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	start := time.Now()
+	p, err := NewConnPipeWithTimeout(s, repInfo, nil, 100*time.Millisecond)
+	if err != mangos.ErrHandshakeTimeout {
+		t.Errorf("Expected ErrHandshakeTimeout, got %v", err)
+	}
+	if p != nil {
+		t.Errorf("Got non-nil pipe")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Timeout took too long: %v", d)
+	}
+}
+
+func TestConnHeaderInBody(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	hdr := []byte{0x80, 0, 0, 1}
+	m := newMsg([]byte("ping"))
+	m.Header = append(m.Header, hdr...)
+	if err := client.Send(m); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if len(m.Header) != 0 {
+		t.Errorf("Header should be empty: %v", m.Header)
+	}
+	if !bytes.Equal(m.Body, append(hdr, []byte("ping")...)) {
+		t.Errorf("Body mismatch: %v", m.Body)
+	}
+}
+
+func benchmarkConnSend(b *testing.B, f Framer, copts map[string]interface{}) {
+	client, server := framerPair(b, copts, nil, f)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			m, err := server.Recv()
+			if err != nil {
+				return
+			}
+			m.Free()
+		}
+	}()
+
+	body := make([]byte, 64)
+	b.SetBytes(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := newMsg(body)
+		m.Header = append(m.Header, 0x80, 0, 0, 1)
+		if err := client.Send(m); err != nil {
+			b.Fatalf("Send failed: %v", err)
+		}
+	}
+	if err := client.(*conn).Flush(); err != nil {
+		b.Fatalf("Flush failed: %v", err)
+	}
+}
+
+func BenchmarkConnSend64(b *testing.B) {
+	benchmarkConnSend(b, nil, nil)
+}
+
+func BenchmarkConnSend64Varint(b *testing.B) {
+	benchmarkConnSend(b, VarintFramer{}, nil)
+}
+
+func BenchmarkConnSend64Batch(b *testing.B) {
+	benchmarkConnSend(b, nil, map[string]interface{}{
+		mangos.OptionSendBatch: time.Millisecond,
+	})
+}
+
+func TestConnSendBatch(t *testing.T) {
+	client, server := connPair(t, map[string]interface{}{
+		mangos.OptionSendBatch: 20 * time.Millisecond,
+	}, nil)
+	defer client.Close()
+	defer server.Close()
+	cc := client.(*conn)
+
+	recv := func(want string) {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != want {
+			t.Errorf("Got %q, expected %q", m.Body, want)
+		}
+		m.Free()
+	}
+
+	// Messages sent in different ways are kept in order, and each
+	// arrives intact.
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := client.Send(newMsg([]byte(fmt.Sprint(i)))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	pm := mangos.NewPreparedMessage(newMsg([]byte("prepared")))
+	if err := cc.SendPrepared(pm); err != nil {
+		t.Fatalf("SendPrepared failed: %v", err)
+	}
+	if err := cc.SendReader(nil, strings.NewReader("reader"), 6); err != nil {
+		t.Fatalf("SendReader failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		recv(fmt.Sprint(i))
+	}
+	recv("prepared")
+	recv("reader")
+	// Without a Flush, they are held back until the timer fires.
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Errorf("Messages arrived after %v, before the batch time", d)
+	}
+
+	// Flush sends them straight away.
+	start = time.Now()
+	if err := client.Send(newMsg([]byte("flushed"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	recv("flushed")
+	if d := time.Since(start); d > 15*time.Millisecond {
+		t.Errorf("Flushed message took %v", d)
+	}
+}
+
+// writeCounter counts the writes made to a net.Conn.
+type writeCounter struct {
+	net.Conn
+	writes int32
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestConnCork(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+	cc := client.(*conn)
+
+	if err := cc.Cork(); err != nil {
+		t.Fatalf("Cork failed: %v", err)
+	}
+	if runtime.GOOS == "linux" && !cc.kcork {
+		t.Errorf("TCP_CORK was not used")
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Send(newMsg([]byte(fmt.Sprint(i)))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	// Flush does not defeat the cork.
+	if err := cc.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	sc := server.(*conn)
+	sc.SetRecvDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := server.Recv(); err == nil {
+		t.Fatalf("Message arrived while corked")
+	}
+	sc.SetRecvDeadline(time.Time{})
+
+	if err := cc.Uncork(); err != nil {
+		t.Fatalf("Uncork failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != fmt.Sprint(i) {
+			t.Errorf("Got %q, expected %d", m.Body, i)
+		}
+		m.Free()
+	}
+	if err := cc.Uncork(); err != nil {
+		t.Errorf("Second Uncork failed: %v", err)
+	}
+}
+
+func TestConnCorkBuffered(t *testing.T) {
+	c1, c2 := net.Pipe()
+	wc := &writeCounter{Conn: c1}
+	client := NewRawConnPipe(wc, mangos.ProtoPair, mangos.ProtoPair)
+	server := NewRawConnPipe(c2, mangos.ProtoPair, mangos.ProtoPair)
+	defer client.Close()
+	defer server.Close()
+	cc := client.(*conn)
+
+	// As net.Pipe is synchronous, these would block if written.
+	if err := cc.Cork(); err != nil {
+		t.Fatalf("Cork failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Send(newMsg([]byte(fmt.Sprint(i)))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&wc.writes); n != 0 {
+		t.Fatalf("Got %d writes while corked", n)
+	}
+
+	done := make(chan error)
+	go func() { done <- cc.Uncork() }()
+	for i := 0; i < 3; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != fmt.Sprint(i) {
+			t.Errorf("Got %q, expected %d", m.Body, i)
+		}
+		m.Free()
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Uncork failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&wc.writes); n != 1 {
+		t.Errorf("Batch took %d writes, expected 1", n)
+	}
+	// Once uncorked, messages are written straight away again.
+	if cc.bw != nil {
+		t.Errorf("Cork buffer was not released")
+	}
+}
+
+func benchmarkConnRecv(b *testing.B, f Framer, free bool) {
+	client, server := framerPair(b, nil, nil, f)
+	defer client.Close()
+	defer server.Close()
+
+	body := make([]byte, 64)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if client.Send(newMsg(body)) != nil {
+				return
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			b.Fatalf("Recv failed: %v", err)
+		}
+		if free {
+			m.Free()
+		}
+	}
+}
+
+func BenchmarkConnRecv64(b *testing.B) {
+	benchmarkConnRecv(b, nil, true)
+}
+
+func BenchmarkConnRecv64NoFree(b *testing.B) {
+	benchmarkConnRecv(b, nil, false)
+}
+
+func BenchmarkConnRecv64Varint(b *testing.B) {
+	benchmarkConnRecv(b, VarintFramer{}, true)
+}
+
+// handshakePair runs the handshake on a pair of raw conns with the
+// given supported version sets.
+func handshakePair(t *testing.T, cv, sv []byte) (*conn, *conn, error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	client := &conn{}
+	client.init(c, reqInfo, nil)
+	client.versions = cv
+	server := &conn{}
+	server.init(s, repInfo, nil)
+	server.versions = sv
+
+	ch := make(chan error)
+	go func() {
+		ch <- server.handshake()
+	}()
+	cerr := client.handshake()
+	serr := <-ch
+	return client, server, cerr, serr
+}
+
+func TestConnVersionNegotiation(t *testing.T) {
+	type vcase struct {
+		cv, sv []byte
+		want   byte
+	}
+	for _, vc := range []vcase{
+		{[]byte{0}, []byte{0}, 0},
+		{[]byte{0, 1}, []byte{0}, 0},
+		{[]byte{0}, []byte{0, 1}, 0},
+		{[]byte{0, 1}, []byte{0, 1, 2}, 1},
+	} {
+		client, server, cerr, serr := handshakePair(t, vc.cv, vc.sv)
+		if cerr != nil || serr != nil {
+			t.Errorf("Handshake %v/%v failed: %v %v",
+				vc.cv, vc.sv, cerr, serr)
+			continue
+		}
+		if client.Version() != vc.want || server.Version() != vc.want {
+			t.Errorf("Handshake %v/%v got %d/%d, wanted %d",
+				vc.cv, vc.sv, client.Version(),
+				server.Version(), vc.want)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// No version in common.
+	_, _, cerr, serr := handshakePair(t, []byte{2}, []byte{0, 1})
+	if cerr != mangos.ErrBadVersion && serr != mangos.ErrBadVersion {
+		t.Errorf("Expected ErrBadVersion, got %v %v", cerr, serr)
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.Send(newMsg([]byte("last"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	cw := client.(interface {
+		CloseWrite() error
+	})
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+
+	m, err := server.Recv()
+	if err != nil || string(m.Body) != "last" {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if _, err = server.Recv(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	// The reverse direction still works.
+	if err = server.Send(newMsg([]byte("reply"))); err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+	if m, err = client.Recv(); err != nil || string(m.Body) != "reply" {
+		t.Errorf("Reply not received: %v", err)
+	}
+}
+
+// mockConn is a net.Conn whose Write behavior can be altered.
+type mockConn struct {
+	net.Conn
+	short  bool  // if true, writes are truncated
+	werr   error // if non-nil, writes fail
+	closed bool
+}
+
+func (c *mockConn) Write(b []byte) (int, error) {
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	if c.short && len(b) > 1 {
+		return len(b) / 2, nil
+	}
+	return len(b), nil
+}
+
+func (c *mockConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (*mockConn) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (*mockConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func (*mockConn) SetReadDeadline(time.Time) error { return nil }
+
+func TestConnHandshakeWriteFail(t *testing.T) {
+	werr := errors.New("write failed")
+	c := &mockConn{werr: werr}
+	if _, err := NewConnPipe(c, reqInfo, nil); err != werr {
+		t.Errorf("Expected write error, got %v", err)
+	}
+	if !c.closed {
+		t.Errorf("Connection was not closed")
+	}
+}
+
+func TestConnShortWrite(t *testing.T) {
+	mc := &mockConn{short: true}
+	p := &conn{}
+	p.init(mc, reqInfo, nil)
+	p.open = true
+
+	if err := p.Send(newMsg([]byte("hello"))); err != mangos.ErrShortWrite {
+		t.Errorf("Expected ErrShortWrite, got %v", err)
+	}
+	if !mc.closed {
+		t.Errorf("Connection not closed")
+	}
+}
+
+func TestConnRecvDeadline(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	dp := server.(interface {
+		SetRecvDeadline(time.Time) error
+	})
+	dp.SetRecvDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := server.Recv()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	// The pipe should still be usable.
+	dp.SetRecvDeadline(time.Time{})
+	if err = client.Send(newMsg([]byte("late"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil || string(m.Body) != "late" {
+		t.Errorf("Recv after timeout failed: %v", err)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		m := newMsg([]byte("hello"))
+		m.Header = append(m.Header, 0x80, 0, 0, 1)
+		if err := client.Send(m); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if _, err := server.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+	}
+	v, err := client.GetOption(mangos.OptionPipeStats)
+	if err != nil {
+		t.Fatalf("Failed getting stats: %v", err)
+	}
+	cs := v.(mangos.PipeStats)
+	if cs.TxMsgs != 3 || cs.TxBytes != 27 || cs.RxMsgs != 0 {
+		t.Errorf("Bad client stats: %+v", cs)
+	}
+	v, _ = server.GetOption(mangos.OptionPipeStats)
+	ss := v.(mangos.PipeStats)
+	if ss.RxMsgs != 3 || ss.RxBytes != 27 || ss.TxMsgs != 0 {
+		t.Errorf("Bad server stats: %+v", ss)
+	}
+	if ss.RemoteProtocol != mangos.ProtoReq || ss.Duration <= 0 {
+		t.Errorf("Bad server info: %+v", ss)
+	}
+}
+
+func TestConnInfo(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	copts := map[string]interface{}{
+		mangos.OptionChecksum:    true,
+		mangos.OptionCompression: "gzip",
+	}
+	// The server holds back its header, delaying the client's handshake.
+	sopts := map[string]interface{}{
+		mangos.OptionChecksum:    true,
+		mangos.OptionCompression: "gzip",
+		mangos.OptionHandshakeHook: mangos.HandshakeHook(func(ev mangos.HandshakeEvent) {
+			if ev.Type == mangos.HandshakeStarted {
+				time.Sleep(delay)
+			}
+		}),
+	}
+	client, server := connPair(t, copts, sopts)
+	defer client.Close()
+	defer server.Close()
+
+	info := client.(*conn).Info()
+	if info.HandshakeDuration < delay || info.HandshakeDuration > 20*delay {
+		t.Errorf("Handshake took %v", info.HandshakeDuration)
+	}
+	if info.Version != 0 {
+		t.Errorf("Wrong version %d", info.Version)
+	}
+	if info.RemoteProtocol != mangos.ProtoRep {
+		t.Errorf("Wrong remote protocol %d", info.RemoteProtocol)
+	}
+	if !info.Checksum || info.Compression != "gzip" {
+		t.Errorf("Wrong options negotiated: %+v", info)
+	}
+	if info.TraceHeader || info.KeepAlive {
+		t.Errorf("Unexpected options negotiated: %+v", info)
+	}
+	if info := server.(*conn).Info(); info.RemoteProtocol != mangos.ProtoReq {
+		t.Errorf("Wrong remote protocol %d", info.RemoteProtocol)
+	}
+}
+
+func TestConnRawPipe(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewRawConnPipe(c1, mangos.ProtoPair, mangos.ProtoPair)
+	server := NewRawConnPipe(c2, mangos.ProtoPair, mangos.ProtoPair)
+	defer client.Close()
+	defer server.Close()
+
+	if client.RemoteProtocol() != mangos.ProtoPair {
+		t.Errorf("Wrong remote protocol %d", client.RemoteProtocol())
+	}
+	for i := 0; i < 3; i++ {
+		body := []byte(fmt.Sprintf("ping %d", i))
+		go func() {
+			if err := client.Send(newMsg(body)); err != nil {
+				t.Errorf("Send failed: %v", err)
+			}
+		}()
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != string(body) {
+			t.Errorf("Got %q, expected %q", m.Body, body)
+		}
+		m.Free()
+	}
+	// No SP header precedes the messages.
+	go client.Send(newMsg([]byte("raw")))
+	var b [11]byte
+	if _, err := io.ReadFull(server.(*conn).rd, b[:]); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(b[:], []byte{0, 0, 0, 0, 0, 0, 0, 3, 'r', 'a', 'w'}) {
+		t.Errorf("Wrong bytes on the wire: %v", b)
+	}
+}
+
+func TestConnHandshakeContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	// The listener accepts, but never performs the handshake.
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			time.Sleep(time.Second)
+			c.Close()
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	p, err := NewConnPipeContext(ctx, c, reqInfo, nil)
+	if err != context.Canceled || p != nil {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Cancel took too long: %v", d)
+	}
+}
+
+func TestConnContextCancelAfterHandshake(t *testing.T) {
+	before := runtime.NumGoroutine()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	opts := map[string]interface{}{mangos.OptionFlowCredits: 4}
+	servers := make(chan Pipe, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			servers <- nil
+			return
+		}
+		p, _ := NewConnPipe(c, repInfo, opts)
+		servers <- p
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	copts := map[string]interface{}{
+		mangos.OptionFlowCredits: 4,
+		mangos.OptionHandshakeHook: mangos.HandshakeHook(func(ev mangos.HandshakeEvent) {
+			if ev.Type == mangos.HandshakeSucceeded {
+				// Canceled once the handshake is done, but
+				// before NewConnPipeContext returns.
+				cancel()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}),
+	}
+	p, err := NewConnPipeContext(ctx, c, reqInfo, copts)
+	if err != context.Canceled || p != nil {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if s := <-servers; s != nil {
+		s.Close()
+	}
+	l.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Goroutines leaked: %d before, %d after",
+				before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnValidPeer(t *testing.T) {
+	protos := []uint16{
+		mangos.ProtoPair, mangos.ProtoPub, mangos.ProtoSub,
+		mangos.ProtoReq, mangos.ProtoRep, mangos.ProtoPush,
+		mangos.ProtoPull, mangos.ProtoSurveyor,
+		mangos.ProtoRespondent, mangos.ProtoBus, mangos.ProtoStar,
+	}
+	valid := map[[2]uint16]bool{
+		{mangos.ProtoPair, mangos.ProtoPair}:           true,
+		{mangos.ProtoPub, mangos.ProtoSub}:             true,
+		{mangos.ProtoSub, mangos.ProtoPub}:             true,
+		{mangos.ProtoReq, mangos.ProtoRep}:             true,
+		{mangos.ProtoRep, mangos.ProtoReq}:             true,
+		{mangos.ProtoPush, mangos.ProtoPull}:           true,
+		{mangos.ProtoPull, mangos.ProtoPush}:           true,
+		{mangos.ProtoSurveyor, mangos.ProtoRespondent}: true,
+		{mangos.ProtoRespondent, mangos.ProtoSurveyor}: true,
+		{mangos.ProtoBus, mangos.ProtoBus}:             true,
+		{mangos.ProtoStar, mangos.ProtoStar}:           true,
+	}
+	for _, self := range protos {
+		for _, peer := range protos {
+			want := valid[[2]uint16{self, peer}]
+			if ValidPeer(self, peer) != want {
+				t.Errorf("ValidPeer(%d, %d) != %v",
+					self, peer, want)
+			}
+		}
+	}
+}
+
+func TestConnIncompatiblePeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	pub := ProtocolInfo{Self: mangos.ProtoPub, Peer: mangos.ProtoSub}
+	pull := ProtocolInfo{Self: mangos.ProtoPull, Peer: mangos.ProtoPush}
+	ch := make(chan error)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_, err = NewConnPipe(c, pull, nil)
+		}
+		ch <- err
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if _, err = NewConnPipe(c, pub, nil); err != mangos.ErrIncompatibleProto {
+		t.Errorf("Expected ErrIncompatibleProto, got %v", err)
+	}
+	if err = <-ch; err != mangos.ErrIncompatibleProto {
+		t.Errorf("Expected ErrIncompatibleProto, got %v", err)
+	}
+}
+
+func TestConnCloseErr(t *testing.T) {
+	closeErr := func(p Pipe) error {
+		return p.(interface{ CloseErr() error }).CloseErr()
+	}
+
+	// Graceful close by the peer.
+	client, server := connPair(t, nil, nil)
+	if err := closeErr(server); err != nil {
+		t.Errorf("Open pipe has error: %v", err)
+	}
+	client.Close()
+	if _, err := server.Recv(); err == nil {
+		t.Errorf("Recv succeeded on closed pipe")
+	}
+	if err := closeErr(server); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	if err := closeErr(client); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	server.Close()
+	if err := closeErr(server); err != io.EOF {
+		t.Errorf("Close replaced the error: %v", err)
+	}
+
+	// Framing violation.
+	sopts := map[string]interface{}{mangos.OptionMaxRecvSize: 8}
+	client, server = connPair(t, nil, sopts)
+	defer client.Close()
+	defer server.Close()
+	if err := client.Send(newMsg(make([]byte, 100))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Recv(); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+	if err := closeErr(server); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestConnVarintFramer(t *testing.T) {
+	sopts := map[string]interface{}{mangos.OptionMaxRecvSize: 20000}
+	client, server := framerPair(t, nil, sopts, VarintFramer{MaxRecvSize: 20000})
+	defer client.Close()
+	defer server.Close()
+
+	for _, sz := range []int{0, 1, 127, 128, 16383, 16384, 20000} {
+		b := bytes.Repeat([]byte{'x'}, sz)
+		if err := client.Send(newMsg(b)); err != nil {
+			t.Fatalf("Send %d failed: %v", sz, err)
+		}
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d failed: %v", sz, err)
+		}
+		if !bytes.Equal(m.Body, b) {
+			t.Errorf("Body mismatch for size %d", sz)
+		}
+		m.Free()
+	}
+	if err := client.Send(newMsg(make([]byte, 20001))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Recv(); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+	if _, _, err := server.(interface {
+		RecvReader() (io.Reader, int64, error)
+	}).RecvReader(); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+}
+
+func TestConnVarintOverhead(t *testing.T) {
+	for _, c := range []struct {
+		size     int
+		overhead int
+	}{{0, 1}, {64, 1}, {127, 1}, {128, 2}, {16383, 2}, {16384, 3}} {
+		var buf bytes.Buffer
+		m := newMsg(make([]byte, c.size))
+		if err := (VarintFramer{}).WriteMsg(&buf, m); err != nil {
+			t.Fatalf("WriteMsg failed: %v", err)
+		}
+		if buf.Len() != c.size+c.overhead {
+			t.Errorf("Size %d: overhead %d", c.size, buf.Len()-c.size)
+		}
+		rm, err := (VarintFramer{}).ReadMsg(&buf)
+		if err != nil || len(rm.Body) != c.size {
+			t.Errorf("Size %d: ReadMsg failed: %v", c.size, err)
+		}
+	}
+}
+
+func TestConnRecvBufferedAfterClose(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := client.Send(newMsg([]byte("data"))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 20)
+	if _, err := server.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	// The remaining messages are most likely in our read buffer now,
+	// but they must not be delivered after close.
+	server.Close()
+	if _, err := server.Recv(); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// readCountConn counts the Read calls made on a connection.
+type readCountConn struct {
+	net.Conn
+	reads int
+}
+
+func (c *readCountConn) Read(b []byte) (int, error) {
+	c.reads++
+	return c.Conn.Read(b)
+}
+
+func benchmarkConnRecvBuffered(b *testing.B, bufsz int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	ch := make(chan Pipe)
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			close(ch)
+			return
+		}
+		p, err := NewConnPipe(c, reqInfo, nil)
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- p
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		b.Fatalf("Accept failed: %v", err)
+	}
+	rc := &readCountConn{Conn: c}
+	opts := map[string]interface{}{mangos.OptionReadBufferSize: bufsz}
+	server, err := NewConnPipe(rc, repInfo, opts)
+	if err != nil {
+		b.Fatalf("Handshake failed: %v", err)
+	}
+	defer server.Close()
+	client := <-ch
+	if client == nil {
+		b.Fatalf("Client failed")
+	}
+	defer client.Close()
+
+	body := make([]byte, 64)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if client.Send(newMsg(body)) != nil {
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	rc.reads = 0
+	for i := 0; i < b.N; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			b.Fatalf("Recv failed: %v", err)
+		}
+		m.Free()
+	}
+	b.ReportMetric(float64(rc.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkConnRecv64Unbuffered(b *testing.B) {
+	benchmarkConnRecvBuffered(b, 0)
+}
+
+func BenchmarkConnRecv64Buffered(b *testing.B) {
+	benchmarkConnRecvBuffered(b, 4096)
+}
+
+func TestConnMaxSendSize(t *testing.T) {
+	copts := map[string]interface{}{mangos.OptionMaxSendSize: 10}
+	client, server := connPair(t, copts, nil)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.Send(newMsg(make([]byte, 11))); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+	// Nothing was written, so the pipe is still usable.
+	if err := client.Send(newMsg([]byte("0123456789"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "0123456789" {
+		t.Errorf("Wrong message: %q", m.Body)
+	}
+}
+
+func TestConnSendPrepared(t *testing.T) {
+	c1, s1 := connPair(t, nil, nil)
+	defer c1.Close()
+	defer s1.Close()
+	c2, s2 := connPair(t, nil, nil)
+	defer c2.Close()
+	defer s2.Close()
+
+	m := newMsg([]byte("body"))
+	m.Header = append(m.Header, 0x80, 0, 0, 1)
+	pm := mangos.NewPreparedMessage(m)
+	wire := pm.Wire()
+
+	type preparer interface {
+		SendPrepared(*mangos.PreparedMessage) error
+	}
+	for _, c := range []Pipe{c1, c2} {
+		if err := c.(preparer).SendPrepared(pm); err != nil {
+			t.Fatalf("SendPrepared failed: %v", err)
+		}
+	}
+	for _, s := range []Pipe{s1, s2} {
+		rm, err := s.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(rm.Body) != "\x80\x00\x00\x01body" {
+			t.Errorf("Wrong message: %q", rm.Body)
+		}
+	}
+	// The encoding is only done once, and shared.
+	if w := pm.Wire(); &w[0] != &wire[0] {
+		t.Errorf("Message serialized more than once")
+	}
+	if c1.(*conn).Stats().TxBytes != 8 {
+		t.Errorf("Wrong byte count: %d", c1.(*conn).Stats().TxBytes)
+	}
+}
+
+func TestConnIsOpenRace(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer server.Close()
+
+	cp := client.(interface{ IsOpen() bool })
+	if !cp.IsOpen() {
+		t.Fatalf("Pipe not open")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for cp.IsOpen() {
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("IsOpen never reported close")
+	}
+}
+
+func TestConnFlush(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer server.Close()
+	flush := func(p Pipe) error {
+		return p.(interface{ Flush() error }).Flush()
+	}
+
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("goodbye")...)
+	if err := client.Send(m); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := flush(client); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	client.Close()
+	if err := flush(client); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "goodbye" {
+		t.Errorf("Wrong message: %q", m.Body)
+	}
+}
+
+// hookHandshake runs a handshake against a raw peer that answers with
+// the given header (or stays silent if it is nil), and returns the
+// events reported to the OptionHandshakeHook.
+func hookHandshake(t *testing.T, versions []byte, hdr []byte) ([]mangos.HandshakeEvent, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, 8))
+		if hdr != nil {
+			c.Write(hdr)
+		}
+		<-done
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if hdr == nil {
+		c.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	}
+
+	var events []mangos.HandshakeEvent
+	hook := func(ev mangos.HandshakeEvent) {
+		events = append(events, ev)
+	}
+	p := &conn{}
+	p.init(c, reqInfo, map[string]interface{}{
+		mangos.OptionHandshakeHook: mangos.HandshakeHook(hook),
+	})
+	if versions != nil {
+		p.versions = versions
+	}
+	err = p.handshake()
+	return events, err
+}
+
+func TestConnHandshakeHook(t *testing.T) {
+	type hcase struct {
+		name     string
+		versions []byte
+		hdr      []byte
+		err      error
+	}
+	for _, hc := range []hcase{
+		{"good", nil, []byte{0, 'S', 'P', 0, 0, mangos.ProtoRep, 0, 0}, nil},
+		{"flags", nil, []byte{0, 'S', 'P', 0, 0, mangos.ProtoRep, 0xff, 0}, nil},
+		{"header", nil, []byte{0, 'X', 'P', 0, 0, mangos.ProtoRep, 0, 0}, mangos.ErrBadHeader},
+		{"version", []byte{1}, []byte{0, 'S', 'P', 0, 0, mangos.ProtoRep, 0, 0}, mangos.ErrBadVersion},
+		{"proto", nil, []byte{0, 'S', 'P', 0, 0, mangos.ProtoPull, 0, 0}, mangos.ErrIncompatibleProto},
+		{"timeout", nil, nil, mangos.ErrHandshakeTimeout},
+	} {
+		events, err := hookHandshake(t, hc.versions, hc.hdr)
+		if hc.err == nil && err != nil {
+			t.Errorf("%s: handshake failed: %v", hc.name, err)
+		}
+		if len(events) != 2 {
+			t.Errorf("%s: got %d events", hc.name, len(events))
+			continue
+		}
+		if ev := events[0]; ev.Type != mangos.HandshakeStarted || ev.RemoteAddr == nil {
+			t.Errorf("%s: bad start event: %+v", hc.name, ev)
+		}
+		ev := events[1]
+		if ev.RemoteAddr == nil || ev.LocalAddr == nil {
+			t.Errorf("%s: missing addresses: %+v", hc.name, ev)
+		}
+		if hc.err == nil {
+			if ev.Type != mangos.HandshakeSucceeded || ev.Proto != mangos.ProtoRep {
+				t.Errorf("%s: bad success event: %+v", hc.name, ev)
+			}
+		} else if ev.Type != mangos.HandshakeFailed || ev.Err != hc.err {
+			t.Errorf("%s: bad failure event: %+v", hc.name, ev)
+		}
+	}
+}
+
+// TestConnHandshakeClosed has the peer close the connection after
+// reading our header, having sent none or only part of its own.
+func TestConnHandshakeClosed(t *testing.T) {
+	for _, hc := range []struct {
+		name string
+		hdr  []byte
+		err  error
+	}{
+		{"close", []byte{}, io.EOF},
+		{"truncated", []byte{0, 'S', 'P', 0}, io.ErrUnexpectedEOF},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		go func(hdr []byte) {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(c, make([]byte, 8))
+			c.Write(hdr)
+			c.Close()
+		}(hc.hdr)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		_, err = NewConnPipe(c, reqInfo, nil)
+		if !errors.Is(err, mangos.ErrHandshakeFailed) {
+			t.Errorf("%s: expected ErrHandshakeFailed, got %v", hc.name, err)
+		}
+		if !errors.Is(err, hc.err) {
+			t.Errorf("%s: expected %v, got %v", hc.name, hc.err, err)
+		}
+		var he *mangos.HandshakeError
+		if !errors.As(err, &he) || he.Err != hc.err {
+			t.Errorf("%s: wrong HandshakeError: %v", hc.name, err)
+		}
+		l.Close()
+	}
+}
+
+func TestConnChecksum(t *testing.T) {
+	on := map[string]interface{}{mangos.OptionChecksum: true}
+	for _, opts := range [][2]map[string]interface{}{
+		{on, on},  // both agree, so checksums are used
+		{on, nil}, // peer did not offer, so they are not
+	} {
+		client, server := connPair(t, opts[0], opts[1])
+		_, crc := server.(*conn).framer.(crcFramer)
+		if crc != (opts[1] != nil) {
+			t.Errorf("Wrong framer negotiated: %T", server.(*conn).framer)
+		}
+		m := mangos.NewMessage(0)
+		m.Header = append(m.Header, 0x80, 0, 0, 1)
+		m.Body = append(m.Body, []byte("payload")...)
+		if err := client.Send(m); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if !bytes.Equal(m.Body, []byte("\x80\x00\x00\x01payload")) {
+			t.Errorf("Wrong message: %q", m.Body)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnTraceHeader(t *testing.T) {
+	on := map[string]interface{}{mangos.OptionTraceHeader: true}
+	both := map[string]interface{}{
+		mangos.OptionTraceHeader: true,
+		mangos.OptionCompression: "gzip",
+	}
+	id := [mangos.TraceIDSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, opts := range [][2]map[string]interface{}{
+		{on, on},     // both agree, so the trace ID is sent
+		{on, nil},    // peer did not offer, so it is not
+		{both, both}, // works along with compression
+	} {
+		client, server := connPair(t, opts[0], opts[1])
+		m := mangos.NewMessage(0)
+		m.Header = append(m.Header, 0x80, 0, 0, 1)
+		m.Body = append(m.Body, bytes.Repeat([]byte("payload"), 40)...)
+		m.TraceID = id
+		if err := client.Send(m); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if !bytes.HasPrefix(m.Body, []byte("\x80\x00\x00\x01payload")) ||
+			len(m.Body) != 4+7*40 {
+			t.Errorf("Wrong message: %q", m.Body)
+		}
+		want := id
+		if opts[1] == nil {
+			want = [mangos.TraceIDSize]byte{}
+		}
+		if m.TraceID != want {
+			t.Errorf("Wrong trace ID: %v", m.TraceID)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnTypeHeader(t *testing.T) {
+	on := map[string]interface{}{mangos.OptionTypeHeader: true}
+	all := map[string]interface{}{
+		mangos.OptionTypeHeader:        true,
+		mangos.OptionTraceHeader:       true,
+		mangos.OptionChecksum:          true,
+		mangos.OptionKeepAliveInterval: time.Hour,
+	}
+	id := [mangos.TraceIDSize]byte{1, 2, 3, 4}
+	for _, opts := range [][2]map[string]interface{}{
+		{on, on},   // both agree, so the type and flags are sent
+		{nil, on},  // we did not offer, so they are not
+		{all, all}, // works along with the other headers
+	} {
+		client, server := connPair(t, opts[0], opts[1])
+		// Mangos does not know about any types, so any value works.
+		for _, typ := range []uint16{0, 7, 0xffff} {
+			m := mangos.NewMessage(0)
+			m.Header = append(m.Header, 0x80, 0, 0, 1)
+			m.Body = append(m.Body, []byte("payload")...)
+			m.Type = typ
+			m.Flags = 0xa5
+			m.TraceID = id
+			if err := client.Send(m); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			m, err := server.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			if string(m.Body) != "\x80\x00\x00\x01payload" {
+				t.Errorf("Wrong message: %q", m.Body)
+			}
+			wantType, wantFlags := typ, uint8(0xa5)
+			if opts[0] == nil {
+				wantType, wantFlags = 0, 0
+			}
+			if m.Type != wantType || m.Flags != wantFlags {
+				t.Errorf("Got type %d flags %x", m.Type, m.Flags)
+			}
+			if opts[0][mangos.OptionTraceHeader] != nil && m.TraceID != id {
+				t.Errorf("Wrong trace ID: %v", m.TraceID)
+			}
+			m.Free()
+		}
+		if server.(*conn).Info().TypeHeader != (opts[0] != nil) {
+			t.Errorf("Wrong PipeInfo: %+v", server.(*conn).Info())
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnSeqHeader(t *testing.T) {
+	on := map[string]interface{}{mangos.OptionSeqHeader: true}
+	all := map[string]interface{}{
+		mangos.OptionSeqHeader:         true,
+		mangos.OptionTypeHeader:        true,
+		mangos.OptionChecksum:          true,
+		mangos.OptionKeepAliveInterval: time.Hour,
+	}
+	pings := map[string]interface{}{
+		mangos.OptionSeqHeader:         true,
+		mangos.OptionKeepAliveInterval: time.Millisecond,
+		mangos.OptionKeepAliveMissed:   1000,
+	}
+	for _, opts := range [][2]map[string]interface{}{
+		{on, on},       // both agree, so the messages are numbered
+		{on, nil},      // the peer did not offer, so they are not
+		{all, all},     // works along with the other headers
+		{pings, pings}, // pings do not use up numbers
+	} {
+		client, server := connPair(t, opts[0], opts[1])
+		for i := 1; i <= 3; i++ {
+			m := mangos.NewMessage(0)
+			m.Body = append(m.Body, []byte("payload")...)
+			m.Seq = 42 // ignored
+			if err := client.Send(m); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			if opts[0][mangos.OptionKeepAliveMissed] != nil {
+				time.Sleep(5 * time.Millisecond)
+			}
+			m, err := server.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			if string(m.Body) != "payload" {
+				t.Errorf("Wrong message: %q", m.Body)
+			}
+			want := uint64(i)
+			if opts[1] == nil {
+				want = 0
+			}
+			if m.Seq != want {
+				t.Errorf("Got sequence %d, expected %d", m.Seq, want)
+			}
+			m.Free()
+		}
+		if server.(*conn).Info().SeqHeader != (opts[1] != nil) {
+			t.Errorf("Wrong PipeInfo: %+v", server.(*conn).Info())
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnKeepAlive(t *testing.T) {
+	opts := map[string]interface{}{
+		mangos.OptionKeepAliveInterval: 10 * time.Millisecond,
+	}
+	client, server := connPair(t, opts, opts)
+	defer client.Close()
+	defer server.Close()
+
+	// Both sides receive, so the pings are answered.  The pings and
+	// pongs must not be seen by the receivers.
+	got := make(chan string, 2)
+	for _, p := range []Pipe{client, server} {
+		go func(p Pipe) {
+			for {
+				m, err := p.Recv()
+				if err != nil {
+					return
+				}
+				got <- string(m.Body)
+				m.Free()
+			}
+		}(p)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !client.(*conn).IsOpen() || !server.(*conn).IsOpen() {
+		t.Fatalf("Pipe closed: %v %v", client.CloseErr(), server.CloseErr())
+	}
+	if err := client.Send(newMsg([]byte("hello"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	select {
+	case s := <-got:
+		if s != "hello" {
+			t.Errorf("Got %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Message not received")
+	}
+	select {
+	case s := <-got:
+		t.Errorf("Got unexpected %q", s)
+	default:
+	}
+}
+
+func TestConnKeepAliveTimeout(t *testing.T) {
+	interval := 10 * time.Millisecond
+	opts := map[string]interface{}{
+		mangos.OptionKeepAliveInterval: interval,
+		mangos.OptionKeepAliveMissed:   3,
+	}
+	// The server pings rarely enough that it never gives up first.
+	sopts := map[string]interface{}{
+		mangos.OptionKeepAliveInterval: time.Hour,
+	}
+	client, server := connPair(t, opts, sopts)
+	defer client.Close()
+	defer server.Close()
+
+	// The server never receives, so it never sees the pings, and
+	// does not answer them.
+	start := time.Now()
+	if _, err := client.Recv(); err == nil {
+		t.Fatalf("Recv succeeded")
+	}
+	elapsed := time.Since(start)
+	if err := client.CloseErr(); err != mangos.ErrKeepAliveTimeout {
+		t.Fatalf("Expected ErrKeepAliveTimeout, got %v", err)
+	}
+	if elapsed < 3*interval || elapsed > 20*interval {
+		t.Errorf("Pipe closed after %v", elapsed)
+	}
+}
+
+func TestConnFlowCredits(t *testing.T) {
+	opts := map[string]interface{}{mangos.OptionFlowCredits: 4}
+	client, server := connPair(t, opts, opts)
+	defer client.Close()
+	defer server.Close()
+	if !client.(*conn).Info().FlowCredits {
+		t.Fatalf("Flow credits not negotiated")
+	}
+
+	// The client must receive to see the grants, as protocols do.
+	// The grants must not be seen as messages.
+	got := make(chan string, 1)
+	go func() {
+		for {
+			m, err := client.Recv()
+			if err != nil {
+				return
+			}
+			got <- string(m.Body)
+			m.Free()
+		}
+	}()
+
+	const count = 10
+	sent := make(chan int, count)
+	go func() {
+		for i := 0; i < count; i++ {
+			if client.Send(newMsg([]byte(fmt.Sprint(i)))) != nil {
+				return
+			}
+			sent <- i
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(sent); n != 4 {
+		t.Fatalf("Sent %d messages before any were received, expected 4", n)
+	}
+
+	for i := 0; i < count; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != fmt.Sprint(i) {
+			t.Errorf("Got %q, expected %d", m.Body, i)
+		}
+		m.Free()
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatalf("Send %d never finished", i)
+		}
+	}
+	select {
+	case s := <-got:
+		t.Errorf("Got unexpected %q", s)
+	default:
+	}
+}
+
+func TestConnFlowCreditsOneSided(t *testing.T) {
+	opts := map[string]interface{}{mangos.OptionFlowCredits: 1}
+	client, server := connPair(t, opts, nil)
+	defer client.Close()
+	defer server.Close()
+	if client.(*conn).Info().FlowCredits {
+		t.Fatalf("Flow credits negotiated with one side")
+	}
+	// Without credits, nothing waits for the receiver.
+	for i := 0; i < 10; i++ {
+		if err := client.Send(newMsg([]byte("hello"))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+}
+
+func TestConnRecvFilter(t *testing.T) {
+	errBad := errors.New("bad message")
+	filter := mangos.MessageFilter(func(m *mangos.Message) error {
+		if bytes.Contains(m.Body, []byte("bad")) {
+			return errBad
+		}
+		return nil
+	})
+	client, server := connPair(t, nil, map[string]interface{}{
+		mangos.OptionRecvFilter: filter,
+	})
+	defer client.Close()
+	defer server.Close()
+
+	for _, b := range []string{"good 1", "bad 1", "bad 2", "good 2"} {
+		if err := client.Send(newMsg([]byte(b))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for _, want := range []string{"good 1", "good 2"} {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != want {
+			t.Errorf("Got %q, expected %q", m.Body, want)
+		}
+		m.Free()
+	}
+	if _, _, err := server.(*conn).RecvReader(); err != mangos.ErrProtoOp {
+		t.Errorf("RecvReader got %v, expected ErrProtoOp", err)
+	}
+
+	// Optionally, the pipe is closed instead.
+	client, server = connPair(t, nil, map[string]interface{}{
+		mangos.OptionRecvFilter:      filter,
+		mangos.OptionRecvFilterClose: true,
+	})
+	defer client.Close()
+	defer server.Close()
+	if err := client.Send(newMsg([]byte("bad"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Recv(); err != errBad {
+		t.Errorf("Recv got %v, expected the filter's error", err)
+	}
+	if err := server.CloseErr(); err != errBad {
+		t.Errorf("CloseErr got %v, expected the filter's error", err)
+	}
+}
+
+func TestConnSendFilter(t *testing.T) {
+	errSecret := errors.New("secret")
+	client, server := connPair(t, map[string]interface{}{
+		mangos.OptionSendFilter: mangos.MessageFilter(func(m *mangos.Message) error {
+			if bytes.HasPrefix(m.Body, []byte("secret")) {
+				return errSecret
+			}
+			// Filters may rewrite messages too.
+			m.Body = append(m.Body, '!')
+			return nil
+		}),
+	}, nil)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.Send(newMsg([]byte("secret"))); err != errSecret {
+		t.Errorf("Send got %v, expected the filter's error", err)
+	}
+	pm := mangos.NewPreparedMessage(newMsg([]byte("hello")))
+	if err := client.(*conn).SendPrepared(pm); err != nil {
+		t.Fatalf("SendPrepared failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "hello!" {
+		t.Errorf("Got %q", m.Body)
+	}
+	m.Free()
+}
+
+func TestConnFragment(t *testing.T) {
+	testConnFragment(t, map[string]interface{}{
+		mangos.OptionMaxFrameSize: 100,
+	})
+	// Other framings apply to the whole message.
+	testConnFragment(t, map[string]interface{}{
+		mangos.OptionMaxFrameSize:      100,
+		mangos.OptionChecksum:          true,
+		mangos.OptionCompression:       "gzip",
+		mangos.OptionKeepAliveInterval: time.Hour,
+	})
+}
+
+func testConnFragment(t *testing.T, opts map[string]interface{}) {
+	client, server := connPair(t, opts, opts)
+	defer client.Close()
+	defer server.Close()
+	if n := client.(*conn).Info().MaxFrameSize; n != 100 {
+		t.Fatalf("Wrong frame size negotiated: %d", n)
+	}
+
+	for _, sz := range []int{0, 99, 100, 101, 1000, 100000} {
+		body := make([]byte, sz)
+		rand.Read(body)
+		m := newMsg(body)
+		// The header spans fragments too.
+		m.Header = append(m.Header, bytes.Repeat([]byte{0xa5}, 150)...)
+		if err := client.Send(m); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		got, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		want := append(bytes.Repeat([]byte{0xa5}, 150), body...)
+		if !bytes.Equal(got.Body, want) {
+			t.Errorf("Message of %d bytes garbled", sz)
+		}
+		got.Free()
+	}
+}
+
+func TestConnFragmentFrames(t *testing.T) {
+	f := newFragFramer(DefaultFramer{}, 10, 0)
+	var buf bytes.Buffer
+	body := []byte("this message is split into several fragments")
+	if err := f.WriteMsg(&buf, newMsg(body)); err != nil {
+		t.Fatalf("WriteMsg failed: %v", err)
+	}
+	wire := buf.Bytes()
+	frames := 0
+	for off := 0; off < len(wire); frames++ {
+		sz := int(binary.BigEndian.Uint64(wire[off:]))
+		if sz > 11 {
+			t.Errorf("Frame of %d bytes", sz)
+		}
+		more := frames < (len(body)-1)/10
+		if (wire[off+8] == fragMore) != more {
+			t.Errorf("Wrong flag %d on frame %d", wire[off+8], frames)
+		}
+		off += 8 + sz
+	}
+	if frames != (len(body)+9)/10 {
+		t.Errorf("Got %d frames", frames)
+	}
+
+	m, err := f.ReadMsg(&buf)
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(m.Body, body) {
+		t.Errorf("Got %q", m.Body)
+	}
+}
+
+func TestConnFragmentTooLong(t *testing.T) {
+	// The fragments are small, but they add up to too much.
+	client, server := connPair(t, map[string]interface{}{
+		mangos.OptionMaxFrameSize: 100,
+	}, map[string]interface{}{
+		mangos.OptionMaxFrameSize: 100,
+		mangos.OptionMaxRecvSize:  500,
+	})
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.Send(newMsg(make([]byte, 400))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	m.Free()
+	if err = client.Send(newMsg(make([]byte, 1000))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	_, err = server.Recv()
+	var tl *mangos.TooLongError
+	if !errors.As(err, &tl) || tl.Limit != 500 {
+		t.Fatalf("Expected TooLongError, got %v", err)
+	}
+	if server.(*conn).IsOpen() {
+		t.Errorf("Pipe still open")
+	}
+}
+
+func TestConnAsyncRecv(t *testing.T) {
+	opts := map[string]interface{}{mangos.OptionAsyncRecv: 2}
+	client, server := connPair(t, nil, opts)
+	defer client.Close()
+
+	// More than fit in the queue are sent before any are received.
+	// The reader waits for room, so none are lost.
+	const count = 10
+	for i := 0; i < count; i++ {
+		if err := client.Send(newMsg([]byte(fmt.Sprintf("%d", i)))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < count; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(m.Body) != fmt.Sprintf("%d", i) {
+			t.Errorf("Got %q, expected %d", m.Body, i)
+		}
+		m.Free()
+	}
+
+	// Deadlines apply to waiting for the queue.
+	sc := server.(*conn)
+	sc.SetRecvDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := server.Recv()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	sc.SetRecvDeadline(time.Time{})
+	if !sc.IsOpen() {
+		t.Errorf("Pipe closed by timeout")
+	}
+	if _, _, err = sc.RecvReader(); err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+
+	// Once closed, the reader goroutine finishes.
+	client.Send(newMsg([]byte("unread")))
+	server.Close()
+	done := make(chan struct{})
+	go func() {
+		for range sc.asyncQ {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Reader did not exit")
+	}
+	if _, err = server.Recv(); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// TestConnAsyncRecvLatency compares the latency of messages sent in
+// bursts, with and without OptionAsyncRecv, while the receiver does a
+// little work for each message.  Timing on shared machines is too noisy
+// for a strict comparison, so it only fails if reading ahead makes
+// things clearly worse.
+func TestConnAsyncRecvLatency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping latency test in short mode")
+	}
+	if runtime.GOMAXPROCS(0) < 2 {
+		t.Skip("Reading ahead needs a spare CPU")
+	}
+	// Checksums make decoding costly enough to be worth overlapping.
+	cks := map[string]interface{}{mangos.OptionChecksum: true}
+	p99 := func(opts map[string]interface{}) time.Duration {
+		client, server := connPair(t, cks, opts)
+		defer client.Close()
+		defer server.Close()
+
+		const bursts, burst = 50, 20
+		lat := make([]time.Duration, 0, bursts*burst)
+		go func() {
+			for i := 0; i < bursts; i++ {
+				for j := 0; j < burst; j++ {
+					b := make([]byte, 32*1024)
+					binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+					client.Send(newMsg(b))
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		for len(lat) < cap(lat) {
+			m, err := server.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			sent := int64(binary.BigEndian.Uint64(m.Body))
+			lat = append(lat, time.Duration(time.Now().UnixNano()-sent))
+			m.Free()
+			// Stand-in for processing the message.
+			for d := time.Now().Add(10 * time.Microsecond); time.Now().Before(d); {
+			}
+		}
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		return lat[len(lat)*99/100]
+	}
+	syncP99 := p99(cks)
+	asyncP99 := p99(map[string]interface{}{
+		mangos.OptionChecksum:  true,
+		mangos.OptionAsyncRecv: 64,
+	})
+	t.Logf("p99 latency: sync %v, async %v", syncP99, asyncP99)
+	if asyncP99 > 2*syncP99+time.Millisecond {
+		t.Errorf("Reading ahead made latency worse")
+	}
+}
+
+// secretAuth is an Authenticator where the client sends a shared secret,
+// and the server answers whether it matched.
+type secretAuth string
+
+func (a secretAuth) ClientAuth(c net.Conn) error {
+	if _, err := c.Write([]byte(a)); err != nil {
+		return err
+	}
+	var ok [1]byte
+	if _, err := io.ReadFull(c, ok[:]); err != nil {
+		return err
+	}
+	if ok[0] != 1 {
+		return errors.New("secret rejected")
+	}
+	return nil
+}
+
+func (a secretAuth) ServerAuth(c net.Conn) error {
+	b := make([]byte, len(a))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != string(a) {
+		c.Write([]byte{0})
+		return errors.New("wrong secret")
+	}
+	_, err := c.Write([]byte{1})
+	return err
+}
+
+func TestConnAuthenticator(t *testing.T) {
+	server := Accepted(map[string]interface{}{
+		mangos.OptionAuthenticator: secretAuth("sesame"),
+	})
+	good := map[string]interface{}{
+		mangos.OptionAuthenticator: secretAuth("sesame"),
+		mangos.OptionChecksum:      true,
+	}
+	c, s, cerr, serr := optsPair(t, good, server)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Handshake failed: %v %v", cerr, serr)
+	}
+	// Messages are exchanged normally once authenticated.
+	if err := c.Send(newMsg([]byte("hello"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := s.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "hello" {
+		t.Errorf("Got %q", m.Body)
+	}
+	c.Close()
+	s.Close()
+
+	bad := map[string]interface{}{
+		mangos.OptionAuthenticator: secretAuth("wrong!"),
+	}
+	_, _, cerr, serr = optsPair(t, bad, server)
+	if cerr != mangos.ErrAuthFailed || serr != mangos.ErrAuthFailed {
+		t.Errorf("Expected ErrAuthFailed, got %v %v", cerr, serr)
+	}
+}
+
+// flipConn flips a bit in the eleventh byte written once it is armed,
+// which is in the body of the first message sent.
+type flipConn struct {
+	net.Conn
+	armed bool
+	n     int
+}
+
+func (c *flipConn) Write(b []byte) (int, error) {
+	if c.armed {
+		if i := 10 - c.n; i >= 0 && i < len(b) {
+			b = append([]byte{}, b...)
+			b[i] ^= 0x01
+		}
+		c.n += len(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestConnChecksumMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	opts := map[string]interface{}{mangos.OptionChecksum: true}
+	ch := make(chan Pipe)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		p, _ := NewConnPipe(c, repInfo, opts)
+		ch <- p
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	fc := &flipConn{Conn: c}
+	client, err := NewConnPipe(fc, reqInfo, opts)
+	if err != nil {
+		t.Fatalf("Client handshake failed: %v", err)
+	}
+	defer client.Close()
+	server := <-ch
+	if server == nil {
+		t.Fatalf("Server handshake failed")
+	}
+	defer server.Close()
+
+	fc.armed = true
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("corrupt me")...)
+	if err = client.Send(m); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err = server.Recv(); err != mangos.ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	if server.(*conn).IsOpen() {
+		t.Errorf("Pipe still open after checksum failure")
+	}
+	if err = server.(*conn).CloseErr(); err != mangos.ErrChecksumMismatch {
+		t.Errorf("Wrong close error: %v", err)
+	}
+}
+
+func TestConnProtocolName(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+	if n := client.LocalProtocolName(); n != "req" {
+		t.Errorf("Wrong local name: %q", n)
+	}
+	if n := client.RemoteProtocolName(); n != "rep" {
+		t.Errorf("Wrong remote name: %q", n)
+	}
+}
+
+func TestConnTooLongDetail(t *testing.T) {
+	sopts := map[string]interface{}{mangos.OptionMaxRecvSize: 1024}
+	copts := map[string]interface{}{mangos.OptionMaxSendSize: 2048}
+	client, server := connPair(t, copts, sopts)
+	defer client.Close()
+	defer server.Close()
+
+	var tl *mangos.TooLongError
+	err := client.Send(newMsg(make([]byte, 4096)))
+	if !errors.As(err, &tl) {
+		t.Fatalf("Expected TooLongError, got %v", err)
+	}
+	if tl.Size != 4096 || tl.Limit != 2048 || tl.Peer != "" {
+		t.Errorf("Wrong send detail: %+v", tl)
+	}
+
+	if err = client.Send(newMsg(make([]byte, 1500))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	_, err = server.Recv()
+	if !errors.Is(err, mangos.ErrTooLong) || !errors.As(err, &tl) {
+		t.Fatalf("Expected TooLongError, got %v", err)
+	}
+	peer := server.(*conn).c.RemoteAddr().String()
+	if tl.Size != 1500 || tl.Limit != 1024 || tl.Peer != peer {
+		t.Errorf("Wrong receive detail: %+v", tl)
+	}
+	want := "message of 1500 bytes exceeds limit 1024 from peer " + peer
+	if err.Error() != want {
+		t.Errorf("Wrong message: %q", err.Error())
+	}
+}
+
+func TestConnEmptyMessage(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer server.Close()
+
+	// An empty message, followed by one with content, to be sure
+	// the stream stays aligned.
+	if err := client.Send(mangos.NewMessage(0)); err != nil {
+		t.Fatalf("Send empty failed: %v", err)
+	}
+	if err := client.Send(newMsg([]byte("next"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv empty failed: %v", err)
+	}
+	if m == nil || len(m.Body) != 0 || len(m.Header) != 0 {
+		t.Fatalf("Expected empty message, got %v", m)
+	}
+	if m, err = server.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "next" {
+		t.Errorf("Wrong message: %q", m.Body)
+	}
+
+	// Once the peer is gone, the result is an error, not an empty
+	// message.
+	client.Close()
+	if m, err = server.Recv(); err == nil || m != nil {
+		t.Errorf("Expected error after close, got %v, %v", m, err)
+	}
+}
+
+func TestConnSetMaxRecvSize(t *testing.T) {
+	sopts := map[string]interface{}{mangos.OptionMaxRecvSize: 1024}
+	client, server := connPair(t, nil, sopts)
+	defer client.Close()
+	defer server.Close()
+
+	sc := server.(*conn)
+	if err := sc.SetMaxRecvSize(-1); err != mangos.ErrBadValue {
+		t.Errorf("Negative limit permitted: %v", err)
+	}
+
+	// The limit applies until raised, and only from the next Recv.
+	if err := client.Send(newMsg(make([]byte, 100))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if err := sc.SetMaxRecvSize(8192); err != nil {
+		t.Fatalf("SetMaxRecvSize failed: %v", err)
+	}
+	if v, err := server.GetOption(mangos.OptionMaxRecvSize); err != nil || v.(int) != 8192 {
+		t.Errorf("Wrong option value: %v %v", v, err)
+	}
+	if err := client.Send(newMsg(make([]byte, 4096))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv after raise failed: %v", err)
+	}
+	if len(m.Body) != 4096 {
+		t.Errorf("Wrong length: %d", len(m.Body))
+	}
+	m.Free()
+
+	// Lowering it works the same way.
+	if err = sc.SetMaxRecvSize(1024); err != nil {
+		t.Fatalf("SetMaxRecvSize failed: %v", err)
+	}
+	if err = client.Send(newMsg(make([]byte, 4096))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	var tl *mangos.TooLongError
+	if _, err = server.Recv(); !errors.As(err, &tl) || tl.Limit != 1024 {
+		t.Errorf("Expected TooLongError, got %v", err)
+	}
+}
+
+func TestConnSendReader(t *testing.T) {
+	client, server := connPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+	cc := client.(*conn)
+
+	big := make([]byte, 256*1024)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	hdr := []byte{0x80, 0, 0, 1}
+	readers := []struct {
+		r    io.Reader
+		want []byte
+	}{
+		{bytes.NewReader(big), big},
+		{strings.NewReader("streamed"), []byte("streamed")},
+		{strings.NewReader(""), []byte{}},
+	}
+	for _, rd := range readers {
+		errq := make(chan error, 1)
+		go func() {
+			errq <- cc.SendReader(hdr, rd.r, int64(len(rd.want)))
+		}()
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if err = <-errq; err != nil {
+			t.Fatalf("SendReader failed: %v", err)
+		}
+		if !bytes.Equal(m.Body[:4], hdr) || !bytes.Equal(m.Body[4:], rd.want) {
+			t.Errorf("Wrong message of %d bytes", len(m.Body))
+		}
+		m.Free()
+	}
+
+	// A short reader leaves the peer expecting more, so the pipe
+	// cannot be used after that.
+	err := cc.SendReader(nil, strings.NewReader("short"), 10)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+	if cc.IsOpen() {
+		t.Errorf("Pipe still open after short body")
+	}
+}
+
+func TestConnSendReaderFramer(t *testing.T) {
+	client, server := framerPair(t, nil, nil, VarintFramer{})
+	defer client.Close()
+	defer server.Close()
+
+	err := client.(*conn).SendReader(nil, strings.NewReader("x"), 1)
+	if err != mangos.ErrProtoOp {
+		t.Errorf("Expected ErrProtoOp, got %v", err)
+	}
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	copts := map[string]interface{}{
+		mangos.OptionWriteTimeout: 20 * time.Millisecond,
+	}
+	client, server := connPair(t, copts, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// The server never reads, so eventually the socket buffers fill,
+	// and the client gives up on it.
+	big := make([]byte, 1024*1024)
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = client.Send(newMsg(big))
+	}
+	// Depending on where the deadline lands, this is either a
+	// timeout or a short write.
+	if err == nil {
+		t.Fatalf("Send never failed")
+	}
+	if client.(*conn).IsOpen() {
+		t.Errorf("Pipe still open after write timeout")
+	}
+}
+
+// optsPair is like connPair, but returns the handshake errors rather
+// than failing the test.
+func optsPair(t *testing.T, copts, sopts map[string]interface{}) (Pipe, Pipe, error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	type result struct {
+		p   Pipe
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		p, err := NewConnPipe(c, repInfo, sopts)
+		ch <- result{p, err}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	client, cerr := NewConnPipe(c, reqInfo, copts)
+	r := <-ch
+	return client, r.p, cerr, r.err
+}
+
+func TestConnMetadata(t *testing.T) {
+	md := map[string]string{"identity": "alice", "token": "s3cret", "": ""}
+	copts := map[string]interface{}{mangos.OptionHandshakeMetadata: md}
+	sopts := map[string]interface{}{
+		mangos.OptionHandshakeMetadata: map[string]string{},
+	}
+	client, server := connPair(t, copts, sopts)
+	defer client.Close()
+	defer server.Close()
+
+	if v := client.(*conn).Version(); v != metadataVersion {
+		t.Errorf("Wrong version: %d", v)
+	}
+	got := server.(*conn).PeerMetadata()
+	if len(got) != len(md) {
+		t.Errorf("Wrong metadata: %v", got)
+	}
+	for k, v := range md {
+		if got[k] != v {
+			t.Errorf("Wrong value for %q: %q", k, got[k])
+		}
+	}
+	if got = client.(*conn).PeerMetadata(); got == nil || len(got) != 0 {
+		t.Errorf("Expected empty metadata, got %v", got)
+	}
+
+	// The stream is intact afterwards.
+	if err := client.Send(newMsg([]byte("hello"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if m, err := server.Recv(); err != nil || string(m.Body) != "hello" {
+		t.Fatalf("Recv failed: %v", err)
+	}
+}
+
+func TestConnMetadataLegacy(t *testing.T) {
+	md := map[string]string{"identity": "alice"}
+	aware := map[string]interface{}{mangos.OptionHandshakeMetadata: md}
+
+	// Either side may be the one without metadata support; the
+	// handshake falls back to version 0, and no metadata is sent.
+	for _, opts := range [][2]map[string]interface{}{
+		{aware, nil},
+		{nil, aware},
+	} {
+		client, server := connPair(t, opts[0], opts[1])
+		for _, p := range []*conn{client.(*conn), server.(*conn)} {
+			if p.Version() != 0 {
+				t.Errorf("Wrong version: %d", p.Version())
+			}
+			if md := p.PeerMetadata(); md != nil {
+				t.Errorf("Unexpected metadata: %v", md)
+			}
+		}
+		if err := client.Send(newMsg([]byte("hello"))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if m, err := server.Recv(); err != nil || string(m.Body) != "hello" {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnMetadataTooLong(t *testing.T) {
+	md := map[string]string{"token": string(make([]byte, 100))}
+	copts := map[string]interface{}{mangos.OptionHandshakeMetadata: md}
+	sopts := map[string]interface{}{
+		mangos.OptionHandshakeMetadata: map[string]string{},
+		mangos.OptionMaxRecvSize:       64,
+	}
+	client, server, _, serr := optsPair(t, copts, sopts)
+	if !errors.Is(serr, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", serr)
+	}
+	if client != nil {
+		client.Close()
+	}
+	if server != nil {
+		server.Close()
+	}
+}
+
+func TestConnMetadataDecode(t *testing.T) {
+	md := map[string]string{"a": "1", "bb": ""}
+	b := encodeMetadata(md)
+	if int(binary.BigEndian.Uint32(b)) != len(b)-4 {
+		t.Fatalf("Wrong length prefix")
+	}
+	got, err := decodeMetadata(b[4:])
+	if err != nil || len(got) != 2 || got["a"] != "1" || got["bb"] != "" {
+		t.Errorf("Decode failed: %v %v", got, err)
+	}
+	for _, bad := range [][]byte{
+		{0, 0},
+		{0, 0, 0, 1},
+		{0, 0, 0, 1, 'a'},
+		{0, 0, 0, 1, 'a', 0, 0, 0, 2, 'x'},
+	} {
+		if _, err = decodeMetadata(bad); err != mangos.ErrBadHeader {
+			t.Errorf("Decode %v: expected ErrBadHeader, got %v", bad, err)
+		}
+	}
+}
+
+// jsonBody returns a representative JSON document of about n bytes.
+func jsonBody(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"events":[`)
+	for i := 0; b.Len() < n; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id":%d,"type":"update","user":"user%d",`+
+			`"status":"active","score":%d.%02d,"tags":["alpha","beta"]}`,
+			i, i%97, i*7%1000, i%100)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+func TestConnCompression(t *testing.T) {
+	body := jsonBody(8192)
+	for _, name := range []string{"gzip", "deflate"} {
+		opts := map[string]interface{}{mangos.OptionCompression: name}
+		client, server := connPair(t, opts, opts)
+		if _, ok := server.(*conn).framer.(compressFramer); !ok {
+			t.Fatalf("%s: wrong framer negotiated: %T", name, server.(*conn).framer)
+		}
+		for _, b := range [][]byte{body, body[:16], {}} {
+			m := newMsg(b)
+			m.Header = append(m.Header, 0x80, 0, 0, 1)
+			if err := client.Send(m); err != nil {
+				t.Fatalf("%s: Send failed: %v", name, err)
+			}
+			m, err := server.Recv()
+			if err != nil {
+				t.Fatalf("%s: Recv failed: %v", name, err)
+			}
+			if want := append([]byte{0x80, 0, 0, 1}, b...); !bytes.Equal(m.Body, want) {
+				t.Errorf("%s: wrong message of %d bytes", name, len(m.Body))
+			}
+			m.Free()
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnCompressionFrames(t *testing.T) {
+	f := newCompressFramer(DefaultFramer{}, codecByName("gzip"), 0)
+	random := make([]byte, 4096)
+	rand.Read(random)
+	for _, tc := range []struct {
+		body   []byte
+		marker byte
+	}{
+		{jsonBody(4096), frameCompressed},
+		{[]byte("tiny"), frameStored},
+		{random, frameStored},
+	} {
+		var buf bytes.Buffer
+		if err := f.WriteMsg(&buf, newMsg(tc.body)); err != nil {
+			t.Fatalf("WriteMsg failed: %v", err)
+		}
+		if buf.Bytes()[8] != tc.marker {
+			t.Errorf("Wrong marker %d for %d byte body", buf.Bytes()[8], len(tc.body))
+		}
+		if tc.marker == frameCompressed && buf.Len() >= len(tc.body) {
+			t.Errorf("Compressed frame too big: %d", buf.Len())
+		}
+		m, err := f.ReadMsg(&buf)
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %v", err)
+		}
+		if !bytes.Equal(m.Body, tc.body) {
+			t.Errorf("Wrong message of %d bytes", len(m.Body))
+		}
+	}
+
+	for _, bad := range [][]byte{{}, {2, 'x'}, {frameCompressed, 'x'}} {
+		var buf bytes.Buffer
+		DefaultFramer{}.WriteMsg(&buf, newMsg(bad))
+		if _, err := f.ReadMsg(&buf); err != mangos.ErrGarbled {
+			t.Errorf("Frame %v: expected ErrGarbled, got %v", bad, err)
+		}
+	}
+}
+
+func TestConnCompressionFallback(t *testing.T) {
+	gz := map[string]interface{}{mangos.OptionCompression: "gzip"}
+	fl := map[string]interface{}{mangos.OptionCompression: "deflate"}
+	none := map[string]interface{}{mangos.OptionCompression: "none"}
+	for _, opts := range [][2]map[string]interface{}{
+		{gz, fl},   // codecs differ
+		{gz, none}, // peer declined
+		{nil, gz},  // peer did not offer
+	} {
+		client, server := connPair(t, opts[0], opts[1])
+		for _, p := range []Pipe{client, server} {
+			if _, ok := p.(*conn).framer.(DefaultFramer); !ok {
+				t.Errorf("Wrong framer negotiated: %T", p.(*conn).framer)
+			}
+		}
+		if err := client.Send(newMsg(jsonBody(1024))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if _, err := server.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnCompressionBomb(t *testing.T) {
+	client, server := connPair(t,
+		map[string]interface{}{
+			mangos.OptionCompression: "gzip",
+			mangos.OptionMaxSendSize: 0,
+		},
+		map[string]interface{}{
+			mangos.OptionCompression: "gzip",
+			mangos.OptionMaxRecvSize: 1024,
+		})
+	defer client.Close()
+	defer server.Close()
+
+	// The frame is well under the limit, but not once decompressed.
+	if err := client.Send(newMsg(make([]byte, 256*1024))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	_, err := server.Recv()
+	var tl *mangos.TooLongError
+	if !errors.As(err, &tl) {
+		t.Fatalf("Expected TooLongError, got %v", err)
+	}
+	if tl.Limit != 1024 {
+		t.Errorf("Wrong limit: %d", tl.Limit)
+	}
+}
+
+func benchmarkConnJSON(b *testing.B, compression string) {
+	opts := map[string]interface{}{mangos.OptionCompression: compression}
+	client, server := connPair(b, opts, opts)
+	defer client.Close()
+	defer server.Close()
+
+	body := jsonBody(16384)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if client.Send(newMsg(body)) != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			b.Fatalf("Recv failed: %v", err)
+		}
+		m.Free()
+	}
+}
+
+func BenchmarkConnJSON(b *testing.B) {
+	benchmarkConnJSON(b, "none")
+}
+
+func BenchmarkConnJSONGzip(b *testing.B) {
+	benchmarkConnJSON(b, "gzip")
+}
+
+func BenchmarkConnJSONDeflate(b *testing.B) {
+	benchmarkConnJSON(b, "deflate")
+}
+
+func TestConnByteOrder(t *testing.T) {
+	var buf bytes.Buffer
+	f := DefaultFramer{ByteOrder: binary.LittleEndian}
+	if err := f.WriteMsg(&buf, newMsg([]byte("abc"))); err != nil {
+		t.Fatalf("WriteMsg failed: %v", err)
+	}
+	if want := []byte{3, 0, 0, 0, 0, 0, 0, 0, 'a', 'b', 'c'}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Wrong frame: %v", buf.Bytes())
+	}
+
+	// Checksums would need big-endian, so they are not offered.
+	opts := map[string]interface{}{
+		mangos.OptionByteOrder: binary.LittleEndian,
+		mangos.OptionChecksum:  true,
+	}
+	client, server := connPair(t, opts, opts)
+	defer client.Close()
+	defer server.Close()
+	if _, ok := server.(*conn).framer.(DefaultFramer); !ok {
+		t.Errorf("Wrong framer negotiated: %T", server.(*conn).framer)
+	}
+	if err := client.Send(newMsg([]byte("framed"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "framed" {
+		t.Errorf("Wrong message: %q", m.Body)
+	}
+
+	if err = client.(*conn).SendReader([]byte{1}, strings.NewReader("streamed"), 8); err != nil {
+		t.Fatalf("SendReader failed: %v", err)
+	}
+	r, sz, err := server.(*conn).RecvReader()
+	if err != nil {
+		t.Fatalf("RecvReader failed: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(r); sz != 9 || string(b) != "\x01streamed" {
+		t.Errorf("Wrong message: %d %q", sz, b)
+	}
+}
+
+func TestConnByteOrderMismatch(t *testing.T) {
+	client, server := connPair(t,
+		map[string]interface{}{mangos.OptionByteOrder: binary.LittleEndian},
+		map[string]interface{}{mangos.OptionMaxRecvSize: 1024})
+	defer client.Close()
+	defer server.Close()
+
+	// The handshake is unaffected, but the length is not.
+	if err := client.Send(newMsg([]byte("abc"))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Recv(); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
+
+// testLogger captures log lines, prefixed by their level.
+type testLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, "WARN "+fmt.Sprintf(format, args...))
+	l.Unlock()
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, "DEBUG "+fmt.Sprintf(format, args...))
+	l.Unlock()
+}
+
+func (l *testLogger) find(level, text string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, level+" ") && strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConnLoggerHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, 8))
+		c.Write([]byte{0, 'X', 'P', 0, 0, mangos.ProtoRep, 0, 0})
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	log := &testLogger{}
+	opts := map[string]interface{}{mangos.OptionLogger: log}
+	if _, err = NewConnPipe(c, reqInfo, opts); err != mangos.ErrBadHeader {
+		t.Fatalf("Expected ErrBadHeader, got %v", err)
+	}
+	if !log.find("WARN", "handshake with "+c.RemoteAddr().String()) ||
+		!log.find("WARN", mangos.ErrBadHeader.Error()) {
+		t.Errorf("Handshake failure not logged: %q", log.lines)
+	}
+}
+
+func TestConnLoggerPipe(t *testing.T) {
+	log := &testLogger{}
+	client, server := connPair(t,
+		map[string]interface{}{mangos.OptionLogger: log},
+		map[string]interface{}{
+			mangos.OptionLogger:      log,
+			mangos.OptionMaxRecvSize: 8,
+		})
+	defer client.Close()
+	defer server.Close()
+	if len(log.lines) != 0 {
+		t.Errorf("Unexpected log: %q", log.lines)
+	}
+
+	if err := client.Send(newMsg(make([]byte, 100))); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Recv(); !errors.Is(err, mangos.ErrTooLong) {
+		t.Fatalf("Expected ErrTooLong, got %v", err)
+	}
+	if !log.find("WARN", "exceeds limit 8") {
+		t.Errorf("Oversized message not logged: %q", log.lines)
+	}
+	client.Close()
+	if !log.find("DEBUG", "closed") {
+		t.Errorf("Close not logged: %q", log.lines)
+	}
+}
+
+func TestConnCloseConcurrent(t *testing.T) {
+	opts := map[string]interface{}{
+		mangos.OptionSendBatch: time.Hour,
+	}
+	for i := 0; i < 20; i++ {
+		client, server := connPair(t, opts, nil)
+
+		// Something is left in the batch buffer.
+		if err := client.Send(newMsg([]byte("hello"))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		errs := make(chan error, 1)
+		go func() {
+			_, err := client.Recv()
+			errs <- err
+		}()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client.Close()
+			}()
+		}
+		wg.Wait()
+		if err := client.Close(); err != nil {
+			t.Errorf("Close again failed: %v", err)
+		}
+		if err := <-errs; err == nil {
+			t.Errorf("Recv succeeded after Close")
+		}
+		server.Close()
+	}
+}
+
+func TestConnRecvDuringClose(t *testing.T) {
+	for _, partial := range []bool{false, true} {
+		client, server := connPair(t, nil, nil)
+
+		if partial {
+			// Part of a length prefix, so the read is mid-message.
+			c := server.(interface{ Conn() net.Conn }).Conn()
+			if _, err := c.Write([]byte{0, 0, 0}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		errs := make(chan error, 1)
+		go func() {
+			_, err := client.Recv()
+			errs <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := client.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		select {
+		case err := <-errs:
+			if err != mangos.ErrClosed {
+				t.Errorf("Partial %v: got %v, expected ErrClosed", partial, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Recv did not return after Close")
+		}
+		server.Close()
+	}
+}
+
+// countingAllocator is a RecvAllocator that counts its buffers.
+type countingAllocator struct {
+	allocs   int32
+	releases int32
+	fail     bool
+}
+
+func (a *countingAllocator) Alloc(size int) ([]byte, func(), error) {
+	if a.fail {
+		return nil, nil, mangos.ErrBufferTooSmall
+	}
+	atomic.AddInt32(&a.allocs, 1)
+	return make([]byte, size), func() { atomic.AddInt32(&a.releases, 1) }, nil
+}
+
+func TestConnRecvAllocator(t *testing.T) {
+	a := &countingAllocator{}
+	client, server := connPair(t, nil, map[string]interface{}{
+		mangos.OptionRecvAllocator: mangos.RecvAllocator(a),
+	})
+	defer client.Close()
+	defer server.Close()
+
+	for _, sz := range []int{0, 10, 100000} {
+		body := bytes.Repeat([]byte{'x'}, sz)
+		go client.Send(newMsg(body))
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if !bytes.Equal(m.Body, body) {
+			t.Fatalf("Got %d bytes, expected %d", len(m.Body), sz)
+		}
+		m.Free()
+	}
+	if a.allocs != 3 || a.releases != 3 {
+		t.Errorf("Got %d allocations and %d releases", a.allocs, a.releases)
+	}
+
+	// The pipe cannot continue without a buffer.
+	a.fail = true
+	go client.Send(newMsg([]byte("hello")))
+	if _, err := server.Recv(); err != mangos.ErrBufferTooSmall {
+		t.Errorf("Expected ErrBufferTooSmall, got %v", err)
+	}
+	if _, err := server.Recv(); err != mangos.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -20,26 +20,30 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"time"
 
 	"nanomsg.org/go/mangos/v2"
 )
 
 // NewConnPipeIPC allocates a new Pipe using the IPC exchange protocol.
 func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
-	p := &connipc{
-		conn: conn{
-			c:       c,
-			proto:   proto,
-			options: make(map[string]interface{}),
-		},
-	}
-	p.options[mangos.OptionMaxRecvSize] = int64(0)
-	for n, v := range options {
-		p.options[n] = v
-	}
-	p.maxrx = p.options[mangos.OptionMaxRecvSize].(int)
+	return NewConnPipeIPCWithTimeout(c, proto, options, 0)
+}
 
-	if err := p.handshake(); err != nil {
+// NewConnPipeIPCWithTimeout is like NewConnPipeIPC, but the handshake
+// must complete within the timeout, as for NewConnPipeWithTimeout.
+func NewConnPipeIPCWithTimeout(c net.Conn, proto ProtocolInfo, options map[string]interface{}, timeout time.Duration) (Pipe, error) {
+	p := &connipc{}
+	p.init(c, proto, options)
+	delete(p.options, mangos.OptionChecksum) // IPC has its own framing
+	delete(p.options, mangos.OptionTraceHeader)
+	delete(p.options, mangos.OptionTypeHeader)
+	delete(p.options, mangos.OptionKeepAliveInterval)
+	delete(p.options, mangos.OptionFlowCredits)
+	delete(p.options, mangos.OptionMaxFrameSize)
+	delete(p.options, mangos.OptionCompression)
+
+	if err := p.handshakeWithin(timeout); err != nil {
 		return nil, err
 	}
 
@@ -48,53 +52,93 @@ func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface
 
 func (p *connipc) Send(msg *Message) error {
 
-	l := uint64(len(msg.Header) + len(msg.Body))
-	var err error
+	p.wlock.Lock()
+	n, err := p.checkSend(msg)
+	p.wlock.Unlock()
+	if err != nil {
+		return err
+	}
+	l := uint64(n)
 
 	// send length header
 	header := make([]byte, 9)
 	header[0] = 1
-	binary.BigEndian.PutUint64(header[1:], l)
+	p.byteOrder.PutUint64(header[1:], l)
 
-	if _, err = p.c.Write(header[:]); err != nil {
+	if err := p.sendWire(net.Buffers{header, msg.Header, msg.Body}, 9); err != nil {
 		return err
 	}
+	msg.Free()
+	return nil
+}
 
-	if _, err = p.c.Write(msg.Header); err != nil {
-		return err
+// SendPrepared sends a message prepared for many pipes, with the IPC
+// message type byte in front of the shared encoding.
+func (p *connipc) SendPrepared(pm *mangos.PreparedMessage) error {
+	if p.sfilter != nil {
+		return p.Send(pm.Message())
 	}
-	// hope this works
-	if _, err = p.c.Write(msg.Body); err != nil {
-		return err
+	return p.sendWire(net.Buffers{[]byte{1}, pm.Wire()}, 9)
+}
+
+// SendReader streams a message body from r, with the IPC message type
+// byte in front of the length.
+func (p *connipc) SendReader(header []byte, r io.Reader, size int64) error {
+	if p.sfilter != nil {
+		return mangos.ErrProtoOp
 	}
-	msg.Free()
-	return nil
+	var b [9]byte
+	b[0] = 1
+	p.byteOrder.PutUint64(b[1:], uint64(int64(len(header))+size))
+	return p.sendReader(b[:], header, r, size)
 }
 
 func (p *connipc) Recv() (*Message, error) {
+	p.rlock.Lock()
+	defer p.rlock.Unlock()
+
+	return p.filterRecv(p.recvMsg)
+}
+
+// recvMsg reads the next message.  The caller must hold the rlock.
+func (p *connipc) recvMsg() (*Message, error) {
 
 	var sz int64
 	var err error
 	var msg *Message
 	var one [1]byte
 
-	if _, err = p.c.Read(one[:]); err != nil {
-		return nil, err
+	if p.closed() {
+		return nil, mangos.ErrClosed
 	}
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
-		return nil, err
+	p.syncMaxRecvSize()
+	if err = p.drain(); err != nil {
+		return nil, p.fail(err)
+	}
+	if _, err = p.rd.Read(one[:]); err != nil {
+		return nil, p.fail(err)
+	}
+	if err = binary.Read(p.rd, p.byteOrder, &sz); err != nil {
+		return nil, p.fail(err)
 	}
 
 	// Limit messages to the maximum receive value, if not
 	// unlimited.  This avoids a potential denaial of service.
 	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) {
-		return nil, mangos.ErrTooLong
+		return nil, p.fail(p.tooLong(uint64(sz)))
+	}
+	if p.alloc != nil {
+		if msg, err = allocMsg(p.alloc, int(sz)); err != nil {
+			return nil, p.abort(err)
+		}
+	} else {
+		msg = mangos.NewMessage(int(sz))
+		msg.Body = msg.Body[0:sz]
 	}
-	msg = mangos.NewMessage(int(sz))
-	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
+	if _, err = io.ReadFull(p.rd, msg.Body); err != nil {
 		msg.Free()
-		return nil, err
+		return nil, p.fail(err)
 	}
+	p.countRx(sz)
 	return msg, nil
 }
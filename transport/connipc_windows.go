@@ -20,26 +20,30 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"time"
 
 	"nanomsg.org/go/mangos/v2"
 )
 
 // NewConnPipeIPC allocates a new Pipe using the IPC exchange protocol.
 func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface{}) (Pipe, error) {
-	p := &connipc{
-		conn: conn{
-			c:       c,
-			proto:   proto,
-			options: make(map[string]interface{}),
-		},
-	}
-	p.options[mangos.OptionMaxRecvSize] = int64(0)
-	for n, v := range options {
-		p.options[n] = v
-	}
-	p.maxrx = p.options[mangos.OptionMaxRecvSize].(int)
+	return NewConnPipeIPCWithTimeout(c, proto, options, 0)
+}
 
-	if err := p.handshake(); err != nil {
+// NewConnPipeIPCWithTimeout is like NewConnPipeIPC, but the handshake
+// must complete within the timeout, as for NewConnPipeWithTimeout.
+func NewConnPipeIPCWithTimeout(c net.Conn, proto ProtocolInfo, options map[string]interface{}, timeout time.Duration) (Pipe, error) {
+	p := &connipc{}
+	p.init(c, proto, options)
+	delete(p.options, mangos.OptionChecksum) // IPC has its own framing
+	delete(p.options, mangos.OptionTraceHeader)
+	delete(p.options, mangos.OptionTypeHeader)
+	delete(p.options, mangos.OptionKeepAliveInterval)
+	delete(p.options, mangos.OptionFlowCredits)
+	delete(p.options, mangos.OptionMaxFrameSize)
+	delete(p.options, mangos.OptionCompression)
+
+	if err := p.handshakeWithin(timeout); err != nil {
 		return nil, err
 	}
 
@@ -48,8 +52,13 @@ func NewConnPipeIPC(c net.Conn, proto ProtocolInfo, options map[string]interface
 
 func (p *connipc) Send(msg *Message) error {
 
-	l := uint64(len(msg.Header) + len(msg.Body))
-	var err error
+	p.wlock.Lock()
+	sz, err := p.checkSend(msg)
+	if err != nil {
+		p.wlock.Unlock()
+		return err
+	}
+	l := uint64(sz)
 
 	// On Windows, we have to put everything into a contiguous buffer.
 	// This is to workaround bugs in legacy libnanomsg.  Eventually we
@@ -60,41 +69,85 @@ func (p *connipc) Send(msg *Message) error {
 	// send length header
 	buf := make([]byte, 9, 9+l)
 	buf[0] = 1
-	binary.BigEndian.PutUint64(buf[1:], l)
+	p.byteOrder.PutUint64(buf[1:], l)
 	buf = append(buf, msg.Header...)
 	buf = append(buf, msg.Body...)
 
-	if _, err = p.c.Write(buf[:]); err != nil {
-		return err
+	p.armWrite()
+	n, err := p.c.Write(buf[:])
+	p.wlock.Unlock()
+	if err != nil {
+		if n != 0 || p.wtimeout > 0 {
+			return p.abort(err)
+		}
+		return p.fail(err)
+	}
+	if n != len(buf) {
+		return p.abort(mangos.ErrShortWrite)
 	}
+	p.countTx(int64(l))
 	msg.Free()
 	return nil
 }
 
+// SendPrepared sends a message prepared for many pipes.  As Windows
+// needs a contiguous buffer anyway, this just sends a copy.
+func (p *connipc) SendPrepared(pm *mangos.PreparedMessage) error {
+	return p.Send(pm.Message())
+}
+
+// SendReader is not supported on Windows, as messages must be sent
+// from a contiguous buffer.
+func (p *connipc) SendReader(header []byte, r io.Reader, size int64) error {
+	return mangos.ErrProtoOp
+}
+
 func (p *connipc) Recv() (*Message, error) {
+	p.rlock.Lock()
+	defer p.rlock.Unlock()
+
+	return p.filterRecv(p.recvMsg)
+}
+
+// recvMsg reads the next message.  The caller must hold the rlock.
+func (p *connipc) recvMsg() (*Message, error) {
 
 	var sz int64
 	var err error
 	var msg *Message
 	var one [1]byte
 
-	if _, err = p.c.Read(one[:]); err != nil {
-		return nil, err
+	if p.closed() {
+		return nil, mangos.ErrClosed
 	}
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
-		return nil, err
+	p.syncMaxRecvSize()
+	if err = p.drain(); err != nil {
+		return nil, p.fail(err)
+	}
+	if _, err = p.rd.Read(one[:]); err != nil {
+		return nil, p.fail(err)
+	}
+	if err = binary.Read(p.rd, p.byteOrder, &sz); err != nil {
+		return nil, p.fail(err)
 	}
 
 	// Limit messages to the maximum receive value, if not
 	// unlimited.  This avoids a potential denaial of service.
 	if sz < 0 || (p.maxrx > 0 && sz > int64(p.maxrx)) {
-		return nil, mangos.ErrTooLong
+		return nil, p.fail(p.tooLong(uint64(sz)))
 	}
-	msg = mangos.NewMessage(int(sz))
-	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
+	if p.alloc != nil {
+		if msg, err = allocMsg(p.alloc, int(sz)); err != nil {
+			return nil, p.abort(err)
+		}
+	} else {
+		msg = mangos.NewMessage(int(sz))
+		msg.Body = msg.Body[0:sz]
+	}
+	if _, err = io.ReadFull(p.rd, msg.Body); err != nil {
 		msg.Free()
-		return nil, err
+		return nil, p.fail(err)
 	}
+	p.countRx(sz)
 	return msg, nil
 }
@@ -0,0 +1,135 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// creditGrant is returned by pingFramer in place of a message, when it
+// reads a grant of credit.  It is never seen outside of conn.
+type creditGrant uint32
+
+func (g creditGrant) Error() string {
+	return fmt.Sprintf("%d credits granted", uint32(g))
+}
+
+// writeCredit writes a grant of n credits.
+func (f pingFramer) writeCredit(w io.Writer, n uint32) error {
+	b := make([]byte, 5)
+	b[0] = frameCredit
+	binary.BigEndian.PutUint32(b[1:], n)
+	return f.inner.WriteMsg(w, &Message{Body: b})
+}
+
+// takeCredit uses up one of the credits granted by the peer, waiting
+// for it to grant more if there are none.  It does nothing without
+// OptionFlowCredits.
+func (p *conn) takeCredit() error {
+	if p.crStop == nil {
+		return nil
+	}
+	for {
+		p.Lock()
+		if p.credits > 0 {
+			p.credits--
+			more := p.credits > 0
+			p.Unlock()
+			if more {
+				// Pass the wakeup on to any other sender.
+				p.signalCredit()
+			}
+			return nil
+		}
+		p.Unlock()
+		select {
+		case <-p.crMore:
+		case <-p.crStop:
+			return mangos.ErrClosed
+		}
+	}
+}
+
+// refundCredit returns the credit taken for a message that was not sent
+// after all.
+func (p *conn) refundCredit() {
+	if p.crStop != nil {
+		p.addCredit(1)
+	}
+}
+
+// addCredit adds credits granted by the peer.
+func (p *conn) addCredit(n int64) {
+	p.Lock()
+	p.credits += n
+	p.Unlock()
+	p.signalCredit()
+}
+
+func (p *conn) signalCredit() {
+	select {
+	case p.crMore <- struct{}{}:
+	default:
+	}
+}
+
+// consumed counts a message handed to the protocol, and has more credit
+// granted to the peer once half of the window has been used.
+func (p *conn) consumed() {
+	p.Lock()
+	p.crUsed++
+	grant := p.crUsed >= (p.crWindow+1)/2
+	p.Unlock()
+	if grant {
+		select {
+		case p.crGrant <- struct{}{}:
+		default: // a grant is already due
+		}
+	}
+}
+
+// grantCredit grants the peer credit, first for the whole window, and
+// then for the messages consumed since the last grant.
+func (p *conn) grantCredit() {
+	for {
+		select {
+		case <-p.crStop:
+			return
+		case <-p.crGrant:
+		}
+		p.Lock()
+		n := p.crUsed
+		p.crUsed = 0
+		p.Unlock()
+		if n == 0 {
+			continue
+		}
+		p.wlock.Lock()
+		p.armWrite()
+		err := p.kaFramer.writeCredit(p.wr, uint32(n))
+		if err == nil {
+			err = p.flushBatch()
+		}
+		p.wlock.Unlock()
+		if err != nil {
+			p.abort(err)
+			return
+		}
+	}
+}
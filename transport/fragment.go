@@ -0,0 +1,135 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// With fragmentation, each frame starts with one of these, saying whether
+// more fragments of the same message follow.
+const (
+	fragLast = 0
+	fragMore = 1
+)
+
+// fragFramer splits messages into fragments of at most size bytes, each
+// framed by another Framer, and preceded by a byte saying whether more
+// follow.  The receiver reassembles them, subject to its receive limit.
+// It is used when both peers agree on it during the handshake.
+type fragFramer struct {
+	inner Framer
+	size  int
+	maxrx int
+}
+
+func newFragFramer(inner Framer, size, maxrx int) fragFramer {
+	// Each fragment is limited by the inner Framer, allowing for the
+	// flag, and the reassembled message by ReadMsg.
+	return fragFramer{
+		inner: withMaxRecvSize(inner, compressedLimit(maxrx)),
+		size:  size,
+		maxrx: maxrx,
+	}
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f fragFramer) ReadMsg(r io.Reader) (*Message, error) {
+	var msg *Message
+	for {
+		m, err := f.inner.ReadMsg(r)
+		if err != nil {
+			var tl *mangos.TooLongError
+			if errors.As(err, &tl) {
+				tl.Size--
+				if tl.Limit > 0 {
+					tl.Limit--
+				}
+			}
+			if msg != nil {
+				msg.Free()
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			return nil, err
+		}
+		if len(m.Body) == 0 || m.Body[0] > fragMore {
+			m.Free()
+			if msg != nil {
+				msg.Free()
+			}
+			return nil, mangos.ErrGarbled
+		}
+		more := m.Body[0] == fragMore
+		if msg == nil {
+			msg = m
+			msg.Body = msg.Body[1:]
+		} else {
+			sz := len(msg.Body) + len(m.Body) - 1
+			if f.maxrx > 0 && sz > f.maxrx {
+				m.Free()
+				msg.Free()
+				return nil, &mangos.TooLongError{Size: uint64(sz), Limit: f.maxrx}
+			}
+			msg.Body = append(msg.Body, m.Body[1:]...)
+			m.Free()
+		}
+		if !more {
+			return msg, nil
+		}
+	}
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f fragFramer) WriteMsg(w io.Writer, m *Message) error {
+	hl := len(m.Header)
+	n := hl + len(m.Body)
+	for off := 0; off == 0 || off < n; off += f.size {
+		end := off + f.size
+		flag := byte(fragMore)
+		if end >= n {
+			end = n
+			flag = fragLast
+		}
+		frag := &Message{Header: []byte{flag}}
+		if off < hl {
+			h := hl
+			if end < h {
+				h = end
+			}
+			frag.Header = append(frag.Header, m.Header[off:h]...)
+		}
+		if end > hl {
+			start := off - hl
+			if start < 0 {
+				start = 0
+			}
+			frag.Body = m.Body[start : end-hl]
+		}
+		if err := f.inner.WriteMsg(w, frag); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && off > 0 {
+				// Part of the message is already written.
+				err = mangos.ErrShortWrite
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// Framer delimits messages on a byte stream.  A Framer is used by the
+// pipes created with NewConnPipe and friends; both peers must of course
+// use the same framing.
+//
+// ReadMsg reads a single message, returning it with the entire content
+// in the Body.  WriteMsg writes the Header followed by the Body as a
+// single message.  If WriteMsg fails part way through a message, it must
+// not return a timeout error, since the stream cannot be resumed;
+// ErrShortWrite is appropriate.  Framers must not retain the Message.
+type Framer interface {
+	ReadMsg(io.Reader) (*Message, error)
+	WriteMsg(io.Writer, *Message) error
+}
+
+// DefaultFramer is the standard SP framing, where each message is
+// preceded by its length as a 64-bit big-endian value.  This is the
+// only framing that interoperates with other SP implementations.
+type DefaultFramer struct {
+	// MaxRecvSize limits the size of received messages.  Larger
+	// messages are rejected with ErrTooLong before any buffer is
+	// allocated.  Zero means no limit.
+	MaxRecvSize int
+
+	// ByteOrder is the byte order of the length.  The SP protocols
+	// require big-endian, which is used if this is nil, but some
+	// legacy systems use little-endian.
+	ByteOrder binary.ByteOrder
+
+	// Allocator, if not nil, supplies the buffer for each message
+	// body, rather than the usual message pools.
+	Allocator mangos.RecvAllocator
+}
+
+func (f DefaultFramer) order() binary.ByteOrder {
+	if f.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return f.ByteOrder
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f DefaultFramer) ReadMsg(r io.Reader) (*Message, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	sz := f.order().Uint64(b[:])
+	if f.Allocator != nil {
+		return readAllocated(r, sz, f.MaxRecvSize, f.Allocator)
+	}
+	return readBody(r, sz, f.MaxRecvSize)
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f DefaultFramer) WriteMsg(w io.Writer, m *Message) error {
+	var b [8]byte
+	f.order().PutUint64(b[:], uint64(len(m.Header)+len(m.Body)))
+	return writeFrame(w, b[:], m)
+}
+
+// VarintFramer is an experimental framing, where each message is
+// preceded by its length encoded as an unsigned varint, in the same
+// manner as binary.PutUvarint.  This takes just one byte for messages
+// of less than 128 bytes, and two for those less than 16KB, instead of
+// eight.  This is NOT compatible with other SP implementations.
+type VarintFramer struct {
+	// MaxRecvSize limits the size of received messages, as with
+	// DefaultFramer.
+	MaxRecvSize int
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f VarintFramer) ReadMsg(r io.Reader) (*Message, error) {
+	var b [binary.MaxVarintLen64]byte
+	for i := range b {
+		if _, err := io.ReadFull(r, b[i:i+1]); err != nil {
+			if i != 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if b[i] < 0x80 {
+			sz, n := binary.Uvarint(b[:i+1])
+			if n <= 0 {
+				return nil, mangos.ErrTooLong
+			}
+			return readBody(r, sz, f.MaxRecvSize)
+		}
+	}
+	return nil, mangos.ErrTooLong
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f VarintFramer) WriteMsg(w io.Writer, m *Message) error {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(m.Header)+len(m.Body)))
+	return writeFrame(w, b[:n], m)
+}
+
+// crcTable is the Castagnoli polynomial, used for CRC32C.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcFramer is the standard SP framing, but with a CRC32C of the
+// message appended to each frame, and counted in its length.  It is
+// used when both peers agree on it during the handshake.
+type crcFramer struct {
+	maxrx int
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f crcFramer) ReadMsg(r io.Reader) (*Message, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	sz := binary.BigEndian.Uint64(b[:])
+	if sz < 4 {
+		return nil, mangos.ErrChecksumMismatch
+	}
+	if f.maxrx > 0 && sz-4 > uint64(f.maxrx) {
+		return nil, &mangos.TooLongError{Size: sz - 4, Limit: f.maxrx}
+	}
+	msg, err := readBody(r, sz, 0)
+	if err != nil {
+		return nil, err
+	}
+	n := len(msg.Body) - 4
+	if crc32.Checksum(msg.Body[:n], crcTable) !=
+		binary.BigEndian.Uint32(msg.Body[n:]) {
+		msg.Free()
+		return nil, mangos.ErrChecksumMismatch
+	}
+	msg.Body = msg.Body[:n]
+	return msg, nil
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f crcFramer) WriteMsg(w io.Writer, m *Message) error {
+	var b [8]byte
+	var sum [4]byte
+	binary.BigEndian.PutUint64(b[:], uint64(len(m.Header)+len(m.Body)+4))
+	crc := crc32.Update(0, crcTable, m.Header)
+	crc = crc32.Update(crc, crcTable, m.Body)
+	binary.BigEndian.PutUint32(sum[:], crc)
+	return writeBuffers(w, net.Buffers{b[:], m.Header, m.Body, sum[:]})
+}
+
+// traceFramer sends the TraceID of each message ahead of its header,
+// and frames the result with another Framer.  It is used when both
+// peers agree on it during the handshake.
+type traceFramer struct {
+	inner Framer
+}
+
+func newTraceFramer(inner Framer, maxrx int) traceFramer {
+	if maxrx > 0 {
+		maxrx += mangos.TraceIDSize
+	}
+	return traceFramer{inner: withMaxRecvSize(inner, maxrx)}
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f traceFramer) ReadMsg(r io.Reader) (*Message, error) {
+	m, err := f.inner.ReadMsg(r)
+	if err != nil {
+		var tl *mangos.TooLongError
+		if errors.As(err, &tl) {
+			tl.Size -= mangos.TraceIDSize
+			if tl.Limit > 0 {
+				tl.Limit -= mangos.TraceIDSize
+			}
+		}
+		return nil, err
+	}
+	if len(m.Body) < mangos.TraceIDSize {
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+	copy(m.TraceID[:], m.Body)
+	m.Body = m.Body[mangos.TraceIDSize:]
+	return m, nil
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f traceFramer) WriteMsg(w io.Writer, m *Message) error {
+	hdr := make([]byte, 0, mangos.TraceIDSize+len(m.Header))
+	hdr = append(append(hdr, m.TraceID[:]...), m.Header...)
+	return f.inner.WriteMsg(w, withHeader(m, hdr))
+}
+
+// withHeader returns a Message with the Body of m, and the given Header.
+// Framers that wrap another use it, so that the fields sent outside the
+// Header, such as TraceID, still reach the Framer that sends them.
+func withHeader(m *Message, hdr []byte) *Message {
+	return &Message{
+		Header:  hdr,
+		Body:    m.Body,
+		TraceID: m.TraceID,
+		Type:    m.Type,
+		Flags:   m.Flags,
+	}
+}
+
+// typeHeaderSize is the size of the Type and Flags sent by typeFramer.
+const typeHeaderSize = 3
+
+// typeFramer sends the Type and Flags of each message ahead of its
+// header, and frames the result with another Framer.  It is used when
+// both peers agree on it during the handshake.
+type typeFramer struct {
+	inner Framer
+}
+
+func newTypeFramer(inner Framer, maxrx int) typeFramer {
+	if maxrx > 0 {
+		maxrx += typeHeaderSize
+	}
+	return typeFramer{inner: withMaxRecvSize(inner, maxrx)}
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f typeFramer) ReadMsg(r io.Reader) (*Message, error) {
+	m, err := f.inner.ReadMsg(r)
+	if err != nil {
+		var tl *mangos.TooLongError
+		if errors.As(err, &tl) {
+			tl.Size -= typeHeaderSize
+			if tl.Limit > 0 {
+				tl.Limit -= typeHeaderSize
+			}
+		}
+		return nil, err
+	}
+	if len(m.Body) < typeHeaderSize {
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+	m.Type = binary.BigEndian.Uint16(m.Body)
+	m.Flags = m.Body[2]
+	m.Body = m.Body[typeHeaderSize:]
+	return m, nil
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f typeFramer) WriteMsg(w io.Writer, m *Message) error {
+	hdr := make([]byte, typeHeaderSize, typeHeaderSize+len(m.Header))
+	binary.BigEndian.PutUint16(hdr, m.Type)
+	hdr[2] = m.Flags
+	hdr = append(hdr, m.Header...)
+	return f.inner.WriteMsg(w, withHeader(m, hdr))
+}
+
+// seqHeaderSize is the size of the sequence number sent by seqFramer.
+const seqHeaderSize = 8
+
+// seqFramer numbers each message it writes, sending the number ahead of
+// its header, and frames the result with another Framer.  It is used
+// when both peers agree on it during the handshake.
+type seqFramer struct {
+	inner Framer
+	last  *uint64 // last sequence number sent
+}
+
+func newSeqFramer(inner Framer, maxrx int) seqFramer {
+	if maxrx > 0 {
+		maxrx += seqHeaderSize
+	}
+	return seqFramer{inner: withMaxRecvSize(inner, maxrx), last: new(uint64)}
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f seqFramer) ReadMsg(r io.Reader) (*Message, error) {
+	m, err := f.inner.ReadMsg(r)
+	if err != nil {
+		var tl *mangos.TooLongError
+		if errors.As(err, &tl) {
+			tl.Size -= seqHeaderSize
+			if tl.Limit > 0 {
+				tl.Limit -= seqHeaderSize
+			}
+		}
+		return nil, err
+	}
+	if len(m.Body) < seqHeaderSize {
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+	m.Seq = binary.BigEndian.Uint64(m.Body)
+	m.Body = m.Body[seqHeaderSize:]
+	return m, nil
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f seqFramer) WriteMsg(w io.Writer, m *Message) error {
+	seq := atomic.AddUint64(f.last, 1)
+	hdr := make([]byte, seqHeaderSize, seqHeaderSize+len(m.Header))
+	binary.BigEndian.PutUint64(hdr, seq)
+	hdr = append(hdr, m.Header...)
+	err := f.inner.WriteMsg(w, withHeader(m, hdr))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// Nothing was written, so the number may be used again.
+		atomic.AddUint64(f.last, ^uint64(0))
+	}
+	return err
+}
+
+// readBody reads a message body of the given size, after checking that
+// it is within limits.
+func readBody(r io.Reader, sz uint64, maxrx int) (*Message, error) {
+	if int64(sz) < 0 || (maxrx > 0 && sz > uint64(maxrx)) {
+		return nil, &mangos.TooLongError{Size: sz, Limit: maxrx}
+	}
+	if sz > readChunkSize {
+		return readBodyChunked(r, sz)
+	}
+	msg := mangos.NewMessage(int(sz))
+	msg.Body = msg.Body[0:sz]
+	if sz == 0 {
+		// Empty messages are valid, and have nothing more to read.
+		return msg, nil
+	}
+	if _, err := io.ReadFull(r, msg.Body); err != nil {
+		msg.Free()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readAllocated is like readBody, but the body is read into a buffer
+// from the RecvAllocator.  The buffer must be whole, so it is requested
+// at the size declared by the peer; see RecvAllocator.
+func readAllocated(r io.Reader, sz uint64, maxrx int, a mangos.RecvAllocator) (*Message, error) {
+	if int64(sz) < 0 || (maxrx > 0 && sz > uint64(maxrx)) {
+		return nil, &mangos.TooLongError{Size: sz, Limit: maxrx}
+	}
+	msg, err := allocMsg(a, int(sz))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(r, msg.Body); err != nil {
+		msg.Free()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// allocMsg returns a message with a body of sz bytes from the
+// RecvAllocator.
+func allocMsg(a mangos.RecvAllocator, sz int) (*Message, error) {
+	b, release, err := a.Alloc(sz)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sz {
+		if release != nil {
+			release()
+		}
+		return nil, mangos.ErrBufferTooSmall
+	}
+	return mangos.NewAllocatedMessage(b, release), nil
+}
+
+// readChunkSize is the most that is allocated for a message body before
+// any of it has arrived.
+const readChunkSize = 64 * 1024
+
+// readBodyChunked is like readBody, for large messages.  The body grows
+// as the data arrives, rather than being allocated at the size declared
+// by the peer, so a peer cannot make us allocate a lot of memory without
+// actually sending that much.
+func readBodyChunked(r io.Reader, sz uint64) (*Message, error) {
+	msg := mangos.NewMessage(readChunkSize)
+	for uint64(len(msg.Body)) < sz {
+		if len(msg.Body) == cap(msg.Body) {
+			n := uint64(cap(msg.Body)) * 2
+			if n > sz {
+				n = sz
+			}
+			b := make([]byte, len(msg.Body), n)
+			copy(b, msg.Body)
+			msg.Body = b
+		}
+		end := uint64(cap(msg.Body))
+		if end > sz {
+			end = sz
+		}
+		if _, err := io.ReadFull(r, msg.Body[len(msg.Body):end]); err != nil {
+			msg.Free()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		msg.Body = msg.Body[:end]
+	}
+	return msg, nil
+}
+
+// writeFrame writes the length prefix, header, and body.  The write is
+// vectored where the writer supports it.
+func writeFrame(w io.Writer, prefix []byte, m *Message) error {
+	return writeBuffers(w, net.Buffers{prefix, m.Header, m.Body})
+}
+
+// writeBuffers writes a complete frame.
+func writeBuffers(w io.Writer, buff net.Buffers) error {
+	var want int64
+	for _, b := range buff {
+		want += int64(len(b))
+	}
+	n, err := buff.WriteTo(w)
+	if err != nil && n == 0 {
+		return err
+	}
+	// A short write leaves the peer unable to find the next message
+	// boundary, so the connection is unusable.
+	if n != want {
+		return mangos.ErrShortWrite
+	}
+	return nil
+}
@@ -13,12 +13,16 @@
 // limitations under the License.
 
 // Package inproc implements an simple inproc transport for mangos.
-// To enable it simply import it.
+// To enable it simply import it.  Messages are handed between the peers
+// directly, without being serialized.
 package inproc
 
 import (
+	"io"
+	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/transport"
@@ -37,6 +41,7 @@ type inproc struct {
 	peerProto uint16
 	addr      addr
 	peer      *inproc
+	err       error
 	sync.Mutex
 }
 
@@ -85,6 +90,7 @@ func (p *inproc) Recv() (*transport.Message, error) {
 	select {
 	case m, ok := <-p.rq:
 		if m == nil || !ok {
+			p.fail(io.EOF)
 			return nil, mangos.ErrClosed
 		}
 		// Upper protocols expect to have to pick header and
@@ -95,6 +101,7 @@ func (p *inproc) Recv() (*transport.Message, error) {
 	case <-p.closeq:
 		return nil, mangos.ErrClosed
 	case <-p.peer.closeq:
+		p.fail(io.EOF)
 		return nil, mangos.ErrClosed
 	}
 }
@@ -105,24 +112,55 @@ func (p *inproc) Send(m *mangos.Message) error {
 		return mangos.ErrClosed
 	}
 
-	// Upper protocols expect to have to pick header and body part.
-	// Also we need to have a fresh copy of the message for receiver, to
-	// break ownership.
-	nmsg := mangos.NewMessage(len(m.Header) + len(m.Body))
-	nmsg.Body = append(nmsg.Body, m.Header...)
-	nmsg.Body = append(nmsg.Body, m.Body...)
+	// Upper protocols expect to have to pick header and body part,
+	// so any header must be merged into the body, which needs a new
+	// message.  Otherwise the sender's message is handed over as is;
+	// a successful Send transfers ownership, so no copy is needed.
+	nmsg := m
+	if len(m.Header) != 0 {
+		nmsg = mangos.NewMessage(len(m.Header) + len(m.Body))
+		nmsg.Body = append(nmsg.Body, m.Header...)
+		nmsg.Body = append(nmsg.Body, m.Body...)
+	}
+	nmsg.Pipe = nil
+	nmsg.Priority = 0
+	nmsg.Expiry = time.Time{}
 	select {
 	case p.wq <- nmsg:
+		if nmsg != m {
+			m.Free()
+		}
 		return nil
 	case <-p.closeq:
-		nmsg.Free()
+		if nmsg != m {
+			nmsg.Free()
+		}
 		return mangos.ErrClosed
 	case <-p.peer.closeq:
-		nmsg.Free()
+		if nmsg != m {
+			nmsg.Free()
+		}
+		p.fail(io.EOF)
 		return mangos.ErrClosed
 	}
 }
 
+// fail records the reason for failure, if not already recorded.
+func (p *inproc) fail(err error) error {
+	p.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.Unlock()
+	return err
+}
+
+func (p *inproc) CloseErr() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
 func (p *inproc) LocalProtocol() uint16 {
 	return p.selfProto
 }
@@ -131,8 +169,19 @@ func (p *inproc) RemoteProtocol() uint16 {
 	return p.peerProto
 }
 
+func (p *inproc) LocalProtocolName() string {
+	return mangos.ProtocolName(p.selfProto)
+}
+
+func (p *inproc) RemoteProtocolName() string {
+	return mangos.ProtocolName(p.peerProto)
+}
+
 func (p *inproc) Close() error {
 	p.Lock()
+	if p.err == nil {
+		p.err = mangos.ErrClosed
+	}
 	select {
 	case <-p.closeq: // If already closed, don't do it again.
 	default:
@@ -142,6 +191,14 @@ func (p *inproc) Close() error {
 	return nil
 }
 
+func (p *inproc) LocalAddr() net.Addr {
+	return p.addr
+}
+
+func (p *inproc) RemoteAddr() net.Addr {
+	return p.addr
+}
+
 func (p *inproc) GetOption(name string) (interface{}, error) {
 	switch name {
 	case mangos.OptionRemoteAddr:
@@ -181,10 +238,12 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 			return nil, mangos.ErrConnRefused
 		}
 
-		if (client.selfProto != l.peerProto) ||
-			(client.peerProto != l.selfProto) {
-			return nil, mangos.ErrBadProto
+		if !transport.ValidPeer(client.selfProto, l.selfProto) ||
+			!transport.ValidPeer(l.selfProto, client.selfProto) {
+			listeners.mx.Unlock()
+			return nil, mangos.ErrIncompatibleProto
 		}
+		client.peerProto = l.selfProto
 
 		if len(l.accepters) != 0 {
 			server = l.accepters[len(l.accepters)-1]
@@ -198,6 +257,7 @@ func (d *dialer) Dial() (transport.Pipe, error) {
 
 	listeners.mx.Unlock()
 
+	server.peerProto = client.selfProto
 	server.wq = make(chan *transport.Message)
 	server.rq = make(chan *transport.Message)
 	client.rq = server.wq
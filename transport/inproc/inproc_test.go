@@ -17,7 +17,10 @@ package inproc
 import (
 	"testing"
 
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/pair"
 	"nanomsg.org/go/mangos/v2/test"
+	"nanomsg.org/go/mangos/v2/transport"
 )
 
 var tt = test.NewTranTest(Transport, "inproc://testname")
@@ -45,3 +48,107 @@ func TestInpSchem(t *testing.T) {
 func TestInp(t *testing.T) {
 	tt.TestAll(t)
 }
+
+// inpPair returns a connected pair of pipes.
+func inpPair(t testing.TB, addr string) (transport.Pipe, transport.Pipe) {
+	sock, err := pair.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %v", err)
+	}
+	l, err := Transport.NewListener(addr, sock)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ch := make(chan transport.Pipe)
+	go func() {
+		p, _ := l.Accept()
+		l.Close()
+		ch <- p
+	}()
+	d, err := Transport.NewDialer(addr, sock)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	client, err := d.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	server := <-ch
+	if server == nil {
+		t.Fatalf("Accept failed")
+	}
+	return client, server
+}
+
+func TestInpZeroCopy(t *testing.T) {
+	client, server := inpPair(t, "inproc://zerocopy")
+	defer client.Close()
+	defer server.Close()
+
+	// Without a header, the message itself is handed over.
+	// Sends block until received, so they run in the background.
+	errq := make(chan error, 1)
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("hello")...)
+	go func() { errq <- client.Send(m) }()
+	r, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if err = <-errq; err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if r != m || string(r.Body) != "hello" {
+		t.Errorf("Message was copied: %q", r.Body)
+	}
+	r.Free()
+
+	// A header must be merged into the body.
+	m = mangos.NewMessage(0)
+	m.Header = append(m.Header, 0x80, 0, 0, 1)
+	m.Body = append(m.Body, []byte("hello")...)
+	go func() { errq <- client.Send(m) }()
+	if r, err = server.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if err = <-errq; err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if len(r.Header) != 0 || string(r.Body) != "\x80\x00\x00\x01hello" {
+		t.Errorf("Wrong message: %q %q", r.Header, r.Body)
+	}
+	r.Free()
+}
+
+// BenchmarkInpRecv64 is the inproc counterpart to the TCP loopback
+// BenchmarkConnRecv64 in the transport package.
+func BenchmarkInpRecv64(b *testing.B) {
+	client, server := inpPair(b, "inproc://bench")
+	defer client.Close()
+	defer server.Close()
+
+	body := make([]byte, 64)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			m := mangos.NewMessage(len(body))
+			m.Body = append(m.Body, body...)
+			if client.Send(m) != nil {
+				return
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			b.Fatalf("Recv failed: %v", err)
+		}
+		m.Free()
+	}
+}
@@ -20,6 +20,9 @@ package ipc
 
 import (
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/transport"
@@ -49,6 +52,20 @@ func (o options) get(name string) (interface{}, error) {
 	return v, nil
 }
 
+// with returns a copy of the options, with the named option set.  The
+// options held by dialers and listeners are replaced rather than
+// modified, so that each connection gets a consistent snapshot of them.
+func (o options) with(name string, val interface{}) (options, error) {
+	n := make(options, len(o)+1)
+	for k, v := range o {
+		n[k] = v
+	}
+	if err := n.set(name, val); err != nil {
+		return o, err
+	}
+	return n, nil
+}
+
 // SetOption sets an option.
 func (o options) set(name string, val interface{}) error {
 	switch name {
@@ -58,6 +75,94 @@ func (o options) set(name string, val interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
+	case mangos.OptionMaxSendSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionHandshakeHook:
+		switch v := val.(type) {
+		case mangos.HandshakeHook:
+			o[name] = v
+			return nil
+		case func(mangos.HandshakeEvent):
+			o[name] = mangos.HandshakeHook(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionAcceptHook:
+		switch v := val.(type) {
+		case mangos.AcceptHook:
+			o[name] = v
+			return nil
+		case func(net.Conn) error:
+			o[name] = mangos.AcceptHook(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionAuthenticator:
+		if v, ok := val.(mangos.Authenticator); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilter:
+		fallthrough
+	case mangos.OptionSendFilter:
+		switch v := val.(type) {
+		case mangos.MessageFilter:
+			o[name] = v
+			return nil
+		case func(*mangos.Message) error:
+			o[name] = mangos.MessageFilter(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilterClose:
+		if v, ok := val.(bool); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvAllocator:
+		if v, ok := val.(mangos.RecvAllocator); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionLogger:
+		if v, ok := val.(mangos.Logger); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionHandshakeMetadata:
+		if v, ok := val.(map[string]string); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionHandshakeTimeout:
+		fallthrough
+	case mangos.OptionWriteTimeout:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionReadBufferSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionIPCSocketPermissions:
+		if v, ok := val.(os.FileMode); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
 	}
 
 	return mangos.ErrBadOption
@@ -67,25 +172,34 @@ type dialer struct {
 	addr  *net.UnixAddr
 	proto transport.ProtocolInfo
 	opts  options
+	lock  sync.Mutex
 }
 
 // Dial implements the Dialer Dial method
 func (d *dialer) Dial() (transport.Pipe, error) {
 
+	d.lock.Lock()
+	opts := d.opts
+	d.lock.Unlock()
 	conn, err := net.DialUnix("unix", nil, d.addr)
 	if err != nil {
 		return nil, err
 	}
-	return transport.NewConnPipeIPC(conn, d.proto, d.opts)
+	return transport.NewConnPipeIPC(conn, d.proto, opts)
 }
 
 // SetOption implements Dialer SetOption method.
-func (d *dialer) SetOption(n string, v interface{}) error {
-	return d.opts.set(n, v)
+func (d *dialer) SetOption(n string, v interface{}) (err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.opts, err = d.opts.with(n, v)
+	return err
 }
 
 // GetOption implements Dialer GetOption method.
 func (d *dialer) GetOption(n string) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	return d.opts.get(n)
 }
 
@@ -94,18 +208,47 @@ type listener struct {
 	proto    transport.ProtocolInfo
 	listener *net.UnixListener
 	opts     options
+	lock     sync.Mutex
 }
 
 // Listen implements the PipeListener Listen method.
 func (l *listener) Listen() error {
 	listener, err := net.ListenUnix("unix", l.addr)
+	if err != nil && removeStale(l.addr) {
+		listener, err = net.ListenUnix("unix", l.addr)
+	}
 	if err != nil {
 		return err
 	}
+	l.lock.Lock()
+	v, ok := l.opts[mangos.OptionIPCSocketPermissions]
+	l.lock.Unlock()
+	if ok {
+		if err = os.Chmod(l.addr.Name, v.(os.FileMode)); err != nil {
+			listener.Close()
+			return err
+		}
+	}
 	l.listener = listener
 	return nil
 }
 
+// removeStale removes the socket file at the given address if nobody is
+// listening on it, such as when a previous process exited without
+// cleaning up.  It returns true if the file was removed.  Files that are
+// not sockets are never removed.
+func removeStale(addr *net.UnixAddr) bool {
+	fi, err := os.Lstat(addr.Name)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	if conn, err := net.DialUnix("unix", nil, addr); err == nil {
+		conn.Close()
+		return false
+	}
+	return os.Remove(addr.Name) == nil
+}
+
 func (l *listener) Address() string {
 	return "ipc://" + l.addr.String()
 }
@@ -117,7 +260,14 @@ func (l *listener) Accept() (transport.Pipe, error) {
 	if err != nil {
 		return nil, err
 	}
-	return transport.NewConnPipeIPC(conn, l.proto, l.opts)
+	l.lock.Lock()
+	opts := l.opts
+	l.lock.Unlock()
+	if err = transport.CheckAccept(conn, opts); err != nil {
+		return nil, err
+	}
+	timeout, _ := opts[mangos.OptionHandshakeTimeout].(time.Duration)
+	return transport.NewConnPipeIPCWithTimeout(conn, l.proto, transport.Accepted(opts), timeout)
 }
 
 // Close implements the PipeListener Close method.
@@ -127,12 +277,17 @@ func (l *listener) Close() error {
 }
 
 // SetOption implements a stub PipeListener SetOption method.
-func (l *listener) SetOption(n string, v interface{}) error {
-	return l.opts.set(n, v)
+func (l *listener) SetOption(n string, v interface{}) (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.opts, err = l.opts.with(n, v)
+	return err
 }
 
 // GetOption implements a stub PipeListener GetOption method.
 func (l *listener) GetOption(n string) (interface{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	return l.opts.get(n)
 }
 
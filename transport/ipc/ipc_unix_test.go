@@ -0,0 +1,174 @@
+// +build !windows,!nacl,!plan9
+
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func tempSocket(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mangos-ipc")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	return filepath.Join(dir, "sock"), func() { os.RemoveAll(dir) }
+}
+
+func TestIpcTempDirSendRecv(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	srv, _ := rep.NewSocket()
+	defer srv.Close()
+	cli, _ := req.NewSocket()
+	defer cli.Close()
+
+	if err := srv.Listen("ipc://" + path); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := cli.Dial("ipc://" + path); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err := cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := srv.Recv(); err != nil || string(b) != "ping" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+	if err := srv.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := cli.Recv(); err != nil || string(b) != "pong" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+}
+
+func TestIpcHandshakeTimeout(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	sock, _ := rep.NewSocket()
+	defer sock.Close()
+	l, err := Transport.NewListener("ipc://"+path, sock)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	if err = l.SetOption(mangos.OptionHandshakeTimeout, 100*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// A peer that never sends its header is dropped.
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = l.Accept(); err != mangos.ErrHandshakeTimeout {
+		t.Fatalf("Expected ErrHandshakeTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Timeout took too long: %v", d)
+	}
+}
+
+func TestIpcStaleSocket(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	// Leave a socket file behind with nobody listening on it.
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	ul, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		t.Fatalf("ListenUnix failed: %v", err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("Socket file missing: %v", err)
+	}
+
+	sock, _ := rep.NewSocket()
+	defer sock.Close()
+	l, err := Transport.NewListener("ipc://"+path, sock)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen over stale socket failed: %v", err)
+	}
+	l.Close()
+}
+
+func TestIpcNotSocket(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	sock, _ := rep.NewSocket()
+	defer sock.Close()
+	l, _ := Transport.NewListener("ipc://"+path, sock)
+	if err := l.Listen(); err == nil {
+		t.Errorf("Listen over regular file succeeded")
+		l.Close()
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Regular file was removed: %v", err)
+	}
+}
+
+func TestIpcSocketPermissions(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	sock, _ := rep.NewSocket()
+	defer sock.Close()
+	l, _ := Transport.NewListener("ipc://"+path, sock)
+	if err := l.SetOption(mangos.OptionIPCSocketPermissions, 0600); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	err := l.SetOption(mangos.OptionIPCSocketPermissions, os.FileMode(0600))
+	if err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong permissions: %v", fi.Mode().Perm())
+	}
+}
@@ -20,6 +20,8 @@ package ipc
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Microsoft/go-winio"
 	"nanomsg.org/go/mangos/v2"
@@ -85,15 +87,20 @@ type listener struct {
 	proto    transport.ProtocolInfo
 	listener net.Listener
 	opts     map[string]interface{}
+	lock     sync.Mutex
 }
 
 // Listen implements the PipeListener Listen method.
 func (l *listener) Listen() error {
 
+	l.lock.Lock()
+	opts := l.opts
+	l.lock.Unlock()
+
 	config := &winio.PipeConfig{
-		InputBufferSize:    l.opts[OptionInputBufferSize].(int32),
-		OutputBufferSize:   l.opts[OptionOutputBufferSize].(int32),
-		SecurityDescriptor: l.opts[OptionSecurityDescriptor].(string),
+		InputBufferSize:    opts[OptionInputBufferSize].(int32),
+		OutputBufferSize:   opts[OptionOutputBufferSize].(int32),
+		SecurityDescriptor: opts[OptionSecurityDescriptor].(string),
 		MessageMode:        false,
 	}
 
@@ -116,7 +123,14 @@ func (l *listener) Accept() (mangos.TranPipe, error) {
 	if err != nil {
 		return nil, err
 	}
-	return transport.NewConnPipeIPC(conn, l.proto, l.opts)
+	l.lock.Lock()
+	opts := l.opts
+	l.lock.Unlock()
+	if err = transport.CheckAccept(conn, opts); err != nil {
+		return nil, err
+	}
+	timeout, _ := opts[mangos.OptionHandshakeTimeout].(time.Duration)
+	return transport.NewConnPipeIPCWithTimeout(conn, l.proto, transport.Accepted(opts), timeout)
 }
 
 // Close implements the PipeListener Close method.
@@ -127,28 +141,125 @@ func (l *listener) Close() error {
 	return nil
 }
 
-// SetOption implements a stub PipeListener SetOption method.
+// SetOption implements a stub PipeListener SetOption method.  The
+// options are replaced rather than modified, so that connections already
+// being accepted keep the values they started with.
 func (l *listener) SetOption(name string, val interface{}) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	opts := make(map[string]interface{}, len(l.opts)+1)
+	for k, v := range l.opts {
+		opts[k] = v
+	}
+	if err := setOption(opts, name, val); err != nil {
+		return err
+	}
+	l.opts = opts
+	return nil
+}
+
+func setOption(opts map[string]interface{}, name string, val interface{}) error {
 	switch name {
 	case OptionInputBufferSize:
 		fallthrough
 	case OptionOutputBufferSize:
 		if v, ok := val.(int32); ok {
-			l.opts[name] = v
+			opts[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
 
 	case OptionSecurityDescriptor:
 		if v, ok := val.(string); ok {
-			l.opts[name] = v
+			opts[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
 
 	case mangos.OptionMaxRecvSize:
 		if v, ok := val.(int); ok {
-			l.opts[name] = v
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionHandshakeHook:
+		switch v := val.(type) {
+		case mangos.HandshakeHook:
+			opts[name] = v
+			return nil
+		case func(mangos.HandshakeEvent):
+			opts[name] = mangos.HandshakeHook(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionAcceptHook:
+		switch v := val.(type) {
+		case mangos.AcceptHook:
+			opts[name] = v
+			return nil
+		case func(net.Conn) error:
+			opts[name] = mangos.AcceptHook(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionAuthenticator:
+		if v, ok := val.(mangos.Authenticator); ok {
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilter:
+		fallthrough
+	case mangos.OptionSendFilter:
+		switch v := val.(type) {
+		case mangos.MessageFilter:
+			opts[name] = v
+			return nil
+		case func(*mangos.Message) error:
+			opts[name] = mangos.MessageFilter(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilterClose:
+		if v, ok := val.(bool); ok {
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvAllocator:
+		if v, ok := val.(mangos.RecvAllocator); ok {
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionLogger:
+		if v, ok := val.(mangos.Logger); ok {
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionHandshakeMetadata:
+		if v, ok := val.(map[string]string); ok {
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionHandshakeTimeout:
+		fallthrough
+	case mangos.OptionWriteTimeout:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionReadBufferSize:
+		fallthrough
+	case mangos.OptionMaxSendSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			opts[name] = v
 			return nil
 		}
 		return mangos.ErrBadValue
@@ -159,6 +270,8 @@ func (l *listener) SetOption(name string, val interface{}) error {
 
 // GetOption implements a stub PipeListener GetOption method.
 func (l *listener) GetOption(name string) (interface{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if v, ok := l.opts[name]; ok {
 		return v, nil
 	}
@@ -0,0 +1,142 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// With keepalives or flow credits, each frame starts with one of these,
+// saying whether it carries a message, or is a ping, pong, or grant of
+// credit (see credit.go).
+const (
+	frameData   = 0
+	framePing   = 1
+	framePong   = 2
+	frameCredit = 3
+)
+
+// errPing and errPong are returned by pingFramer in place of a message,
+// when it reads a ping or pong.  They are never seen outside of conn.
+var (
+	errPing = errors.New("ping received")
+	errPong = errors.New("pong received")
+)
+
+// defaultKeepAliveMissed is the default for OptionKeepAliveMissed.
+const defaultKeepAliveMissed = 3
+
+// pingFramer marks each message with frameData, so that pings, pongs, and
+// grants of credit can be sent between them, and frames the result with
+// another Framer.
+// It is used when both peers agree on it during the handshake.
+type pingFramer struct {
+	inner Framer
+}
+
+func newPingFramer(inner Framer, maxrx int) pingFramer {
+	return pingFramer{inner: withMaxRecvSize(inner, compressedLimit(maxrx))}
+}
+
+// ReadMsg implements the Framer ReadMsg method.
+func (f pingFramer) ReadMsg(r io.Reader) (*Message, error) {
+	m, err := f.inner.ReadMsg(r)
+	if err != nil {
+		var tl *mangos.TooLongError
+		if errors.As(err, &tl) {
+			tl.Size--
+			if tl.Limit > 0 {
+				tl.Limit--
+			}
+		}
+		return nil, err
+	}
+	if len(m.Body) == 0 {
+		m.Free()
+		return nil, mangos.ErrGarbled
+	}
+	switch m.Body[0] {
+	case frameData:
+		m.Body = m.Body[1:]
+		return m, nil
+	case framePing:
+		err = errPing
+	case framePong:
+		err = errPong
+	case frameCredit:
+		if len(m.Body) != 5 {
+			err = mangos.ErrGarbled
+			break
+		}
+		err = creditGrant(binary.BigEndian.Uint32(m.Body[1:]))
+	default:
+		err = mangos.ErrGarbled
+	}
+	m.Free()
+	return nil, err
+}
+
+// WriteMsg implements the Framer WriteMsg method.
+func (f pingFramer) WriteMsg(w io.Writer, m *Message) error {
+	hdr := make([]byte, 0, 1+len(m.Header))
+	hdr = append(append(hdr, frameData), m.Header...)
+	return f.inner.WriteMsg(w, withHeader(m, hdr))
+}
+
+// writeControl writes a ping or pong.
+func (f pingFramer) writeControl(w io.Writer, typ byte) error {
+	return f.inner.WriteMsg(w, &Message{Body: []byte{typ}})
+}
+
+// keepAlive pings the peer every interval, closing the pipe with
+// ErrKeepAliveTimeout once too many pings in a row have gone without
+// anything being heard from the peer.  It also answers the peer's pings.
+func (p *conn) keepAlive(interval time.Duration, missed int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		typ := byte(framePong)
+		select {
+		case <-p.kaStop:
+			return
+		case <-p.kaPong:
+		case <-t.C:
+			// While paused, nothing is read, so nothing is heard.
+			if atomic.LoadInt32(&p.kaPaused) == 0 &&
+				atomic.AddInt32(&p.kaMissed, 1) > int32(missed) {
+				p.abort(mangos.ErrKeepAliveTimeout)
+				return
+			}
+			typ = framePing
+		}
+		p.wlock.Lock()
+		p.armWrite()
+		err := p.kaFramer.writeControl(p.wr, typ)
+		if err == nil {
+			err = p.flushBatch()
+		}
+		p.wlock.Unlock()
+		if err != nil {
+			p.abort(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+
+	"nanomsg.org/go/mangos/v2"
+)
+
+// metadataVersion is the SP wire version at which both peers send a
+// block of metadata immediately after the connHeader.  The block is a
+// 32-bit length, followed by that many bytes of entries.  Each entry is
+// a key and a value, each preceded by its 32-bit length.  All values are
+// big-endian.  Peers that negotiate version 0 send no block.
+const metadataVersion = 1
+
+// metadataVersions are the SP wire versions spoken by a pipe that has
+// OptionHandshakeMetadata set.
+var metadataVersions = []byte{0, metadataVersion}
+
+// encodeMetadata returns the metadata block for md, including the
+// length prefix.
+func encodeMetadata(md map[string]string) []byte {
+	sz := 4
+	for k, v := range md {
+		sz += 8 + len(k) + len(v)
+	}
+	b := make([]byte, 4, sz)
+	binary.BigEndian.PutUint32(b, uint32(sz-4))
+	for k, v := range md {
+		b = appendString(b, k)
+		b = appendString(b, v)
+	}
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(s)))
+	return append(append(b, l[:]...), s...)
+}
+
+// decodeMetadata parses the entries of a metadata block, without its
+// length prefix.  Later entries replace earlier ones with the same key.
+func decodeMetadata(b []byte) (map[string]string, error) {
+	md := make(map[string]string)
+	for len(b) > 0 {
+		k, rest, ok := cutString(b)
+		if !ok {
+			return nil, mangos.ErrBadHeader
+		}
+		v, rest, ok := cutString(rest)
+		if !ok {
+			return nil, mangos.ErrBadHeader
+		}
+		md[k] = v
+		b = rest
+	}
+	return md, nil
+}
+
+func cutString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	l := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) < uint64(l) {
+		return "", nil, false
+	}
+	return string(b[:l]), b[l:], true
+}
+
+// exchangeMetadata sends our metadata to the peer, and receives the
+// peer's.  Our block is written while the peer's is read, so that large
+// blocks cannot leave both sides stuck writing.  The peer's block is
+// limited by our receive limit.
+func (p *conn) exchangeMetadata() error {
+	md, _ := p.options[mangos.OptionHandshakeMetadata].(map[string]string)
+	out := encodeMetadata(md)
+	wq := make(chan error, 1)
+	go func() {
+		_, err := p.c.Write(out)
+		wq <- err
+	}()
+
+	var b [4]byte
+	if _, err := io.ReadFull(p.c, b[:]); err != nil {
+		return handshakeError(err)
+	}
+	sz := binary.BigEndian.Uint32(b[:])
+	if p.maxrx > 0 && uint64(sz) > uint64(p.maxrx) {
+		return p.tooLong(uint64(sz))
+	}
+	in := make([]byte, sz)
+	if _, err := io.ReadFull(p.c, in); err != nil {
+		return handshakeError(err)
+	}
+	if err := <-wq; err != nil {
+		return err
+	}
+	peer, err := decodeMetadata(in)
+	if err != nil {
+		return err
+	}
+	p.peerMD = peer
+	return nil
+}
+
+// PeerMetadata returns the metadata that the peer sent during the
+// handshake, using OptionHandshakeMetadata.  If the metadata was not
+// exchanged, because either side did not set the option, nil is
+// returned.
+func (p *conn) PeerMetadata() map[string]string {
+	if p.peerMD == nil {
+		return nil
+	}
+	md := make(map[string]string, len(p.peerMD))
+	for k, v := range p.peerMD {
+		md[k] = v
+	}
+	return md
+}
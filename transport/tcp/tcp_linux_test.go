@@ -0,0 +1,252 @@
+// +build linux
+
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
+)
+
+func sockOpt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var v int
+	var serr error
+	rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if serr != nil {
+		t.Fatalf("Getsockopt failed: %v", serr)
+	}
+	return v
+}
+
+func TestTCPConfigApplied(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	o := newOptions()
+	o.set(mangos.OptionNoDelay, false)
+	o.set(mangos.OptionKeepAliveTime, 42*time.Second)
+	if err = o.configTCP(c); err != nil {
+		t.Fatalf("configTCP failed: %v", err)
+	}
+	if v := sockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Errorf("TCP_NODELAY not cleared")
+	}
+	if v := sockOpt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Errorf("SO_KEEPALIVE not set")
+	}
+	if v := sockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 42 {
+		t.Errorf("Keepalive idle time wrong: %d", v)
+	}
+
+	o = newOptions()
+	o.set(mangos.OptionKeepAlive, false)
+	if err = o.configTCP(c); err != nil {
+		t.Fatalf("configTCP failed: %v", err)
+	}
+	if v := sockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+		t.Errorf("TCP_NODELAY not set by default")
+	}
+	if v := sockOpt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 0 {
+		t.Errorf("SO_KEEPALIVE not cleared")
+	}
+}
+
+func TestTCPPipeConn(t *testing.T) {
+	srv, _ := rep.NewSocket()
+	defer srv.Close()
+	cli, _ := req.NewSocket()
+	defer cli.Close()
+
+	pipeq := make(chan mangos.Pipe, 1)
+	cli.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			pipeq <- p
+		}
+	})
+	if err := srv.Listen("tcp://127.0.0.1:3340"); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := cli.Dial("tcp://127.0.0.1:3340"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	p := <-pipeq
+
+	tc, ok := p.Conn().(*net.TCPConn)
+	if !ok {
+		t.Fatalf("Not a TCP connection: %T", p.Conn())
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var serr error
+	rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x10)
+	})
+	if serr != nil {
+		t.Fatalf("Setsockopt failed: %v", serr)
+	}
+	if v := sockOpt(t, tc, syscall.IPPROTO_IP, syscall.IP_TOS); v != 0x10 {
+		t.Errorf("IP_TOS not set: %x", v)
+	}
+
+	// The pipe still works after tuning.
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := srv.Recv(); err != nil || string(b) != "ping" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+
+	p.Close()
+	if c := p.Conn(); c != nil {
+		t.Errorf("Conn available after close")
+	}
+}
+
+func TestTCPReusePort(t *testing.T) {
+	addr := "tcp://127.0.0.1:0"
+	for i := 0; i < 2; i++ {
+		l, err := tran.NewListener(addr, sockRep)
+		if err != nil {
+			t.Fatalf("NewListener failed: %v", err)
+		}
+		defer l.Close()
+		if err = l.SetOption(mangos.OptionReusePort, true); err != nil {
+			t.Fatalf("SetOption failed: %v", err)
+		}
+		if err = l.Listen(); err != nil {
+			t.Fatalf("Listen %d failed: %v", i, err)
+		}
+		addr = l.Address()
+	}
+}
+
+func TestTCPLocalAddress(t *testing.T) {
+	srv, _ := rep.NewSocket()
+	defer srv.Close()
+	cli, _ := req.NewSocket()
+	defer cli.Close()
+
+	pipeq := make(chan mangos.Pipe, 1)
+	cli.SetPipeEventHook(func(ev mangos.PipeEvent, p mangos.Pipe) {
+		if ev == mangos.PipeEventAttached {
+			pipeq <- p
+		}
+	})
+	if err := srv.Listen("tcp://127.0.0.1:3341"); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// All of 127/8 is loopback on Linux, so this is usable, but not
+	// what would be chosen otherwise.
+	if err := cli.DialOptions("tcp://127.0.0.1:3341", map[string]interface{}{
+		mangos.OptionLocalAddress: "127.0.0.2",
+	}); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	p := <-pipeq
+	v, err := p.GetOption(mangos.OptionLocalAddr)
+	if err != nil {
+		t.Fatalf("GetOption failed: %v", err)
+	}
+	if a, ok := v.(*net.TCPAddr); !ok || !a.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("Wrong local address %v", v)
+	}
+	if err = cli.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if b, err := srv.Recv(); err != nil || string(b) != "ping" {
+		t.Fatalf("Recv failed: %v %q", err, b)
+	}
+
+	// An address that is not ours cannot be used.  (This one is
+	// reserved for documentation.)
+	d, err := tran.NewDialer("tcp://127.0.0.1:3341", sockReq)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	if err = d.SetOption(mangos.OptionLocalAddress, 1234); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = d.SetOption(mangos.OptionLocalAddress, &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if _, err = d.Dial(); err == nil {
+		t.Errorf("Dial from a foreign address succeeded")
+	}
+}
+
+func TestTCPOptionTOS(t *testing.T) {
+	d, err := tran.NewDialer("tcp://127.0.0.1:19", sockReq)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	for _, v := range []interface{}{-1, 256, "EF"} {
+		if err = d.SetOption(mangos.OptionTOS, v); err != mangos.ErrBadValue {
+			t.Errorf("Expected ErrBadValue for %v, got %v", v, err)
+		}
+	}
+
+	o := newOptions()
+	if err = o.set(mangos.OptionTOS, 46<<2); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	for _, test := range []struct {
+		addr       string
+		level, opt int
+	}{
+		{"127.0.0.1", syscall.IPPROTO_IP, syscall.IP_TOS},
+		{"::1", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS},
+	} {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(test.addr)})
+		if err != nil {
+			t.Logf("No loopback for %s: %v", test.addr, err)
+			continue
+		}
+		defer l.Close()
+		c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer c.Close()
+		if err = o.configTCP(c); err != nil {
+			t.Fatalf("configTCP failed for %s: %v", test.addr, err)
+		}
+		if v := sockOpt(t, c, test.level, test.opt); v != 46<<2 {
+			t.Errorf("TOS not set for %s: %x", test.addr, v)
+		}
+	}
+}
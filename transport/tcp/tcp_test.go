@@ -16,12 +16,18 @@ package tcp
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/protocol/rep"
 	"nanomsg.org/go/mangos/v2/protocol/req"
+	"nanomsg.org/go/mangos/v2/transport"
 )
 
 var tran = Transport
@@ -112,6 +118,107 @@ func TestTCPAnonymousPort(t *testing.T) {
 		server.LocalProtocol(), server.RemoteProtocol())
 }
 
+// ipv6Loopback returns a free port on the IPv6 loopback address, and
+// the name of the loopback interface, skipping the test if there is no
+// IPv6.
+func ipv6Loopback(t *testing.T) (int, string) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Cannot list interfaces: %v", err)
+	}
+	for _, i := range ifs {
+		if i.Flags&net.FlagLoopback != 0 {
+			return port, i.Name
+		}
+	}
+	t.Skipf("No loopback interface")
+	return 0, ""
+}
+
+func testTCPIPv6(t *testing.T, laddr, daddr string) {
+	l, err := tran.NewListener(laddr, sockRep)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	ch := make(chan mangos.TranPipe, 1)
+	go func() {
+		d, err := tran.NewDialer(daddr, sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			ch <- nil
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+		}
+		ch <- client
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	client := <-ch
+	if client == nil {
+		t.FailNow()
+	}
+	defer client.Close()
+
+	if err = client.Send(mangos.NewMessage(0)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err = server.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	v, _ := server.GetOption(mangos.OptionRemoteAddr)
+	if ip := v.(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Errorf("Peer address is %v", ip)
+	}
+}
+
+func TestTCPIPv6(t *testing.T) {
+	port, _ := ipv6Loopback(t)
+	addr := fmt.Sprintf("tcp://[::1]:%d", port)
+	testTCPIPv6(t, addr, addr)
+}
+
+func TestTCPIPv6Zone(t *testing.T) {
+	port, lo := ipv6Loopback(t)
+	// Both the URL escaped form of the zone, and the plain one work.
+	laddr := fmt.Sprintf("tcp://[::1%%25%s]:%d", lo, port)
+	daddr := fmt.Sprintf("tcp://[::1%%%s]:%d", lo, port)
+	testTCPIPv6(t, laddr, daddr)
+}
+
+func TestTCPZoneAddress(t *testing.T) {
+	d, err := tran.NewDialer("tcp://[fe80::1%25eth0]:4444", sockReq)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	if a := d.(*dialer).addr; a != "[fe80::1%eth0]:4444" {
+		t.Errorf("Zone not preserved: %s", a)
+	}
+	a, err := transport.ResolveTCPAddr("[fe80::1%25eth0]:4444")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if a.Zone != "eth0" || a.Port != 4444 {
+		t.Errorf("Wrong address: %v", a)
+	}
+}
+
 func TestTCPDuplicateListen(t *testing.T) {
 	addr := "tcp://127.0.0.1:3333"
 	var err error
@@ -139,6 +246,204 @@ func TestTCPDuplicateListen(t *testing.T) {
 	t.Logf("Got expected error: %v", err)
 }
 
+// TestTCPReuseAddr closes a listener while its connection is in
+// TIME_WAIT, and then immediately binds the same port again.
+func TestTCPReuseAddr(t *testing.T) {
+	listen := func(addr string) mangos.TranListener {
+		l, err := tran.NewListener(addr, sockRep)
+		if err != nil {
+			t.Fatalf("NewListener failed: %v", err)
+		}
+		if err = l.SetOption(mangos.OptionReuseAddr, true); err != nil {
+			t.Fatalf("SetOption failed: %v", err)
+		}
+		if err = l.Listen(); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		return l
+	}
+
+	l := listen("tcp://127.0.0.1:0")
+	addr := l.Address()
+
+	ch := make(chan mangos.TranPipe)
+	go func() {
+		d, err := tran.NewDialer(addr, sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			ch <- nil
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+		}
+		ch <- client
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	client := <-ch
+	if client == nil {
+		t.FailNow()
+	}
+
+	// Closing the server side first leaves its end in TIME_WAIT.
+	server.Close()
+	client.Close()
+	l.Close()
+
+	l = listen(addr)
+	l.Close()
+}
+
+func TestTCPAcceptHook(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	var seen []net.Addr
+	var handshakes int
+	// Only the first peer is blocked.
+	accept := func(c net.Conn) error {
+		seen = append(seen, c.RemoteAddr())
+		if len(seen) == 1 {
+			return errBlocked
+		}
+		return nil
+	}
+	hs := func(mangos.HandshakeEvent) { handshakes++ }
+
+	l, err := tran.NewListener("tcp://127.0.0.1:0", sockRep)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	if err = l.SetOption(mangos.OptionAcceptHook, accept); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.SetOption(mangos.OptionHandshakeHook, hs); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr, _ := transport.StripScheme(tran, l.Address())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if _, err = l.Accept(); err != errBlocked {
+		t.Fatalf("Expected blocked, got %v", err)
+	}
+	if len(seen) != 1 || seen[0].String() != c.LocalAddr().String() {
+		t.Errorf("Hook saw %v, expected %v", seen, c.LocalAddr())
+	}
+	// The connection is closed, without the SP header being sent.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF, got %d bytes, %v", n, err)
+	}
+	if handshakes != 0 {
+		t.Errorf("Handshake attempted for blocked peer")
+	}
+
+	// Other peers are still accepted.
+	ch := make(chan mangos.TranPipe, 1)
+	go func() {
+		d, err := tran.NewDialer(l.Address(), sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			ch <- nil
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+		}
+		ch <- client
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	if client := <-ch; client != nil {
+		client.Close()
+	}
+	if handshakes != 2 {
+		t.Errorf("Expected one handshake, got %d events", handshakes)
+	}
+}
+
+func TestTCPHandshakeTimeout(t *testing.T) {
+	l, err := tran.NewListener("tcp://127.0.0.1:0", sockRep)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	if err = l.SetOption(mangos.OptionHandshakeTimeout, -time.Second); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = l.SetOption(mangos.OptionHandshakeTimeout, 100*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr, _ := transport.StripScheme(tran, l.Address())
+
+	// A peer that never sends its header is dropped.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = l.Accept(); err != mangos.ErrHandshakeTimeout {
+		t.Fatalf("Expected ErrHandshakeTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Timeout took too long: %v", d)
+	}
+
+	// A well behaved peer is not limited once the handshake is done.
+	ch := make(chan mangos.TranPipe, 1)
+	go func() {
+		d, err := tran.NewDialer(l.Address(), sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			ch <- nil
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+		}
+		ch <- client
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	client := <-ch
+	if client == nil {
+		return
+	}
+	defer client.Close()
+	time.Sleep(200 * time.Millisecond)
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, "late"...)
+	if err = client.Send(m); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if m, err = server.Recv(); err != nil || string(m.Body) != "late" {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	m.Free()
+}
+
 func TestTCPConnRefused(t *testing.T) {
 	addr := "tcp://127.0.0.1:19" // Port 19 is chargen, rarely in use
 	var err error
@@ -292,7 +597,8 @@ func TestTCPOptions(t *testing.T) {
 	t.Logf("Options are %v", interface{}(d).(*dialer).opts)
 
 	// Valid Boolean Options
-	for _, n := range []string{mangos.OptionNoDelay, mangos.OptionKeepAlive} {
+	for _, n := range []string{mangos.OptionNoDelay, mangos.OptionKeepAlive,
+		mangos.OptionReuseAddr, mangos.OptionReusePort} {
 		t.Logf("Checking option %s", n)
 
 		if err := d.SetOption(n, true); err != nil {
@@ -337,3 +643,209 @@ func TestTCPOptions(t *testing.T) {
 		return
 	}
 }
+
+func TestTCPMaxRecvSize(t *testing.T) {
+	addr := "tcp://127.0.0.1:3333"
+	l, err := tran.NewListener(addr, sockRep)
+	if err != nil {
+		t.Errorf("NewListener failed: %v", err)
+		return
+	}
+	defer l.Close()
+	if err = l.SetOption(mangos.OptionMaxRecvSize, 100); err != nil {
+		t.Errorf("Failed setting max recv size: %v", err)
+		return
+	}
+	if err = l.Listen(); err != nil {
+		t.Errorf("Listen failed: %v", err)
+		return
+	}
+
+	go func() {
+		d, err := tran.NewDialer(addr, sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+			return
+		}
+		defer client.Close()
+
+		for _, sz := range []int{100, 200} {
+			msg := mangos.NewMessage(sz)
+			msg.Body = append(msg.Body, make([]byte, sz)...)
+			if err = client.Send(msg); err != nil {
+				t.Errorf("Client send error: %v", err)
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Errorf("Accept failed: %v", err)
+		return
+	}
+	defer server.Close()
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Errorf("Server receive error: %v", err)
+		return
+	}
+	if len(msg.Body) != 100 {
+		t.Errorf("Wrong message size: %d", len(msg.Body))
+	}
+	if _, err = server.Recv(); !errors.Is(err, mangos.ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
+
+// stubDialer records the dial request, and hands back one end of an
+// in-memory pipe, with a fake REP peer on the other end.
+type stubDialer struct {
+	network string
+	addr    string
+	peer    chan net.Conn
+}
+
+func (d *stubDialer) DialContext(_ context.Context, network, addr string) (net.Conn, error) {
+	d.network = network
+	d.addr = addr
+	c1, c2 := net.Pipe()
+	d.peer <- c2
+	return c1, nil
+}
+
+func TestTCPOptionDialer(t *testing.T) {
+	stub := &stubDialer{peer: make(chan net.Conn, 1)}
+
+	d, err := tran.NewDialer("tcp://127.0.0.1:3339", sockReq)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	if err = d.SetOption(mangos.OptionDialer, "garbage"); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = d.SetOption(mangos.OptionDialer, stub); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+
+	go func() {
+		c := <-stub.peer
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		c.Write([]byte{0, 'S', 'P', 0, 0, mangos.ProtoRep, 0, 0})
+		stub.peer <- c
+	}()
+
+	client, err := d.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	if stub.network != "tcp" || stub.addr != "127.0.0.1:3339" {
+		t.Errorf("Wrong dial: %s %s", stub.network, stub.addr)
+	}
+
+	msg := mangos.NewMessage(0)
+	msg.Body = append(msg.Body, []byte("hello")...)
+	peer := <-stub.peer
+	go client.Send(msg)
+	buf := make([]byte, 13)
+	if _, err = io.ReadFull(peer, buf); err != nil {
+		t.Fatalf("Peer read failed: %v", err)
+	}
+	if !bytes.Equal(buf, []byte{0, 0, 0, 0, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Errorf("Wrong frame: %v", buf)
+	}
+}
+
+func TestTCPOptionListener(t *testing.T) {
+	// A listener on a descriptor of its own, as one inherited from
+	// systemd would be.
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	f, err := nl.(*net.TCPListener).File()
+	nl.Close()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	inherited, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("FileListener failed: %v", err)
+	}
+
+	l, err := tran.NewListener("tcp://127.0.0.1:0", sockRep)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	if err = l.SetOption(mangos.OptionListener, "garbage"); err != mangos.ErrBadValue {
+		t.Errorf("Expected ErrBadValue, got %v", err)
+	}
+	if err = l.SetOption(mangos.OptionListener, inherited); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	addr := "tcp://" + inherited.Addr().String()
+	if l.Address() != addr {
+		t.Errorf("Address is %s, expected %s", l.Address(), addr)
+	}
+
+	d, err := tran.NewDialer(addr, sockReq)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	type result struct {
+		p   transport.Pipe
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		p, err := d.Dial()
+		ch <- result{p, err}
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("Dial failed: %v", r.err)
+	}
+	client := r.p
+	defer client.Close()
+
+	msg := mangos.NewMessage(0)
+	msg.Body = append(msg.Body, []byte("hello")...)
+	if err = client.Send(msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "hello" {
+		t.Errorf("Got %q", m.Body)
+	}
+	m.Free()
+
+	// Closing the Listener closes the socket.
+	l.Close()
+	if _, err = inherited.Accept(); err == nil {
+		t.Errorf("Inherited listener still open")
+	}
+}
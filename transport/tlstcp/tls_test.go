@@ -15,8 +15,16 @@
 package tlstcp
 
 import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"nanomsg.org/go/mangos/v2"
+	"nanomsg.org/go/mangos/v2/protocol/rep"
+	"nanomsg.org/go/mangos/v2/protocol/req"
 	"nanomsg.org/go/mangos/v2/test"
 )
 
@@ -41,3 +49,140 @@ func TestTLSSendRecv(t *testing.T) {
 func TestTLSAll(t *testing.T) {
 	tt.TestAll(t)
 }
+
+// TestTLSNoPlaintext runs the traffic through a snooping proxy, and
+// verifies that the SP header is never visible on the wire.
+func TestTLSHandshakeTimeout(t *testing.T) {
+	srvCfg, _ := test.GetTLSConfig(true)
+	sockRep, _ := rep.NewSocket()
+
+	l, err := Transport.NewListener("tls+tcp://127.0.0.1:0", sockRep)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	if err = l.SetOption(mangos.OptionTLSConfig, srvCfg); err != nil {
+		t.Fatalf("Failed setting TLS config: %v", err)
+	}
+	if err = l.SetOption(mangos.OptionHandshakeTimeout, 100*time.Millisecond); err != nil {
+		t.Fatalf("SetOption failed: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// The peer never starts the TLS handshake.
+	c, err := net.Dial("tcp", strings.TrimPrefix(l.Address(), "tls+tcp://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = l.Accept(); err != mangos.ErrHandshakeTimeout {
+		t.Fatalf("Expected ErrHandshakeTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Timeout took too long: %v", d)
+	}
+}
+
+func TestTLSNoPlaintext(t *testing.T) {
+	srvCfg, _ := test.GetTLSConfig(true)
+	cliCfg, _ := test.GetTLSConfig(false)
+	sockRep, _ := rep.NewSocket()
+	sockReq, _ := req.NewSocket()
+
+	l, err := Transport.NewListener("tls+tcp://127.0.0.1:0", sockRep)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	if err = l.SetOption(mangos.OptionTLSConfig, srvCfg); err != nil {
+		t.Fatalf("Failed setting TLS config: %v", err)
+	}
+	if err = l.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Proxy listen failed: %v", err)
+	}
+	defer proxy.Close()
+
+	var wire bytes.Buffer
+	var lock sync.Mutex
+	snoop := func(dst, src net.Conn) {
+		buf := make([]byte, 1024)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				dst.Close()
+				return
+			}
+			lock.Lock()
+			wire.Write(buf[:n])
+			lock.Unlock()
+			dst.Write(buf[:n])
+		}
+	}
+	go func() {
+		c, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		s, err := net.Dial("tcp", strings.TrimPrefix(l.Address(), "tls+tcp://"))
+		if err != nil {
+			c.Close()
+			return
+		}
+		go snoop(c, s)
+		go snoop(s, c)
+	}()
+
+	go func() {
+		d, err := Transport.NewDialer("tls+tcp://"+proxy.Addr().String(), sockReq)
+		if err != nil {
+			t.Errorf("NewDialer failed: %v", err)
+			return
+		}
+		if err = d.SetOption(mangos.OptionTLSConfig, cliCfg); err != nil {
+			t.Errorf("Failed setting TLS config: %v", err)
+			return
+		}
+		client, err := d.Dial()
+		if err != nil {
+			t.Errorf("Dial failed: %v", err)
+			return
+		}
+		defer client.Close()
+		m := mangos.NewMessage(0)
+		m.Body = append(m.Body, []byte("SECRET")...)
+		client.Send(m)
+	}()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	m, err := server.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(m.Body) != "SECRET" {
+		t.Errorf("Wrong message received: %v", m.Body)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if wire.Len() == 0 {
+		t.Fatalf("Nothing snooped")
+	}
+	if bytes.Contains(wire.Bytes(), []byte{0, 'S', 'P', 0}) {
+		t.Errorf("SP header visible in plaintext")
+	}
+	if bytes.Contains(wire.Bytes(), []byte("SECRET")) {
+		t.Errorf("Message visible in plaintext")
+	}
+}
@@ -17,8 +17,10 @@
 package tlstcp
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"sync"
 	"time"
 
 	"nanomsg.org/go/mangos/v2"
@@ -41,6 +43,20 @@ func (o options) get(name string) (interface{}, error) {
 	return nil, mangos.ErrBadOption
 }
 
+// with returns a copy of the options, with the named option set.  The
+// options held by dialers and listeners are replaced rather than
+// modified, so that each connection gets a consistent snapshot of them.
+func (o options) with(name string, val interface{}) (options, error) {
+	n := make(options, len(o)+1)
+	for k, v := range o {
+		n[k] = v
+	}
+	if err := n.set(name, val); err != nil {
+		return o, err
+	}
+	return n, nil
+}
+
 func (o options) set(name string, val interface{}) error {
 	switch name {
 	case mangos.OptionTLSConfig:
@@ -55,8 +71,128 @@ func (o options) set(name string, val interface{}) error {
 			return nil
 		}
 		return mangos.ErrBadValue
+	case mangos.OptionTOS:
+		if v, ok := val.(int); ok && v >= 0 && v <= 255 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionKeepAliveMissed:
+		if v, ok := val.(int); ok && v > 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionFlowCredits:
+		fallthrough
+	case mangos.OptionMaxFrameSize:
+		fallthrough
+	case mangos.OptionAsyncRecv:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionMaxSendSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionHandshakeHook:
+		switch v := val.(type) {
+		case mangos.HandshakeHook:
+			o[name] = v
+			return nil
+		case func(mangos.HandshakeEvent):
+			o[name] = mangos.HandshakeHook(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionAcceptHook:
+		switch v := val.(type) {
+		case mangos.AcceptHook:
+			o[name] = v
+			return nil
+		case func(net.Conn) error:
+			o[name] = mangos.AcceptHook(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionAuthenticator:
+		if v, ok := val.(mangos.Authenticator); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilter:
+		fallthrough
+	case mangos.OptionSendFilter:
+		switch v := val.(type) {
+		case mangos.MessageFilter:
+			o[name] = v
+			return nil
+		case func(*mangos.Message) error:
+			o[name] = mangos.MessageFilter(v)
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvFilterClose:
+		if v, ok := val.(bool); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionRecvAllocator:
+		if v, ok := val.(mangos.RecvAllocator); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionLogger:
+		if v, ok := val.(mangos.Logger); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionHandshakeMetadata:
+		if v, ok := val.(map[string]string); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionSendBatch:
+		fallthrough
+	case mangos.OptionKeepAliveInterval:
+		fallthrough
+	case mangos.OptionHandshakeTimeout:
+		fallthrough
+	case mangos.OptionWriteTimeout:
+		if v, ok := val.(time.Duration); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+	case mangos.OptionReadBufferSize:
+		if v, ok := val.(int); ok && v >= 0 {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
 	case mangos.OptionNoDelay:
 		fallthrough
+	case mangos.OptionChecksum:
+		fallthrough
+	case mangos.OptionTraceHeader:
+		fallthrough
+	case mangos.OptionTypeHeader:
+		fallthrough
+	case mangos.OptionSeqHeader:
+		fallthrough
+	case mangos.OptionReuseAddr:
+		fallthrough
+	case mangos.OptionReusePort:
+		fallthrough
 	case mangos.OptionKeepAlive:
 		if v, ok := val.(bool); ok {
 			o[name] = v
@@ -64,6 +200,47 @@ func (o options) set(name string, val interface{}) error {
 		}
 		return mangos.ErrBadValue
 
+	case mangos.OptionCompression:
+		if v, ok := val.(string); ok && transport.ValidCompression(v) {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionDialer:
+		if v, ok := val.(mangos.ContextDialer); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionLocalAddress:
+		switch v := val.(type) {
+		case string:
+			if a, err := transport.ResolveLocalAddr(v); err == nil {
+				o[name] = a
+				return nil
+			}
+		case *net.TCPAddr:
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionListener:
+		if v, ok := val.(net.Listener); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case mangos.OptionResolver:
+		if v, ok := val.(mangos.Resolver); ok {
+			o[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
 	case mangos.OptionKeepAliveTime:
 		if v, ok := val.(time.Duration); ok && v.Nanoseconds() > 0 {
 			o[name] = v
@@ -91,6 +268,11 @@ func (o options) configTCP(conn *net.TCPConn) error {
 			return err
 		}
 	}
+	if v, ok := o[mangos.OptionTOS]; ok {
+		if err := transport.SetTOS(conn, v.(int)); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -104,67 +286,138 @@ func newOptions(t tlsTran) options {
 	return options(o)
 }
 
+// dial connects to addr, using the OptionDialer if one was supplied.
+// TCP settings are only applied if the result is a TCP connection.
+func (o options) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if v, ok := o[mangos.OptionDialer]; ok {
+		conn, err := v.(mangos.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if err = o.configTCP(tc); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+
+	raddr, err := transport.ResolveTCPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	var nd net.Dialer
+	if laddr, ok := o[mangos.OptionLocalAddress].(*net.TCPAddr); ok {
+		nd.LocalAddr = laddr
+	}
+	c, err := nd.DialContext(ctx, "tcp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.TCPConn)
+	if err = o.configTCP(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 type dialer struct {
 	addr  string
 	proto transport.ProtocolInfo
 	opts  options
+	dials int
+	lock  sync.Mutex
 }
 
 func (d *dialer) Dial() (transport.Pipe, error) {
-	var (
-		addr   *net.TCPAddr
-		config *tls.Config
-		err    error
-	)
-
-	if addr, err = transport.ResolveTCPAddr(d.addr); err != nil {
-		return nil, err
-	}
+	return d.DialContext(context.Background())
+}
 
-	tconn, err := net.DialTCP("tcp", nil, addr)
+// DialContext is like Dial, but gives up once ctx is done, whether that
+// is while connecting, or during the TLS or SP handshakes.
+func (d *dialer) DialContext(ctx context.Context) (transport.Pipe, error) {
+	var config *tls.Config
+
+	d.lock.Lock()
+	dopts := d.opts
+	n := d.dials
+	d.dials++
+	d.lock.Unlock()
+	addrs, err := transport.ResolveAddrs(ctx, d.addr, n, dopts)
 	if err != nil {
-		return nil, err
+		return nil, dialErr(ctx, err)
 	}
-	if err = d.opts.configTCP(tconn); err != nil {
-		tconn.Close()
-		return nil, err
+	var tconn net.Conn
+	for _, addr := range addrs {
+		if tconn, err = dopts.dial(ctx, addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, dialErr(ctx, err)
 	}
-	if v, ok := d.opts[mangos.OptionTLSConfig]; ok {
+	if v, ok := dopts[mangos.OptionTLSConfig]; ok {
 		config = v.(*tls.Config)
 	}
 	conn := tls.Client(tconn, config)
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
 	if err = conn.Handshake(); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, dialErr(ctx, err)
 	}
+	conn.SetDeadline(time.Time{})
 	opts := make(map[string]interface{})
-	for n, v := range d.opts {
+	for n, v := range dopts {
 		opts[n] = v
 	}
 	opts[mangos.OptionTLSConnState] = conn.ConnectionState()
-	return transport.NewConnPipe(conn, d.proto, opts)
+	return transport.NewConnPipeContext(ctx, conn, d.proto, opts)
 }
 
-func (d *dialer) SetOption(n string, v interface{}) error {
-	return d.opts.set(n, v)
+// dialErr returns the context's error if it is the reason that dialing
+// failed, rather than the error from the network.
+func dialErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (d *dialer) SetOption(n string, v interface{}) (err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.opts, err = d.opts.with(n, v)
+	return err
 }
 
 func (d *dialer) GetOption(n string) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	return d.opts.get(n)
 }
 
 type listener struct {
 	addr     *net.TCPAddr
 	bound    net.Addr
-	listener *net.TCPListener
+	listener net.Listener
 	proto    transport.ProtocolInfo
 	opts     options
 	config   *tls.Config
+	lock     sync.Mutex
 }
 
 func (l *listener) Listen() error {
 	var err error
+	l.lock.Lock()
 	v, ok := l.opts[mangos.OptionTLSConfig]
+	reuseAddr, _ := l.opts[mangos.OptionReuseAddr].(bool)
+	reusePort, _ := l.opts[mangos.OptionReusePort].(bool)
+	inherited, _ := l.opts[mangos.OptionListener].(net.Listener)
+	l.lock.Unlock()
 	if !ok {
 		return mangos.ErrTLSNoConfig
 	}
@@ -176,7 +429,9 @@ func (l *listener) Listen() error {
 		return mangos.ErrTLSNoCert
 	}
 
-	if l.listener, err = net.ListenTCP("tcp", l.addr); err != nil {
+	if inherited != nil {
+		l.listener = inherited
+	} else if l.listener, err = transport.ListenTCP(l.addr, reuseAddr, reusePort); err != nil {
 		return err
 	}
 
@@ -194,39 +449,76 @@ func (l *listener) Address() string {
 
 func (l *listener) Accept() (transport.Pipe, error) {
 
-	tconn, err := l.listener.AcceptTCP()
+	if l.listener == nil {
+		return nil, mangos.ErrClosed
+	}
+	tconn, err := l.listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	if err = l.opts.configTCP(tconn); err != nil {
-		tconn.Close()
+	l.lock.Lock()
+	lopts := l.opts
+	l.lock.Unlock()
+	if err = transport.CheckAccept(tconn, lopts); err != nil {
 		return nil, err
 	}
+	if tc, ok := tconn.(*net.TCPConn); ok {
+		if err = lopts.configTCP(tc); err != nil {
+			tconn.Close()
+			return nil, err
+		}
+	}
 
+	// The timeout covers both the TLS and SP handshakes.
+	timeout, _ := lopts[mangos.OptionHandshakeTimeout].(time.Duration)
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		if err = tconn.SetDeadline(deadline); err != nil {
+			tconn.Close()
+			return nil, err
+		}
+	}
 	conn := tls.Server(tconn, l.config)
 	if err = conn.Handshake(); err != nil {
 		conn.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, mangos.ErrHandshakeTimeout
+		}
 		return nil, err
 	}
+	if timeout > 0 {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			conn.Close()
+			return nil, mangos.ErrHandshakeTimeout
+		}
+	}
 	opts := make(map[string]interface{})
-	for n, v := range l.opts {
+	for n, v := range lopts {
 		opts[n] = v
 	}
 	opts[mangos.OptionTLSConnState] = conn.ConnectionState()
-	return transport.NewConnPipe(conn, l.proto, opts)
+	return transport.NewConnPipeWithTimeout(conn, l.proto, transport.Accepted(opts), timeout)
 }
 
 func (l *listener) Close() error {
-	l.listener.Close()
+	if l.listener != nil {
+		l.listener.Close()
+	}
 	return nil
 }
 
-func (l *listener) SetOption(n string, v interface{}) error {
-	return l.opts.set(n, v)
+func (l *listener) SetOption(n string, v interface{}) (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.opts, err = l.opts.with(n, v)
+	return err
 }
 
 func (l *listener) GetOption(n string) (interface{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	return l.opts.get(n)
 }
 
@@ -243,10 +535,12 @@ func (t tlsTran) NewDialer(addr string, sock mangos.Socket) (transport.Dialer, e
 		return nil, err
 	}
 
-	// check to ensure the provided addr resolves correctly.
-	if _, err = transport.ResolveTCPAddr(addr); err != nil {
+	// The host is resolved when dialing, as it may be a name known
+	// only to an OptionResolver.
+	if err = transport.CheckTCPAddr(addr); err != nil {
 		return nil, err
 	}
+	addr = transport.UnescapeZone(addr)
 
 	d := &dialer{
 		proto: sock.Info(),
@@ -0,0 +1,53 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetTOS sets the IP type of service (or for IPv6, the traffic class)
+// used for packets sent on c, which carries the DSCP marking.  Nothing
+// is done if c is not a TCP connection, or if the system does not
+// support the setting for this kind of socket.
+func SetTOS(c net.Conn, tos int) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_TOS
+	if a, ok := tc.LocalAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), level, opt, tos)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	switch err {
+	case unix.ENOPROTOOPT, unix.EOPNOTSUPP:
+		return nil
+	}
+	return err
+}
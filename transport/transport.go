@@ -15,6 +15,7 @@
 package transport
 
 import (
+	"context"
 	"net"
 	"strings"
 	"sync"
@@ -56,12 +57,122 @@ func StripScheme(t Transport, addr string) (string, error) {
 
 // ResolveTCPAddr is like net.ResolveTCPAddr, but it handles the
 // wildcard used in nanomsg URLs, replacing it with an empty
-// string to indicate that all local interfaces be used.
+// string to indicate that all local interfaces be used.  IPv6
+// zones may be escaped as in URLs (see UnescapeZone).
 func ResolveTCPAddr(addr string) (*net.TCPAddr, error) {
 	if strings.HasPrefix(addr, "*") {
 		addr = addr[1:]
 	}
-	return net.ResolveTCPAddr("tcp", addr)
+	return net.ResolveTCPAddr("tcp", UnescapeZone(addr))
+}
+
+// ResolveLocalAddr resolves the value of OptionLocalAddress, which is
+// an IP address, with or without a port.  Without one, any port is used.
+func ResolveLocalAddr(addr string) (*net.TCPAddr, error) {
+	if _, _, err := net.SplitHostPort(UnescapeZone(addr)); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "0")
+	}
+	return ResolveTCPAddr(addr)
+}
+
+// CheckTCPAddr checks that the address given to a TCP based Dialer is
+// of the form host:port.  The host is not resolved, as that is done
+// each time the Dialer connects, possibly by an OptionResolver.
+func CheckTCPAddr(addr string) error {
+	_, port, err := net.SplitHostPort(UnescapeZone(addr))
+	if err != nil {
+		return mangos.ErrBadAddr
+	}
+	if _, err = net.LookupPort("tcp", port); err != nil {
+		return mangos.ErrBadAddr
+	}
+	return nil
+}
+
+// ResolveAddrs returns the addresses a Dialer should try, in order, to
+// connect to addr.  If there is an OptionResolver in the options, the
+// addresses are the ones it returns, rotated by n places, so that
+// Dialers passing a count of their attempts go round-robin.  Otherwise
+// addr is the only address.  The context is passed to the Resolver.
+func ResolveAddrs(ctx context.Context, addr string, n int, options map[string]interface{}) ([]string, error) {
+	r, ok := options[mangos.OptionResolver].(mangos.Resolver)
+	if !ok {
+		return []string{addr}, nil
+	}
+	addrs, err := r.Resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, mangos.ErrConnRefused
+	}
+	n %= len(addrs)
+	return append(addrs[n:len(addrs):len(addrs)], addrs[:n]...), nil
+}
+
+// UnescapeZone undoes the URL escaping of the zone in a scoped IPv6
+// address, so that "[fe80::1%25eth0]:4444" becomes "[fe80::1%eth0]:4444",
+// the form understood by the net package.  (RFC 6874 requires the
+// escape in URLs, but many people leave it out.)  Other addresses are
+// returned unchanged.
+func UnescapeZone(addr string) string {
+	end := strings.Index(addr, "]")
+	if !strings.HasPrefix(addr, "[") || end < 0 {
+		return addr
+	}
+	if i := strings.Index(addr[:end], "%25"); i >= 0 {
+		return addr[:i+1] + addr[i+3:]
+	}
+	return addr
+}
+
+// CheckAccept calls the OptionAcceptHook, if any, with a connection that
+// was just accepted.  If the hook rejects the connection, it is closed,
+// and the hook's error is returned.  Transports that accept connections
+// should call this before doing anything else with them.
+func CheckAccept(c net.Conn, options map[string]interface{}) error {
+	if hook, ok := options[mangos.OptionAcceptHook].(mangos.AcceptHook); ok {
+		if err := hook(c); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// optionAccepted marks the options of connections made by a Listener.
+const optionAccepted = "ACCEPTED"
+
+// Accepted returns options, marked to say that the connection they are
+// for was accepted by a Listener, rather than dialed.  Transports pass
+// the result to NewConnPipe and friends for accepted connections, so
+// that the server side of an OptionAuthenticator is used.  The options
+// passed in are not modified.
+func Accepted(options map[string]interface{}) map[string]interface{} {
+	if _, ok := options[mangos.OptionAuthenticator]; !ok {
+		return options
+	}
+	opts := make(map[string]interface{}, len(options)+1)
+	for n, v := range options {
+		opts[n] = v
+	}
+	opts[optionAccepted] = true
+	return opts
+}
+
+// ListenTCP is like net.ListenTCP, but it can also enable SO_REUSEADDR
+// and SO_REUSEPORT on the socket before it is bound.  These are quietly
+// ignored on platforms that lack them.
+func ListenTCP(addr *net.TCPAddr, reuseAddr, reusePort bool) (*net.TCPListener, error) {
+	if !reuseAddr && !reusePort {
+		return net.ListenTCP("tcp", addr)
+	}
+	lc := net.ListenConfig{Control: reuseControl(reuseAddr, reusePort)}
+	l, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
 }
 
 var lock sync.RWMutex
@@ -87,3 +198,43 @@ func GetTransport(scheme string) Transport {
 	}
 	return nil
 }
+
+var peerLock sync.RWMutex
+var validPeers = map[uint16]map[uint16]bool{}
+
+func init() {
+	for _, pair := range [][2]uint16{
+		{mangos.ProtoPair, mangos.ProtoPair},
+		{mangos.ProtoPub, mangos.ProtoSub},
+		{mangos.ProtoReq, mangos.ProtoRep},
+		{mangos.ProtoPush, mangos.ProtoPull},
+		{mangos.ProtoSurveyor, mangos.ProtoRespondent},
+		{mangos.ProtoBus, mangos.ProtoBus},
+		{mangos.ProtoStar, mangos.ProtoStar},
+	} {
+		RegisterPeer(pair[0], pair[1])
+		RegisterPeer(pair[1], pair[0])
+	}
+}
+
+// RegisterPeer records that a socket using protocol self may be connected
+// to a peer using protocol peer.  The standard SP protocols are registered
+// already, so this is only needed for new protocols.  Note that the
+// relationship is not automatically symmetric.
+func RegisterPeer(self, peer uint16) {
+	peerLock.Lock()
+	if validPeers[self] == nil {
+		validPeers[self] = map[uint16]bool{}
+	}
+	validPeers[self][peer] = true
+	peerLock.Unlock()
+}
+
+// ValidPeer returns true if a socket using protocol self may be connected
+// to one using protocol peer.  Transports use this to reject incompatible
+// peers (such as PUB and PULL) during connection establishment.
+func ValidPeer(self, peer uint16) bool {
+	peerLock.RLock()
+	defer peerLock.RUnlock()
+	return validPeers[self][peer]
+}
@@ -14,10 +14,19 @@
 
 // Package ws implements a simple WebSocket transport for mangos.
 // To enable it simply import it.
+//
+// Each SP message is carried in a single binary WebSocket frame.  Rather
+// than exchanging the SP header, peers negotiate the protocol using the
+// Sec-WebSocket-Protocol header.  The sub-protocol name is the name of
+// the protocol the server side is using, followed by ".sp.nanomsg.org".
+// For example, a SUB client connecting to a PUB server requests the
+// "pub.sp.nanomsg.org" sub-protocol.  Non-Go clients (such as browsers)
+// can interoperate by requesting the same sub-protocol.
 package ws
 
 import (
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -133,6 +142,7 @@ type wsPipe struct {
 	options map[string]interface{}
 	iswss   bool
 	dtype   int
+	err     error
 	sync.Mutex
 }
 
@@ -143,7 +153,7 @@ func (w *wsPipe) Recv() (*mangos.Message, error) {
 	// We ignore the message type for receive.
 	_, body, err := w.ws.ReadMessage()
 	if err != nil {
-		return nil, err
+		return nil, w.fail(err)
 	}
 	msg := mangos.NewMessage(0)
 	msg.Body = body
@@ -162,7 +172,7 @@ func (w *wsPipe) Send(m *mangos.Message) error {
 		buf = m.Body
 	}
 	if err := w.ws.WriteMessage(w.dtype, buf); err != nil {
-		return err
+		return w.fail(err)
 	}
 	m.Free()
 	return nil
@@ -176,9 +186,49 @@ func (w *wsPipe) RemoteProtocol() uint16 {
 	return w.proto.Peer
 }
 
+func (w *wsPipe) LocalProtocolName() string {
+	return mangos.ProtocolName(w.proto.Self)
+}
+
+func (w *wsPipe) RemoteProtocolName() string {
+	return mangos.ProtocolName(w.proto.Peer)
+}
+
+func (w *wsPipe) LocalAddr() net.Addr {
+	return w.ws.LocalAddr()
+}
+
+func (w *wsPipe) RemoteAddr() net.Addr {
+	return w.ws.RemoteAddr()
+}
+
+// fail records the reason for failure, if not already recorded.  A
+// normal websocket close from the peer is recorded as io.EOF.
+func (w *wsPipe) fail(err error) error {
+	w.Lock()
+	if w.err == nil {
+		w.err = err
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure,
+			websocket.CloseGoingAway) {
+			w.err = io.EOF
+		}
+	}
+	w.Unlock()
+	return err
+}
+
+func (w *wsPipe) CloseErr() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.err
+}
+
 func (w *wsPipe) Close() error {
 	w.Lock()
 	defer w.Unlock()
+	if w.err == nil {
+		w.err = mangos.ErrClosed
+	}
 	if w.open {
 		w.open = false
 		w.ws.Close()
@@ -21,6 +21,7 @@ import (
 	"testing"
 	"time"
 
+	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/protocol/rep"
 	"nanomsg.org/go/mangos/v2/protocol/req"
 	//"nanomsg.org/go-mangos/test"
@@ -61,7 +62,7 @@ func TestWebsockPath(t *testing.T) {
 var bogusstr = "THIS IS BOGUS"
 
 func bogusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, bogusstr)
+	fmt.Fprint(w, bogusstr)
 }
 
 func TestWebsockMux(t *testing.T) {
@@ -195,3 +196,60 @@ func TestWebsockHandler(t *testing.T) {
 	}
 	t.Logf("Got body: %s", string(body))
 }
+
+// This test verifies that messages flow between a dialer and the
+// handler mounted on an application supplied mux.
+func TestWebsockHandlerSendRecv(t *testing.T) {
+	sockReq, _ := req.NewSocket()
+	sockRep, _ := rep.NewSocket()
+	tran := Transport
+	l, e := tran.NewListener("ws://127.0.0.1:3338/mysock", sockRep)
+	if e != nil {
+		t.Errorf("Failed new Listener: %v", e)
+		return
+	}
+	defer l.Close()
+	hi, e := l.GetOption(OptionWebSocketHandler)
+	if e != nil {
+		t.Errorf("Failed get WebSocketHandler: %v", e)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/mysock", hi.(http.Handler))
+	go http.ListenAndServe("127.0.0.1:3338", mux)
+	time.Sleep(time.Second / 10)
+
+	d, e := tran.NewDialer("ws://127.0.0.1:3338/mysock", sockReq)
+	if e != nil {
+		t.Errorf("Failed new Dialer: %v", e)
+		return
+	}
+	client, e := d.Dial()
+	if e != nil {
+		t.Errorf("Dial failed: %v", e)
+		return
+	}
+	defer client.Close()
+
+	server, e := l.Accept()
+	if e != nil {
+		t.Errorf("Accept failed: %v", e)
+		return
+	}
+	defer server.Close()
+
+	m := mangos.NewMessage(0)
+	m.Body = append(m.Body, []byte("hello")...)
+	if e = client.Send(m); e != nil {
+		t.Errorf("Send failed: %v", e)
+		return
+	}
+	if m, e = server.Recv(); e != nil {
+		t.Errorf("Recv failed: %v", e)
+		return
+	}
+	if string(m.Body) != "hello" {
+		t.Errorf("Got wrong message: %v", m.Body)
+	}
+}